@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// CORS returns the middleware of a playback route that lets the pages of allowOrigins play from other origins.
+// Without allowOrigins there is none, so only pages of the same origin play.
+func CORS(allowOrigins []string, allowMethods ...string) []echo.MiddlewareFunc {
+	if len(allowOrigins) == 0 {
+		return nil
+	}
+	return []echo.MiddlewareFunc{middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins: allowOrigins,
+		AllowMethods: allowMethods,
+	})}
+}
+
+// AllowOrigin reports whether a page may open req like a cross-origin request allowed by CORS, for WebSockets that
+// CORS does not cover. Requests without an Origin are not from browsers and are allowed.
+func AllowOrigin(allowOrigins []string, req *http.Request) bool {
+	origin := req.Header.Get(echo.HeaderOrigin)
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == req.Host {
+		return true
+	}
+	for _, allowed := range allowOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PlaybackTokenParam is the query parameter playback tokens are passed in.
+const PlaybackTokenParam = "token"
+
+// jwtHeader is the header of every playback token, only HS256 is accepted.
+const jwtHeader = `{"alg":"HS256","typ":"JWT"}`
+
+// PlaybackClaims are the claims of a playback token.
+type PlaybackClaims struct {
+	StreamID string `json:"stream_id"`
+	// ExpiresAt is in unix seconds.
+	ExpiresAt int64 `json:"exp"`
+	// IP binds the token to the address of a viewer when it is set.
+	IP string `json:"ip,omitempty"`
+}
+
+// SignPlaybackToken returns an HS256 JWT of claims, any JWT library with the same secret makes the same tokens.
+func SignPlaybackToken(secret string, claims PlaybackClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(jwtHeader)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + signJWT([]byte(secret), signingInput), nil
+}
+
+// PlaybackVerifier checks the playback tokens of the HLS, DASH, FLV, RTSP and WHEP viewers.
+type PlaybackVerifier struct {
+	secret []byte
+}
+
+func NewPlaybackVerifier(secret string) *PlaybackVerifier {
+	return &PlaybackVerifier{
+		secret: []byte(secret),
+	}
+}
+
+// Verify checks that token is signed with the secret, has not expired, is for streamID and, when it is bound to an
+// address, for remoteIP. The error wraps ErrUnauthorized.
+func (v *PlaybackVerifier) Verify(token string, streamID string, remoteIP string) error {
+	if token == "" {
+		return fmt.Errorf("%w: no playback token", ErrUnauthorized)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("%w: malformed playback token", ErrUnauthorized)
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("%w: malformed playback token", ErrUnauthorized)
+	}
+	var alg struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &alg); err != nil || alg.Alg != "HS256" {
+		return fmt.Errorf("%w: playback token is not HS256", ErrUnauthorized)
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(signJWT(v.secret, parts[0]+"."+parts[1]))) {
+		return fmt.Errorf("%w: bad signature", ErrUnauthorized)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("%w: malformed playback token", ErrUnauthorized)
+	}
+	var claims PlaybackClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return fmt.Errorf("%w: malformed playback token", ErrUnauthorized)
+	}
+	if time.Now().Unix() > claims.ExpiresAt {
+		return fmt.Errorf("%w: %w", ErrUnauthorized, ErrExpired)
+	}
+	if claims.StreamID != streamID {
+		return fmt.Errorf("%w: playback token is for another stream", ErrUnauthorized)
+	}
+	if claims.IP != "" && claims.IP != remoteIP {
+		return fmt.Errorf("%w: playback token is for another address", ErrUnauthorized)
+	}
+	return nil
+}
+
+func signJWT(secret []byte, signingInput string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultCallbackTimeout = 3 * time.Second
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrExpired      = errors.New("expired")
+)
+
+// PublishRequest is a publisher asking to publish with a stream key, the RTMP publishing name or the WHIP bearer token.
+type PublishRequest struct {
+	// Ingress is the protocol of the publisher, e.g. "rtmp" or "whip".
+	Ingress    string
+	StreamKey  string
+	RemoteAddr string
+}
+
+// Authorizer decides whether a publisher may publish, and the stream it publishes to.
+// Ingresses call it before they notify the hub, a rejected publisher never reaches it.
+type Authorizer interface {
+	// AuthorizePublish returns the stream ID to publish to, or an error that wraps ErrUnauthorized.
+	AuthorizePublish(ctx context.Context, req PublishRequest) (string, error)
+}
+
+// AllowAll publishes every stream key as the stream ID of the same name.
+type AllowAll struct{}
+
+func (AllowAll) AuthorizePublish(_ context.Context, req PublishRequest) (string, error) {
+	if req.StreamKey == "" {
+		return "", fmt.Errorf("%w: empty stream key", ErrUnauthorized)
+	}
+	return req.StreamKey, nil
+}
+
+// StaticAuthorizer accepts the stream keys of a fixed list.
+type StaticAuthorizer struct {
+	// [key]streamID
+	keys map[string]string
+}
+
+// NewStaticAuthorizer takes the stream ID of every key, a key with an empty stream ID publishes to the stream of its name.
+func NewStaticAuthorizer(keys map[string]string) *StaticAuthorizer {
+	return &StaticAuthorizer{
+		keys: keys,
+	}
+}
+
+func (a *StaticAuthorizer) AuthorizePublish(_ context.Context, req PublishRequest) (string, error) {
+	streamID, ok := a.keys[req.StreamKey]
+	if !ok || req.StreamKey == "" {
+		return "", fmt.Errorf("%w: unknown stream key", ErrUnauthorized)
+	}
+	if streamID == "" {
+		return req.StreamKey, nil
+	}
+	return streamID, nil
+}
+
+// HMACAuthorizer accepts the keys made by SignPublishKey with the same secret until they expire.
+type HMACAuthorizer struct {
+	secret []byte
+}
+
+func NewHMACAuthorizer(secret string) *HMACAuthorizer {
+	return &HMACAuthorizer{
+		secret: []byte(secret),
+	}
+}
+
+// SignPublishKey returns "<streamID>.<expiry unix seconds>.<hex HMAC-SHA256 of both>", a key for streamID until expires.
+func SignPublishKey(secret string, streamID string, expires time.Time) string {
+	payload := streamID + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + sign([]byte(secret), payload)
+}
+
+func (a *HMACAuthorizer) AuthorizePublish(_ context.Context, req PublishRequest) (string, error) {
+	// the stream ID may have dots of its own
+	sigAt := strings.LastIndexByte(req.StreamKey, '.')
+	if sigAt < 0 {
+		return "", fmt.Errorf("%w: malformed stream key", ErrUnauthorized)
+	}
+	payload, sig := req.StreamKey[:sigAt], req.StreamKey[sigAt+1:]
+	expiresAt := strings.LastIndexByte(payload, '.')
+	if expiresAt <= 0 {
+		return "", fmt.Errorf("%w: malformed stream key", ErrUnauthorized)
+	}
+	streamID := payload[:expiresAt]
+	expires, err := strconv.ParseInt(payload[expiresAt+1:], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed stream key", ErrUnauthorized)
+	}
+	if !hmac.Equal([]byte(sig), []byte(sign(a.secret, payload))) {
+		return "", fmt.Errorf("%w: bad signature", ErrUnauthorized)
+	}
+	if time.Now().Unix() > expires {
+		return "", fmt.Errorf("%w: %w", ErrUnauthorized, ErrExpired)
+	}
+	return streamID, nil
+}
+
+func sign(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HTTPAuthorizer asks a backend. It POSTs the request as JSON and the backend answers with
+// {"allow": true, "stream_id": "..."}, an empty stream_id keeps the stream key.
+// Publishers are rejected when the backend cannot be reached or does not answer 2xx.
+type HTTPAuthorizer struct {
+	url    string
+	client *http.Client
+}
+
+type HTTPAuthorizerArgs struct {
+	URL     string
+	Timeout time.Duration
+}
+
+type httpAuthorizeRequest struct {
+	Ingress    string `json:"ingress"`
+	StreamKey  string `json:"stream_key"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+type httpAuthorizeResponse struct {
+	Allow    bool   `json:"allow"`
+	StreamID string `json:"stream_id"`
+}
+
+func NewHTTPAuthorizer(args HTTPAuthorizerArgs) *HTTPAuthorizer {
+	timeout := args.Timeout
+	if timeout <= 0 {
+		timeout = defaultCallbackTimeout
+	}
+	return &HTTPAuthorizer{
+		url:    args.URL,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (a *HTTPAuthorizer) AuthorizePublish(ctx context.Context, req PublishRequest) (string, error) {
+	body, err := json.Marshal(httpAuthorizeRequest{
+		Ingress:    req.Ingress,
+		StreamKey:  req.StreamKey,
+		RemoteAddr: req.RemoteAddr,
+	})
+	if err != nil {
+		return "", err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("%w: backend answered %s", ErrUnauthorized, resp.Status)
+	}
+	var decision httpAuthorizeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	if !decision.Allow {
+		return "", fmt.Errorf("%w: denied by backend", ErrUnauthorized)
+	}
+	if decision.StreamID == "" {
+		return req.StreamKey, nil
+	}
+	return decision.StreamID, nil
+}
@@ -1,22 +1,83 @@
 package config
 
+import "time"
+
 // Struct to hold the configuration
 type Config struct {
-	RTMP    RTMP         `mapstructure:"rtmp"`
-	Service Service      `mapstructure:"service"`
-	Docker  DockerConfig `mapstructure:"docker"`
-	MP4     MP4          `mapstructure:"mp4"`
-	EBML    EBML         `mapstructure:"ebml"`
+	RTMP       RTMP         `mapstructure:"rtmp"`
+	SRT        SRT          `mapstructure:"srt"`
+	RTSP       RTSP         `mapstructure:"rtsp"`
+	RTSPServer RTSPServer   `mapstructure:"rtsp_server"`
+	Service    Service      `mapstructure:"service"`
+	HLS        HLS          `mapstructure:"hls"`
+	Docker     DockerConfig `mapstructure:"docker"`
+	MP4        MP4          `mapstructure:"mp4"`
+	EBML       EBML         `mapstructure:"ebml"`
+	FLV        FLV          `mapstructure:"flv"`
+	Webhook    Webhook      `mapstructure:"webhook"`
+	Publish    Publish      `mapstructure:"publish"`
+	Playback   Playback     `mapstructure:"playback"`
+	API        API          `mapstructure:"api"`
 }
 
 type RTMP struct {
 	Port int `mapstructure:"port"`
 }
 
+type SRT struct {
+	Enable     bool   `mapstructure:"enable"`
+	Port       int    `mapstructure:"port"`
+	Mode       string `mapstructure:"mode"`
+	Address    string `mapstructure:"address"`
+	StreamID   string `mapstructure:"stream_id"`
+	Passphrase string `mapstructure:"passphrase"`
+	Latency    int    `mapstructure:"latency"`
+}
+
+type RTSP struct {
+	Enable    bool         `mapstructure:"enable"`
+	Transport string       `mapstructure:"transport"`
+	Streams   []RTSPStream `mapstructure:"streams"`
+}
+
+type RTSPStream struct {
+	StreamID  string `mapstructure:"stream_id"`
+	URL       string `mapstructure:"url"`
+	Transport string `mapstructure:"transport"`
+}
+
+type RTSPServer struct {
+	Enable   bool `mapstructure:"enable"`
+	Port     int  `mapstructure:"port"`
+	RTPPort  int  `mapstructure:"rtp_port"`
+	RTCPPort int  `mapstructure:"rtcp_port"`
+}
+
 type Service struct {
-	Port    int  `mapstructure:"port"`
-	LLHLS   bool `mapstructure:"llhls"`
-	DiskRam bool `mapstructure:"disk_ram"`
+	Port int `mapstructure:"port"`
+}
+
+type HLS struct {
+	// Variant is one of mpegts, fmp4 or lowLatency.
+	Variant         string        `mapstructure:"variant"`
+	SegmentDuration time.Duration `mapstructure:"segment_duration"`
+	PartDuration    time.Duration `mapstructure:"part_duration"`
+	SegmentCount    int           `mapstructure:"segment_count"`
+	// Directory keeps segments in RAM when it is empty.
+	Directory  string         `mapstructure:"directory"`
+	Renditions []HLSRendition `mapstructure:"renditions"`
+	DVR        bool           `mapstructure:"dvr"`
+	// DVRWindow keeps the whole stream when it is zero.
+	DVRWindow time.Duration `mapstructure:"dvr_window"`
+}
+
+// HLSRendition is a transcoded variant served next to the passthrough one.
+type HLSRendition struct {
+	Name string `mapstructure:"name"`
+	// Width keeps the source aspect ratio when it is zero.
+	Width   int `mapstructure:"width"`
+	Height  int `mapstructure:"height"`
+	Bitrate int `mapstructure:"bitrate"`
 }
 
 type DockerConfig struct {
@@ -30,3 +91,54 @@ type MP4 struct {
 type EBML struct {
 	Record bool `mapstructure:"record"`
 }
+
+type FLV struct {
+	Record bool `mapstructure:"record"`
+}
+
+// Publish authorizes the RTMP and WHIP publishers by their stream key.
+type Publish struct {
+	// Auth is one of none, static, hmac or http.
+	Auth string `mapstructure:"auth"`
+	// Keys are the stream keys of static.
+	Keys []PublishKey `mapstructure:"keys"`
+	// Secret signs the keys of hmac.
+	Secret string `mapstructure:"secret"`
+	// CallbackURL is asked by http.
+	CallbackURL     string        `mapstructure:"callback_url"`
+	CallbackTimeout time.Duration `mapstructure:"callback_timeout"`
+	// Takeover is one of reject, takeover or standby, what happens to a publisher of a stream that is published.
+	Takeover string `mapstructure:"takeover"`
+}
+
+type PublishKey struct {
+	Key string `mapstructure:"key"`
+	// StreamID is the stream the key publishes to, the key itself when it is empty.
+	StreamID string `mapstructure:"stream_id"`
+}
+
+// Playback authorizes the HLS, DASH, FLV, RTSP and WHEP viewers by a signed token.
+type Playback struct {
+	// Secret signs the playback tokens, viewers need no token when it is empty.
+	Secret string `mapstructure:"secret"`
+	// AllowOrigins are the origins of the pages that play /hls, /dash and /live from another origin, none when empty.
+	AllowOrigins []string `mapstructure:"allow_origins"`
+}
+
+// API is the admin API at /api/v1, served on its own address apart from the service port.
+type API struct {
+	// Address is local only by default, 127.0.0.1:8045 when it is empty.
+	Address string `mapstructure:"address"`
+	// Token is the bearer token every request needs, requests need none when it is empty.
+	Token string `mapstructure:"token"`
+}
+
+type Webhook struct {
+	// URLs receive every event, webhooks are off when it is empty.
+	URLs   []string `mapstructure:"urls"`
+	Secret string   `mapstructure:"secret"`
+	// QueueDirectory keeps undelivered webhooks across restarts, they are kept in RAM when it is empty.
+	QueueDirectory string        `mapstructure:"queue_directory"`
+	MaxAttempts    int           `mapstructure:"max_attempts"`
+	Timeout        time.Duration `mapstructure:"timeout"`
+}
@@ -0,0 +1,299 @@
+package httpsrv
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/sirupsen/logrus"
+
+	"liveflow/log"
+	"liveflow/media/hub"
+	"liveflow/media/streamer/egress/record"
+	"liveflow/media/streamer/egress/whep"
+	"liveflow/media/streamer/fields"
+	"liveflow/media/streamer/ingress/whip"
+)
+
+// API is the admin API at /api/v1, it lists the streams and their outputs and controls them.
+// It should be served apart from the public routes, on a local address or with a token.
+type API struct {
+	echo       *echo.Echo
+	token      string
+	hub        *hub.Hub
+	whip       *whip.WHIP
+	whep       *whep.Server
+	recordings *record.Manager
+}
+
+type APIArgs struct {
+	Echo *echo.Echo
+	// Token is the bearer token every request needs, requests need none when it is empty.
+	Token      string
+	Hub        *hub.Hub
+	WHIP       *whip.WHIP
+	WHEP       *whep.Server
+	Recordings *record.Manager
+}
+
+func NewAPI(args APIArgs) *API {
+	return &API{
+		echo:       args.Echo,
+		token:      args.Token,
+		hub:        args.Hub,
+		whip:       args.WHIP,
+		whep:       args.WHEP,
+		recordings: args.Recordings,
+	}
+}
+
+func (a *API) RegisterRoute() {
+	v1 := a.echo.Group("/api/v1")
+	if a.token != "" {
+		v1.Use(middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+			Validator: func(key string, c echo.Context) (bool, error) {
+				return subtle.ConstantTimeCompare([]byte(key), []byte(a.token)) == 1, nil
+			},
+		}))
+	}
+	v1.GET("/streams", a.handleListStreams)
+	v1.GET("/streams/:streamID", a.handleGetStream)
+	v1.DELETE("/streams/:streamID", a.handleKickStream)
+	v1.GET("/streams/:streamID/viewers", a.handleListViewers)
+	v1.DELETE("/viewers/:sessionID", a.handleKillViewer)
+	v1.GET("/streams/:streamID/recordings", a.handleListRecordings)
+	v1.POST("/streams/:streamID/recordings/:format", a.handleStartRecording)
+	v1.DELETE("/streams/:streamID/recordings/:format", a.handleStopRecording)
+}
+
+type mediaSpecResponse struct {
+	MediaType string `json:"media_type"`
+	CodecType string `json:"codec"`
+	ClockRate uint32 `json:"clock_rate"`
+}
+
+type subscriberResponse struct {
+	Name     string `json:"name"`
+	Overflow string `json:"overflow"`
+	Queued   int    `json:"queued"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+type streamResponse struct {
+	StreamID      string               `json:"stream_id"`
+	Source        string               `json:"source"`
+	MediaSpecs    []mediaSpecResponse  `json:"media_specs"`
+	StartedAt     time.Time            `json:"started_at"`
+	UptimeSeconds float64              `json:"uptime_seconds"`
+	Bitrate       int                  `json:"bitrate"`
+	Subscribers   []subscriberResponse `json:"subscribers"`
+	Recordings    []string             `json:"recordings"`
+	// Publishers are the WHIP sessions of the stream, including those on standby
+	Publishers []publisherResponse `json:"publishers"`
+}
+
+type trackResponse struct {
+	Kind             string `json:"kind"`
+	RID              string `json:"rid,omitempty"`
+	Received         uint64 `json:"received"`
+	Lost             uint64 `json:"lost"`
+	Recovered        uint64 `json:"recovered"`
+	Reordered        uint64 `json:"reordered"`
+	Late             uint64 `json:"late"`
+	Duplicates       uint64 `json:"duplicates"`
+	FramesDropped    uint64 `json:"frames_dropped"`
+	FramesSkipped    uint64 `json:"frames_skipped"`
+	KeyFrameRequests uint64 `json:"key_frame_requests"`
+}
+
+type publisherResponse struct {
+	ID     string          `json:"id"`
+	Tracks []trackResponse `json:"tracks"`
+}
+
+type viewerResponse struct {
+	ID               string    `json:"id"`
+	StreamID         string    `json:"stream_id"`
+	StartedAt        time.Time `json:"started_at"`
+	State            string    `json:"state"`
+	Layer            string    `json:"layer"`
+	AutoLayer        bool      `json:"auto_layer"`
+	PacketsSent      uint64    `json:"packets_sent"`
+	BytesSent        uint64    `json:"bytes_sent"`
+	WriteErrors      uint64    `json:"write_errors"`
+	KeyFrameRequests uint64    `json:"key_frame_requests"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func mediaTypeName(mediaType hub.MediaType) string {
+	switch mediaType {
+	case hub.Video:
+		return "video"
+	case hub.Audio:
+		return "audio"
+	}
+	return "unknown"
+}
+
+func (a *API) streamResponse(info hub.StreamInfo) streamResponse {
+	ret := streamResponse{
+		StreamID:      info.StreamID,
+		Source:        info.Source.Name(),
+		MediaSpecs:    []mediaSpecResponse{},
+		StartedAt:     info.StartedAt,
+		UptimeSeconds: time.Since(info.StartedAt).Seconds(),
+		Bitrate:       info.Bitrate,
+		Subscribers:   []subscriberResponse{},
+		Recordings:    a.recordings.Formats(info.StreamID),
+		Publishers:    []publisherResponse{},
+	}
+	for _, spec := range info.MediaSpecs {
+		ret.MediaSpecs = append(ret.MediaSpecs, mediaSpecResponse{
+			MediaType: mediaTypeName(spec.MediaType),
+			CodecType: string(spec.CodecType),
+			ClockRate: spec.ClockRate,
+		})
+	}
+	for _, sub := range a.hub.Subscribers(info.StreamID) {
+		ret.Subscribers = append(ret.Subscribers, subscriberResponse{
+			Name:     sub.Name,
+			Overflow: sub.Overflow.String(),
+			Queued:   sub.Queued,
+			Dropped:  sub.Dropped,
+		})
+	}
+	for _, session := range a.whip.Sessions(info.StreamID) {
+		publisher := publisherResponse{ID: session.ID, Tracks: []trackResponse{}}
+		for _, track := range session.Tracks {
+			publisher.Tracks = append(publisher.Tracks, trackResponse{
+				Kind:             track.Kind,
+				RID:              track.RID,
+				Received:         track.Received,
+				Lost:             track.Lost,
+				Recovered:        track.Recovered,
+				Reordered:        track.Reordered,
+				Late:             track.Late,
+				Duplicates:       track.Duplicates,
+				FramesDropped:    track.FramesDropped,
+				FramesSkipped:    track.FramesSkipped,
+				KeyFrameRequests: track.KeyFrameRequests,
+			})
+		}
+		ret.Publishers = append(ret.Publishers, publisher)
+	}
+	return ret
+}
+
+func (a *API) handleListStreams(c echo.Context) error {
+	ret := []streamResponse{}
+	for _, info := range a.hub.List() {
+		ret = append(ret, a.streamResponse(info))
+	}
+	return c.JSON(http.StatusOK, ret)
+}
+
+func (a *API) handleGetStream(c echo.Context) error {
+	info, ok := a.hub.Get(c.Param("streamID"))
+	if !ok {
+		return c.JSON(http.StatusNotFound, errorResponse{Error: "stream not found"})
+	}
+	return c.JSON(http.StatusOK, a.streamResponse(info))
+}
+
+// handleKickStream disconnects the publisher of a stream and unpublishes it.
+func (a *API) handleKickStream(c echo.Context) error {
+	streamID := c.Param("streamID")
+	info, ok := a.hub.Get(streamID)
+	if !ok {
+		return c.JSON(http.StatusNotFound, errorResponse{Error: "stream not found"})
+	}
+	source, ok := info.Source.(hub.ClosableSource)
+	if !ok {
+		return c.JSON(http.StatusNotImplemented, errorResponse{Error: info.Source.Name() + " publishers cannot be disconnected"})
+	}
+	ctx := log.WithFields(context.Background(), logrus.Fields{
+		fields.StreamID:   streamID,
+		fields.SourceName: source.Name(),
+	})
+	log.Info(ctx, "kicking publisher")
+	if err := source.Close(); err != nil {
+		log.Error(ctx, err, "failed to close publisher")
+	}
+	// a publisher on standby takes over
+	a.hub.Unpublish(source)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (a *API) handleListViewers(c echo.Context) error {
+	ret := []viewerResponse{}
+	for _, stats := range a.whep.Sessions(c.Param("streamID")) {
+		ret = append(ret, viewerResponse{
+			ID:               stats.ID,
+			StreamID:         stats.StreamID,
+			StartedAt:        stats.StartedAt,
+			State:            stats.State,
+			Layer:            stats.Layer,
+			AutoLayer:        stats.AutoLayer,
+			PacketsSent:      stats.PacketsSent,
+			BytesSent:        stats.BytesSent,
+			WriteErrors:      stats.WriteErrors,
+			KeyFrameRequests: stats.KeyFrameRequests,
+		})
+	}
+	return c.JSON(http.StatusOK, ret)
+}
+
+func (a *API) handleKillViewer(c echo.Context) error {
+	if !a.whep.CloseSession(c.Param("sessionID")) {
+		return c.JSON(http.StatusNotFound, errorResponse{Error: "viewer not found"})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (a *API) handleListRecordings(c echo.Context) error {
+	streamID := c.Param("streamID")
+	if _, ok := a.hub.Get(streamID); !ok {
+		return c.JSON(http.StatusNotFound, errorResponse{Error: "stream not found"})
+	}
+	return c.JSON(http.StatusOK, a.recordings.Formats(streamID))
+}
+
+func (a *API) handleStartRecording(c echo.Context) error {
+	streamID := c.Param("streamID")
+	info, ok := a.hub.Get(streamID)
+	if !ok {
+		return c.JSON(http.StatusNotFound, errorResponse{Error: "stream not found"})
+	}
+	ctx := log.WithFields(context.Background(), logrus.Fields{
+		fields.StreamID: streamID,
+	})
+	err := a.recordings.Start(ctx, info.Source, c.Param("format"))
+	switch {
+	case errors.Is(err, record.ErrUnknownFormat):
+		return c.JSON(http.StatusNotFound, errorResponse{Error: err.Error()})
+	case errors.Is(err, record.ErrAlreadyRecording):
+		return c.JSON(http.StatusConflict, errorResponse{Error: err.Error()})
+	case err != nil:
+		// e.g. a codec the format cannot carry
+		return c.JSON(http.StatusUnprocessableEntity, errorResponse{Error: err.Error()})
+	}
+	return c.NoContent(http.StatusCreated)
+}
+
+func (a *API) handleStopRecording(c echo.Context) error {
+	streamID := c.Param("streamID")
+	ctx := log.WithFields(context.Background(), logrus.Fields{
+		fields.StreamID: streamID,
+	})
+	if err := a.recordings.Stop(ctx, streamID, c.Param("format")); err != nil {
+		return c.JSON(http.StatusNotFound, errorResponse{Error: err.Error()})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -6,33 +6,53 @@ import (
 	"net/http"
 	"path"
 	"path/filepath"
+	"sort"
 
 	"github.com/bluenviron/gohlslib/pkg/codecparams"
 	"github.com/bluenviron/gohlslib/pkg/playlist"
 	"github.com/labstack/echo/v4"
 
+	"liveflow/auth"
 	"liveflow/log"
 	"liveflow/media/hlshub"
 )
 
 const (
 	cacheControl = "CDN-Cache-Control"
+	// defaultBandwidth is announced until the bitrate of a variant has been measured.
+	defaultBandwidth = 33033
 )
 
 type Handler struct {
 	endpoint *hlshub.HLSHub
+	playback *auth.PlaybackVerifier
 }
 
-func NewHandler(hlsEndpoint *hlshub.HLSHub) *Handler {
+// NewHandler serves the HLS streams, every request needs a playback token for its stream when playback is not nil.
+func NewHandler(hlsEndpoint *hlshub.HLSHub, playback *auth.PlaybackVerifier) *Handler {
 	return &Handler{
 		endpoint: hlsEndpoint,
+		playback: playback,
 	}
 }
 
+// authorize checks the playback token of a request. The query of a playlist request is appended to the URIs of the
+// playlist, so players send the token with every request that follows.
+func (h *Handler) authorize(c echo.Context, workID string) error {
+	if h.playback == nil {
+		return nil
+	}
+	return h.playback.Verify(c.QueryParam(auth.PlaybackTokenParam), workID, c.RealIP())
+}
+
 func (h *Handler) HandleMasterM3U8(c echo.Context) error {
 	ctx := context.Background()
 	log.Info(ctx, "HandleMasterM3U8")
 	workID := c.Param("streamID")
+	if err := h.authorize(c, workID); err != nil {
+		log.Warnf(ctx, "rejected hls viewer of %s: %v", workID, err)
+		return c.NoContent(http.StatusUnauthorized)
+	}
 	muxers, err := h.endpoint.MuxersByWorkID(workID)
 	if err != nil {
 		log.Error(ctx, err, "get muxer failed")
@@ -47,22 +67,22 @@ func (h *Handler) HandleMasterM3U8(c echo.Context) error {
 	}
 	var variants []*playlist.MultivariantVariant
 	for name, muxer := range muxers {
-		// TODO: muxer.Bandwidth() is not implemented
-		//_, average, err := muxer.Bandwidth()
-		//if err != nil {
-		//	continue
-		//}
-		average := 33033
+		info := h.endpoint.VariantInfo(workID, name)
+		bandwidth := info.Bandwidth
+		if bandwidth <= 0 {
+			bandwidth = defaultBandwidth
+		}
 		variant := &playlist.MultivariantVariant{
-			Bandwidth: average,
+			Bandwidth: bandwidth,
 			FrameRate: nil,
 			URI:       path.Join(name, "stream.m3u8"),
 		}
-		// TODO: muxer.ResolutionString() is not implemented
-		//resolution, err := muxer.ResolutionString()
-		//if err == nil {
-		//	variant.Resolution = resolution
-		//}
+		if query := c.QueryString(); query != "" {
+			variant.URI += "?" + query
+		}
+		if info.Width > 0 && info.Height > 0 {
+			variant.Resolution = fmt.Sprintf("%dx%d", info.Width, info.Height)
+		}
 		variant.Codecs = []string{}
 		if muxer.VideoTrack != nil {
 			variant.Codecs = append(variant.Codecs, codecparams.Marshal(muxer.VideoTrack.Codec))
@@ -72,6 +92,10 @@ func (h *Handler) HandleMasterM3U8(c echo.Context) error {
 		}
 		variants = append(variants, variant)
 	}
+	// map order is random, list the variants from the highest bandwidth
+	sort.Slice(variants, func(i, j int) bool {
+		return variants[i].Bandwidth > variants[j].Bandwidth
+	})
 	pl.Variants = variants
 	c.Response().Header().Set(cacheControl, "max-age=1")
 	masterM3u8Bytes, err := pl.Marshal()
@@ -86,10 +110,9 @@ func (h *Handler) HandleM3U8(c echo.Context) error {
 	log.Info(ctx, "HandleM3U8")
 	workID := c.Param("streamID")
 	playlistName := c.Param("playlistName")
-	muxer, err := h.endpoint.Muxer(workID, playlistName)
-	if err != nil {
-		log.Error(ctx, err, "no hls stream")
-		return c.NoContent(http.StatusNotFound)
+	if err := h.authorize(c, workID); err != nil {
+		log.Warnf(ctx, "rejected hls viewer of %s: %v", workID, err)
+		return c.NoContent(http.StatusUnauthorized)
 	}
 	extension := filepath.Ext(c.Request().URL.String())
 	switch extension {
@@ -98,6 +121,20 @@ func (h *Handler) HandleM3U8(c echo.Context) error {
 	case ".ts", ".mp4":
 		c.Response().Header().Set(cacheControl, "max-age=3600")
 	}
+	if playlistName == hlshub.DVRName {
+		dvr, err := h.endpoint.DVR(workID)
+		if err != nil {
+			log.Error(ctx, err, "no hls dvr")
+			return c.NoContent(http.StatusNotFound)
+		}
+		dvr.ServeHTTP(c.Response(), c.Request())
+		return nil
+	}
+	muxer, err := h.endpoint.Muxer(workID, playlistName)
+	if err != nil {
+		log.Error(ctx, err, "no hls stream")
+		return c.NoContent(http.StatusNotFound)
+	}
 	muxer.Handle(c.Response(), c.Request())
 	return nil
 }
@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"liveflow/config"
+	"liveflow/media/streamer/egress/dash"
 	"liveflow/media/streamer/egress/hls"
+	"liveflow/media/streamer/egress/httpflv"
+	"liveflow/media/streamer/egress/record"
+	"liveflow/media/streamer/egress/record/flv"
 	"liveflow/media/streamer/egress/record/mp4"
 	"liveflow/media/streamer/egress/record/webm"
+	rtspserver "liveflow/media/streamer/egress/rtsp"
 	"liveflow/media/streamer/egress/whep"
 	"liveflow/media/streamer/ingress/whip"
 	"net/http"
@@ -14,17 +20,19 @@ import (
 	"strconv"
 
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
-	"github.com/pion/webrtc/v3"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
+	"liveflow/auth"
 	"liveflow/httpsrv"
 	"liveflow/log"
 	"liveflow/media/hlshub"
 	"liveflow/media/hub"
 	"liveflow/media/streamer/ingress/rtmp"
+	"liveflow/media/streamer/ingress/rtsp"
+	"liveflow/media/streamer/ingress/srt"
+	"liveflow/webhook"
 )
 
 // RTMP 받으면 자동으로 Service 서비스 동작, 녹화 서비스까지~?
@@ -53,20 +61,51 @@ func main() {
 		"app": "liveflow",
 	})
 	log.Info(ctx, "liveflow is started")
+	takeover, err := hub.ParseTakeoverPolicy(conf.Publish.Takeover)
+	if err != nil {
+		log.Errorf(ctx, "invalid takeover policy %q, falling back to reject: %v", conf.Publish.Takeover, err)
+	}
 	hub := hub.NewHub()
-	var tracks map[string][]*webrtc.TrackLocalStaticRTP
-	tracks = make(map[string][]*webrtc.TrackLocalStaticRTP)
+	hub.SetTakeoverPolicy(takeover)
+	authorizer, err := newPublishAuthorizer(conf.Publish)
+	if err != nil {
+		panic(fmt.Errorf("failed to create publish authorizer: %w", err))
+	}
+	var playback *auth.PlaybackVerifier
+	if conf.Playback.Secret != "" {
+		playback = auth.NewPlaybackVerifier(conf.Playback.Secret)
+	}
+	webhooks := webhook.NewNotifier(webhook.NotifierArgs{
+		Hub:            hub,
+		URLs:           conf.Webhook.URLs,
+		Secret:         conf.Webhook.Secret,
+		QueueDirectory: conf.Webhook.QueueDirectory,
+		MaxAttempts:    conf.Webhook.MaxAttempts,
+		Timeout:        conf.Webhook.Timeout,
+	})
+	go webhooks.Run(ctx)
+	var rtspServer *rtspserver.Server
+	if conf.RTSPServer.Enable {
+		rtspServer = rtspserver.NewServer(rtspserver.ServerArgs{
+			Port:     conf.RTSPServer.Port,
+			RTPPort:  conf.RTSPServer.RTPPort,
+			RTCPPort: conf.RTSPServer.RTCPPort,
+			Playback: playback,
+		})
+		go func() {
+			if err := rtspServer.Serve(ctx); err != nil {
+				log.Errorf(ctx, "failed to serve rtsp server: %v", err)
+			}
+		}()
+	}
 	// ingress
 	// Egress 서비스는 streamID 알림을 구독하여 처리 시작
 	go func() {
 		api := echo.New()
 		api.HideBanner = true
 		hlsHub := hlshub.NewHLSHub()
-		hlsHandler := httpsrv.NewHandler(hlsHub)
-		hlsRoute := api.Group("/hls", middleware.CORSWithConfig(middleware.CORSConfig{
-			AllowOrigins: []string{"*"}, // Adjust origins as necessary
-			AllowMethods: []string{http.MethodGet, http.MethodHead, http.MethodOptions},
-		}))
+		hlsHandler := httpsrv.NewHandler(hlsHub, playback)
+		hlsRoute := api.Group("/hls", auth.CORS(conf.Playback.AllowOrigins, http.MethodGet, http.MethodHead, http.MethodOptions)...)
 		api.GET("/prometheus", echo.WrapHandler(promhttp.Handler()))
 		api.GET("/debug/pprof/*", echo.WrapHandler(http.DefaultServeMux))
 		// Enable CORS only for /hls routes
@@ -75,11 +114,87 @@ func main() {
 		hlsRoute.GET("/:streamID/:playlistName/:resourceName", hlsHandler.HandleM3U8)
 		whipServer := whip.NewWHIP(whip.WHIPArgs{
 			Hub:        hub,
-			Tracks:     tracks,
 			DockerMode: conf.Docker.Mode,
 			Echo:       api,
+			Authorizer: authorizer,
 		})
 		whipServer.RegisterRoute()
+		whepServer := whep.NewServer(whep.ServerArgs{
+			Echo:          api,
+			Hub:           hub,
+			DockerMode:    conf.Docker.Mode,
+			Playback:      playback,
+			OnViewerJoin:  webhooks.ViewerJoined,
+			OnViewerLeave: webhooks.ViewerLeft,
+		})
+		whepServer.RegisterRoute()
+		flvServer := httpflv.NewServer(httpflv.ServerArgs{
+			Echo:         api,
+			Playback:     playback,
+			AllowOrigins: conf.Playback.AllowOrigins,
+		})
+		flvServer.RegisterRoute()
+		dashServer := dash.NewServer(dash.ServerArgs{
+			Echo:         api,
+			Playback:     playback,
+			AllowOrigins: conf.Playback.AllowOrigins,
+		})
+		dashServer.RegisterRoute()
+		recordings := record.NewManager(record.ManagerArgs{
+			Hub: hub,
+			Recorders: map[string]func(streamID string) record.Recorder{
+				"mp4": func(streamID string) record.Recorder {
+					return mp4.NewMP4(mp4.MP4Args{
+						Hub:             hub,
+						SplitIntervalMS: 3000,
+						OnFile:          webhooks.RecordingFinalized,
+					})
+				},
+				"webm": func(streamID string) record.Recorder {
+					return webm.NewWEBM(webm.WebMArgs{
+						Hub:             hub,
+						SplitIntervalMS: 6000,
+						StreamID:        streamID,
+						OnFile:          webhooks.RecordingFinalized,
+					})
+				},
+			},
+		})
+		go recordings.Run(ctx)
+		// the admin API is not on the public service port
+		admin := echo.New()
+		admin.HideBanner = true
+		adminAPI := httpsrv.NewAPI(httpsrv.APIArgs{
+			Echo:       admin,
+			Token:      conf.API.Token,
+			Hub:        hub,
+			WHIP:       whipServer,
+			WHEP:       whepServer,
+			Recordings: recordings,
+		})
+		adminAPI.RegisterRoute()
+		adminAddress := conf.API.Address
+		if adminAddress == "" {
+			adminAddress = "127.0.0.1:8045"
+		}
+		go func() {
+			if err := admin.Start(adminAddress); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Errorf(ctx, "failed to serve the admin api: %v", err)
+			}
+		}()
+		hlsVariant, err := hls.ParseVariant(conf.HLS.Variant)
+		if err != nil {
+			log.Errorf(ctx, "invalid hls variant %q, falling back to mpegts: %v", conf.HLS.Variant, err)
+		}
+		var renditions []hls.Rendition
+		for _, rendition := range conf.HLS.Renditions {
+			renditions = append(renditions, hls.Rendition{
+				Name:    rendition.Name,
+				Width:   rendition.Width,
+				Height:  rendition.Height,
+				Bitrate: rendition.Bitrate,
+			})
+		}
 		go func() {
 			fmt.Println("----------------", conf.Service.Port)
 			api.Start("0.0.0.0:" + strconv.Itoa(conf.Service.Port))
@@ -88,40 +203,73 @@ func main() {
 		for source := range hub.SubscribeToStreamID() {
 			log.Infof(ctx, "New streamID received: %s", source.StreamID())
 			if conf.MP4.Record {
-				mp4 := mp4.NewMP4(mp4.MP4Args{
-					Hub:             hub,
-					SplitIntervalMS: 3000,
-				})
-				err = mp4.Start(ctx, source)
+				err = recordings.Start(ctx, source, "mp4")
 				if err != nil {
 					log.Errorf(ctx, "failed to start mp4: %v", err)
 				}
 			}
 			if conf.EBML.Record {
-				webmStarter := webm.NewWEBM(webm.WebMArgs{
+				err = recordings.Start(ctx, source, "webm")
+				if err != nil {
+					log.Errorf(ctx, "failed to start webm: %v", err)
+				}
+			}
+			if conf.FLV.Record {
+				flvRecorder := flv.NewFLV(flv.FLVArgs{
 					Hub:             hub,
-					SplitIntervalMS: 6000,
-					StreamID:        source.StreamID(),
+					SplitIntervalMS: 3000,
 				})
-				err = webmStarter.Start(ctx, source)
+				err = flvRecorder.Start(ctx, source)
 				if err != nil {
-					log.Errorf(ctx, "failed to start webm: %v", err)
+					log.Errorf(ctx, "failed to start flv: %v", err)
 				}
 			}
 			hls := hls.NewHLS(hls.HLSArgs{
-				Hub:     hub,
-				HLSHub:  hlsHub,
-				Port:    conf.Service.Port,
-				LLHLS:   conf.Service.LLHLS,
-				DiskRam: conf.Service.DiskRam,
+				Hub:             hub,
+				HLSHub:          hlsHub,
+				Port:            conf.Service.Port,
+				Variant:         hlsVariant,
+				SegmentDuration: conf.HLS.SegmentDuration,
+				PartDuration:    conf.HLS.PartDuration,
+				SegmentCount:    conf.HLS.SegmentCount,
+				Directory:       conf.HLS.Directory,
+				Renditions:      renditions,
+				DVR:             conf.HLS.DVR,
+				DVRWindow:       conf.HLS.DVRWindow,
 			})
 			err := hls.Start(ctx, source)
 			if err != nil {
 				log.Errorf(ctx, "failed to start hls: %v", err)
 			}
+			httpFLV := httpflv.NewHTTPFLV(httpflv.HTTPFLVArgs{
+				Hub:    hub,
+				Server: flvServer,
+			})
+			err = httpFLV.Start(ctx, source)
+			if err != nil {
+				log.Errorf(ctx, "failed to start httpflv: %v", err)
+			}
+			dashStream := dash.NewDASH(dash.DASHArgs{
+				Hub:    hub,
+				Server: dashServer,
+			})
+			err = dashStream.Start(ctx, source)
+			if err != nil {
+				log.Errorf(ctx, "failed to start dash: %v", err)
+			}
+			if rtspServer != nil {
+				rtspEgress := rtspserver.NewRTSP(rtspserver.RTSPArgs{
+					Hub:    hub,
+					Server: rtspServer,
+				})
+				err = rtspEgress.Start(ctx, source)
+				if err != nil {
+					log.Errorf(ctx, "failed to start rtsp: %v", err)
+				}
+			}
 			whep := whep.NewWHEP(whep.WHEPArgs{
-				Tracks: tracks,
 				Hub:    hub,
+				Server: whepServer,
 			})
 			err = whep.Start(ctx, source)
 			if err != nil {
@@ -130,9 +278,75 @@ func main() {
 		}
 	}()
 
+	if conf.SRT.Enable {
+		srtServer := srt.NewSRT(srt.SRTArgs{
+			Hub:        hub,
+			Port:       conf.SRT.Port,
+			Mode:       conf.SRT.Mode,
+			Address:    conf.SRT.Address,
+			StreamID:   conf.SRT.StreamID,
+			Passphrase: conf.SRT.Passphrase,
+			LatencyMS:  conf.SRT.Latency,
+		})
+		go func() {
+			if err := srtServer.Serve(ctx); err != nil {
+				log.Errorf(ctx, "failed to serve srt: %v", err)
+			}
+		}()
+	}
+
+	if conf.RTSP.Enable {
+		var streams []rtsp.Stream
+		for _, stream := range conf.RTSP.Streams {
+			streams = append(streams, rtsp.Stream{
+				StreamID:  stream.StreamID,
+				URL:       stream.URL,
+				Transport: stream.Transport,
+			})
+		}
+		rtspPuller := rtsp.NewRTSP(rtsp.RTSPArgs{
+			Hub:       hub,
+			Streams:   streams,
+			Transport: conf.RTSP.Transport,
+		})
+		go func() {
+			if err := rtspPuller.Serve(ctx); err != nil {
+				log.Errorf(ctx, "failed to serve rtsp: %v", err)
+			}
+		}()
+	}
+
 	rtmpServer := rtmp.NewRTMP(rtmp.RTMPArgs{
-		Hub:  hub,
-		Port: conf.RTMP.Port,
+		Hub:        hub,
+		Port:       conf.RTMP.Port,
+		Authorizer: authorizer,
 	})
 	rtmpServer.Serve(ctx)
 }
+
+func newPublishAuthorizer(conf config.Publish) (auth.Authorizer, error) {
+	switch conf.Auth {
+	case "", "none":
+		return auth.AllowAll{}, nil
+	case "static":
+		keys := map[string]string{}
+		for _, key := range conf.Keys {
+			keys[key.Key] = key.StreamID
+		}
+		return auth.NewStaticAuthorizer(keys), nil
+	case "hmac":
+		if conf.Secret == "" {
+			return nil, fmt.Errorf("publish.secret is required for hmac")
+		}
+		return auth.NewHMACAuthorizer(conf.Secret), nil
+	case "http":
+		if conf.CallbackURL == "" {
+			return nil, fmt.Errorf("publish.callback_url is required for http")
+		}
+		return auth.NewHTTPAuthorizer(auth.HTTPAuthorizerArgs{
+			URL:     conf.CallbackURL,
+			Timeout: conf.CallbackTimeout,
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown publish auth %q", conf.Auth)
+}
@@ -2,6 +2,7 @@ package hlshub
 
 import (
 	"errors"
+	"net/http"
 	"sync"
 
 	"github.com/bluenviron/gohlslib"
@@ -11,16 +12,40 @@ var (
 	errNotFoundStream = errors.New("no HLS stream")
 )
 
+// DVRName is the playlist name of the DVR under /hls/:streamID/, no variant can use it.
+const DVRName = "dvr"
+
+// VariantInfo describes a variant in the master playlist.
+type VariantInfo struct {
+	// Bandwidth is in bits per second.
+	Bandwidth int
+	Width     int
+	Height    int
+}
+
+// DVR serves the time-shift playlist of a stream. It outlives the stream until the stream is published again.
+type DVR interface {
+	http.Handler
+	// Close releases the segments of the DVR.
+	Close()
+}
+
 type HLSHub struct {
 	mu *sync.RWMutex
 	// [workID][name(low|pass)]muxer
 	hlsMuxers map[string]map[string]*gohlslib.Muxer
+	// [workID][name]info
+	variantInfos map[string]map[string]VariantInfo
+	// [workID]dvr
+	dvrs map[string]DVR
 }
 
 func NewHLSHub() *HLSHub {
 	return &HLSHub{
-		mu:        &sync.RWMutex{},
-		hlsMuxers: map[string]map[string]*gohlslib.Muxer{},
+		mu:           &sync.RWMutex{},
+		hlsMuxers:    map[string]map[string]*gohlslib.Muxer{},
+		variantInfos: map[string]map[string]VariantInfo{},
+		dvrs:         map[string]DVR{},
 	}
 }
 
@@ -37,6 +62,44 @@ func (s *HLSHub) DeleteMuxer(workID string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	delete(s.hlsMuxers, workID)
+	delete(s.variantInfos, workID)
+}
+
+func (s *HLSHub) StoreVariantInfo(workID string, name string, info VariantInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.variantInfos[workID] == nil {
+		s.variantInfos[workID] = map[string]VariantInfo{}
+	}
+	s.variantInfos[workID][name] = info
+}
+
+// VariantInfo returns a zero VariantInfo if nothing is known about the variant yet.
+func (s *HLSHub) VariantInfo(workID string, name string) VariantInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.variantInfos[workID][name]
+}
+
+// StoreDVR replaces the DVR of the previous publish of workID and closes it.
+func (s *HLSHub) StoreDVR(workID string, dvr DVR) {
+	s.mu.Lock()
+	old := s.dvrs[workID]
+	s.dvrs[workID] = dvr
+	s.mu.Unlock()
+	if old != nil && old != dvr {
+		old.Close()
+	}
+}
+
+func (s *HLSHub) DVR(workID string) (DVR, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dvr, prs := s.dvrs[workID]
+	if !prs {
+		return nil, errNotFoundStream
+	}
+	return dvr, nil
 }
 
 func (s *HLSHub) Muxer(workID string, name string) (*gohlslib.Muxer, error) {
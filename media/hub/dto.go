@@ -6,6 +6,9 @@ import (
 
 type FrameData struct {
 	H264Video *H264Video
+	VP8Video  *VP8Video
+	VP9Video  *VP9Video
+	AV1Video  *AV1Video
 	AACAudio  *AACAudio
 	OPUSAudio *OPUSAudio
 }
@@ -44,6 +47,75 @@ func (h *H264Video) RawDTS() int64 {
 	}
 }
 
+// VP8Video is a VP8 frame.
+type VP8Video struct {
+	PTS            int64
+	DTS            int64
+	VideoClockRate uint32
+	Data           []byte
+	KeyFrame       bool
+}
+
+func (v *VP8Video) RawPTS() int64 {
+	if v.VideoClockRate == 0 {
+		return v.PTS
+	}
+	return int64(float64(v.PTS) / float64(v.VideoClockRate/1000.0))
+}
+
+func (v *VP8Video) RawDTS() int64 {
+	if v.VideoClockRate == 0 {
+		return v.DTS
+	}
+	return int64(float64(v.DTS) / float64(v.VideoClockRate/1000.0))
+}
+
+// VP9Video is a VP9 frame, a superframe when it carries several layers.
+type VP9Video struct {
+	PTS            int64
+	DTS            int64
+	VideoClockRate uint32
+	Data           []byte
+	KeyFrame       bool
+}
+
+func (v *VP9Video) RawPTS() int64 {
+	if v.VideoClockRate == 0 {
+		return v.PTS
+	}
+	return int64(float64(v.PTS) / float64(v.VideoClockRate/1000.0))
+}
+
+func (v *VP9Video) RawDTS() int64 {
+	if v.VideoClockRate == 0 {
+		return v.DTS
+	}
+	return int64(float64(v.DTS) / float64(v.VideoClockRate/1000.0))
+}
+
+// AV1Video is an AV1 temporal unit in the low overhead bitstream format, every OBU has its obu_size field.
+type AV1Video struct {
+	PTS            int64
+	DTS            int64
+	VideoClockRate uint32
+	Data           []byte
+	KeyFrame       bool
+}
+
+func (v *AV1Video) RawPTS() int64 {
+	if v.VideoClockRate == 0 {
+		return v.PTS
+	}
+	return int64(float64(v.PTS) / float64(v.VideoClockRate/1000.0))
+}
+
+func (v *AV1Video) RawDTS() int64 {
+	if v.VideoClockRate == 0 {
+		return v.DTS
+	}
+	return int64(float64(v.DTS) / float64(v.VideoClockRate/1000.0))
+}
+
 type OPUSAudio struct {
 	PTS            int64
 	DTS            int64
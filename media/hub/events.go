@@ -0,0 +1,92 @@
+package hub
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"liveflow/log"
+)
+
+// eventQueueSize bounds the events a consumer has not read yet, later events are dropped for it.
+const eventQueueSize = 256
+
+type EventType int
+
+const (
+	// EventPublished is sent when a source is notified, also when it replaces the source of a stream.
+	EventPublished EventType = iota + 1
+	// EventUnpublished is sent when the stream ends, Stream is the stream as it was.
+	EventUnpublished
+	// EventCodecChanged is sent when the frames of a stream change codec or codec configuration.
+	EventCodecChanged
+	EventSubscriberAdded
+	EventSubscriberRemoved
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPublished:
+		return "published"
+	case EventUnpublished:
+		return "unpublished"
+	case EventCodecChanged:
+		return "codec_changed"
+	case EventSubscriberAdded:
+		return "subscriber_added"
+	case EventSubscriberRemoved:
+		return "subscriber_removed"
+	}
+	return "unknown"
+}
+
+// Event is a change of the lifecycle of a stream.
+type Event struct {
+	Type     EventType
+	StreamID string
+	Time     time.Time
+	// Stream is the registered stream, its Source is nil for the subscriber events of streams that are not notified,
+	// e.g. simulcast renditions.
+	Stream StreamInfo
+	// Subscriber is the name of the subscriber of the subscriber events.
+	Subscriber string
+}
+
+// eventBus sends every event to every consumer. A consumer that does not keep up loses events,
+// the hub never waits for it.
+type eventBus struct {
+	mu        sync.Mutex
+	consumers map[chan Event]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		consumers: map[chan Event]struct{}{},
+	}
+}
+
+func (b *eventBus) subscribe(ctx context.Context) <-chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan Event, eventQueueSize)
+	b.consumers[ch] = struct{}{}
+	context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.consumers, ch)
+		close(ch)
+	})
+	return ch
+}
+
+func (b *eventBus) publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.consumers {
+		select {
+		case ch <- event:
+		default:
+			log.Warnf(context.Background(), "event consumer is too slow, dropping %s event of %s", event.Type, event.StreamID)
+		}
+	}
+}
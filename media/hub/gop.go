@@ -0,0 +1,59 @@
+package hub
+
+// maxGOPFrames bounds the cache of streams with very long or missing key frame intervals.
+const maxGOPFrames = 3000
+
+// gopCache keeps the frames of a stream from its last key frame on, so that a new subscriber starts with a
+// decodable picture. The latest AAC sequence header is kept apart, it may have been sent long before the key frame.
+//
+// The cache is replayed when a subscription starts. WHEP subscribes once per stream and fans the RTP packets out to
+// its viewers, so a viewer that joins later is not a new subscriber. It keeps the GOP as the packets it already
+// sent instead: the live packets continue their sequence numbers, which frames packetized again would not.
+type gopCache struct {
+	audioConfig *FrameData
+	frames      []*FrameData
+}
+
+func (c *gopCache) add(data *FrameData) {
+	if data.AACAudio != nil && data.AACAudio.SequenceHeader {
+		c.audioConfig = data
+		return
+	}
+	switch {
+	case IsKeyFrame(data):
+		c.frames = []*FrameData{data}
+	case len(c.frames) >= maxGOPFrames:
+		c.frames = nil
+	case len(c.frames) > 0:
+		c.frames = append(c.frames, data)
+	}
+}
+
+// replay returns the codec configuration followed by the cached GOP.
+func (c *gopCache) replay() []*FrameData {
+	ret := make([]*FrameData, 0, len(c.frames)+1)
+	if c.audioConfig != nil {
+		ret = append(ret, c.audioConfig)
+	}
+	return append(ret, c.frames...)
+}
+
+// IsKeyFrame reports whether data is a video frame that can be decoded on its own.
+// H.264 frames are identified by their slice types.
+func IsKeyFrame(data *FrameData) bool {
+	switch {
+	case data.H264Video != nil:
+		for _, sliceType := range data.H264Video.SliceTypes {
+			if sliceType == SliceI {
+				return true
+			}
+		}
+	case data.VP8Video != nil:
+		return data.VP8Video.KeyFrame
+	case data.VP9Video != nil:
+		return data.VP9Video.KeyFrame
+	case data.AV1Video != nil:
+		return data.AV1Video.KeyFrame
+	}
+	return false
+}
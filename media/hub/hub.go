@@ -5,13 +5,12 @@ import (
 	"fmt"
 	"sync"
 	"time"
-
-	"liveflow/log"
 )
 
 var (
 	ErrNotFoundAudioClockRate = fmt.Errorf("audio clock rate not found")
 	ErrNotFoundVideoClockRate = fmt.Errorf("video clock rate not found")
+	ErrNoControlHandler       = fmt.Errorf("no control handler")
 )
 
 type MediaType int
@@ -25,6 +24,8 @@ type CodecType string
 
 const (
 	CodecTypeVP8  CodecType = "vp8"
+	CodecTypeVP9  CodecType = "vp9"
+	CodecTypeAV1  CodecType = "av1"
 	CodecTypeH264 CodecType = "h264"
 	CodecTypeOpus CodecType = "opus"
 	CodecTypeAAC  CodecType = "aac"
@@ -43,6 +44,49 @@ type Source interface {
 	Depth() int
 }
 
+// Rendition is a layer of a stream, e.g. a simulcast layer of a WHIP publisher.
+// Every rendition is published under its own stream ID, the main one under the stream ID of the source.
+type Rendition struct {
+	Name     string
+	StreamID string
+}
+
+// RenditionSource is a Source that publishes more than one rendition. Only the source itself is notified,
+// the other renditions are published without notification.
+type RenditionSource interface {
+	Source
+	// Renditions lists the main rendition first.
+	Renditions() []Rendition
+}
+
+// ClosableSource is a Source whose publisher can be disconnected by the server, e.g. by an admin.
+type ClosableSource interface {
+	Source
+	// Close disconnects the publisher, the source unpublishes its streams.
+	Close() error
+}
+
+// Renditions returns nil for sources with a single rendition.
+func Renditions(source Source) []Rendition {
+	if s, ok := source.(RenditionSource); ok {
+		return s.Renditions()
+	}
+	return nil
+}
+
+// RenditionStreamID returns the stream ID a rendition other than the main one is published under.
+func RenditionStreamID(streamID string, name string) string {
+	return streamID + "/" + name
+}
+
+// Control is a message from a subscriber to the source of a stream.
+type Control int
+
+const (
+	// ControlKeyFrameRequest asks the source for a key frame, e.g. for a viewer that joined or lost packets.
+	ControlKeyFrameRequest Control = iota + 1
+)
+
 func HasCodecType(specs []MediaSpec, codecType CodecType) bool {
 	for _, spec := range specs {
 		if spec.CodecType == codecType {
@@ -72,66 +116,201 @@ func VideoClockRate(specs []MediaSpec) (uint32, error) {
 
 // Hub struct: Manages data independently for each streamID and supports Pub/Sub mechanism.
 type Hub struct {
-	streams    map[string][]chan *FrameData // Stores channels for each streamID
-	notifyChan chan Source                  // Channel for notifying when streamID is determined
-	mu         sync.RWMutex                 // Mutex for concurrency
+	streams    map[string][]*subscriber            // Stores subscribers for each streamID
+	controls   map[string]map[Source]func(Control) // Control handlers of the sources for each streamID
+	gops       map[string]*gopCache                // Last GOP and codec configuration for each streamID
+	registry   map[string]*registeredStream        // Notified sources, the owners, for each streamID
+	standby    map[string][]Source                 // Sources waiting to own each streamID, the first first
+	takeover   TakeoverPolicy                      // What happens to a source notified for an owned stream
+	events     *eventBus                           // Lifecycle events for any number of consumers
+	notifyChan chan Source                         // Channel for notifying when streamID is determined
+	mu         sync.RWMutex                        // Mutex for concurrency
 }
 
 // NewHub : Hub constructor
 func NewHub() *Hub {
 	return &Hub{
-		streams:    make(map[string][]chan *FrameData),
+		streams:    make(map[string][]*subscriber),
+		controls:   make(map[string]map[Source]func(Control)),
+		gops:       make(map[string]*gopCache),
+		registry:   make(map[string]*registeredStream),
+		standby:    make(map[string][]Source),
+		events:     newEventBus(),
 		notifyChan: make(chan Source, 1024), // Buffer size can be adjusted.
 	}
 }
 
-func (h *Hub) Notify(ctx context.Context, streamID Source) {
-	log.Info(ctx, "Notify", streamID.Name(), streamID.MediaSpecs())
-	h.notifyChan <- streamID
+// SubscribeEvents : Returns a channel of the lifecycle events of all streams until ctx is done.
+// Every consumer receives every event, a consumer that does not keep up loses events.
+func (h *Hub) SubscribeEvents(ctx context.Context) <-chan Event {
+	return h.events.subscribe(ctx)
 }
 
-// Publish : Publishes data to the given streamID.
-func (h *Hub) Publish(streamID string, data *FrameData) {
+// emit is called with the mutex held.
+func (h *Hub) emit(eventType EventType, streamID string, subscriber string) {
+	h.events.publish(Event{
+		Type:       eventType,
+		StreamID:   streamID,
+		Time:       time.Now(),
+		Stream:     h.streamInfo(streamID),
+		Subscriber: subscriber,
+	})
+}
+
+// Publish : Publishes data of source to the given streamID, the stream of source or of one of its renditions.
+// The frames of a source that does not own its stream are dropped. It never waits for subscribers,
+// a subscriber whose queue is full is handled by its OverflowPolicy.
+func (h *Hub) Publish(source Source, streamID string, data *FrameData) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if _, exists := h.streams[streamID]; !exists {
-		h.streams[streamID] = make([]chan *FrameData, 0)
+	if !h.owns(source) {
+		return
+	}
+
+	if _, exists := h.gops[streamID]; !exists {
+		h.gops[streamID] = &gopCache{}
+	}
+	h.gops[streamID].add(data)
+	if stream, ok := h.registry[streamID]; ok {
+		stream.measure(data)
+		if stream.observe(data) {
+			h.emit(EventCodecChanged, streamID, "")
+		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-	defer cancel()
-	for _, ch := range h.streams[streamID] {
-		select {
-		case ch <- data:
-		case <-ctx.Done():
-			log.Warn(ctx, "publish timeout")
+	subs := h.streams[streamID]
+	for i := 0; i < len(subs); {
+		if subs[i].push(data) {
+			i++
+			continue
 		}
+		sub := subs[i]
+		sub.close()
+		subs = append(subs[:i], subs[i+1:]...)
+		h.setSubscribers(streamID, subs)
+		h.emit(EventSubscriberRemoved, streamID, sub.name)
+	}
+}
+
+// setSubscribers is called with the mutex held.
+func (h *Hub) setSubscribers(streamID string, subs []*subscriber) {
+	if len(subs) > 0 {
+		h.streams[streamID] = subs
+	} else {
+		delete(h.streams, streamID)
+	}
+}
+
+// endStream is called with the mutex held, it closes the subscribers and unregisters the source.
+func (h *Hub) endStream(streamID string) {
+	delete(h.gops, streamID)
+	subs := h.streams[streamID]
+	delete(h.streams, streamID)
+	for _, sub := range subs {
+		sub.close()
+		h.emit(EventSubscriberRemoved, streamID, sub.name)
+	}
+	if _, ok := h.registry[streamID]; ok {
+		h.emit(EventUnpublished, streamID, "")
+		delete(h.registry, streamID)
 	}
 }
 
-func (h *Hub) Unpublish(streamID string) {
+// Subscribe : Subscribes to the given streamID with the default options.
+func (h *Hub) Subscribe(streamID string) *Subscription {
+	return h.SubscribeWithOptions(streamID, SubscribeOptions{})
+}
+
+// SubscribeWithOptions : Subscribes to the given streamID with its own queue and overflow policy.
+func (h *Hub) SubscribeWithOptions(streamID string, options SubscribeOptions) *Subscription {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if _, exists := h.streams[streamID]; !exists {
-		return
+	return h.subscribe(streamID, options)
+}
+
+// SubscribeWithContext : Subscribes to the given streamID until ctx is done, e.g. for the request of a viewer.
+func (h *Hub) SubscribeWithContext(ctx context.Context, streamID string, options SubscribeOptions) *Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subscription := h.subscribe(streamID, options)
+	subscription.sub.stopContext = context.AfterFunc(ctx, subscription.Close)
+	return subscription
+}
+
+// subscribe is called with the mutex held.
+func (h *Hub) subscribe(streamID string, options SubscribeOptions) *Subscription {
+	var replay []*FrameData
+	if gop, exists := h.gops[streamID]; exists && options.ReplayGOP {
+		replay = gop.replay()
 	}
+	sub := newSubscriber(streamID, options, replay)
+	h.streams[streamID] = append(h.streams[streamID], sub)
+	h.emit(EventSubscriberAdded, streamID, sub.name)
+	return &Subscription{hub: h, sub: sub}
+}
+
+func (h *Hub) removeSubscriber(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-	for _, ch := range h.streams[streamID] {
-		close(ch)
+	if sub.closed {
+		return
 	}
-	delete(h.streams, streamID)
+	subs := h.streams[sub.streamID]
+	for i := range subs {
+		if subs[i] == sub {
+			subs = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	h.setSubscribers(sub.streamID, subs)
+	sub.close()
+	h.emit(EventSubscriberRemoved, sub.streamID, sub.name)
 }
 
-// Subscribe : Subscribes to the given streamID.
-func (h *Hub) Subscribe(streamID string) <-chan *FrameData {
+// Subscribers : Returns the queue counters of the subscribers of the given streamID.
+func (h *Hub) Subscribers(streamID string) []SubscriberStats {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
-	ch := make(chan *FrameData)
-	h.streams[streamID] = append(h.streams[streamID], ch)
-	return ch
+	ret := make([]SubscriberStats, 0, len(h.streams[streamID]))
+	for _, sub := range h.streams[streamID] {
+		ret = append(ret, sub.stats())
+	}
+	return ret
+}
+
+// HandleControl : Registers the handler of source for the control messages sent to streamID until source is
+// unpublished. Only the handler of the owner is called, from the goroutine of the sender, and it must not block.
+func (h *Hub) HandleControl(source Source, streamID string, handler func(Control)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.controls[streamID] == nil {
+		h.controls[streamID] = map[Source]func(Control){}
+	}
+	h.controls[streamID][source] = handler
+}
+
+// SendControl : Sends a control message to the source of streamID.
+// It returns ErrNoControlHandler when the source cannot take control messages, e.g. an RTMP publisher.
+func (h *Hub) SendControl(streamID string, control Control) error {
+	h.mu.RLock()
+	var handler func(Control)
+	for source, sourceHandler := range h.controls[streamID] {
+		if owner := h.owner(source.StreamID()); owner == source {
+			handler = sourceHandler
+			break
+		}
+	}
+	h.mu.RUnlock()
+	if handler == nil {
+		return ErrNoControlHandler
+	}
+	handler(control)
+	return nil
 }
 
 // SubscribeToStreamID : Returns a channel that subscribes to notifications when a stream ID is determined.
@@ -139,15 +318,11 @@ func (h *Hub) SubscribeToStreamID() <-chan Source {
 	return h.notifyChan
 }
 
-// RemoveStream : Function to remove unused streams (releases resources)
+// RemoveStream : Function to remove unused streams (releases resources), whichever source owns them
 func (h *Hub) RemoveStream(streamID string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if chs, exists := h.streams[streamID]; exists {
-		for _, ch := range chs {
-			close(ch)
-		}
-		delete(h.streams, streamID)
-	}
+	delete(h.controls, streamID)
+	h.endStream(streamID)
 }
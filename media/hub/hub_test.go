@@ -0,0 +1,259 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitClosed reads the frames of sub until its channel is closed.
+func waitClosed(t *testing.T, sub *Subscription) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-sub.Frames():
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("subscription was not closed")
+		}
+	}
+}
+
+func TestCloseRemovesOnlyItsOwnSubscriber(t *testing.T) {
+	h := NewHub()
+	source := &testSource{streamID: "stream"}
+	// the same name and options, only the subscription tells them apart
+	a := h.SubscribeWithOptions("stream", SubscribeOptions{Name: "hls"})
+	b := h.SubscribeWithOptions("stream", SubscribeOptions{Name: "hls"})
+	other := h.Subscribe("other")
+	defer other.Close()
+
+	a.Close()
+	waitClosed(t, a)
+	h.Publish(source, "stream", keyFrame(1))
+	if got := drain(b); !equalPTS(got, []int64{1}) {
+		t.Fatalf("the other subscriber got %v, want the published frame", got)
+	}
+	if subscribers := h.Subscribers("stream"); len(subscribers) != 1 {
+		t.Fatalf("subscribers %+v, want one", subscribers)
+	}
+	// closing again leaves the other subscriber alone
+	a.Close()
+	if subscribers := h.Subscribers("stream"); len(subscribers) != 1 {
+		t.Fatalf("subscribers %+v after a second close, want one", subscribers)
+	}
+	b.Close()
+	waitClosed(t, b)
+	if subscribers := h.Subscribers("stream"); len(subscribers) != 0 {
+		t.Fatalf("subscribers %+v, want none", subscribers)
+	}
+	if subscribers := h.Subscribers("other"); len(subscribers) != 1 {
+		t.Fatalf("subscribers of the other stream %+v, want one", subscribers)
+	}
+}
+
+func TestCloseAfterUnpublish(t *testing.T) {
+	h := NewHub()
+	source := &testSource{streamID: "stream"}
+	sub := h.Subscribe("stream")
+	h.Publish(source, "stream", keyFrame(1))
+	h.RemoveStream("stream")
+	waitClosed(t, sub)
+	// the stream is published again, the closed subscription must not remove the new subscriber
+	next := h.Subscribe("stream")
+	defer next.Close()
+	sub.Close()
+	if subscribers := h.Subscribers("stream"); len(subscribers) != 1 {
+		t.Fatalf("subscribers %+v, want the new one", subscribers)
+	}
+}
+
+func TestSubscribeWithContextCancel(t *testing.T) {
+	h := NewHub()
+	source := &testSource{streamID: "stream"}
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := h.SubscribeWithContext(ctx, "stream", SubscribeOptions{Name: "viewer"})
+	stays := h.SubscribeWithContext(context.Background(), "stream", SubscribeOptions{Name: "recorder"})
+	defer stays.Close()
+
+	h.Publish(source, "stream", keyFrame(1))
+	cancel()
+	waitClosed(t, sub)
+	subscribers := h.Subscribers("stream")
+	if len(subscribers) != 1 || subscribers[0].Name != "recorder" {
+		t.Fatalf("subscribers %+v after the cancel, want the recorder", subscribers)
+	}
+	h.Publish(source, "stream", deltaFrame(2))
+	if got := drain(stays); !equalPTS(got, []int64{1, 2}) {
+		t.Fatalf("the other subscriber got %v", got)
+	}
+	// Close after the cancel is a no-op
+	sub.Close()
+}
+
+func TestSubscribeWithContextEndsFirst(t *testing.T) {
+	h := NewHub()
+	ctx, cancel := context.WithCancel(context.Background())
+	closed := h.SubscribeWithContext(ctx, "stream", SubscribeOptions{})
+	closed.Close()
+	unpublished := h.SubscribeWithContext(ctx, "other", SubscribeOptions{})
+	h.RemoveStream("other")
+	waitClosed(t, unpublished)
+	// the subscriptions are gone before the context, canceling it closes nothing twice
+	cancel()
+	if n := len(h.Subscribers("stream")) + len(h.Subscribers("other")); n != 0 {
+		t.Fatalf("%d subscribers left", n)
+	}
+	// a context that is already done closes the subscription right away
+	done := h.SubscribeWithContext(ctx, "stream", SubscribeOptions{})
+	waitClosed(t, done)
+}
+
+func TestConcurrentSubscribePublishUnpublish(t *testing.T) {
+	const (
+		streamCount     = 4
+		publishRounds   = 50
+		framesPerRound  = 20
+		subscriberCount = 8
+	)
+	h := NewHub()
+	h.SetTakeoverPolicy(StandbyNewPublisher)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case <-h.SubscribeToStreamID():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	events := h.SubscribeEvents(ctx)
+	go func() {
+		for range events {
+		}
+	}()
+
+	var publishers sync.WaitGroup
+	for i := 0; i < streamCount; i++ {
+		streamID := fmt.Sprintf("stream%d", i)
+		// two publishers per stream, one of them is on standby at times
+		for j := 0; j < 2; j++ {
+			publishers.Add(1)
+			go func() {
+				defer publishers.Done()
+				for round := 0; round < publishRounds; round++ {
+					source := &testSource{streamID: streamID}
+					_ = h.Notify(ctx, source)
+					h.HandleControl(source, streamID, func(Control) {})
+					for k := 0; k < framesPerRound; k++ {
+						if k%10 == 0 {
+							h.Publish(source, streamID, keyFrame(int64(k)))
+						} else {
+							h.Publish(source, streamID, deltaFrame(int64(k)))
+						}
+					}
+					h.Unpublish(source)
+				}
+			}()
+		}
+	}
+
+	stop := make(chan struct{})
+	var subscribers sync.WaitGroup
+	for i := 0; i < subscriberCount; i++ {
+		subscribers.Add(1)
+		go func(seed int64) {
+			defer subscribers.Done()
+			r := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				streamID := fmt.Sprintf("stream%d", r.Intn(streamCount))
+				options := SubscribeOptions{
+					Name:      "test",
+					QueueSize: 1 + r.Intn(8),
+					Overflow:  OverflowPolicy(r.Intn(3)),
+					ReplayGOP: r.Intn(2) == 0,
+				}
+				var sub *Subscription
+				subCtx, subCancel := context.WithCancel(ctx)
+				if r.Intn(2) == 0 {
+					sub = h.SubscribeWithContext(subCtx, streamID, options)
+				} else {
+					sub = h.SubscribeWithOptions(streamID, options)
+				}
+				for k := r.Intn(5); k > 0; k-- {
+					select {
+					case <-sub.Frames():
+					default:
+					}
+				}
+				_ = sub.Stats()
+				_ = h.Subscribers(streamID)
+				_ = h.List()
+				_ = h.SendControl(streamID, ControlKeyFrameRequest)
+				// cancel and close race each other for half of the context subscriptions
+				if r.Intn(2) == 0 {
+					go subCancel()
+				} else {
+					subCancel()
+				}
+				sub.Close()
+			}
+		}(int64(i))
+	}
+
+	publishers.Wait()
+	close(stop)
+	subscribers.Wait()
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.streams) != 0 || len(h.registry) != 0 || len(h.standby) != 0 || len(h.controls) != 0 {
+		t.Fatalf("left %d subscribed streams, %d registered, %d on standby and %d with controls",
+			len(h.streams), len(h.registry), len(h.standby), len(h.controls))
+	}
+}
+
+func TestCanPublish(t *testing.T) {
+	for _, tt := range []struct {
+		policy TakeoverPolicy
+		want   error
+	}{
+		{policy: RejectNewPublisher, want: ErrStreamTaken},
+		{policy: KickOldPublisher},
+		{policy: StandbyNewPublisher},
+	} {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			h := NewHub()
+			h.SetTakeoverPolicy(tt.policy)
+			if err := h.CanPublish("stream"); err != nil {
+				t.Fatalf("got %v for a stream nobody publishes", err)
+			}
+			source := &testSource{streamID: "stream"}
+			if err := h.Notify(context.Background(), source); err != nil {
+				t.Fatal(err)
+			}
+			<-h.SubscribeToStreamID()
+			if err := h.CanPublish("stream"); err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			// Notify agrees with CanPublish
+			if err := h.Notify(context.Background(), &testSource{streamID: "stream"}); tt.want != nil && err != tt.want {
+				t.Fatalf("notify %v, want %v", err, tt.want)
+			}
+			h.Unpublish(source)
+		})
+	}
+}
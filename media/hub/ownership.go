@@ -0,0 +1,202 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"liveflow/log"
+)
+
+var (
+	// ErrStreamTaken is returned by Notify when another source publishes the stream and newcomers are rejected.
+	ErrStreamTaken = errors.New("stream is published by another source")
+	// ErrStandby is returned by Notify when the source waits as a backup of the source that publishes the stream.
+	// The source keeps running, its frames are dropped until it takes over.
+	ErrStandby               = errors.New("source is on standby")
+	ErrUnknownTakeoverPolicy = errors.New("unknown takeover policy")
+)
+
+// TakeoverPolicy decides what happens when a source is notified for a stream that another source publishes.
+// A stream is owned by the source that was notified for it, only the owner publishes frames, takes control
+// messages and ends the stream.
+type TakeoverPolicy int
+
+const (
+	// RejectNewPublisher keeps the owner, the newcomer gets ErrStreamTaken and should disconnect.
+	RejectNewPublisher TakeoverPolicy = iota
+	// KickOldPublisher ends the stream of the owner, closes it when it is a ClosableSource and publishes the
+	// stream of the newcomer. The outputs of the old stream end, a new set is started for the new one.
+	KickOldPublisher
+	// StandbyNewPublisher queues the newcomer, it publishes the stream when the sources before it end.
+	StandbyNewPublisher
+)
+
+func (p TakeoverPolicy) String() string {
+	switch p {
+	case KickOldPublisher:
+		return "takeover"
+	case StandbyNewPublisher:
+		return "standby"
+	}
+	return "reject"
+}
+
+// ParseTakeoverPolicy maps the policy names of the config (reject, takeover, standby) to policies.
+func ParseTakeoverPolicy(name string) (TakeoverPolicy, error) {
+	switch strings.ToLower(name) {
+	case "", "reject":
+		return RejectNewPublisher, nil
+	case "takeover":
+		return KickOldPublisher, nil
+	case "standby":
+		return StandbyNewPublisher, nil
+	}
+	return 0, ErrUnknownTakeoverPolicy
+}
+
+// SetTakeoverPolicy : Sets the policy of the sources notified from now on, RejectNewPublisher by default.
+func (h *Hub) SetTakeoverPolicy(policy TakeoverPolicy) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.takeover = policy
+}
+
+// Notify : Makes source the owner of its stream and starts the outputs of the stream.
+// When another source owns the stream it returns ErrStreamTaken or ErrStandby, as the takeover policy says.
+// Notifying the owner again restarts the outputs.
+func (h *Hub) Notify(ctx context.Context, source Source) error {
+	log.Info(ctx, "Notify", source.Name(), source.MediaSpecs())
+	streamID := source.StreamID()
+	var kicked Source
+	h.mu.Lock()
+	if owner := h.owner(streamID); owner != nil && owner != source {
+		switch h.takeover {
+		case KickOldPublisher:
+			log.Infof(ctx, "%s publisher takes over %s from %s publisher", source.Name(), streamID, owner.Name())
+			h.endSource(owner)
+			kicked = owner
+		case StandbyNewPublisher:
+			log.Infof(ctx, "%s publisher is on standby for %s", source.Name(), streamID)
+			h.standby[streamID] = append(h.standby[streamID], source)
+			h.mu.Unlock()
+			return ErrStandby
+		default:
+			h.mu.Unlock()
+			return ErrStreamTaken
+		}
+	}
+	h.register(source)
+	h.mu.Unlock()
+	if closable, ok := kicked.(ClosableSource); ok {
+		if err := closable.Close(); err != nil {
+			log.Error(ctx, err, "failed to close the publisher taken over")
+		}
+	} else if kicked != nil {
+		log.Warnf(ctx, "%s publisher cannot be disconnected, its frames are dropped", kicked.Name())
+	}
+	h.notifyChan <- source
+	return nil
+}
+
+// CanPublish : Returns ErrStreamTaken when a new source of streamID would be rejected by Notify, so that publishers
+// can be refused before they are answered. Notify decides again, the stream may be taken in between.
+func (h *Hub) CanPublish(streamID string) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.owner(streamID) != nil && h.takeover == RejectNewPublisher {
+		return ErrStreamTaken
+	}
+	return nil
+}
+
+// Unpublish : Ends the streams of source and hands the stream to the first source on standby.
+// A source that does not own its stream leaves it alone, e.g. one on standby or one that has been taken over.
+func (h *Hub) Unpublish(source Source) {
+	streamID := source.StreamID()
+	var promoted Source
+	h.mu.Lock()
+	h.removeControls(source)
+	if h.removeStandby(source) {
+		h.mu.Unlock()
+		return
+	}
+	if owner := h.owner(streamID); owner != nil && owner != source {
+		h.mu.Unlock()
+		return
+	}
+	h.endSource(source)
+	if standby := h.standby[streamID]; len(standby) > 0 {
+		promoted = standby[0]
+		if len(standby) > 1 {
+			h.standby[streamID] = standby[1:]
+		} else {
+			delete(h.standby, streamID)
+		}
+		h.register(promoted)
+	}
+	h.mu.Unlock()
+	if promoted != nil {
+		log.Infof(context.Background(), "%s publisher on standby takes over %s", promoted.Name(), streamID)
+		h.notifyChan <- promoted
+	}
+}
+
+// owner is called with the mutex held, it is nil for a stream no source has been notified for.
+func (h *Hub) owner(streamID string) Source {
+	if stream, ok := h.registry[streamID]; ok {
+		return stream.source
+	}
+	return nil
+}
+
+// owns is called with the mutex held. A source owns the streams of its renditions with its own stream,
+// frames of a stream without owner are taken from any source until one is notified.
+func (h *Hub) owns(source Source) bool {
+	owner := h.owner(source.StreamID())
+	return owner == nil || owner == source
+}
+
+// register is called with the mutex held.
+func (h *Hub) register(source Source) {
+	h.registry[source.StreamID()] = newRegisteredStream(source)
+	h.emit(EventPublished, source.StreamID(), "")
+}
+
+// endSource is called with the mutex held, it ends the stream of source and of its renditions.
+func (h *Hub) endSource(source Source) {
+	h.endStream(source.StreamID())
+	for _, rendition := range Renditions(source) {
+		if rendition.StreamID != source.StreamID() {
+			h.endStream(rendition.StreamID)
+		}
+	}
+}
+
+// removeStandby is called with the mutex held, it reports whether source was on standby.
+func (h *Hub) removeStandby(source Source) bool {
+	streamID := source.StreamID()
+	standby := h.standby[streamID]
+	for i := range standby {
+		if standby[i] == source {
+			standby = append(standby[:i], standby[i+1:]...)
+			if len(standby) > 0 {
+				h.standby[streamID] = standby
+			} else {
+				delete(h.standby, streamID)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// removeControls is called with the mutex held.
+func (h *Hub) removeControls(source Source) {
+	for streamID, handlers := range h.controls {
+		delete(handlers, source)
+		if len(handlers) == 0 {
+			delete(h.controls, streamID)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package hub
+
+import (
+	"bytes"
+	"sort"
+	"time"
+)
+
+// bitrateWindow is the window the bitrate of a stream is measured over.
+const bitrateWindow = 2 * time.Second
+
+// StreamInfo describes a stream whose source has been notified.
+type StreamInfo struct {
+	StreamID   string
+	Source     Source
+	StartedAt  time.Time
+	MediaSpecs []MediaSpec
+	// Bitrate is the bitrate of the frames in bits per second, zero until it has been measured.
+	Bitrate int
+	// Subscribers counts the subscribers of the stream and of its renditions.
+	Subscribers int
+}
+
+// registeredStream is guarded by the mutex of the hub.
+type registeredStream struct {
+	source     Source
+	startedAt  time.Time
+	mediaSpecs []MediaSpec
+
+	// the codec configuration of the frames, to tell when it changes
+	videoCodec CodecType
+	audioCodec CodecType
+	sps        []byte
+	aacConfig  []byte
+
+	bitrate      int
+	bitrateBytes int
+	bitrateSince time.Time
+}
+
+func newRegisteredStream(source Source) *registeredStream {
+	return &registeredStream{
+		source:     source,
+		startedAt:  time.Now(),
+		mediaSpecs: source.MediaSpecs(),
+	}
+}
+
+// observe reports whether the codec or the codec configuration of data differs from the previous frames.
+// The media specs follow the codec of the frames.
+func (r *registeredStream) observe(data *FrameData) bool {
+	changed := false
+	videoCodec, audioCodec := frameCodecs(data)
+	if videoCodec != "" {
+		if r.videoCodec != "" && r.videoCodec != videoCodec {
+			changed = true
+		}
+		r.videoCodec = videoCodec
+		r.setCodec(Video, videoCodec)
+	}
+	if audioCodec != "" {
+		if r.audioCodec != "" && r.audioCodec != audioCodec {
+			changed = true
+		}
+		r.audioCodec = audioCodec
+		r.setCodec(Audio, audioCodec)
+	}
+	if data.H264Video != nil && len(data.H264Video.SPS) > 0 {
+		if r.sps != nil && !bytes.Equal(r.sps, data.H264Video.SPS) {
+			changed = true
+		}
+		r.sps = data.H264Video.SPS
+	}
+	if data.AACAudio != nil && len(data.AACAudio.MPEG4AudioConfigBytes) > 0 {
+		if r.aacConfig != nil && !bytes.Equal(r.aacConfig, data.AACAudio.MPEG4AudioConfigBytes) {
+			changed = true
+		}
+		r.aacConfig = data.AACAudio.MPEG4AudioConfigBytes
+	}
+	return changed
+}
+
+// measure adds the size of a frame to the bitrate.
+func (r *registeredStream) measure(data *FrameData) {
+	now := time.Now()
+	if r.bitrateSince.IsZero() {
+		r.bitrateSince = now
+	}
+	r.bitrateBytes += frameSize(data)
+	elapsed := now.Sub(r.bitrateSince)
+	if elapsed < bitrateWindow {
+		return
+	}
+	r.bitrate = int(float64(r.bitrateBytes*8) / elapsed.Seconds())
+	r.bitrateBytes = 0
+	r.bitrateSince = now
+}
+
+func frameSize(data *FrameData) int {
+	n := 0
+	switch {
+	case data.H264Video != nil:
+		n += len(data.H264Video.Data)
+	case data.VP8Video != nil:
+		n += len(data.VP8Video.Data)
+	case data.VP9Video != nil:
+		n += len(data.VP9Video.Data)
+	case data.AV1Video != nil:
+		n += len(data.AV1Video.Data)
+	}
+	switch {
+	case data.AACAudio != nil:
+		n += len(data.AACAudio.Data)
+	case data.OPUSAudio != nil:
+		n += len(data.OPUSAudio.Data)
+	}
+	return n
+}
+
+func (r *registeredStream) setCodec(mediaType MediaType, codecType CodecType) {
+	for i, spec := range r.mediaSpecs {
+		if spec.MediaType == mediaType {
+			if spec.CodecType != codecType {
+				// the specs may be shared with the source
+				specs := append([]MediaSpec(nil), r.mediaSpecs...)
+				specs[i].CodecType = codecType
+				r.mediaSpecs = specs
+			}
+			return
+		}
+	}
+}
+
+func frameCodecs(data *FrameData) (CodecType, CodecType) {
+	var videoCodec, audioCodec CodecType
+	switch {
+	case data.H264Video != nil:
+		videoCodec = CodecTypeH264
+	case data.VP8Video != nil:
+		videoCodec = CodecTypeVP8
+	case data.VP9Video != nil:
+		videoCodec = CodecTypeVP9
+	case data.AV1Video != nil:
+		videoCodec = CodecTypeAV1
+	}
+	switch {
+	case data.AACAudio != nil:
+		audioCodec = CodecTypeAAC
+	case data.OPUSAudio != nil:
+		audioCodec = CodecTypeOpus
+	}
+	return videoCodec, audioCodec
+}
+
+// List returns the registered streams ordered by stream ID.
+func (h *Hub) List() []StreamInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ret := make([]StreamInfo, 0, len(h.registry))
+	for streamID := range h.registry {
+		ret = append(ret, h.streamInfo(streamID))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].StreamID < ret[j].StreamID
+	})
+	return ret
+}
+
+// Get returns the registered stream of streamID.
+func (h *Hub) Get(streamID string) (StreamInfo, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if _, ok := h.registry[streamID]; !ok {
+		return StreamInfo{}, false
+	}
+	return h.streamInfo(streamID), true
+}
+
+// streamInfo is called with the mutex held. It is the zero StreamInfo with the stream ID for unregistered streams.
+func (h *Hub) streamInfo(streamID string) StreamInfo {
+	stream, ok := h.registry[streamID]
+	if !ok {
+		return StreamInfo{StreamID: streamID, Subscribers: len(h.streams[streamID])}
+	}
+	subscribers := len(h.streams[streamID])
+	for _, rendition := range Renditions(stream.source) {
+		if rendition.StreamID != streamID {
+			subscribers += len(h.streams[rendition.StreamID])
+		}
+	}
+	return StreamInfo{
+		StreamID:    streamID,
+		Source:      stream.source,
+		StartedAt:   stream.startedAt,
+		MediaSpecs:  append([]MediaSpec(nil), stream.mediaSpecs...),
+		Bitrate:     stream.bitrate,
+		Subscribers: subscribers,
+	}
+}
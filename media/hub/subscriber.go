@@ -0,0 +1,173 @@
+package hub
+
+import (
+	"context"
+
+	"liveflow/log"
+)
+
+// DefaultQueueSize is the queue size of a subscriber that does not ask for one, about 10 seconds of video and audio.
+const DefaultQueueSize = 1024
+
+// OverflowPolicy decides what happens to the frames of a subscriber whose queue is full.
+// Publish never waits for a subscriber, a slow output only loses its own frames.
+type OverflowPolicy int
+
+const (
+	// DropUntilKeyFrame drops the frame that does not fit and every frame after it until a key frame fits,
+	// so that the subscriber continues with a decodable picture. Streams without video drop single frames.
+	DropUntilKeyFrame OverflowPolicy = iota
+	// DropOldest makes room by dropping the oldest queued frame.
+	DropOldest
+	// Disconnect closes the channel of the subscriber.
+	Disconnect
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case Disconnect:
+		return "disconnect"
+	}
+	return "drop-until-keyframe"
+}
+
+type SubscribeOptions struct {
+	// Name identifies the subscriber in its stats and logs, e.g. "hls" or "mp4".
+	Name string
+	// QueueSize is DefaultQueueSize when zero.
+	QueueSize int
+	Overflow  OverflowPolicy
+	// ReplayGOP replays the codec configuration and the frames since the last key frame first,
+	// so that a subscriber that starts after the source starts with a decodable picture.
+	ReplayGOP bool
+}
+
+// SubscriberStats are the queue counters of a subscriber.
+type SubscriberStats struct {
+	Name     string
+	Overflow OverflowPolicy
+	// Queued frames have not been read yet.
+	Queued  int
+	Dropped uint64
+}
+
+type subscriber struct {
+	streamID string
+	name     string
+	overflow OverflowPolicy
+	ch       chan *FrameData
+
+	// the fields below are guarded by the mutex of the hub
+	dropped  uint64
+	dropping bool
+	hasVideo bool
+	closed   bool
+	// stopContext releases the context of a subscription made with SubscribeWithContext
+	stopContext func() bool
+}
+
+func newSubscriber(streamID string, options SubscribeOptions, replay []*FrameData) *subscriber {
+	queueSize := options.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	s := &subscriber{
+		streamID: streamID,
+		name:     options.Name,
+		overflow: options.Overflow,
+		// the replayed frames never count against the queue size
+		ch: make(chan *FrameData, queueSize+len(replay)),
+	}
+	for _, data := range replay {
+		s.ch <- data
+	}
+	return s
+}
+
+// push never blocks. It reports false when the subscriber has to be disconnected.
+func (s *subscriber) push(data *FrameData) bool {
+	isVideo := data.H264Video != nil || data.VP8Video != nil || data.VP9Video != nil || data.AV1Video != nil
+	s.hasVideo = s.hasVideo || isVideo
+	if s.dropping && !IsKeyFrame(data) {
+		s.dropped++
+		return true
+	}
+	select {
+	case s.ch <- data:
+		if s.dropping {
+			s.dropping = false
+			log.Infof(context.Background(), "subscriber %s of %s resumes at a key frame, %d frames dropped so far", s.name, s.streamID, s.dropped)
+		}
+		return true
+	default:
+	}
+	switch s.overflow {
+	case Disconnect:
+		log.Warnf(context.Background(), "subscriber %s of %s is too slow, disconnecting", s.name, s.streamID)
+		return false
+	case DropOldest:
+		select {
+		case <-s.ch:
+			s.dropped++
+		default:
+		}
+		select {
+		case s.ch <- data:
+		default:
+			s.dropped++
+		}
+	default:
+		s.dropped++
+		if s.hasVideo && !s.dropping {
+			log.Warnf(context.Background(), "subscriber %s of %s is too slow, dropping frames until the next key frame", s.name, s.streamID)
+			s.dropping = true
+		}
+	}
+	return true
+}
+
+// close is called with the mutex of the hub held, it is a no-op for a closed subscriber.
+func (s *subscriber) close() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.ch)
+	if s.stopContext != nil {
+		s.stopContext()
+	}
+}
+
+func (s *subscriber) stats() SubscriberStats {
+	return SubscriberStats{
+		Name:     s.name,
+		Overflow: s.overflow,
+		Queued:   len(s.ch),
+		Dropped:  s.dropped,
+	}
+}
+
+// Subscription is a subscriber of a stream. Its channel is closed when the stream is unpublished,
+// when the subscriber is disconnected by its OverflowPolicy or when the subscription is closed.
+type Subscription struct {
+	hub *Hub
+	sub *subscriber
+}
+
+// Frames returns the channel the frames of the stream are received from.
+func (s *Subscription) Frames() <-chan *FrameData {
+	return s.sub.ch
+}
+
+// Close removes exactly this subscriber, the stream and its other subscribers go on. It may be called more than once.
+func (s *Subscription) Close() {
+	s.hub.removeSubscriber(s.sub)
+}
+
+func (s *Subscription) Stats() SubscriberStats {
+	s.hub.mu.RLock()
+	defer s.hub.mu.RUnlock()
+	return s.sub.stats()
+}
@@ -0,0 +1,241 @@
+package hub
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+type testSource struct {
+	streamID string
+}
+
+func (s *testSource) Name() string {
+	return "test"
+}
+
+func (s *testSource) MediaSpecs() []MediaSpec {
+	return []MediaSpec{{MediaType: Video, ClockRate: 90000, CodecType: CodecTypeH264}}
+}
+
+func (s *testSource) StreamID() string {
+	return s.streamID
+}
+
+func (s *testSource) Depth() int {
+	return 0
+}
+
+func keyFrame(pts int64) *FrameData {
+	return &FrameData{H264Video: &H264Video{PTS: pts, DTS: pts, VideoClockRate: 90000, SliceTypes: []SliceType{SliceI}}}
+}
+
+func deltaFrame(pts int64) *FrameData {
+	return &FrameData{H264Video: &H264Video{PTS: pts, DTS: pts, VideoClockRate: 90000, SliceTypes: []SliceType{SliceP}}}
+}
+
+func audioFrame(pts int64) *FrameData {
+	return &FrameData{OPUSAudio: &OPUSAudio{PTS: pts, DTS: pts, AudioClockRate: 48000}}
+}
+
+func framePTS(data *FrameData) int64 {
+	if data.H264Video != nil {
+		return data.H264Video.PTS
+	}
+	return data.OPUSAudio.PTS
+}
+
+// drain returns the PTS of the queued frames without waiting for more.
+func drain(sub *Subscription) []int64 {
+	var ret []int64
+	for {
+		select {
+		case data, ok := <-sub.Frames():
+			if !ok {
+				return ret
+			}
+			ret = append(ret, framePTS(data))
+		default:
+			return ret
+		}
+	}
+}
+
+func equalPTS(a []int64, b []int64) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		name      string
+		overflow  OverflowPolicy
+		queueSize int
+		// frames are published, a nil frame stands for a read of everything queued so far
+		frames  []*FrameData
+		want    []int64
+		dropped uint64
+		closed  bool
+	}{
+		{
+			name:      "drop until key frame",
+			overflow:  DropUntilKeyFrame,
+			queueSize: 2,
+			frames:    []*FrameData{keyFrame(1), deltaFrame(2), deltaFrame(3), deltaFrame(4), nil, deltaFrame(5), keyFrame(6), deltaFrame(7)},
+			want:      []int64{1, 2, 6, 7},
+			dropped:   3,
+		},
+		{
+			name:      "drop until key frame without video drops single frames",
+			overflow:  DropUntilKeyFrame,
+			queueSize: 2,
+			frames:    []*FrameData{audioFrame(1), audioFrame(2), audioFrame(3), nil, audioFrame(4)},
+			want:      []int64{1, 2, 4},
+			dropped:   1,
+		},
+		{
+			name:      "drop oldest",
+			overflow:  DropOldest,
+			queueSize: 2,
+			frames:    []*FrameData{keyFrame(1), deltaFrame(2), deltaFrame(3), deltaFrame(4), nil, deltaFrame(5)},
+			want:      []int64{3, 4, 5},
+			dropped:   2,
+		},
+		{
+			name:      "disconnect",
+			overflow:  Disconnect,
+			queueSize: 2,
+			frames:    []*FrameData{keyFrame(1), deltaFrame(2), deltaFrame(3), deltaFrame(4)},
+			want:      []int64{1, 2},
+			closed:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHub()
+			source := &testSource{streamID: "stream"}
+			sub := h.SubscribeWithOptions("stream", SubscribeOptions{Name: "slow", QueueSize: tt.queueSize, Overflow: tt.overflow})
+			// a subscriber that keeps up is not affected by the slow one
+			fast := h.SubscribeWithOptions("stream", SubscribeOptions{Name: "fast", QueueSize: len(tt.frames)})
+			defer fast.Close()
+			defer sub.Close()
+
+			var got []int64
+			published := 0
+			for _, data := range tt.frames {
+				if data == nil {
+					got = append(got, drain(sub)...)
+					continue
+				}
+				h.Publish(source, "stream", data)
+				published++
+			}
+			stats := sub.Stats()
+			got = append(got, drain(sub)...)
+			if !equalPTS(got, tt.want) {
+				t.Errorf("got frames %v, want %v", got, tt.want)
+			}
+			if stats.Dropped != tt.dropped || stats.Overflow != tt.overflow || stats.Name != "slow" {
+				t.Errorf("stats %+v, want %d dropped by %s", stats, tt.dropped, tt.overflow)
+			}
+			closed := false
+			select {
+			case _, ok := <-sub.Frames():
+				closed = !ok
+			default:
+			}
+			if closed != tt.closed {
+				t.Errorf("subscriber closed %v, want %v", closed, tt.closed)
+			}
+			if n := len(drain(fast)); n != published {
+				t.Errorf("fast subscriber got %d frames, want %d", n, published)
+			}
+
+			subscribers := h.Subscribers("stream")
+			if tt.closed {
+				if len(subscribers) != 1 || subscribers[0].Name != "fast" {
+					t.Errorf("subscribers %+v after the disconnect, want the fast one", subscribers)
+				}
+				return
+			}
+			if len(subscribers) != 2 || subscribers[0].Dropped != tt.dropped || subscribers[1].Dropped != 0 {
+				t.Errorf("subscribers %+v, want %d dropped by the slow one", subscribers, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestSubscriberStatsQueued(t *testing.T) {
+	h := NewHub()
+	source := &testSource{streamID: "stream"}
+	sub := h.SubscribeWithOptions("stream", SubscribeOptions{QueueSize: 4})
+	defer sub.Close()
+	for i := int64(0); i < 3; i++ {
+		h.Publish(source, "stream", keyFrame(i))
+	}
+	if stats := sub.Stats(); stats.Queued != 3 || stats.Dropped != 0 {
+		t.Fatalf("stats %+v, want 3 queued", stats)
+	}
+	<-sub.Frames()
+	if stats := sub.Stats(); stats.Queued != 2 {
+		t.Fatalf("stats %+v, want 2 queued", stats)
+	}
+}
+
+func TestReplayGOPDoesNotCountAgainstTheQueue(t *testing.T) {
+	h := NewHub()
+	source := &testSource{streamID: "stream"}
+	for _, data := range []*FrameData{deltaFrame(0), keyFrame(1), deltaFrame(2), deltaFrame(3)} {
+		h.Publish(source, "stream", data)
+	}
+	sub := h.SubscribeWithOptions("stream", SubscribeOptions{QueueSize: 1, ReplayGOP: true})
+	defer sub.Close()
+	h.Publish(source, "stream", deltaFrame(4))
+	if got := drain(sub); !equalPTS(got, []int64{1, 2, 3, 4}) {
+		t.Fatalf("got frames %v, want the GOP from the key frame and the live frame", got)
+	}
+	if stats := sub.Stats(); stats.Dropped != 0 {
+		t.Fatalf("stats %+v, want nothing dropped", stats)
+	}
+}
+
+// BenchmarkPublish publishes to fast subscribers next to one that never reads.
+// The stalled subscriber must not slow Publish down, it only drops its own frames.
+func BenchmarkPublish(b *testing.B) {
+	for _, fastCount := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("fast=%d", fastCount), func(b *testing.B) {
+			h := NewHub()
+			source := &testSource{streamID: "stream"}
+			stalled := h.SubscribeWithOptions("stream", SubscribeOptions{Name: "stalled"})
+			defer stalled.Close()
+			var wg sync.WaitGroup
+			var fast []*Subscription
+			for i := 0; i < fastCount; i++ {
+				sub := h.SubscribeWithOptions("stream", SubscribeOptions{Name: "fast"})
+				fast = append(fast, sub)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range sub.Frames() {
+					}
+				}()
+			}
+			frames := []*FrameData{keyFrame(0)}
+			for i := 1; i < 30; i++ {
+				frames = append(frames, deltaFrame(int64(i)))
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.Publish(source, "stream", frames[i%len(frames)])
+			}
+			b.StopTimer()
+
+			b.ReportMetric(float64(stalled.Stats().Dropped)/float64(b.N), "stalled-drops/op")
+			for _, sub := range fast {
+				sub.Close()
+			}
+			wg.Wait()
+		})
+	}
+}
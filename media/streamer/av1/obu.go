@@ -0,0 +1,101 @@
+// Package av1 converts AV1 temporal units between the low overhead bitstream format of the hub
+// and the OBUs without obu_size fields carried by RTP.
+package av1
+
+import (
+	"errors"
+
+	"github.com/pion/rtp/codecs/av1/obu"
+)
+
+const (
+	obuTypeSequenceHeader    = 1
+	obuTypeTemporalDelimiter = 2
+	obuExtensionFlag         = 0x04
+	obuHasSizeField          = 0x02
+)
+
+var (
+	ErrInvalidOBU = errors.New("invalid obu")
+)
+
+func obuType(header byte) byte {
+	return (header >> 3) & 0x0f
+}
+
+func headerSize(header byte) int {
+	if header&obuExtensionFlag != 0 {
+		return 2
+	}
+	return 1
+}
+
+// Marshal joins OBUs into a temporal unit with an obu_size field on every OBU. Temporal delimiters are dropped.
+func Marshal(obus [][]byte) ([]byte, error) {
+	var tu []byte
+	for _, o := range obus {
+		if len(o) == 0 {
+			continue
+		}
+		if obuType(o[0]) == obuTypeTemporalDelimiter {
+			continue
+		}
+		if o[0]&obuHasSizeField != 0 {
+			tu = append(tu, o...)
+			continue
+		}
+		n := headerSize(o[0])
+		if len(o) < n {
+			return nil, ErrInvalidOBU
+		}
+		tu = append(tu, o[0]|obuHasSizeField)
+		tu = append(tu, o[1:n]...)
+		tu = append(tu, obu.WriteToLeb128(uint(len(o)-n))...)
+		tu = append(tu, o[n:]...)
+	}
+	return tu, nil
+}
+
+// Split returns the OBUs of a temporal unit without obu_size fields, as RTP carries them. Temporal delimiters are dropped.
+func Split(tu []byte) ([][]byte, error) {
+	var obus [][]byte
+	for len(tu) > 0 {
+		header := tu[0]
+		n := headerSize(header)
+		if len(tu) < n {
+			return nil, ErrInvalidOBU
+		}
+		size := len(tu) - n
+		sizeLen := 0
+		if header&obuHasSizeField != 0 {
+			value, read, err := obu.ReadLeb128(tu[n:])
+			if err != nil {
+				return nil, err
+			}
+			size = int(value)
+			sizeLen = int(read)
+		}
+		if len(tu) < n+sizeLen+size {
+			return nil, ErrInvalidOBU
+		}
+		if obuType(header) != obuTypeTemporalDelimiter {
+			o := make([]byte, 0, n+size)
+			o = append(o, header&^obuHasSizeField)
+			o = append(o, tu[1:n]...)
+			o = append(o, tu[n+sizeLen:n+sizeLen+size]...)
+			obus = append(obus, o)
+		}
+		tu = tu[n+sizeLen+size:]
+	}
+	return obus, nil
+}
+
+// HasSequenceHeader reports whether one of the OBUs is a sequence header, which starts every key frame in WebRTC.
+func HasSequenceHeader(obus [][]byte) bool {
+	for _, o := range obus {
+		if len(o) > 0 && obuType(o[0]) == obuTypeSequenceHeader {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package dash
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sirupsen/logrus"
+
+	"liveflow/log"
+	"liveflow/media/hub"
+	"liveflow/media/streamer/fields"
+)
+
+var (
+	ErrUnsupportedCodec = errors.New("unsupported codec")
+	ErrInvalidSPS       = errors.New("invalid sps")
+)
+
+type DASHArgs struct {
+	Hub    *hub.Hub
+	Server *Server
+}
+
+// DASH segments a source into CMAF tracks served by the Server.
+type DASH struct {
+	hub    *hub.Hub
+	server *Server
+}
+
+func NewDASH(args DASHArgs) *DASH {
+	return &DASH{
+		hub:    args.Hub,
+		server: args.Server,
+	}
+}
+
+func (d *DASH) Start(ctx context.Context, source hub.Source) error {
+	if !hub.HasCodecType(source.MediaSpecs(), hub.CodecTypeH264) {
+		return ErrUnsupportedCodec
+	}
+	ctx = log.WithFields(ctx, logrus.Fields{
+		fields.StreamID:   source.StreamID(),
+		fields.SourceName: source.Name(),
+	})
+	log.Info(ctx, "start dash")
+	st := newStream(source)
+	sub := d.hub.SubscribeWithOptions(source.StreamID(), hub.SubscribeOptions{Name: "dash", ReplayGOP: true})
+	d.server.addStream(st)
+	go func() {
+		defer d.server.removeStream(st)
+		for data := range sub.Frames() {
+			st.onFrame(ctx, data)
+		}
+		log.Info(ctx, "end dash")
+	}()
+	return nil
+}
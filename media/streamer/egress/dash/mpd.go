@@ -0,0 +1,134 @@
+package dash
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	mpdNamespace = "urn:mpeg:dash:schema:mpd:2011"
+	mpdProfiles  = "urn:mpeg:dash:profile:isoff-live:2011,urn:mpeg:dash:profile:cmaf:2019"
+	// players stay this many seconds behind the live edge
+	suggestedPresentationDelay = 6 * time.Second
+)
+
+type mpd struct {
+	XMLName                    xml.Name `xml:"MPD"`
+	XMLNS                      string   `xml:"xmlns,attr"`
+	Profiles                   string   `xml:"profiles,attr"`
+	Type                       string   `xml:"type,attr"`
+	AvailabilityStartTime      string   `xml:"availabilityStartTime,attr"`
+	PublishTime                string   `xml:"publishTime,attr"`
+	MinimumUpdatePeriod        string   `xml:"minimumUpdatePeriod,attr"`
+	MinBufferTime              string   `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth       string   `xml:"timeShiftBufferDepth,attr"`
+	SuggestedPresentationDelay string   `xml:"suggestedPresentationDelay,attr"`
+	Period                     mpdPeriod
+}
+
+type mpdPeriod struct {
+	XMLName        xml.Name `xml:"Period"`
+	ID             string   `xml:"id,attr"`
+	Start          string   `xml:"start,attr"`
+	AdaptationSets []mpdAdaptationSet
+}
+
+type mpdAdaptationSet struct {
+	XMLName          xml.Name `xml:"AdaptationSet"`
+	ID               int      `xml:"id,attr"`
+	ContentType      string   `xml:"contentType,attr"`
+	MimeType         string   `xml:"mimeType,attr"`
+	SegmentAlignment bool     `xml:"segmentAlignment,attr"`
+	StartWithSAP     int      `xml:"startWithSAP,attr"`
+	Representation   mpdRepresentation
+}
+
+type mpdRepresentation struct {
+	XMLName         xml.Name `xml:"Representation"`
+	ID              string   `xml:"id,attr"`
+	Codecs          string   `xml:"codecs,attr"`
+	Bandwidth       int      `xml:"bandwidth,attr"`
+	Width           int      `xml:"width,attr,omitempty"`
+	Height          int      `xml:"height,attr,omitempty"`
+	SegmentTemplate mpdSegmentTemplate
+}
+
+type mpdSegmentTemplate struct {
+	XMLName         xml.Name     `xml:"SegmentTemplate"`
+	Timescale       uint32       `xml:"timescale,attr"`
+	Initialization  string       `xml:"initialization,attr"`
+	Media           string       `xml:"media,attr"`
+	SegmentTimeline []mpdSegment `xml:"SegmentTimeline>S"`
+}
+
+type mpdSegment struct {
+	T int64 `xml:"t,attr"`
+	D int64 `xml:"d,attr"`
+}
+
+// manifest returns a dynamic MPD with a SegmentTimeline for every track. The caller holds the read lock.
+// The query of the manifest request is carried into the segment URLs, so a playback token reaches every segment.
+func (st *stream) manifest(query string) ([]byte, error) {
+	if query != "" {
+		// $ starts an identifier in a SegmentTemplate, $$ is a literal one.
+		query = "?" + strings.ReplaceAll(query, "$", "$$")
+	}
+	timeShiftBufferDepth := st.video.duration()
+	m := mpd{
+		XMLNS:                      mpdNamespace,
+		Profiles:                   mpdProfiles,
+		Type:                       "dynamic",
+		AvailabilityStartTime:      st.startTime.UTC().Format(time.RFC3339Nano),
+		PublishTime:                time.Now().UTC().Format(time.RFC3339Nano),
+		MinimumUpdatePeriod:        formatDuration(minSegmentDuration.Seconds()),
+		MinBufferTime:              formatDuration(minSegmentDuration.Seconds()),
+		TimeShiftBufferDepth:       formatDuration(timeShiftBufferDepth),
+		SuggestedPresentationDelay: formatDuration(suggestedPresentationDelay.Seconds()),
+		Period: mpdPeriod{
+			ID:    "0",
+			Start: formatDuration(0),
+		},
+	}
+	for i, t := range []*track{st.video, st.audio} {
+		if t == nil || len(t.segments) == 0 {
+			continue
+		}
+		set := mpdAdaptationSet{
+			ID:               i,
+			ContentType:      t.name,
+			MimeType:         t.name + "/mp4",
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+			Representation: mpdRepresentation{
+				ID:        t.name,
+				Codecs:    t.codecs,
+				Bandwidth: t.bandwidth,
+				Width:     t.width,
+				Height:    t.height,
+				SegmentTemplate: mpdSegmentTemplate{
+					Timescale:      t.timeScale,
+					Initialization: t.name + "/init.mp4" + query,
+					Media:          t.name + "/$Time$.m4s" + query,
+				},
+			},
+		}
+		for _, seg := range t.segments {
+			set.Representation.SegmentTemplate.SegmentTimeline = append(set.Representation.SegmentTemplate.SegmentTimeline, mpdSegment{
+				T: seg.time,
+				D: seg.duration,
+			})
+		}
+		m.Period.AdaptationSets = append(m.Period.AdaptationSets, set)
+	}
+	out, err := xml.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+func formatDuration(seconds float64) string {
+	return fmt.Sprintf("PT%.3fS", seconds)
+}
@@ -0,0 +1,135 @@
+package dash
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+
+	"liveflow/auth"
+	"liveflow/log"
+)
+
+const (
+	cacheControl = "CDN-Cache-Control"
+)
+
+// Server serves DASH at /dash/<streamID>/manifest.mpd with the init and media segments of every track next to it.
+type Server struct {
+	echo         *echo.Echo
+	playback     *auth.PlaybackVerifier
+	allowOrigins []string
+
+	mu      sync.RWMutex
+	streams map[string]*stream
+}
+
+type ServerArgs struct {
+	Echo *echo.Echo
+	// Playback checks the token of every request, viewers need none when it is nil.
+	Playback *auth.PlaybackVerifier
+	// AllowOrigins are the origins of the pages that play from another origin.
+	AllowOrigins []string
+}
+
+func NewServer(args ServerArgs) *Server {
+	return &Server{
+		echo:         args.Echo,
+		playback:     args.Playback,
+		allowOrigins: args.AllowOrigins,
+		streams:      map[string]*stream{},
+	}
+}
+
+func (s *Server) RegisterRoute() {
+	dashRoute := s.echo.Group("/dash", auth.CORS(s.allowOrigins, http.MethodGet, http.MethodHead, http.MethodOptions)...)
+	dashRoute.GET("/:streamID/manifest.mpd", s.handleManifest)
+	dashRoute.GET("/:streamID/:track/:resourceName", s.handleSegment)
+}
+
+func (s *Server) addStream(st *stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams[st.streamID] = st
+}
+
+func (s *Server) removeStream(st *stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.streams[st.streamID] == st {
+		delete(s.streams, st.streamID)
+	}
+}
+
+func (s *Server) stream(streamID string) *stream {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.streams[streamID]
+}
+
+// authorize checks the playback token in the query of a request for streamID.
+func (s *Server) authorize(c echo.Context, streamID string) bool {
+	if s.playback == nil {
+		return true
+	}
+	if err := s.playback.Verify(c.QueryParam(auth.PlaybackTokenParam), streamID, c.RealIP()); err != nil {
+		log.Warnf(c.Request().Context(), "rejected dash viewer of %s: %v", streamID, err)
+		return false
+	}
+	return true
+}
+
+func (s *Server) handleManifest(c echo.Context) error {
+	if !s.authorize(c, c.Param("streamID")) {
+		return c.NoContent(http.StatusUnauthorized)
+	}
+	st := s.stream(c.Param("streamID"))
+	if st == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if !st.ready() {
+		return c.NoContent(http.StatusNotFound)
+	}
+	manifest, err := st.manifest(c.QueryString())
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(cacheControl, "max-age=1")
+	return c.Blob(http.StatusOK, "application/dash+xml", manifest)
+}
+
+func (s *Server) handleSegment(c echo.Context) error {
+	if !s.authorize(c, c.Param("streamID")) {
+		return c.NoContent(http.StatusUnauthorized)
+	}
+	st := s.stream(c.Param("streamID"))
+	if st == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	t := st.track(c.Param("track"))
+	if t == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	contentType := t.name + "/mp4"
+	resourceName := c.Param("resourceName")
+	if resourceName == "init.mp4" {
+		c.Response().Header().Set(cacheControl, "max-age=3600")
+		return c.Blob(http.StatusOK, contentType, t.init)
+	}
+	segmentTime, err := strconv.ParseInt(strings.TrimSuffix(resourceName, ".m4s"), 10, 64)
+	if err != nil || !strings.HasSuffix(resourceName, ".m4s") {
+		return c.NoContent(http.StatusNotFound)
+	}
+	seg := t.segment(segmentTime)
+	if seg == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	c.Response().Header().Set(cacheControl, "max-age=3600")
+	return c.Blob(http.StatusOK, contentType, seg.data)
+}
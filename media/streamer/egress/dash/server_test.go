@@ -0,0 +1,150 @@
+package dash
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"liveflow/auth"
+)
+
+const testSecret = "s3cret"
+
+func newTestServer(t *testing.T, args ServerArgs) *echo.Echo {
+	t.Helper()
+	args.Echo = echo.New()
+	s := NewServer(args)
+	s.RegisterRoute()
+	s.addStream(&stream{
+		streamID: "stream",
+		video: &track{
+			name:      trackVideo,
+			timeScale: videoTimeScale,
+			codecs:    "avc1.64001f",
+			init:      []byte("init"),
+			segments:  []*segment{{time: 0, duration: 2 * videoTimeScale, data: []byte("segment")}},
+		},
+	})
+	return args.Echo
+}
+
+func token(t *testing.T, claims auth.PlaybackClaims) string {
+	t.Helper()
+	if claims.ExpiresAt == 0 {
+		claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	}
+	token, err := auth.SignPlaybackToken(testSecret, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func get(e *echo.Echo, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.RemoteAddr = "192.0.2.1:4000"
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPlaybackToken(t *testing.T) {
+	valid := token(t, auth.PlaybackClaims{StreamID: "stream"})
+	tests := []struct {
+		name     string
+		playback *auth.PlaybackVerifier
+		query    string
+		want     int
+	}{
+		{name: "open", want: http.StatusOK},
+		{name: "no token", playback: auth.NewPlaybackVerifier(testSecret), want: http.StatusUnauthorized},
+		{name: "valid", playback: auth.NewPlaybackVerifier(testSecret), query: "?token=" + valid, want: http.StatusOK},
+		{
+			name:     "other stream",
+			playback: auth.NewPlaybackVerifier(testSecret),
+			query:    "?token=" + token(t, auth.PlaybackClaims{StreamID: "other"}),
+			want:     http.StatusUnauthorized,
+		},
+		{
+			name:     "expired",
+			playback: auth.NewPlaybackVerifier(testSecret),
+			query:    "?token=" + token(t, auth.PlaybackClaims{StreamID: "stream", ExpiresAt: time.Now().Add(-time.Minute).Unix()}),
+			want:     http.StatusUnauthorized,
+		},
+		{
+			name:     "bound to the viewer address",
+			playback: auth.NewPlaybackVerifier(testSecret),
+			query:    "?token=" + token(t, auth.PlaybackClaims{StreamID: "stream", IP: "192.0.2.1"}),
+			want:     http.StatusOK,
+		},
+		{
+			name:     "bound to another address",
+			playback: auth.NewPlaybackVerifier(testSecret),
+			query:    "?token=" + token(t, auth.PlaybackClaims{StreamID: "stream", IP: "192.0.2.2"}),
+			want:     http.StatusUnauthorized,
+		},
+		{name: "other secret", playback: auth.NewPlaybackVerifier("other"), query: "?token=" + valid, want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestServer(t, ServerArgs{Playback: tt.playback})
+			for _, path := range []string{"/dash/stream/manifest.mpd", "/dash/stream/video/init.mp4", "/dash/stream/video/0.m4s"} {
+				if rec := get(e, path+tt.query, nil); rec.Code != tt.want {
+					t.Errorf("%s: status %d, want %d", path, rec.Code, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestManifestCarriesTheQuery(t *testing.T) {
+	valid := token(t, auth.PlaybackClaims{StreamID: "stream"})
+	e := newTestServer(t, ServerArgs{Playback: auth.NewPlaybackVerifier(testSecret)})
+	rec := get(e, "/dash/stream/manifest.mpd?token="+valid+"&x=a$b", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	manifest := rec.Body.String()
+	for _, want := range []string{
+		`initialization="video/init.mp4?token=` + valid + `&amp;x=a$$b"`,
+		`media="video/$Time$.m4s?token=` + valid + `&amp;x=a$$b"`,
+	} {
+		if !strings.Contains(manifest, want) {
+			t.Errorf("manifest has no %s:\n%s", want, manifest)
+		}
+	}
+
+	// a player resolves the template against the manifest URL, the segments it asks for are authorized
+	if rec := get(e, "/dash/stream/video/0.m4s?token="+valid+"&x=a$b", nil); rec.Code != http.StatusOK {
+		t.Fatalf("segment status %d", rec.Code)
+	}
+
+	e = newTestServer(t, ServerArgs{})
+	if manifest := get(e, "/dash/stream/manifest.mpd", nil).Body.String(); !strings.Contains(manifest, `media="video/$Time$.m4s"`) {
+		t.Errorf("manifest without a query has a query in its template:\n%s", manifest)
+	}
+}
+
+func TestAllowOrigins(t *testing.T) {
+	origin := http.Header{echo.HeaderOrigin: []string{"https://player.example"}}
+	rec := get(newTestServer(t, ServerArgs{}), "/dash/stream/manifest.mpd", origin)
+	if got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); got != "" {
+		t.Errorf("allowed origin %q without allowed origins", got)
+	}
+	rec = get(newTestServer(t, ServerArgs{AllowOrigins: []string{"https://player.example"}}), "/dash/stream/manifest.mpd", origin)
+	if got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); got != "https://player.example" {
+		t.Errorf("allowed origin %q, want the player", got)
+	}
+	rec = get(newTestServer(t, ServerArgs{AllowOrigins: []string{"https://player.example"}}), "/dash/stream/manifest.mpd",
+		http.Header{echo.HeaderOrigin: []string{"https://other.example"}})
+	if got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); got != "" {
+		t.Errorf("allowed origin %q of another page", got)
+	}
+}
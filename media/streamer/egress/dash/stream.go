@@ -0,0 +1,237 @@
+package dash
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4"
+	"github.com/deepch/vdk/codec/h264parser"
+
+	"liveflow/log"
+	"liveflow/media/hub"
+)
+
+const (
+	videoTimeScale = 90000
+	opusTimeScale  = 48000
+	// segments are cut at the first keyframe after this duration.
+	minSegmentDuration = 2 * time.Second
+	naluTypeAUD        = 9
+)
+
+// stream segments the frames of a source. Timelines of all tracks start at the first keyframe.
+type stream struct {
+	streamID      string
+	audioExpected bool
+
+	mu        sync.RWMutex
+	started   bool
+	startTime time.Time
+	// videoBase is the DTS of the first keyframe in videoTimeScale
+	videoBase int64
+	video     *track
+	audio     *track
+	// audioCut is the time of the last video cut in the audio timescale; audio follows it at its next sample.
+	audioCut    int64
+	hasAudioCut bool
+}
+
+func newStream(source hub.Source) *stream {
+	specs := source.MediaSpecs()
+	return &stream{
+		streamID:      source.StreamID(),
+		audioExpected: hub.HasCodecType(specs, hub.CodecTypeAAC) || hub.HasCodecType(specs, hub.CodecTypeOpus),
+	}
+}
+
+func (st *stream) onFrame(ctx context.Context, data *hub.FrameData) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var err error
+	switch {
+	case data.H264Video != nil:
+		err = st.onVideo(data.H264Video)
+	case data.AACAudio != nil:
+		err = st.onAAC(data.AACAudio)
+	case data.OPUSAudio != nil:
+		err = st.onOpus(data.OPUSAudio)
+	}
+	if err != nil {
+		log.Error(ctx, err, "failed to write dash segment")
+	}
+}
+
+func (st *stream) onVideo(video *hub.H264Video) error {
+	sps, pps := video.SPS, video.PPS
+	var au [][]byte
+	keyframe := false
+	nalus, _ := h264parser.SplitNALUs(video.Data)
+	for _, nalu := range nalus {
+		if len(nalu) < 1 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case h264parser.NALU_SPS:
+			sps = nalu
+		case h264parser.NALU_PPS:
+			pps = nalu
+		case naluTypeAUD:
+			continue
+		}
+		au = append(au, nalu)
+	}
+	for _, sliceType := range video.SliceTypes {
+		if sliceType == hub.SliceI {
+			keyframe = true
+		}
+	}
+	if len(au) == 0 {
+		return nil
+	}
+	dts := scaleTimestamp(video.DTS, video.VideoClockRate, videoTimeScale)
+	pts := scaleTimestamp(video.PTS, video.VideoClockRate, videoTimeScale)
+	if !st.started {
+		if !keyframe || len(sps) == 0 || len(pps) == 0 {
+			return nil
+		}
+		videoTrack, err := newVideoTrack(sps, pps)
+		if err != nil {
+			return err
+		}
+		st.video = videoTrack
+		st.videoBase = dts
+		st.startTime = time.Now()
+		st.started = true
+	}
+	dts -= st.videoBase
+	pts -= st.videoBase
+	if dts < 0 {
+		return nil
+	}
+	cut := keyframe && st.video.pending != nil &&
+		time.Duration(dts-st.video.segStart)*time.Second/videoTimeScale >= minSegmentDuration
+	partSample, err := fmp4.NewPartSampleH26x(int32(pts-dts), keyframe, au)
+	if err != nil {
+		return err
+	}
+	if err := st.video.push(&sample{
+		dts:       dts,
+		ptsOffset: partSample.PTSOffset,
+		keyframe:  keyframe,
+		payload:   partSample.Payload,
+	}, cut); err != nil {
+		return err
+	}
+	if cut && st.audio != nil {
+		st.audioCut = dts * int64(st.audio.timeScale) / videoTimeScale
+		st.hasAudioCut = true
+	}
+	return nil
+}
+
+func (st *stream) onAAC(audio *hub.AACAudio) error {
+	if !st.started || audio.SequenceHeader || len(audio.Data) == 0 {
+		return nil
+	}
+	if st.audio == nil {
+		if len(audio.MPEG4AudioConfigBytes) == 0 {
+			return nil
+		}
+		var config mpeg4audio.Config
+		if err := config.Unmarshal(audio.MPEG4AudioConfigBytes); err != nil {
+			return err
+		}
+		audioTrack, err := newTrack(trackAudio, uint32(config.SampleRate), &fmp4.CodecMPEG4Audio{
+			Config: config,
+		}, fmt.Sprintf("mp4a.40.%d", config.Type))
+		if err != nil {
+			return err
+		}
+		st.audio = audioTrack
+	}
+	return st.pushAudio(audio.DTS, audio.AudioClockRate, audio.Data)
+}
+
+// onOpus carries Opus as is, fMP4 has an Opus sample entry.
+func (st *stream) onOpus(audio *hub.OPUSAudio) error {
+	if !st.started || len(audio.Data) == 0 {
+		return nil
+	}
+	if st.audio == nil {
+		audioTrack, err := newTrack(trackAudio, opusTimeScale, &fmp4.CodecOpus{
+			// WebRTC always signals Opus as stereo
+			ChannelCount: 2,
+		}, "opus")
+		if err != nil {
+			return err
+		}
+		st.audio = audioTrack
+	}
+	return st.pushAudio(audio.DTS, audio.AudioClockRate, audio.Data)
+}
+
+func (st *stream) pushAudio(rawDTS int64, clockRate uint32, data []byte) error {
+	dts := scaleTimestamp(rawDTS, clockRate, st.audio.timeScale) - st.videoBase*int64(st.audio.timeScale)/videoTimeScale
+	if dts < 0 {
+		return nil
+	}
+	cut := st.hasAudioCut && dts >= st.audioCut
+	if cut {
+		st.hasAudioCut = false
+	}
+	return st.audio.push(&sample{
+		dts:      dts,
+		keyframe: true,
+		payload:  append([]byte{}, data...),
+	}, cut)
+}
+
+// ready reports whether every expected track has a segment to play.
+func (st *stream) ready() bool {
+	if st.video == nil || len(st.video.segments) == 0 {
+		return false
+	}
+	if st.audioExpected && (st.audio == nil || len(st.audio.segments) == 0) {
+		return false
+	}
+	return true
+}
+
+func (st *stream) track(name string) *track {
+	switch name {
+	case trackVideo:
+		return st.video
+	case trackAudio:
+		return st.audio
+	}
+	return nil
+}
+
+func newVideoTrack(sps []byte, pps []byte) (*track, error) {
+	if len(sps) < 4 {
+		return nil, ErrInvalidSPS
+	}
+	videoTrack, err := newTrack(trackVideo, videoTimeScale, &fmp4.CodecH264{
+		SPS: sps,
+		PPS: pps,
+	}, fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3]))
+	if err != nil {
+		return nil, err
+	}
+	if spsInfo, err := h264parser.ParseSPS(sps); err == nil {
+		videoTrack.width = int(spsInfo.Width)
+		videoTrack.height = int(spsInfo.Height)
+	}
+	return videoTrack, nil
+}
+
+func scaleTimestamp(ts int64, clockRate uint32, timeScale uint32) int64 {
+	if clockRate == 0 {
+		// timestamps without a clock rate are in milliseconds
+		clockRate = 1000
+	}
+	return ts * int64(timeScale) / int64(clockRate)
+}
@@ -0,0 +1,141 @@
+package dash
+
+import (
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4/seekablebuffer"
+)
+
+const (
+	trackVideo = "video"
+	trackAudio = "audio"
+	// maxSegments is the number of segments kept per track, and the length of the timeline in the manifest.
+	maxSegments = 10
+)
+
+// track writes a single CMAF track: an init segment and fMP4 media segments with one moof per segment.
+type track struct {
+	name      string
+	timeScale uint32
+	codecs    string
+	init      []byte
+
+	// pending waits for the next sample to know its duration.
+	pending  *sample
+	samples  []*fmp4.PartSample
+	segStart int64
+	seq      uint32
+	segments []*segment
+
+	// bandwidth is the highest bitrate of the segments written so far.
+	bandwidth int
+	width     int
+	height    int
+}
+
+type sample struct {
+	dts       int64
+	ptsOffset int32
+	keyframe  bool
+	payload   []byte
+}
+
+type segment struct {
+	time     int64
+	duration int64
+	data     []byte
+}
+
+func newTrack(name string, timeScale uint32, codec fmp4.Codec, codecs string) (*track, error) {
+	init := &fmp4.Init{
+		Tracks: []*fmp4.InitTrack{{
+			ID:        1,
+			TimeScale: timeScale,
+			Codec:     codec,
+		}},
+	}
+	var buf seekablebuffer.Buffer
+	if err := init.Marshal(&buf); err != nil {
+		return nil, err
+	}
+	return &track{
+		name:      name,
+		timeScale: timeScale,
+		codecs:    codecs,
+		init:      buf.Bytes(),
+	}, nil
+}
+
+// push adds a sample in the timescale of the track. With cut, the current segment ends before the sample.
+func (t *track) push(s *sample, cut bool) error {
+	if t.pending != nil {
+		duration := s.dts - t.pending.dts
+		if duration <= 0 {
+			// drop samples that do not advance the timeline
+			return nil
+		}
+		t.samples = append(t.samples, &fmp4.PartSample{
+			Duration:        uint32(duration),
+			PTSOffset:       t.pending.ptsOffset,
+			IsNonSyncSample: !t.pending.keyframe,
+			Payload:         t.pending.payload,
+		})
+	} else {
+		t.segStart = s.dts
+	}
+	if cut && len(t.samples) > 0 {
+		if err := t.finishSegment(s.dts); err != nil {
+			return err
+		}
+	}
+	t.pending = s
+	return nil
+}
+
+func (t *track) finishSegment(end int64) error {
+	part := &fmp4.Part{
+		SequenceNumber: t.seq,
+		Tracks: []*fmp4.PartTrack{{
+			ID:       1,
+			BaseTime: uint64(t.segStart),
+			Samples:  t.samples,
+		}},
+	}
+	var buf seekablebuffer.Buffer
+	if err := part.Marshal(&buf); err != nil {
+		return err
+	}
+	seg := &segment{
+		time:     t.segStart,
+		duration: end - t.segStart,
+		data:     buf.Bytes(),
+	}
+	if bandwidth := int(int64(len(seg.data)) * 8 * int64(t.timeScale) / seg.duration); bandwidth > t.bandwidth {
+		t.bandwidth = bandwidth
+	}
+	t.segments = append(t.segments, seg)
+	if len(t.segments) > maxSegments {
+		t.segments = t.segments[len(t.segments)-maxSegments:]
+	}
+	t.seq++
+	t.samples = nil
+	t.segStart = end
+	return nil
+}
+
+func (t *track) segment(time int64) *segment {
+	for _, seg := range t.segments {
+		if seg.time == time {
+			return seg
+		}
+	}
+	return nil
+}
+
+// duration is the length of the timeline of the kept segments in seconds.
+func (t *track) duration() float64 {
+	var d int64
+	for _, seg := range t.segments {
+		d += seg.duration
+	}
+	return float64(d) / float64(t.timeScale)
+}
@@ -0,0 +1,336 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	"github.com/bluenviron/mediacommon/pkg/formats/mpegts"
+	"github.com/deepch/vdk/codec/h264parser"
+
+	"liveflow/media/hub"
+)
+
+const (
+	mpegtsClockRate = 90000
+	// dvrMinSegmentDuration keeps the playlist of long windows short.
+	dvrMinSegmentDuration = 2 * time.Second
+)
+
+// DVR keeps the MPEG-TS segments of a stream within a rolling window and serves them as an HLS playlist
+// with EXT-X-PROGRAM-DATE-TIME, so that players can seek back in the live stream.
+// Without a window the playlist is an EVENT playlist. Once the stream ends, the playlist becomes a VOD playlist.
+type DVR struct {
+	window          time.Duration
+	segmentDuration time.Duration
+	// directory keeps segments in RAM when it is empty.
+	directory string
+
+	mu            sync.RWMutex
+	segments      []*dvrSegment
+	nextID        int
+	ended         bool
+	videoTrack    *mpegts.Track
+	audioTrack    *mpegts.Track
+	started       bool
+	startTime     time.Time
+	base          int64
+	lastVideoDTS  int64
+	lastVideoStep int64
+
+	cur       *dvrSegment
+	curBuf    bytes.Buffer
+	curWriter *mpegts.Writer
+}
+
+type dvrSegment struct {
+	id int
+	// start and duration are in the 90kHz clock of MPEG-TS.
+	start    int64
+	duration int64
+	size     int
+	data     []byte
+	path     string
+}
+
+type DVRArgs struct {
+	Window          time.Duration
+	SegmentDuration time.Duration
+	Directory       string
+	// MPEG4AudioConfig is the config of the AAC track. The DVR is video only without it.
+	MPEG4AudioConfig []byte
+}
+
+func NewDVR(args DVRArgs) (*DVR, error) {
+	d := &DVR{
+		window:          args.Window,
+		segmentDuration: args.SegmentDuration,
+		videoTrack: &mpegts.Track{
+			Codec: &mpegts.CodecH264{},
+		},
+	}
+	if d.segmentDuration < dvrMinSegmentDuration {
+		d.segmentDuration = dvrMinSegmentDuration
+	}
+	if len(args.MPEG4AudioConfig) > 0 {
+		var config mpeg4audio.Config
+		if err := config.Unmarshal(args.MPEG4AudioConfig); err != nil {
+			return nil, err
+		}
+		d.audioTrack = &mpegts.Track{
+			Codec: &mpegts.CodecMPEG4Audio{Config: config},
+		}
+	}
+	if args.Directory != "" {
+		directory, err := os.MkdirTemp(args.Directory, "dvr-")
+		if err != nil {
+			return nil, err
+		}
+		d.directory = directory
+	}
+	return d, nil
+}
+
+func (d *DVR) tracks() []*mpegts.Track {
+	if d.audioTrack == nil {
+		return []*mpegts.Track{d.videoTrack}
+	}
+	return []*mpegts.Track{d.videoTrack, d.audioTrack}
+}
+
+// WriteVideo starts a new segment at the first keyframe after the segment duration.
+func (d *DVR) WriteVideo(video *hub.H264Video) error {
+	au, _ := h264parser.SplitNALUs(video.Data)
+	if len(au) == 0 {
+		return nil
+	}
+	keyframe := false
+	for _, sliceType := range video.SliceTypes {
+		if sliceType == hub.SliceI {
+			keyframe = true
+		}
+	}
+	dts := scaleTimestamp(video.DTS, video.VideoClockRate)
+	pts := scaleTimestamp(video.PTS, video.VideoClockRate)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ended {
+		return nil
+	}
+	if !d.started {
+		if !keyframe {
+			return nil
+		}
+		d.started = true
+		d.startTime = time.Now()
+		d.base = dts
+	}
+	dts -= d.base
+	pts -= d.base
+	if dts < 0 {
+		return nil
+	}
+	if dts > d.lastVideoDTS {
+		d.lastVideoStep = dts - d.lastVideoDTS
+	}
+	d.lastVideoDTS = dts
+	if keyframe && (d.cur == nil || time.Duration(dts-d.cur.start)*time.Second/mpegtsClockRate >= d.segmentDuration) {
+		if err := d.finishSegment(dts); err != nil {
+			return err
+		}
+		d.cur = &dvrSegment{
+			id:    d.nextID,
+			start: dts,
+		}
+		d.nextID++
+		d.curBuf.Reset()
+		d.curWriter = mpegts.NewWriter(&d.curBuf, d.tracks())
+	}
+	if d.cur == nil {
+		return nil
+	}
+	return d.curWriter.WriteH264(d.videoTrack, pts, dts, keyframe, au)
+}
+
+func (d *DVR) WriteAAC(audio *hub.AACAudio) error {
+	if d.audioTrack == nil || audio.SequenceHeader || len(audio.Data) == 0 {
+		return nil
+	}
+	dts := scaleTimestamp(audio.DTS, audio.AudioClockRate)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cur == nil || d.ended || dts-d.base < 0 {
+		return nil
+	}
+	return d.curWriter.WriteMPEG4Audio(d.audioTrack, dts-d.base, [][]byte{audio.Data})
+}
+
+// finishSegment closes the current segment at end and drops the segments that left the window.
+// The caller holds the lock.
+func (d *DVR) finishSegment(end int64) error {
+	if d.cur == nil {
+		return nil
+	}
+	seg := d.cur
+	d.cur = nil
+	seg.duration = end - seg.start
+	seg.size = d.curBuf.Len()
+	if d.directory != "" {
+		seg.path = filepath.Join(d.directory, strconv.Itoa(seg.id)+".ts")
+		if err := os.WriteFile(seg.path, d.curBuf.Bytes(), 0o644); err != nil {
+			return err
+		}
+	} else {
+		seg.data = append([]byte{}, d.curBuf.Bytes()...)
+	}
+	d.segments = append(d.segments, seg)
+	if d.window > 0 {
+		for len(d.segments) > 1 && time.Duration(end-d.segments[0].start)*time.Second/mpegtsClockRate > d.window {
+			d.removeSegment(d.segments[0])
+			d.segments = d.segments[1:]
+		}
+	}
+	return nil
+}
+
+func (d *DVR) removeSegment(seg *dvrSegment) {
+	if seg.path != "" {
+		_ = os.Remove(seg.path)
+	}
+}
+
+// End finishes the last segment, the playlist is served as VOD from now on.
+func (d *DVR) End() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ended {
+		return nil
+	}
+	d.ended = true
+	return d.finishSegment(d.lastVideoDTS + d.lastVideoStep)
+}
+
+// Close removes the segments, it is called when the stream is published again.
+func (d *DVR) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ended = true
+	for _, seg := range d.segments {
+		d.removeSegment(seg)
+	}
+	d.segments = nil
+	if d.directory != "" {
+		_ = os.RemoveAll(d.directory)
+	}
+}
+
+// ServeHTTP serves stream.m3u8 and the <id>.ts segments.
+func (d *DVR) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+	if name == "stream.m3u8" {
+		d.mu.RLock()
+		playlist := d.playlist(r.URL.RawQuery)
+		d.mu.RUnlock()
+		if playlist == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		_, _ = w.Write(playlist)
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimSuffix(name, ".ts"))
+	if err != nil || !strings.HasSuffix(name, ".ts") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	d.mu.RLock()
+	seg := d.segment(id)
+	d.mu.RUnlock()
+	if seg == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var reader io.Reader
+	if seg.path != "" {
+		f, err := os.Open(seg.path)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		reader = f
+	} else {
+		reader = bytes.NewReader(seg.data)
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Content-Length", strconv.Itoa(seg.size))
+	_, _ = io.Copy(w, reader)
+}
+
+func (d *DVR) segment(id int) *dvrSegment {
+	for _, seg := range d.segments {
+		if seg.id == id {
+			return seg
+		}
+	}
+	return nil
+}
+
+// playlist returns nil until the first segment is complete, rawQuery is appended to the segment URIs.
+// The caller holds the read lock.
+func (d *DVR) playlist(rawQuery string) []byte {
+	if len(d.segments) == 0 {
+		return nil
+	}
+	targetDuration := 0
+	for _, seg := range d.segments {
+		if t := int(math.Ceil(float64(seg.duration) / mpegtsClockRate)); t > targetDuration {
+			targetDuration = t
+		}
+	}
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", d.segments[0].id)
+	switch {
+	case d.ended:
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	case d.window == 0:
+		// nothing is removed from the playlist, players can seek back to the beginning
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	}
+	for _, seg := range d.segments {
+		programDateTime := d.startTime.Add(time.Duration(seg.start) * time.Second / mpegtsClockRate)
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", programDateTime.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", float64(seg.duration)/mpegtsClockRate)
+		if rawQuery != "" {
+			fmt.Fprintf(&b, "%d.ts?%s\n", seg.id, rawQuery)
+		} else {
+			fmt.Fprintf(&b, "%d.ts\n", seg.id)
+		}
+	}
+	if d.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return []byte(b.String())
+}
+
+func scaleTimestamp(ts int64, clockRate uint32) int64 {
+	if clockRate == 0 {
+		// timestamps without a clock rate are in milliseconds
+		clockRate = 1000
+	}
+	return ts * mpegtsClockRate / int64(clockRate)
+}
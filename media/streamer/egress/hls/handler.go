@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"liveflow/media/streamer/processes"
+	"strings"
 	"time"
 
 	"github.com/asticode/go-astiav"
@@ -23,10 +24,14 @@ import (
 var (
 	ErrNotContainAudioOrVideo = errors.New("media spec does not contain audio or video")
 	ErrUnsupportedCodec       = errors.New("unsupported codec")
+	ErrUnknownVariant         = errors.New("unknown hls variant")
 )
 
 const (
 	audioSampleRate = 48000
+	passVariantName = "pass"
+	// the bitrate of the passthrough variant is measured over this window.
+	bandwidthWindow = 5 * time.Second
 )
 
 type HLS struct {
@@ -36,26 +41,72 @@ type HLS struct {
 	muxer                 *gohlslib.Muxer
 	mpeg4AudioConfigBytes []byte
 	mpeg4AudioConfig      *aacparser.MPEG4AudioConfig
-	llHLS                 bool
-	diskRam               bool
+	variant               gohlslib.MuxerVariant
+	segmentDuration       time.Duration
+	partDuration          time.Duration
+	segmentCount          int
+	directory             string
+	renditions            []Rendition
+	variants              []*variant
+	layers                []*layer
+	dvrEnabled            bool
+	dvrWindow             time.Duration
+	dvr                   *DVR
+
+	passInfo  hlshub.VariantInfo
+	bandwidth bandwidthMeter
 }
 
 type HLSArgs struct {
-	Hub     *hub.Hub
-	HLSHub  *hlshub.HLSHub
-	Port    int
-	LLHLS   bool
-	DiskRam bool
+	Hub    *hub.Hub
+	HLSHub *hlshub.HLSHub
+	Port   int
+	// Variant defaults to MPEG-TS. The other variants use fMP4 segments and carry Opus as is.
+	Variant gohlslib.MuxerVariant
+	// SegmentDuration, PartDuration and SegmentCount default to the values of gohlslib when they are zero.
+	SegmentDuration time.Duration
+	PartDuration    time.Duration
+	SegmentCount    int
+	// Directory keeps segments in RAM when it is empty.
+	Directory  string
+	Renditions []Rendition
+	// DVR keeps the segments of the last DVRWindow in a playlist at /hls/:streamID/dvr/stream.m3u8,
+	// which becomes a VOD playlist once the stream ends. A zero DVRWindow keeps the whole stream.
+	DVR       bool
+	DVRWindow time.Duration
 }
 
 func NewHLS(args HLSArgs) *HLS {
+	variant := args.Variant
+	if variant == 0 {
+		variant = gohlslib.MuxerVariantMPEGTS
+	}
 	return &HLS{
-		hub:     args.Hub,
-		hlsHub:  args.HLSHub,
-		port:    args.Port,
-		llHLS:   args.LLHLS,
-		diskRam: args.DiskRam,
+		hub:             args.Hub,
+		hlsHub:          args.HLSHub,
+		port:            args.Port,
+		variant:         variant,
+		segmentDuration: args.SegmentDuration,
+		partDuration:    args.PartDuration,
+		segmentCount:    args.SegmentCount,
+		directory:       args.Directory,
+		renditions:      args.Renditions,
+		dvrEnabled:      args.DVR,
+		dvrWindow:       args.DVRWindow,
+	}
+}
+
+// ParseVariant maps the variant names of the config (mpegts, fmp4, lowLatency) to muxer variants.
+func ParseVariant(name string) (gohlslib.MuxerVariant, error) {
+	switch strings.ToLower(name) {
+	case "", "mpegts":
+		return gohlslib.MuxerVariantMPEGTS, nil
+	case "fmp4":
+		return gohlslib.MuxerVariantFMP4, nil
+	case "lowlatency":
+		return gohlslib.MuxerVariantLowLatency, nil
 	}
+	return 0, ErrUnknownVariant
 }
 
 func (h *HLS) Start(ctx context.Context, source hub.Source) error {
@@ -73,11 +124,16 @@ func (h *HLS) Start(ctx context.Context, source hub.Source) error {
 	log.Info(ctx, "view url: ",
 		fmt.Sprintf("http://localhost:8044/m3u8player.html?streamid=%s", source.StreamID()))
 
-	sub := h.hub.Subscribe(source.StreamID())
+	h.startLayers(ctx, source)
+	sub := h.hub.SubscribeWithOptions(source.StreamID(), hub.SubscribeOptions{Name: "hls", ReplayGOP: true})
 	go func() {
 		var audioTranscodingProcess *processes.AudioTranscodingProcess
-		for data := range sub {
-			if data.OPUSAudio != nil {
+		for data := range sub.Frames() {
+			if data.OPUSAudio != nil && h.variant != gohlslib.MuxerVariantMPEGTS {
+				// fMP4 segments carry Opus, MPEG-TS segments need AAC
+				h.onOPUSAudio(ctx, source, data.OPUSAudio)
+			}
+			if data.OPUSAudio != nil && (h.variant == gohlslib.MuxerVariantMPEGTS || h.dvrEnabled) {
 				if audioTranscodingProcess == nil {
 					audioTranscodingProcess = processes.NewTranscodingProcess(astiav.CodecIDOpus, astiav.CodecIDAac, audioSampleRate)
 					audioTranscodingProcess.Init()
@@ -89,14 +145,22 @@ func (h *HLS) Start(ctx context.Context, source hub.Source) error {
 					}
 					h.mpeg4AudioConfig = &tmpAudioCodec.Config
 				}
-				h.onOPUSAudio(ctx, source, audioTranscodingProcess, data.OPUSAudio)
+				h.onTranscodedOPUSAudio(ctx, source, audioTranscodingProcess, data.OPUSAudio)
 			} else {
 				if data.AACAudio != nil {
 					h.onAudio(ctx, source, data.AACAudio)
 				}
 			}
 			if data.H264Video != nil {
-				h.onVideo(ctx, data.H264Video)
+				h.onVideo(ctx, source, data.H264Video)
+			}
+		}
+		for _, v := range h.variants {
+			v.close()
+		}
+		if h.dvr != nil {
+			if err := h.dvr.End(); err != nil {
+				log.Error(ctx, err, "failed to end hls dvr")
 			}
 		}
 		log.Info(ctx, "[HLS] end of streamID: ", source.StreamID())
@@ -105,38 +169,221 @@ func (h *HLS) Start(ctx context.Context, source hub.Source) error {
 }
 
 func (h *HLS) onAudio(ctx context.Context, source hub.Source, aacAudio *hub.AACAudio) {
+	h.writeDVRAudio(ctx, source, aacAudio)
+	if h.muxer != nil && !h.isAACMuxer() {
+		// the muxers carry Opus, AAC is transcoded for the DVR only
+		return
+	}
 	if len(aacAudio.MPEG4AudioConfigBytes) > 0 {
 		if h.muxer == nil {
-			muxer, err := h.makeMuxer(aacAudio.MPEG4AudioConfigBytes)
+			mpeg4Audio := &codecs.MPEG4Audio{}
+			err := mpeg4Audio.Unmarshal(aacAudio.MPEG4AudioConfigBytes)
 			if err != nil {
-				log.Error(ctx, err)
+				log.Error(ctx, err, "failed to unmarshal mpeg4 audio")
+				return
 			}
-			h.hlsHub.StoreMuxer(source.StreamID(), "pass", muxer)
-			err = muxer.Start()
-			if err != nil {
-				log.Error(ctx, err)
-			}
-			h.muxer = muxer
+			h.startMuxers(ctx, source, mpeg4Audio)
 		}
 	}
 	if h.muxer != nil {
 		audioData := make([]byte, len(aacAudio.Data))
 		copy(audioData, aacAudio.Data)
-		h.muxer.WriteMPEG4Audio(time.Now(), time.Duration(aacAudio.RawDTS())*time.Millisecond, [][]byte{audioData})
+		ntp := time.Now()
+		pts := time.Duration(aacAudio.RawDTS()) * time.Millisecond
+		h.muxer.WriteMPEG4Audio(ntp, pts, [][]byte{audioData})
+		for _, v := range h.variants {
+			v.onAudio(ctx, ntp, pts, audioData)
+		}
+		for _, l := range h.layers {
+			l.onAudio(ctx, ntp, pts, audioData)
+		}
+		h.measureBandwidth(source, len(audioData))
+	}
+}
+
+func (h *HLS) isAACMuxer() bool {
+	_, ok := h.muxer.AudioTrack.Codec.(*codecs.MPEG4Audio)
+	return ok
+}
+
+// writeDVRAudio starts the DVR once the AAC config is known. The DVR always records MPEG-TS with AAC.
+func (h *HLS) writeDVRAudio(ctx context.Context, source hub.Source, aacAudio *hub.AACAudio) {
+	if !h.dvrEnabled {
+		return
+	}
+	if h.dvr == nil {
+		if len(aacAudio.MPEG4AudioConfigBytes) == 0 {
+			return
+		}
+		dvr, err := NewDVR(DVRArgs{
+			Window:           h.dvrWindow,
+			SegmentDuration:  h.segmentDuration,
+			Directory:        h.directory,
+			MPEG4AudioConfig: aacAudio.MPEG4AudioConfigBytes,
+		})
+		if err != nil {
+			log.Error(ctx, err, "failed to start hls dvr")
+			h.dvrEnabled = false
+			return
+		}
+		h.hlsHub.StoreDVR(source.StreamID(), dvr)
+		h.dvr = dvr
+	}
+	if err := h.dvr.WriteAAC(aacAudio); err != nil {
+		log.Error(ctx, err, "failed to write hls dvr audio")
+	}
+}
+
+func (h *HLS) onOPUSAudio(ctx context.Context, source hub.Source, opusAudio *hub.OPUSAudio) {
+	if h.muxer == nil {
+		h.startMuxers(ctx, source, &codecs.Opus{
+			// WebRTC always signals Opus as stereo
+			ChannelCount: 2,
+		})
+	}
+	if h.muxer != nil {
+		audioData := make([]byte, len(opusAudio.Data))
+		copy(audioData, opusAudio.Data)
+		ntp := time.Now()
+		pts := time.Duration(opusAudio.RawDTS()) * time.Millisecond
+		err := h.muxer.WriteOpus(ntp, pts, [][]byte{audioData})
+		if err != nil {
+			log.Errorf(ctx, "failed to write opus: %v", err)
+		}
+		for _, v := range h.variants {
+			v.onOPUSAudio(ctx, ntp, pts, audioData)
+		}
+		for _, l := range h.layers {
+			l.onOPUSAudio(ctx, ntp, pts, audioData)
+		}
+		h.measureBandwidth(source, len(audioData))
+	}
+}
+
+// startMuxers creates the passthrough muxer once the audio codec is known.
+func (h *HLS) startMuxers(ctx context.Context, source hub.Source, audioCodec codecs.Codec) {
+	muxer := h.makeMuxer(audioCodec)
+	err := muxer.Start()
+	if err != nil {
+		log.Error(ctx, err, "failed to start hls muxer")
+		return
+	}
+	h.hlsHub.StoreMuxer(source.StreamID(), passVariantName, muxer)
+	h.muxer = muxer
+	h.startVariants(ctx, source, audioCodec)
+	for _, l := range h.layers {
+		layerMuxer := h.makeMuxer(audioCodec)
+		if err := layerMuxer.Start(); err != nil {
+			log.Error(ctx, err)
+			continue
+		}
+		h.hlsHub.StoreMuxer(source.StreamID(), l.rendition.Name, layerMuxer)
+		l.start(layerMuxer)
+	}
+}
+
+// startLayers subscribes to the simulcast layers other than the main one, which is the passthrough variant.
+// Every layer becomes a variant named after its rid. Their muxers start with the passthrough muxer.
+func (h *HLS) startLayers(ctx context.Context, source hub.Source) {
+	for _, rendition := range hub.Renditions(source) {
+		if rendition.StreamID == source.StreamID() {
+			continue
+		}
+		if !h.isFreeVariantName(rendition.Name) {
+			log.Warnf(ctx, "invalid simulcast layer name %q", rendition.Name)
+			continue
+		}
+		l := newLayer(source.StreamID(), rendition, h.hlsHub)
+		go l.run(ctx, h.hub.SubscribeWithOptions(rendition.StreamID, hub.SubscribeOptions{Name: "hls", ReplayGOP: true}).Frames())
+		h.layers = append(h.layers, l)
+	}
+}
+
+func (h *HLS) isFreeVariantName(name string) bool {
+	if name == "" || name == passVariantName || name == hlshub.DVRName {
+		return false
+	}
+	for _, rendition := range h.renditions {
+		if rendition.Name == name {
+			return false
+		}
+	}
+	return true
+}
+
+// startVariants creates a muxer and a transcoder for every rendition of the ladder.
+func (h *HLS) startVariants(ctx context.Context, source hub.Source, audioCodec codecs.Codec) {
+	for _, rendition := range h.renditions {
+		if rendition.Name == "" || rendition.Name == passVariantName || rendition.Name == hlshub.DVRName {
+			log.Warnf(ctx, "invalid rendition name %q", rendition.Name)
+			continue
+		}
+		muxer := h.makeMuxer(audioCodec)
+		err := muxer.Start()
+		if err != nil {
+			log.Error(ctx, err)
+			continue
+		}
+		h.hlsHub.StoreMuxer(source.StreamID(), rendition.Name, muxer)
+		h.hlsHub.StoreVariantInfo(source.StreamID(), rendition.Name, hlshub.VariantInfo{
+			Bandwidth: rendition.Bitrate + audioBandwidth,
+			Width:     rendition.Width,
+			Height:    rendition.Height,
+		})
+		v := newVariant(source.StreamID(), rendition, h.hlsHub, muxer)
+		go v.run(ctx)
+		h.variants = append(h.variants, v)
 	}
 }
 
-func (h *HLS) onVideo(ctx context.Context, h264Video *hub.H264Video) {
+func (h *HLS) onVideo(ctx context.Context, source hub.Source, h264Video *hub.H264Video) {
+	if h.dvr != nil {
+		if err := h.dvr.WriteVideo(h264Video); err != nil {
+			log.Error(ctx, err, "failed to write hls dvr video")
+		}
+	}
 	if h.muxer != nil {
 		au, _ := h264parser.SplitNALUs(h264Video.Data)
+		for _, nalu := range au {
+			if len(nalu) > 0 && nalu[0]&0x1f == h264parser.NALU_SPS {
+				h.updateResolution(source, nalu)
+			}
+		}
 		err := h.muxer.WriteH264(time.Now(), time.Duration(h264Video.RawDTS())*time.Millisecond, au)
 		if err != nil {
 			log.Errorf(ctx, "failed to write h264: %v", err)
 		}
+		for _, v := range h.variants {
+			v.onVideo(ctx, h264Video)
+		}
+		h.measureBandwidth(source, len(h264Video.Data))
+	}
+}
+
+func (h *HLS) updateResolution(source hub.Source, sps []byte) {
+	spsInfo, err := h264parser.ParseSPS(sps)
+	if err != nil {
+		return
 	}
+	if int(spsInfo.Width) == h.passInfo.Width && int(spsInfo.Height) == h.passInfo.Height {
+		return
+	}
+	h.passInfo.Width = int(spsInfo.Width)
+	h.passInfo.Height = int(spsInfo.Height)
+	h.hlsHub.StoreVariantInfo(source.StreamID(), passVariantName, h.passInfo)
 }
 
-func (h *HLS) onOPUSAudio(ctx context.Context, source hub.Source, audioTranscodingProcess *processes.AudioTranscodingProcess, opusAudio *hub.OPUSAudio) {
+// measureBandwidth updates the bandwidth of the passthrough variant, whose bitrate is decided by the publisher.
+func (h *HLS) measureBandwidth(source hub.Source, n int) {
+	bandwidth, ok := h.bandwidth.add(n)
+	if !ok {
+		return
+	}
+	h.passInfo.Bandwidth = bandwidth
+	h.hlsHub.StoreVariantInfo(source.StreamID(), passVariantName, h.passInfo)
+}
+
+func (h *HLS) onTranscodedOPUSAudio(ctx context.Context, source hub.Source, audioTranscodingProcess *processes.AudioTranscodingProcess, opusAudio *hub.OPUSAudio) {
 	packets, err := audioTranscodingProcess.Process(&processes.MediaPacket{
 		Data: opusAudio.Data,
 		PTS:  opusAudio.PTS,
@@ -157,36 +404,25 @@ func (h *HLS) onOPUSAudio(ctx context.Context, source hub.Source, audioTranscodi
 		})
 	}
 }
-func (h *HLS) makeMuxer(extraData []byte) (*gohlslib.Muxer, error) {
-	var audioTrack *gohlslib.Track
-	if len(extraData) > 0 {
-		mpeg4Audio := &codecs.MPEG4Audio{}
-		err := mpeg4Audio.Unmarshal(extraData)
-		if err != nil {
-			return nil, errors.New("failed to unmarshal mpeg4 audio")
-		}
-		audioTrack = &gohlslib.Track{
-			Codec: mpeg4Audio,
-		}
+func (h *HLS) makeMuxer(audioCodec codecs.Codec) *gohlslib.Muxer {
+	// every muxer needs its own codec since the muxer updates it from the stream
+	switch c := audioCodec.(type) {
+	case *codecs.MPEG4Audio:
+		audioCodec = &codecs.MPEG4Audio{Config: c.Config}
+	case *codecs.Opus:
+		audioCodec = &codecs.Opus{ChannelCount: c.ChannelCount}
 	}
-	var directory string
-	if h.diskRam {
-		directory = "/tmp"
-	}
-	muxer := &gohlslib.Muxer{
+	return &gohlslib.Muxer{
 		VideoTrack: &gohlslib.Track{
 			Codec: &codecs.H264{},
 		},
-		AudioTrack: audioTrack,
-		Directory:  directory,
-	}
-
-	if h.llHLS {
-		muxer.Variant = gohlslib.MuxerVariantLowLatency
-		muxer.PartDuration = 500 * time.Millisecond
-	} else {
-		muxer.Variant = gohlslib.MuxerVariantMPEGTS
-		muxer.SegmentDuration = 1 * time.Second
+		AudioTrack: &gohlslib.Track{
+			Codec: audioCodec,
+		},
+		Variant:            h.variant,
+		SegmentCount:       h.segmentCount,
+		SegmentMinDuration: h.segmentDuration,
+		PartMinDuration:    h.partDuration,
+		Directory:          h.directory,
 	}
-	return muxer, nil
 }
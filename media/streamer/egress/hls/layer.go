@@ -0,0 +1,144 @@
+package hls
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/gohlslib"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/sirupsen/logrus"
+
+	"liveflow/log"
+	"liveflow/media/hlshub"
+	"liveflow/media/hub"
+	"liveflow/media/streamer/fields"
+)
+
+// layer muxes a simulcast layer of the source as is, so the publisher encodes the ladder instead of us.
+// Audio is shared with the passthrough variant.
+type layer struct {
+	rendition hub.Rendition
+	streamID  string
+	hlsHub    *hlshub.HLSHub
+
+	// mu serializes muxer writes, audio comes from the hub subscriber of the source while video comes from run.
+	mu              sync.Mutex
+	muxer           *gohlslib.Muxer
+	waitingKeyframe bool
+
+	info      hlshub.VariantInfo
+	bandwidth bandwidthMeter
+}
+
+func newLayer(streamID string, rendition hub.Rendition, hlsHub *hlshub.HLSHub) *layer {
+	return &layer{
+		rendition:       rendition,
+		streamID:        streamID,
+		hlsHub:          hlsHub,
+		waitingKeyframe: true,
+	}
+}
+
+// run drops the video of the layer until the passthrough muxer has started, which decides the audio codec.
+func (l *layer) run(ctx context.Context, sub <-chan *hub.FrameData) {
+	ctx = log.WithFields(ctx, logrus.Fields{
+		fields.Rendition: l.rendition.Name,
+	})
+	for data := range sub {
+		if data.H264Video != nil {
+			l.onVideo(ctx, data.H264Video)
+		}
+	}
+}
+
+func (l *layer) start(muxer *gohlslib.Muxer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.muxer = muxer
+}
+
+func (l *layer) onVideo(ctx context.Context, h264Video *hub.H264Video) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.muxer == nil {
+		return
+	}
+	if l.waitingKeyframe {
+		if !isKeyframe(h264Video) {
+			return
+		}
+		l.waitingKeyframe = false
+	}
+	au, _ := h264parser.SplitNALUs(h264Video.Data)
+	for _, nalu := range au {
+		if len(nalu) > 0 && nalu[0]&0x1f == h264parser.NALU_SPS {
+			l.updateResolution(nalu)
+		}
+	}
+	if err := l.muxer.WriteH264(time.Now(), time.Duration(h264Video.RawDTS())*time.Millisecond, au); err != nil {
+		log.Errorf(ctx, "failed to write h264: %v", err)
+	}
+	if bandwidth, ok := l.bandwidth.add(len(h264Video.Data)); ok {
+		l.info.Bandwidth = bandwidth + audioBandwidth
+		l.hlsHub.StoreVariantInfo(l.streamID, l.rendition.Name, l.info)
+	}
+}
+
+func (l *layer) updateResolution(sps []byte) {
+	spsInfo, err := h264parser.ParseSPS(sps)
+	if err != nil {
+		return
+	}
+	if int(spsInfo.Width) == l.info.Width && int(spsInfo.Height) == l.info.Height {
+		return
+	}
+	l.info.Width = int(spsInfo.Width)
+	l.info.Height = int(spsInfo.Height)
+	l.hlsHub.StoreVariantInfo(l.streamID, l.rendition.Name, l.info)
+}
+
+func (l *layer) onAudio(ctx context.Context, ntp time.Time, pts time.Duration, audioData []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.muxer == nil {
+		return
+	}
+	if err := l.muxer.WriteMPEG4Audio(ntp, pts, [][]byte{audioData}); err != nil {
+		log.Errorf(ctx, "failed to write audio: %v", err)
+	}
+}
+
+func (l *layer) onOPUSAudio(ctx context.Context, ntp time.Time, pts time.Duration, audioData []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.muxer == nil {
+		return
+	}
+	if err := l.muxer.WriteOpus(ntp, pts, [][]byte{audioData}); err != nil {
+		log.Errorf(ctx, "failed to write opus: %v", err)
+	}
+}
+
+// bandwidthMeter measures the bitrate of a variant whose bitrate is decided by the publisher.
+type bandwidthMeter struct {
+	bytes int
+	since time.Time
+}
+
+// add adds n bytes and returns the bitrate in bits per second once a window has passed.
+func (m *bandwidthMeter) add(n int) (int, bool) {
+	now := time.Now()
+	if m.since.IsZero() {
+		m.since = now
+	}
+	m.bytes += n
+	elapsed := now.Sub(m.since)
+	if elapsed < bandwidthWindow {
+		return 0, false
+	}
+	bandwidth := int(float64(m.bytes*8) / elapsed.Seconds())
+	m.bytes = 0
+	m.since = now
+	return bandwidth, true
+}
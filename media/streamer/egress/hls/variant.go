@@ -0,0 +1,148 @@
+package hls
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/gohlslib"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/sirupsen/logrus"
+
+	"liveflow/log"
+	"liveflow/media/hlshub"
+	"liveflow/media/hub"
+	"liveflow/media/streamer/fields"
+	"liveflow/media/streamer/processes"
+)
+
+const (
+	// audioBandwidth is added to the video bitrate of a rendition in the master playlist.
+	audioBandwidth = 128000
+	// transcoding runs behind the hub; frames are dropped until the next keyframe when it falls further behind.
+	variantQueueSize = 120
+)
+
+// Rendition is a rung of the ABR ladder.
+type Rendition struct {
+	Name    string
+	Width   int
+	Height  int
+	Bitrate int
+}
+
+// variant transcodes the source video into its own muxer. Audio is shared with the passthrough variant.
+type variant struct {
+	rendition Rendition
+	streamID  string
+	hlsHub    *hlshub.HLSHub
+
+	// mu serializes muxer writes, audio comes from the hub subscriber while video comes from run.
+	mu    sync.Mutex
+	muxer *gohlslib.Muxer
+
+	videos          chan *hub.H264Video
+	done            chan struct{}
+	waitingKeyframe bool
+}
+
+func newVariant(streamID string, rendition Rendition, hlsHub *hlshub.HLSHub, muxer *gohlslib.Muxer) *variant {
+	return &variant{
+		rendition:       rendition,
+		streamID:        streamID,
+		hlsHub:          hlsHub,
+		muxer:           muxer,
+		videos:          make(chan *hub.H264Video, variantQueueSize),
+		done:            make(chan struct{}),
+		waitingKeyframe: true,
+	}
+}
+
+func (v *variant) run(ctx context.Context) {
+	defer close(v.done)
+	ctx = log.WithFields(ctx, logrus.Fields{
+		fields.Rendition: v.rendition.Name,
+	})
+	transcodingProcess := processes.NewVideoTranscodingProcess(processes.VideoTranscodingArgs{
+		Width:   v.rendition.Width,
+		Height:  v.rendition.Height,
+		Bitrate: v.rendition.Bitrate,
+		// the muxer is fed with DTS only, so the ladder is encoded without B-frames
+		Tune: "zerolatency",
+	})
+	if err := transcodingProcess.Init(); err != nil {
+		log.Error(ctx, err, "failed to init video transcoding")
+		return
+	}
+	defer transcodingProcess.Close()
+	infoStored := false
+	for video := range v.videos {
+		videos, err := transcodingProcess.Process(video)
+		if err != nil {
+			log.Error(ctx, err, "failed to transcode video")
+			continue
+		}
+		if !infoStored && len(videos) > 0 {
+			v.hlsHub.StoreVariantInfo(v.streamID, v.rendition.Name, hlshub.VariantInfo{
+				Bandwidth: v.rendition.Bitrate + audioBandwidth,
+				Width:     transcodingProcess.Width(),
+				Height:    transcodingProcess.Height(),
+			})
+			infoStored = true
+		}
+		for _, transcoded := range videos {
+			au, _ := h264parser.SplitNALUs(transcoded.Data)
+			v.mu.Lock()
+			err := v.muxer.WriteH264(time.Now(), time.Duration(transcoded.RawDTS())*time.Millisecond, au)
+			v.mu.Unlock()
+			if err != nil {
+				log.Errorf(ctx, "failed to write h264: %v", err)
+			}
+		}
+	}
+}
+
+func (v *variant) onVideo(ctx context.Context, h264Video *hub.H264Video) {
+	if v.waitingKeyframe {
+		if !isKeyframe(h264Video) {
+			return
+		}
+		v.waitingKeyframe = false
+	}
+	select {
+	case <-v.done:
+	case v.videos <- h264Video:
+	default:
+		log.Warnf(ctx, "transcoding of rendition %s is too slow, waiting for the next keyframe", v.rendition.Name)
+		v.waitingKeyframe = true
+	}
+}
+
+func (v *variant) onAudio(ctx context.Context, ntp time.Time, pts time.Duration, audioData []byte) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := v.muxer.WriteMPEG4Audio(ntp, pts, [][]byte{audioData}); err != nil {
+		log.Errorf(ctx, "failed to write audio: %v", err)
+	}
+}
+
+func (v *variant) onOPUSAudio(ctx context.Context, ntp time.Time, pts time.Duration, audioData []byte) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if err := v.muxer.WriteOpus(ntp, pts, [][]byte{audioData}); err != nil {
+		log.Errorf(ctx, "failed to write opus: %v", err)
+	}
+}
+
+func (v *variant) close() {
+	close(v.videos)
+}
+
+func isKeyframe(video *hub.H264Video) bool {
+	for _, sliceType := range video.SliceTypes {
+		if sliceType == hub.SliceI {
+			return true
+		}
+	}
+	return false
+}
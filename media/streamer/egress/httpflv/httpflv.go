@@ -0,0 +1,71 @@
+package httpflv
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sirupsen/logrus"
+
+	"liveflow/log"
+	"liveflow/media/hub"
+	"liveflow/media/streamer/fields"
+)
+
+var ErrUnsupportedCodec = errors.New("unsupported codec")
+
+type HTTPFLVArgs struct {
+	Hub    *hub.Hub
+	Server *Server
+}
+
+// HTTPFLV makes a source playable as live FLV by the viewers of the Server.
+type HTTPFLV struct {
+	hub    *hub.Hub
+	server *Server
+}
+
+func NewHTTPFLV(args HTTPFLVArgs) *HTTPFLV {
+	return &HTTPFLV{
+		hub:    args.Hub,
+		server: args.Server,
+	}
+}
+
+func (h *HTTPFLV) Start(ctx context.Context, source hub.Source) error {
+	if !hub.HasCodecType(source.MediaSpecs(), hub.CodecTypeH264) && !hub.HasCodecType(source.MediaSpecs(), hub.CodecTypeAAC) {
+		return ErrUnsupportedCodec
+	}
+	ctx = log.WithFields(ctx, logrus.Fields{
+		fields.StreamID:   source.StreamID(),
+		fields.SourceName: source.Name(),
+	})
+	log.Info(ctx, "start httpflv")
+	st := newStream(h.hub, source)
+	// the viewers subscribe on their own, the stream is served until it is unpublished or replaced
+	eventCtx, cancel := context.WithCancel(context.Background())
+	events := h.hub.SubscribeEvents(eventCtx)
+	h.server.addStream(st)
+	go func() {
+		defer h.server.removeStream(st)
+		defer cancel()
+		// the stream may have ended before the events were subscribed
+		if info, ok := h.hub.Get(source.StreamID()); ok && info.Source == source {
+			h.waitUnpublished(events, st)
+		}
+		log.Info(ctx, "end httpflv")
+	}()
+	return nil
+}
+
+func (h *HTTPFLV) waitUnpublished(events <-chan hub.Event, st *stream) {
+	for {
+		select {
+		case event := <-events:
+			if event.Type == hub.EventUnpublished && event.StreamID == st.streamID {
+				return
+			}
+		case <-st.done:
+			return
+		}
+	}
+}
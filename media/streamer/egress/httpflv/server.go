@@ -0,0 +1,206 @@
+package httpflv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+
+	"liveflow/auth"
+	"liveflow/log"
+	"liveflow/media/hub"
+	"liveflow/media/streamer/egress/record/flv"
+)
+
+const viewerQueueSize = 512
+
+var ErrOriginNotAllowed = errors.New("origin not allowed")
+
+// Server serves live FLV at /live/<streamID>.flv over chunked HTTP and WebSocket.
+type Server struct {
+	echo         *echo.Echo
+	playback     *auth.PlaybackVerifier
+	allowOrigins []string
+
+	mu      sync.RWMutex
+	streams map[string]*stream
+}
+
+type ServerArgs struct {
+	Echo *echo.Echo
+	// Playback checks the token of every viewer, /live/<streamID>.flv?token=<token>, viewers need none when it is nil.
+	Playback *auth.PlaybackVerifier
+	// AllowOrigins are the origins of the pages that play from another origin, over HTTP and WebSocket.
+	AllowOrigins []string
+}
+
+func NewServer(args ServerArgs) *Server {
+	return &Server{
+		echo:         args.Echo,
+		playback:     args.Playback,
+		allowOrigins: args.AllowOrigins,
+		streams:      map[string]*stream{},
+	}
+}
+
+func (s *Server) RegisterRoute() {
+	liveRoute := s.echo.Group("/live", auth.CORS(s.allowOrigins, http.MethodGet, http.MethodOptions)...)
+	liveRoute.GET("/:streamID", s.handleFLV)
+}
+
+func (s *Server) addStream(st *stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.streams[st.streamID]; ok {
+		old.close()
+	}
+	s.streams[st.streamID] = st
+}
+
+func (s *Server) removeStream(st *stream) {
+	s.mu.Lock()
+	if s.streams[st.streamID] == st {
+		delete(s.streams, st.streamID)
+	}
+	s.mu.Unlock()
+	st.close()
+}
+
+func (s *Server) stream(streamID string) *stream {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.streams[streamID]
+}
+
+func (s *Server) handleFLV(c echo.Context) error {
+	streamID, ok := strings.CutSuffix(c.Param("streamID"), ".flv")
+	if !ok {
+		return echo.ErrNotFound
+	}
+	ctx := c.Request().Context()
+	if s.playback != nil {
+		if err := s.playback.Verify(c.QueryParam(auth.PlaybackTokenParam), streamID, c.RealIP()); err != nil {
+			log.Warnf(ctx, "rejected flv viewer of %s: %v", streamID, err)
+			return c.NoContent(http.StatusUnauthorized)
+		}
+	}
+	st := s.stream(streamID)
+	if st == nil {
+		return echo.ErrNotFound
+	}
+	if c.IsWebSocket() {
+		// CORS does not apply to WebSockets, the handshake checks the origin of the page instead.
+		websocket.Server{
+			Handshake: func(config *websocket.Config, req *http.Request) error {
+				if !auth.AllowOrigin(s.allowOrigins, req) {
+					return ErrOriginNotAllowed
+				}
+				return nil
+			},
+			Handler: func(ws *websocket.Conn) {
+				ws.PayloadType = websocket.BinaryFrame
+				st.serveViewer(ctx, ws)
+			},
+		}.ServeHTTP(c.Response(), c.Request())
+		return nil
+	}
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "video/x-flv")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.WriteHeader(http.StatusOK)
+	st.serveViewer(ctx, &flushWriter{res: res})
+	return nil
+}
+
+// flushWriter sends every FLV tag to the viewer as soon as it is written.
+type flushWriter struct {
+	res *echo.Response
+}
+
+func (w *flushWriter) Write(b []byte) (int, error) {
+	n, err := w.res.Write(b)
+	if err != nil {
+		return n, err
+	}
+	w.res.Flush()
+	return n, nil
+}
+
+// stream is a source playable as FLV. Every viewer subscribes to the hub on its own,
+// so a slow viewer is disconnected without affecting the others.
+type stream struct {
+	hub      *hub.Hub
+	streamID string
+	hasVideo bool
+	hasAudio bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newStream(h *hub.Hub, source hub.Source) *stream {
+	specs := source.MediaSpecs()
+	return &stream{
+		hub:      h,
+		streamID: source.StreamID(),
+		hasVideo: hub.HasCodecType(specs, hub.CodecTypeH264),
+		hasAudio: hub.HasCodecType(specs, hub.CodecTypeAAC),
+		done:     make(chan struct{}),
+	}
+}
+
+func (st *stream) close() {
+	st.closeOnce.Do(func() {
+		close(st.done)
+	})
+}
+
+func (st *stream) serveViewer(ctx context.Context, w io.Writer) {
+	muxer, err := flv.NewMuxer(flv.MuxerArgs{
+		Writer:   w,
+		HasVideo: st.hasVideo,
+		HasAudio: st.hasAudio,
+	})
+	if err != nil {
+		log.Error(ctx, err, "failed to create flv muxer")
+		return
+	}
+	sub := st.hub.SubscribeWithContext(ctx, st.streamID, hub.SubscribeOptions{
+		Name:      "httpflv viewer",
+		QueueSize: viewerQueueSize,
+		Overflow:  hub.Disconnect,
+		ReplayGOP: true,
+	})
+	defer sub.Close()
+	waitingKeyframe := st.hasVideo
+	for {
+		select {
+		case <-st.done:
+			return
+		case data, ok := <-sub.Frames():
+			if !ok {
+				return
+			}
+			if waitingKeyframe {
+				if data.H264Video == nil || !hub.IsKeyFrame(data) {
+					continue
+				}
+				waitingKeyframe = false
+			}
+			if data.H264Video != nil && st.hasVideo {
+				err = muxer.WriteVideo(data.H264Video)
+			}
+			if err == nil && data.AACAudio != nil && st.hasAudio {
+				err = muxer.WriteAAC(data.AACAudio)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -1 +1,194 @@
 package flv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	astiav "github.com/asticode/go-astiav"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/sirupsen/logrus"
+
+	"liveflow/log"
+	"liveflow/media/hub"
+	"liveflow/media/streamer/egress/record"
+	"liveflow/media/streamer/fields"
+	"liveflow/media/streamer/processes"
+)
+
+var (
+	ErrUnsupportedCodec = errors.New("unsupported codec")
+)
+
+const (
+	audioSampleRate = 48000
+)
+
+type FLV struct {
+	hub      *hub.Hub
+	muxer    *Muxer
+	file     *os.File
+	streamID string
+	hasAudio bool
+
+	mpeg4AudioConfigBytes []byte
+	mpeg4AudioConfig      *aacparser.MPEG4AudioConfig
+
+	splitIntervalMS int64
+	lastSplitTime   int64
+	splitPending    bool
+}
+
+type FLVArgs struct {
+	Hub             *hub.Hub
+	SplitIntervalMS int64
+}
+
+func NewFLV(args FLVArgs) *FLV {
+	return &FLV{
+		hub:             args.Hub,
+		splitIntervalMS: args.SplitIntervalMS,
+	}
+}
+
+func (f *FLV) Start(ctx context.Context, source hub.Source) error {
+	if !hub.HasCodecType(source.MediaSpecs(), hub.CodecTypeH264) {
+		return ErrUnsupportedCodec
+	}
+	f.streamID = source.StreamID()
+	f.hasAudio = hub.HasCodecType(source.MediaSpecs(), hub.CodecTypeAAC) || hub.HasCodecType(source.MediaSpecs(), hub.CodecTypeOpus)
+	ctx = log.WithFields(ctx, logrus.Fields{
+		fields.StreamID:   source.StreamID(),
+		fields.SourceName: source.Name(),
+	})
+	log.Info(ctx, "start flv")
+	sub := f.hub.SubscribeWithOptions(source.StreamID(), hub.SubscribeOptions{Name: "flv", QueueSize: record.QueueSize, ReplayGOP: true})
+	go func() {
+		defer f.closeFile(ctx)
+		defer sub.Close()
+		// The first file is created at the first keyframe.
+		f.splitPending = true
+
+		var audioTranscodingProcess *processes.AudioTranscodingProcess
+		for data := range sub.Frames() {
+			if data.H264Video != nil {
+				if !f.splitPending && data.H264Video.RawDTS()-f.lastSplitTime >= f.splitIntervalMS {
+					f.splitPending = true
+				}
+				f.onVideo(ctx, data.H264Video)
+			}
+			if data.OPUSAudio != nil {
+				if audioTranscodingProcess == nil {
+					audioTranscodingProcess = processes.NewTranscodingProcess(astiav.CodecIDOpus, astiav.CodecIDAac, audioSampleRate)
+					if err := audioTranscodingProcess.Init(); err != nil {
+						log.Error(ctx, err, "failed to init audio transcoding")
+						return
+					}
+					defer audioTranscodingProcess.Close()
+					f.mpeg4AudioConfigBytes = audioTranscodingProcess.ExtraData()
+					codecData, err := aacparser.NewCodecDataFromMPEG4AudioConfigBytes(f.mpeg4AudioConfigBytes)
+					if err != nil {
+						log.Error(ctx, err, "failed to parse transcoded audio config")
+						return
+					}
+					f.mpeg4AudioConfig = &codecData.Config
+				}
+				f.onOPUSAudio(ctx, audioTranscodingProcess, data.OPUSAudio)
+			} else if data.AACAudio != nil {
+				f.onAudio(ctx, data.AACAudio)
+			}
+		}
+	}()
+	return nil
+}
+
+// createNewFile starts a new FLV file; the muxer writes fresh sequence headers and timestamps from zero.
+func (f *FLV) createNewFile(ctx context.Context) error {
+	f.closeFile(ctx)
+	timestamp := time.Now().Format("2006-01-02-15-04-05")
+	fileName := fmt.Sprintf("videos/%s_%s.flv", f.streamID, timestamp)
+	file, err := record.CreateFileInDir(fileName)
+	if err != nil {
+		return err
+	}
+	muxer, err := NewMuxer(MuxerArgs{
+		Writer:   file,
+		HasVideo: true,
+		HasAudio: f.hasAudio,
+	})
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file = file
+	f.muxer = muxer
+	return nil
+}
+
+func (f *FLV) closeFile(ctx context.Context) {
+	f.muxer = nil
+	if f.file != nil {
+		err := f.file.Close()
+		if err != nil {
+			log.Error(ctx, err, "failed to close flv file")
+		}
+		f.file = nil
+	}
+}
+
+func (f *FLV) onVideo(ctx context.Context, h264Video *hub.H264Video) {
+	isKeyFrame := false
+	for _, sliceType := range h264Video.SliceTypes {
+		if sliceType == hub.SliceI {
+			isKeyFrame = true
+			break
+		}
+	}
+	if f.splitPending && isKeyFrame {
+		if err := f.createNewFile(ctx); err != nil {
+			log.Error(ctx, err, "failed to split flv file")
+			return
+		}
+		f.lastSplitTime = h264Video.RawDTS()
+		f.splitPending = false
+	}
+	if f.muxer == nil {
+		return
+	}
+	if err := f.muxer.WriteVideo(h264Video); err != nil {
+		log.Error(ctx, err, "failed to write video")
+	}
+}
+
+func (f *FLV) onAudio(ctx context.Context, aacAudio *hub.AACAudio) {
+	if f.muxer == nil {
+		return
+	}
+	if err := f.muxer.WriteAAC(aacAudio); err != nil {
+		log.Error(ctx, err, "failed to write audio")
+	}
+}
+
+func (f *FLV) onOPUSAudio(ctx context.Context, audioTranscodingProcess *processes.AudioTranscodingProcess, opusAudio *hub.OPUSAudio) {
+	packets, err := audioTranscodingProcess.Process(&processes.MediaPacket{
+		Data: opusAudio.Data,
+		PTS:  opusAudio.PTS,
+		DTS:  opusAudio.DTS,
+	})
+	if err != nil {
+		log.Error(ctx, err, "failed to transcode audio")
+		return
+	}
+	for _, packet := range packets {
+		f.onAudio(ctx, &hub.AACAudio{
+			Data:                  packet.Data,
+			MPEG4AudioConfigBytes: f.mpeg4AudioConfigBytes,
+			MPEG4AudioConfig:      f.mpeg4AudioConfig,
+			PTS:                   packet.PTS,
+			DTS:                   packet.DTS,
+			AudioClockRate:        uint32(packet.SampleRate),
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/deepch/vdk/codec/h264parser"
+	goflv "github.com/yutopp/go-flv"
+	flvtag "github.com/yutopp/go-flv/tag"
+
+	"liveflow/media/hub"
+)
+
+var ErrNoTrack = errors.New("flv needs a video or an audio track")
+
+const (
+	naluTypeIDR = 5
+	naluTypeAUD = 9
+)
+
+// Muxer writes hub frames as FLV tags. Timestamps start at zero from the first written frame.
+// Every call writes whole tags to the underlying writer at once.
+type Muxer struct {
+	w   io.Writer
+	buf bytes.Buffer
+	enc *goflv.Encoder
+
+	sps              []byte
+	pps              []byte
+	audioConfigBytes []byte
+
+	hasTimestampBase bool
+	timestampBase    int64
+}
+
+type MuxerArgs struct {
+	Writer   io.Writer
+	HasVideo bool
+	HasAudio bool
+}
+
+func NewMuxer(args MuxerArgs) (*Muxer, error) {
+	var flags goflv.Flags
+	if args.HasVideo {
+		flags |= goflv.FlagsVideo
+	}
+	if args.HasAudio {
+		flags |= goflv.FlagsAudio
+	}
+	if flags == 0 {
+		return nil, ErrNoTrack
+	}
+	m := &Muxer{w: args.Writer}
+	enc, err := goflv.NewEncoder(&m.buf, flags)
+	if err != nil {
+		return nil, err
+	}
+	m.enc = enc
+	return m, m.flush()
+}
+
+// WriteVideo writes an AVC sequence header whenever SPS/PPS change, followed by the frame.
+func (m *Muxer) WriteVideo(video *hub.H264Video) error {
+	sps, pps := video.SPS, video.PPS
+	var avcc []byte
+	keyframe := false
+	nalus, _ := h264parser.SplitNALUs(video.Data)
+	for _, nalu := range nalus {
+		if len(nalu) < 1 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case h264parser.NALU_SPS:
+			sps = nalu
+			continue
+		case h264parser.NALU_PPS:
+			pps = nalu
+			continue
+		case naluTypeAUD:
+			continue
+		case naluTypeIDR:
+			keyframe = true
+		}
+		avcc = binary.BigEndian.AppendUint32(avcc, uint32(len(nalu)))
+		avcc = append(avcc, nalu...)
+	}
+	if len(sps) > 0 && len(pps) > 0 && (!bytes.Equal(sps, m.sps) || !bytes.Equal(pps, m.pps)) {
+		codecData, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+		if err != nil {
+			return err
+		}
+		m.sps = append([]byte{}, sps...)
+		m.pps = append([]byte{}, pps...)
+		dts := m.timestamp(toMS(video.DTS, video.VideoClockRate))
+		if err := m.encode(flvtag.TagTypeVideo, dts, &flvtag.VideoData{
+			FrameType:     flvtag.FrameTypeKeyFrame,
+			CodecID:       flvtag.CodecIDAVC,
+			AVCPacketType: flvtag.AVCPacketTypeSequenceHeader,
+			Data:          bytes.NewReader(codecData.AVCDecoderConfRecordBytes()),
+		}); err != nil {
+			return err
+		}
+	}
+	if m.sps == nil || len(avcc) == 0 {
+		return nil
+	}
+	frameType := flvtag.FrameTypeInterFrame
+	if keyframe {
+		frameType = flvtag.FrameTypeKeyFrame
+	}
+	dts := toMS(video.DTS, video.VideoClockRate)
+	pts := toMS(video.PTS, video.VideoClockRate)
+	if err := m.encode(flvtag.TagTypeVideo, m.timestamp(dts), &flvtag.VideoData{
+		FrameType:       frameType,
+		CodecID:         flvtag.CodecIDAVC,
+		AVCPacketType:   flvtag.AVCPacketTypeNALU,
+		CompositionTime: int32(pts - dts),
+		Data:            bytes.NewReader(avcc),
+	}); err != nil {
+		return err
+	}
+	return m.flush()
+}
+
+// WriteAAC writes an AAC sequence header whenever the audio config changes, followed by the frame.
+func (m *Muxer) WriteAAC(audio *hub.AACAudio) error {
+	ts := m.timestamp(toMS(audio.DTS, audio.AudioClockRate))
+	if len(audio.MPEG4AudioConfigBytes) > 0 && !bytes.Equal(audio.MPEG4AudioConfigBytes, m.audioConfigBytes) {
+		m.audioConfigBytes = append([]byte{}, audio.MPEG4AudioConfigBytes...)
+		if err := m.encode(flvtag.TagTypeAudio, ts, aacAudioData(flvtag.AACPacketTypeSequenceHeader, m.audioConfigBytes)); err != nil {
+			return err
+		}
+	}
+	if m.audioConfigBytes == nil || len(audio.Data) == 0 || audio.SequenceHeader {
+		return m.flush()
+	}
+	if err := m.encode(flvtag.TagTypeAudio, ts, aacAudioData(flvtag.AACPacketTypeRaw, audio.Data)); err != nil {
+		return err
+	}
+	return m.flush()
+}
+
+func (m *Muxer) encode(tagType flvtag.TagType, ts uint32, data interface{}) error {
+	return m.enc.Encode(&flvtag.FlvTag{
+		TagType:   tagType,
+		Timestamp: ts,
+		Data:      data,
+	})
+}
+
+func (m *Muxer) flush() error {
+	if m.buf.Len() == 0 {
+		return nil
+	}
+	_, err := m.w.Write(m.buf.Bytes())
+	m.buf.Reset()
+	return err
+}
+
+func (m *Muxer) timestamp(ms int64) uint32 {
+	if !m.hasTimestampBase {
+		m.timestampBase = ms
+		m.hasTimestampBase = true
+	}
+	if ms < m.timestampBase {
+		return 0
+	}
+	return uint32(ms - m.timestampBase)
+}
+
+func aacAudioData(packetType flvtag.AACPacketType, data []byte) *flvtag.AudioData {
+	// AAC always signals 44kHz stereo 16bit, the real parameters are in the sequence header.
+	return &flvtag.AudioData{
+		SoundFormat:   flvtag.SoundFormatAAC,
+		SoundRate:     flvtag.SoundRate44kHz,
+		SoundSize:     flvtag.SoundSize16Bit,
+		SoundType:     flvtag.SoundTypeStereo,
+		AACPacketType: packetType,
+		Data:          bytes.NewReader(data),
+	}
+}
+
+func toMS(ts int64, clockRate uint32) int64 {
+	if clockRate == 0 {
+		return ts
+	}
+	return ts * 1000 / int64(clockRate)
+}
@@ -0,0 +1,151 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"liveflow/log"
+	"liveflow/media/hub"
+)
+
+var (
+	ErrUnknownFormat    = errors.New("unknown recording format")
+	ErrAlreadyRecording = errors.New("already recording")
+	ErrNotRecording     = errors.New("not recording")
+)
+
+// Recorder records a stream to files until it is stopped or the stream ends.
+type Recorder interface {
+	Start(ctx context.Context, source hub.Source) error
+	Stop()
+}
+
+type ManagerArgs struct {
+	Hub *hub.Hub
+	// Recorders creates a recorder for a stream, by format name, e.g. "mp4".
+	Recorders map[string]func(streamID string) Recorder
+}
+
+// Manager starts and stops the recordings of running streams, whether configured or asked for by the admin API.
+// A recording belongs to the source it was started for. Once another source owns the stream, e.g. after a
+// reconnect or a takeover, the recording is over even if the unpublished event has not been handled yet.
+type Manager struct {
+	hub       *hub.Hub
+	recorders map[string]func(streamID string) Recorder
+
+	mu sync.Mutex
+	// [streamID][format]recording
+	recordings map[string]map[string]*recording
+}
+
+type recording struct {
+	source   hub.Source
+	recorder Recorder
+}
+
+func NewManager(args ManagerArgs) *Manager {
+	return &Manager{
+		hub:        args.Hub,
+		recorders:  args.Recorders,
+		recordings: map[string]map[string]*recording{},
+	}
+}
+
+// Run forgets the recordings of the streams that end, their recorders finish on their own.
+// The events only free memory early, a recording of a source that no longer owns its stream is ignored anyway.
+func (m *Manager) Run(ctx context.Context) {
+	for event := range m.hub.SubscribeEvents(ctx) {
+		if event.Type != hub.EventUnpublished || event.Stream.Source == nil {
+			continue
+		}
+		m.mu.Lock()
+		m.forget(event.Stream.Source)
+		m.mu.Unlock()
+	}
+}
+
+// forget is called with the mutex held, it removes the recordings of source and leaves those of the
+// source that publishes the stream now.
+func (m *Manager) forget(source hub.Source) {
+	streamID := source.StreamID()
+	for format, r := range m.recordings[streamID] {
+		if r.source == source {
+			delete(m.recordings[streamID], format)
+		}
+	}
+	if len(m.recordings[streamID]) == 0 {
+		delete(m.recordings, streamID)
+	}
+}
+
+// current is called with the mutex held, it returns the recordings of streamID after removing those of
+// sources that no longer own it.
+func (m *Manager) current(streamID string) map[string]*recording {
+	info, published := m.hub.Get(streamID)
+	for format, r := range m.recordings[streamID] {
+		if !published || info.Source != r.source {
+			delete(m.recordings[streamID], format)
+		}
+	}
+	if len(m.recordings[streamID]) == 0 {
+		delete(m.recordings, streamID)
+	}
+	return m.recordings[streamID]
+}
+
+// Start starts recording source in format.
+func (m *Manager) Start(ctx context.Context, source hub.Source, format string) error {
+	newRecorder, ok := m.recorders[format]
+	if !ok {
+		return ErrUnknownFormat
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.current(source.StreamID())[format]; ok {
+		return ErrAlreadyRecording
+	}
+	recorder := newRecorder(source.StreamID())
+	if err := recorder.Start(ctx, source); err != nil {
+		return err
+	}
+	if m.recordings[source.StreamID()] == nil {
+		m.recordings[source.StreamID()] = map[string]*recording{}
+	}
+	m.recordings[source.StreamID()][format] = &recording{source: source, recorder: recorder}
+	log.Infof(ctx, "started %s recording of %s", format, source.StreamID())
+	return nil
+}
+
+// Stop stops recording streamID in format, the stream goes on.
+func (m *Manager) Stop(ctx context.Context, streamID string, format string) error {
+	m.mu.Lock()
+	r, ok := m.current(streamID)[format]
+	if ok {
+		delete(m.recordings[streamID], format)
+		if len(m.recordings[streamID]) == 0 {
+			delete(m.recordings, streamID)
+		}
+	}
+	m.mu.Unlock()
+	if !ok {
+		return ErrNotRecording
+	}
+	r.recorder.Stop()
+	log.Infof(ctx, "stopped %s recording of %s", format, streamID)
+	return nil
+}
+
+// Formats returns the formats streamID is recorded in.
+func (m *Manager) Formats(streamID string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	recordings := m.current(streamID)
+	ret := make([]string, 0, len(recordings))
+	for format := range recordings {
+		ret = append(ret, format)
+	}
+	sort.Strings(ret)
+	return ret
+}
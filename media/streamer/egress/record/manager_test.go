@@ -0,0 +1,183 @@
+package record
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"liveflow/media/hub"
+)
+
+type testSource struct {
+	streamID string
+}
+
+func (s *testSource) Name() string {
+	return "test"
+}
+
+func (s *testSource) MediaSpecs() []hub.MediaSpec {
+	return []hub.MediaSpec{{MediaType: hub.Video, ClockRate: 90000, CodecType: hub.CodecTypeH264}}
+}
+
+func (s *testSource) StreamID() string {
+	return s.streamID
+}
+
+func (s *testSource) Depth() int {
+	return 0
+}
+
+type testRecorder struct {
+	started hub.Source
+	stopped bool
+}
+
+func (r *testRecorder) Start(ctx context.Context, source hub.Source) error {
+	r.started = source
+	return nil
+}
+
+func (r *testRecorder) Stop() {
+	r.stopped = true
+}
+
+func newTestManager(h *hub.Hub) (*Manager, *[]*testRecorder) {
+	var recorders []*testRecorder
+	m := NewManager(ManagerArgs{
+		Hub: h,
+		Recorders: map[string]func(streamID string) Recorder{
+			"mp4": func(string) Recorder {
+				r := &testRecorder{}
+				recorders = append(recorders, r)
+				return r
+			},
+		},
+	})
+	return m, &recorders
+}
+
+func notify(t *testing.T, h *hub.Hub, source hub.Source) {
+	t.Helper()
+	if err := h.Notify(context.Background(), source); err != nil {
+		t.Fatal(err)
+	}
+	<-h.SubscribeToStreamID()
+}
+
+func TestManagerStartStop(t *testing.T) {
+	ctx := context.Background()
+	h := hub.NewHub()
+	m, recorders := newTestManager(h)
+	source := &testSource{streamID: "stream"}
+	notify(t, h, source)
+
+	if err := m.Start(ctx, source, "flv"); !errors.Is(err, ErrUnknownFormat) {
+		t.Fatalf("got %v, want %v", err, ErrUnknownFormat)
+	}
+	if err := m.Start(ctx, source, "mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(ctx, source, "mp4"); !errors.Is(err, ErrAlreadyRecording) {
+		t.Fatalf("got %v, want %v", err, ErrAlreadyRecording)
+	}
+	if got := m.Formats("stream"); !reflect.DeepEqual(got, []string{"mp4"}) {
+		t.Fatalf("formats %v, want mp4", got)
+	}
+	if err := m.Stop(ctx, "stream", "mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if !(*recorders)[0].stopped {
+		t.Fatal("recorder was not stopped")
+	}
+	if err := m.Stop(ctx, "stream", "mp4"); !errors.Is(err, ErrNotRecording) {
+		t.Fatalf("got %v, want %v", err, ErrNotRecording)
+	}
+	if got := m.Formats("stream"); len(got) != 0 {
+		t.Fatalf("formats %v after stop", got)
+	}
+}
+
+// The unpublished event of the old source may come late or not at all, the recording of the new one starts anyway.
+func TestManagerRestartWithoutUnpublishedEvent(t *testing.T) {
+	ctx := context.Background()
+	for _, policy := range []hub.TakeoverPolicy{hub.RejectNewPublisher, hub.KickOldPublisher, hub.StandbyNewPublisher} {
+		t.Run(policy.String(), func(t *testing.T) {
+			h := hub.NewHub()
+			h.SetTakeoverPolicy(policy)
+			m, recorders := newTestManager(h)
+			old := &testSource{streamID: "stream"}
+			notify(t, h, old)
+			if err := m.Start(ctx, old, "mp4"); err != nil {
+				t.Fatal(err)
+			}
+
+			next := &testSource{streamID: "stream"}
+			switch policy {
+			case hub.RejectNewPublisher:
+				// the publisher reconnects
+				h.Unpublish(old)
+				notify(t, h, next)
+			case hub.KickOldPublisher:
+				notify(t, h, next)
+			case hub.StandbyNewPublisher:
+				if err := h.Notify(ctx, next); !errors.Is(err, hub.ErrStandby) {
+					t.Fatalf("got %v, want %v", err, hub.ErrStandby)
+				}
+				h.Unpublish(old)
+				<-h.SubscribeToStreamID()
+			}
+			if got := m.Formats("stream"); len(got) != 0 {
+				t.Fatalf("formats %v of the old source", got)
+			}
+			if err := m.Start(ctx, next, "mp4"); err != nil {
+				t.Fatalf("start for the new source: %v", err)
+			}
+			if len(*recorders) != 2 || (*recorders)[1].started != next {
+				t.Fatalf("the new source was not recorded")
+			}
+
+			// the late event of the old source leaves the new recording alone
+			m.mu.Lock()
+			m.forget(old)
+			m.mu.Unlock()
+			if got := m.Formats("stream"); !reflect.DeepEqual(got, []string{"mp4"}) {
+				t.Fatalf("formats %v after the old source was forgotten", got)
+			}
+			if err := m.Stop(ctx, "stream", "mp4"); err != nil || !(*recorders)[1].stopped || (*recorders)[0].stopped {
+				t.Fatalf("stop %v, stopped the old recorder %v and the new one %v", err, (*recorders)[0].stopped, (*recorders)[1].stopped)
+			}
+		})
+	}
+}
+
+func TestManagerRunForgetsUnpublishedStreams(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := hub.NewHub()
+	m, _ := newTestManager(h)
+	go m.Run(ctx)
+
+	// the events before Run subscribes are lost, the stream is published again until one is handled
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		source := &testSource{streamID: "stream"}
+		notify(t, h, source)
+		if err := m.Start(ctx, source, "mp4"); err != nil {
+			t.Fatal(err)
+		}
+		h.Unpublish(source)
+		time.Sleep(10 * time.Millisecond)
+		m.mu.Lock()
+		left := len(m.recordings)
+		m.mu.Unlock()
+		if left == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the recording of the unpublished stream was not forgotten")
+		}
+	}
+}
@@ -40,6 +40,8 @@ type MP4 struct {
 	mpeg4AudioConfigBytes []byte
 	mpeg4AudioConfig      *aacparser.MPEG4AudioConfig
 	streamID              string
+	sub                   *hub.Subscription
+	onFile                func(record.File)
 
 	// New fields for splitting
 	splitIntervalMS int64
@@ -51,12 +53,15 @@ type MP4 struct {
 type MP4Args struct {
 	Hub             *hub.Hub
 	SplitIntervalMS int64
+	// OnFile is called for every file that has been finalized, it may be nil.
+	OnFile func(record.File)
 }
 
 func NewMP4(args MP4Args) *MP4 {
 	return &MP4{
 		hub:             args.Hub,
 		splitIntervalMS: args.SplitIntervalMS,
+		onFile:          args.OnFile,
 	}
 }
 
@@ -73,7 +78,8 @@ func (m *MP4) Start(ctx context.Context, source hub.Source) error {
 		fields.SourceName: source.Name(),
 	})
 	log.Info(ctx, "start mp4")
-	sub := m.hub.Subscribe(source.StreamID())
+	sub := m.hub.SubscribeWithOptions(source.StreamID(), hub.SubscribeOptions{Name: "mp4", QueueSize: record.QueueSize, ReplayGOP: true})
+	m.sub = sub
 	go func() {
 		var err error
 
@@ -87,7 +93,7 @@ func (m *MP4) Start(ctx context.Context, source hub.Source) error {
 		defer m.closeFile(ctx)
 
 		var audioTranscodingProcess *processes.AudioTranscodingProcess
-		for data := range sub {
+		for data := range sub.Frames() {
 			// Check if we need to initiate a split
 			if data.H264Video != nil {
 				if !m.splitPending && data.H264Video.RawDTS()-m.lastSplitTime >= m.splitIntervalMS {
@@ -126,6 +132,13 @@ func (m *MP4) Start(ctx context.Context, source hub.Source) error {
 	return nil
 }
 
+// Stop ends the recording without ending the stream, the file is finished in the background.
+func (m *MP4) Stop() {
+	if m.sub != nil {
+		m.sub.Close()
+	}
+}
+
 // createNewFile creates a new MP4 file and initializes the muxer
 func (m *MP4) createNewFile(ctx context.Context) error {
 	var err error
@@ -162,6 +175,8 @@ func (m *MP4) closeFile(ctx context.Context) {
 		err := m.tempFile.Close()
 		if err != nil {
 			log.Error(ctx, err, "failed to close mp4 file")
+		} else if m.onFile != nil {
+			m.onFile(record.NewFile(m.streamID, "mp4", m.tempFile.Name()))
 		}
 		m.tempFile = nil
 	}
@@ -3,8 +3,39 @@ package record
 import (
 	"os"
 	"path/filepath"
+	"time"
+
+	"liveflow/media/hub"
 )
 
+// QueueSize is the hub queue size of the recorders, a stalled disk write should not cost frames right away.
+const QueueSize = 4 * hub.DefaultQueueSize
+
+// File is a recording file that has been finalized.
+type File struct {
+	StreamID string
+	// Format is the container, e.g. "mp4", "webm" or "mkv".
+	Format   string
+	Path     string
+	Size     int64
+	ClosedAt time.Time
+}
+
+// NewFile describes the finalized file at path.
+func NewFile(streamID string, format string, path string) File {
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+	return File{
+		StreamID: streamID,
+		Format:   format,
+		Path:     path,
+		Size:     size,
+		ClosedAt: time.Now(),
+	}
+}
+
 func CreateFileInDir(path string) (*os.File, error) {
 	dirPath := filepath.Dir(path)
 	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
@@ -28,6 +28,8 @@ type WebMArgs struct {
 	Hub             *hub.Hub
 	SplitIntervalMS int64  // Add SplitIntervalMS to arguments
 	StreamID        string // Add StreamID
+	// OnFile is called for every file that has been finalized, it may be nil.
+	OnFile func(record.File)
 }
 
 type WebM struct {
@@ -40,6 +42,10 @@ type WebM struct {
 	streamID                string
 	audioTranscodingProcess *processes.AudioTranscodingProcess
 	mediaSpecs              []hub.MediaSpec
+	container               Name
+	videoCodecID            string
+	sub                     *hub.Subscription
+	onFile                  func(record.File)
 }
 
 func NewWEBM(args WebMArgs) *WebM {
@@ -47,6 +53,7 @@ func NewWEBM(args WebMArgs) *WebM {
 		hub:             args.Hub,
 		splitIntervalMS: args.SplitIntervalMS,
 		streamID:        args.StreamID,
+		onFile:          args.OnFile,
 	}
 }
 
@@ -54,9 +61,12 @@ func (w *WebM) Start(ctx context.Context, source hub.Source) error {
 	if !hub.HasCodecType(source.MediaSpecs(), hub.CodecTypeAAC) && !hub.HasCodecType(source.MediaSpecs(), hub.CodecTypeOpus) {
 		return ErrUnsupportedCodec
 	}
-	if !hub.HasCodecType(source.MediaSpecs(), hub.CodecTypeH264) {
+	container, videoCodecID, ok := containerFor(source.MediaSpecs())
+	if !ok {
 		return ErrUnsupportedCodec
 	}
+	w.container = container
+	w.videoCodecID = videoCodecID
 	audioClockRate, err := hub.AudioClockRate(source.MediaSpecs())
 	if err != nil {
 		return err
@@ -68,7 +78,8 @@ func (w *WebM) Start(ctx context.Context, source hub.Source) error {
 		fields.SourceName: source.Name(),
 	})
 	log.Info(ctx, "start webm")
-	sub := w.hub.Subscribe(source.StreamID())
+	sub := w.hub.SubscribeWithOptions(source.StreamID(), hub.SubscribeOptions{Name: "webm", QueueSize: record.QueueSize, ReplayGOP: true})
+	w.sub = sub
 	go func() {
 		// Initialize splitting logic
 		err := w.createNewMuxer(ctx, int(audioClockRate))
@@ -84,14 +95,16 @@ func (w *WebM) Start(ctx context.Context, source hub.Source) error {
 			defer w.audioTranscodingProcess.Close()
 		}
 
-		for data := range sub {
-			// Check if we need to initiate a split
-
-			if data.H264Video != nil {
-				if !w.splitPending && data.H264Video.RawDTS()-w.lastSplitTime >= w.splitIntervalMS {
-					w.splitPending = true
-				}
-				w.onVideo(ctx, data.H264Video)
+		for data := range sub.Frames() {
+			switch {
+			case data.H264Video != nil:
+				w.onVideo(ctx, data.H264Video.Data, isKeyFrame(data.H264Video), data.H264Video.RawPTS(), data.H264Video.RawDTS())
+			case data.VP8Video != nil:
+				w.onVideo(ctx, data.VP8Video.Data, data.VP8Video.KeyFrame, data.VP8Video.RawPTS(), data.VP8Video.RawDTS())
+			case data.VP9Video != nil:
+				w.onVideo(ctx, data.VP9Video.Data, data.VP9Video.KeyFrame, data.VP9Video.RawPTS(), data.VP9Video.RawDTS())
+			case data.AV1Video != nil:
+				w.onVideo(ctx, data.AV1Video.Data, data.AV1Video.KeyFrame, data.AV1Video.RawPTS(), data.AV1Video.RawDTS())
 			}
 			if data.AACAudio != nil {
 				w.onAACAudio(ctx, data.AACAudio)
@@ -105,10 +118,17 @@ func (w *WebM) Start(ctx context.Context, source hub.Source) error {
 	return nil
 }
 
+// Stop ends the recording without ending the stream, the file is written in the background.
+func (w *WebM) Stop() {
+	if w.sub != nil {
+		w.sub.Close()
+	}
+}
+
 // createNewMuxer initializes a new EBMLMuxer
 func (w *WebM) createNewMuxer(ctx context.Context, audioClockRate int) error {
 	// Initialize new muxer
-	w.webmMuxer = NewEBMLMuxer(audioClockRate, 2, ContainerMKV)
+	w.webmMuxer = NewEBMLMuxer(audioClockRate, 2, w.container, w.videoCodecID)
 	err := w.webmMuxer.Init(ctx)
 	if err != nil {
 		return err
@@ -121,13 +141,12 @@ func (w *WebM) closeMuxer(ctx context.Context) {
 	if w.webmMuxer != nil {
 		// Create output file with timestamp
 		timestamp := time.Now().Format("2006-01-02-15-04-05")
-		fileName := fmt.Sprintf("videos/%s_%s.mkv", w.streamID, timestamp)
+		fileName := fmt.Sprintf("videos/%s_%s.%s", w.streamID, timestamp, w.container)
 		outputFile, err := record.CreateFileInDir(fileName)
 		if err != nil {
 			log.Error(ctx, err, "failed to create output file")
 			return
 		}
-		defer outputFile.Close()
 
 		// Finalize muxer with output file
 		err = w.webmMuxer.Finalize(ctx, outputFile)
@@ -135,6 +154,13 @@ func (w *WebM) closeMuxer(ctx context.Context) {
 			log.Error(ctx, err, "failed to finalize muxer")
 		}
 		w.webmMuxer = nil
+		if closeErr := outputFile.Close(); closeErr != nil {
+			log.Error(ctx, closeErr, "failed to close output file")
+			return
+		}
+		if err == nil && w.onFile != nil {
+			w.onFile(record.NewFile(w.streamID, string(w.container), fileName))
+		}
 	}
 }
 
@@ -150,15 +176,34 @@ func (w *WebM) splitMuxer(ctx context.Context) error {
 	return w.createNewMuxer(ctx, int(audioClockRate))
 }
 
-func (w *WebM) onVideo(ctx context.Context, data *hub.H264Video) {
-	keyFrame := false
+// containerFor keeps H.264 in Matroska and writes the codecs of WebRTC publishers as WebM.
+func containerFor(specs []hub.MediaSpec) (Name, string, bool) {
+	switch {
+	case hub.HasCodecType(specs, hub.CodecTypeH264):
+		return ContainerMKV, codecIDH264, true
+	case hub.HasCodecType(specs, hub.CodecTypeVP8):
+		return ContainerWebM, codecIDVP8, true
+	case hub.HasCodecType(specs, hub.CodecTypeVP9):
+		return ContainerWebM, codecIDVP9, true
+	case hub.HasCodecType(specs, hub.CodecTypeAV1):
+		return ContainerWebM, codecIDAV1, true
+	}
+	return "", "", false
+}
+
+func isKeyFrame(data *hub.H264Video) bool {
 	for _, sliceType := range data.SliceTypes {
 		if sliceType == hub.SliceI {
-			keyFrame = true
-			break
+			return true
 		}
 	}
+	return false
+}
 
+func (w *WebM) onVideo(ctx context.Context, data []byte, keyFrame bool, rawPTS int64, rawDTS int64) {
+	if !w.splitPending && rawDTS-w.lastSplitTime >= w.splitIntervalMS {
+		w.splitPending = true
+	}
 	// If a split is pending and we have a keyframe, perform the split
 	if w.splitPending && keyFrame {
 		err := w.splitMuxer(ctx)
@@ -166,11 +211,11 @@ func (w *WebM) onVideo(ctx context.Context, data *hub.H264Video) {
 			log.Error(ctx, err, "failed to split webm file")
 			return
 		}
-		w.lastSplitTime = data.RawDTS()
+		w.lastSplitTime = rawDTS
 		w.splitPending = false // Reset the split pending flag
 	}
 
-	err := w.webmMuxer.WriteVideo(data.Data, keyFrame, uint64(data.RawPTS()-w.lastSplitTime), uint64(data.RawDTS()-w.lastSplitTime))
+	err := w.webmMuxer.WriteVideo(data, keyFrame, uint64(rawPTS-w.lastSplitTime), uint64(rawDTS-w.lastSplitTime))
 	if err != nil {
 		log.Error(ctx, err, "failed to write video")
 	}
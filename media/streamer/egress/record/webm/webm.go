@@ -29,6 +29,8 @@ const (
 
 const (
 	codecIDVP8  = "V_VP8"
+	codecIDVP9  = "V_VP9"
+	codecIDAV1  = "V_AV1"
 	codecIDH264 = "V_MPEG4/ISO/AVC"
 	codecIDOPUS = "A_OPUS"
 	codecIDAAC  = "A_AAC"
@@ -45,6 +47,7 @@ type EBMLMuxer struct {
 	writers          []mkvcore.BlockWriteCloser
 	tempFile         *os.File
 	container        Name
+	videoCodecID     string
 	audioSampleRate  float64
 	audioChannels    uint64
 	durationPos      int64
@@ -53,8 +56,9 @@ type EBMLMuxer struct {
 	videoStreamIndex int
 }
 
-func NewEBMLMuxer(sampleRate int, channels int, container Name) *EBMLMuxer {
+func NewEBMLMuxer(sampleRate int, channels int, container Name, videoCodecID string) *EBMLMuxer {
 	return &EBMLMuxer{
+		videoCodecID:    videoCodecID,
 		writers:         nil,
 		audioSampleRate: float64(sampleRate),
 		audioChannels:   uint64(channels),
@@ -88,7 +92,7 @@ func (w *EBMLMuxer) makeWebmWriters() ([]mkvcore.BlockWriteCloser, error) {
 			Name:        trackNameVideo,
 			TrackNumber: webmVideoTrackNumber,
 			TrackUID:    webmVideoTrackNumber,
-			CodecID:     codecIDVP8,
+			CodecID:     w.videoCodecID,
 			TrackType:   trackTypeVideo,
 			Video: &webm.Video{
 				PixelWidth:  1280,
@@ -157,7 +161,7 @@ func (w *EBMLMuxer) makeMKVWriters() ([]mkvcore.BlockWriteCloser, error) {
 				TrackUID:        webmVideoTrackNumber,
 				TrackType:       trackTypeVideo,
 				Name:            trackNameVideo,
-				CodecID:         codecIDH264,
+				CodecID:         w.videoCodecID,
 				DefaultDuration: 0,
 			},
 		},
@@ -0,0 +1,54 @@
+package rtsp
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sirupsen/logrus"
+
+	"liveflow/log"
+	"liveflow/media/hub"
+	"liveflow/media/streamer/fields"
+)
+
+var ErrUnsupportedCodec = errors.New("unsupported codec")
+
+type RTSPArgs struct {
+	Hub    *hub.Hub
+	Server *Server
+}
+
+// RTSP makes a source available to the clients of the RTSP server.
+type RTSP struct {
+	hub    *hub.Hub
+	server *Server
+}
+
+func NewRTSP(args RTSPArgs) *RTSP {
+	return &RTSP{
+		hub:    args.Hub,
+		server: args.Server,
+	}
+}
+
+func (r *RTSP) Start(ctx context.Context, source hub.Source) error {
+	st, err := newStream(source)
+	if err != nil {
+		return err
+	}
+	ctx = log.WithFields(ctx, logrus.Fields{
+		fields.StreamID:   source.StreamID(),
+		fields.SourceName: source.Name(),
+	})
+	log.Info(ctx, "start rtsp")
+	sub := r.hub.SubscribeWithOptions(source.StreamID(), hub.SubscribeOptions{Name: "rtsp", ReplayGOP: true})
+	r.server.addStream(st)
+	go func() {
+		defer r.server.removeStream(st)
+		for data := range sub.Frames() {
+			st.onFrame(ctx, data)
+		}
+		log.Info(ctx, "end rtsp")
+	}()
+	return nil
+}
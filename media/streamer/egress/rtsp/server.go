@@ -0,0 +1,360 @@
+package rtsp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"liveflow/auth"
+	"liveflow/log"
+	"liveflow/media/streamer/rtspbase"
+)
+
+var ErrStreamNotFound = errors.New("rtsp stream not found")
+
+const (
+	describeTimeout = 5 * time.Second
+	sessionTimeout  = 60 * time.Second
+	publicMethods   = "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"
+)
+
+// Server serves the published streams at rtsp://host:port/<streamID>.
+type Server struct {
+	port     int
+	rtpPort  int
+	rtcpPort int
+	playback *auth.PlaybackVerifier
+
+	mu       sync.RWMutex
+	streams  map[string]*stream
+	rtpConn  *net.UDPConn
+	rtcpConn *net.UDPConn
+}
+
+type ServerArgs struct {
+	Port int
+	// RTPPort and RTCPPort are the server ports of UDP sessions.
+	RTPPort  int
+	RTCPPort int
+	// Playback checks the token of every viewer, rtsp://host:port/<streamID>?token=<token>, viewers need none when
+	// it is nil.
+	Playback *auth.PlaybackVerifier
+}
+
+func NewServer(args ServerArgs) *Server {
+	return &Server{
+		port:     args.Port,
+		rtpPort:  args.RTPPort,
+		rtcpPort: args.RTCPPort,
+		playback: args.Playback,
+		streams:  map[string]*stream{},
+	}
+}
+
+func (s *Server) Serve(ctx context.Context) error {
+	var err error
+	if s.rtpConn, err = net.ListenUDP("udp", &net.UDPAddr{Port: s.rtpPort}); err != nil {
+		return err
+	}
+	defer s.rtpConn.Close()
+	if s.rtcpConn, err = net.ListenUDP("udp", &net.UDPAddr{Port: s.rtcpPort}); err != nil {
+		return err
+	}
+	defer s.rtcpConn.Close()
+	go discardUDP(s.rtcpConn)
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(s.port))
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	log.Infof(ctx, "rtsp server listening on %d", s.port)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.handleConn(ctx, conn)
+	}
+}
+
+func (s *Server) addStream(st *stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.streams[st.streamID]; ok {
+		old.close()
+	}
+	s.streams[st.streamID] = st
+}
+
+func (s *Server) removeStream(st *stream) {
+	s.mu.Lock()
+	if s.streams[st.streamID] == st {
+		delete(s.streams, st.streamID)
+	}
+	s.mu.Unlock()
+	st.close()
+}
+
+func (s *Server) stream(streamID string) *stream {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.streams[streamID]
+}
+
+// serverConn is the control connection of a client, it owns at most one session.
+type serverConn struct {
+	server  *Server
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+	session *session
+	// authorized is the stream whose playback token the client has shown on this connection.
+	authorized string
+}
+
+func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
+	c := &serverConn{
+		server: s,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+	defer func() {
+		if c.session != nil {
+			c.session.close()
+		}
+		conn.Close()
+	}()
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return
+		}
+		// Interleaved RTCP receiver reports of TCP clients.
+		if b[0] == rtspbase.InterleavedSign {
+			if _, _, err := rtspbase.ReadInterleavedFrame(c.reader); err != nil {
+				return
+			}
+			continue
+		}
+		req, err := rtspbase.ReadRequest(c.reader)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Warnf(ctx, "failed to read rtsp request: %v", err)
+			}
+			return
+		}
+		res, onSent := c.handleRequest(ctx, req)
+		c.writeMu.Lock()
+		err = res.Write(conn)
+		c.writeMu.Unlock()
+		if err != nil {
+			return
+		}
+		if onSent != nil {
+			onSent()
+		}
+	}
+}
+
+// handleRequest returns the response and an optional action to run once the response is sent.
+func (c *serverConn) handleRequest(ctx context.Context, req *rtspbase.Request) (*rtspbase.Response, func()) {
+	cseq := req.Header.Get("CSeq")
+	streamID, control, err := parsePath(req.URL)
+	if err != nil {
+		return rtspbase.NewResponse(400, cseq), nil
+	}
+	switch req.Method {
+	case rtspbase.MethodOptions:
+		res := rtspbase.NewResponse(200, cseq)
+		res.Header.Set("Public", publicMethods)
+		return res, nil
+	case rtspbase.MethodDescribe:
+		if !c.authorize(ctx, req, streamID) {
+			return rtspbase.NewResponse(401, cseq), nil
+		}
+		return c.describe(req, cseq, streamID), nil
+	case rtspbase.MethodSetup:
+		if !c.authorize(ctx, req, streamID) {
+			return rtspbase.NewResponse(401, cseq), nil
+		}
+		return c.setup(req, cseq, streamID, control), nil
+	case rtspbase.MethodPlay:
+		if c.session == nil || len(c.session.transports) == 0 {
+			return rtspbase.NewResponse(454, cseq), nil
+		}
+		res := rtspbase.NewResponse(200, cseq)
+		res.Header.Set("Session", c.session.id)
+		sess := c.session
+		return res, func() {
+			log.Infof(ctx, "rtsp session %s started playing %s", sess.id, sess.stream.streamID)
+			sess.start()
+		}
+	case rtspbase.MethodTeardown:
+		if c.session != nil {
+			c.session.close()
+			c.session = nil
+		}
+		return rtspbase.NewResponse(200, cseq), nil
+	case rtspbase.MethodGetParameter:
+		res := rtspbase.NewResponse(200, cseq)
+		if c.session != nil {
+			res.Header.Set("Session", c.session.id)
+		}
+		return res, nil
+	default:
+		return rtspbase.NewResponse(405, cseq), nil
+	}
+}
+
+// authorize checks the playback token in the query of the request URL. Clients send it with DESCRIBE and build the
+// SETUP URLs from the Content-Base without it, so a stream stays authorized for the rest of the connection.
+func (c *serverConn) authorize(ctx context.Context, req *rtspbase.Request, streamID string) bool {
+	if c.server.playback == nil {
+		return true
+	}
+	token := ""
+	if u, err := url.Parse(req.URL); err == nil {
+		token = u.Query().Get(auth.PlaybackTokenParam)
+	}
+	if token == "" && c.authorized == streamID {
+		return true
+	}
+	remoteIP, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err := c.server.playback.Verify(token, streamID, remoteIP); err != nil {
+		log.Warnf(ctx, "rejected rtsp viewer of %s: %v", streamID, err)
+		return false
+	}
+	c.authorized = streamID
+	return true
+}
+
+func (c *serverConn) describe(req *rtspbase.Request, cseq string, streamID string) *rtspbase.Response {
+	st := c.server.stream(streamID)
+	if st == nil {
+		return rtspbase.NewResponse(404, cseq)
+	}
+	// SPS/PPS and the AAC config are only known after the first frames.
+	select {
+	case <-st.ready:
+	case <-st.closed:
+		return rtspbase.NewResponse(404, cseq)
+	case <-time.After(describeTimeout):
+		return rtspbase.NewResponse(404, cseq)
+	}
+	host, _, _ := net.SplitHostPort(c.conn.LocalAddr().String())
+	res := rtspbase.NewResponse(200, cseq)
+	res.Header.Set("Content-Type", "application/sdp")
+	res.Header.Set("Content-Base", contentBase(req.URL))
+	res.Body = st.sdp(host)
+	return res
+}
+
+func (c *serverConn) setup(req *rtspbase.Request, cseq string, streamID string, control string) *rtspbase.Response {
+	st := c.server.stream(streamID)
+	if st == nil {
+		return rtspbase.NewResponse(404, cseq)
+	}
+	t := st.trackByControl(control)
+	if t == nil {
+		return rtspbase.NewResponse(404, cseq)
+	}
+	if c.session != nil && c.session.stream != st {
+		return rtspbase.NewResponse(455, cseq)
+	}
+	transport, err := rtspbase.ParseTransport(req.Header.Get("Transport"))
+	if err != nil {
+		return rtspbase.NewResponse(461, cseq)
+	}
+	switch transport.Protocol {
+	case rtspbase.ProtocolTCP:
+		if len(transport.Interleaved) != 2 {
+			transport.Interleaved = []int{2 * t.index, 2*t.index + 1}
+		}
+	case rtspbase.ProtocolUDP:
+		if len(transport.ClientPort) != 2 {
+			return rtspbase.NewResponse(461, cseq)
+		}
+		transport.ServerPort = []int{c.server.rtpPort, c.server.rtcpPort}
+	}
+	transport.Unicast = true
+	if c.session == nil {
+		remoteIP := c.conn.RemoteAddr().(*net.TCPAddr).IP
+		c.session = &session{
+			id:         randomSessionID(),
+			stream:     st,
+			conn:       c.conn,
+			writeMu:    &c.writeMu,
+			udpConn:    c.server.rtpConn,
+			remoteIP:   remoteIP,
+			transports: map[int]rtspbase.Transport{},
+			packets:    make(chan outPacket, sessionQueueSize),
+			done:       make(chan struct{}),
+		}
+	}
+	c.session.transports[t.index] = transport
+	res := rtspbase.NewResponse(200, cseq)
+	res.Header.Set("Transport", transport.String())
+	res.Header.Set("Session", c.session.id+";timeout="+strconv.Itoa(int(sessionTimeout.Seconds())))
+	return res
+}
+
+// parsePath splits rtsp://host/<streamID>[/trackID=N] into the stream id and the track control.
+func parsePath(rawURL string) (string, string, error) {
+	if rawURL == "*" {
+		return "", "", nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+	path := strings.Trim(u.Path, "/")
+	if i := strings.LastIndex(path, "/"); i >= 0 && strings.HasPrefix(path[i+1:], "trackID=") {
+		return path[:i], path[i+1:], nil
+	}
+	return path, "", nil
+}
+
+// contentBase is the URL the track controls are relative to, without the query of the DESCRIBE URL.
+func contentBase(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		u.RawQuery = ""
+		rawURL = u.String()
+	}
+	return strings.TrimSuffix(rawURL, "/") + "/"
+}
+
+func discardUDP(conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := conn.ReadFromUDP(buf); err != nil {
+			return
+		}
+	}
+}
+
+func randomSessionID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func randomUint32() uint32 {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
@@ -0,0 +1,204 @@
+package rtsp
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"liveflow/auth"
+	"liveflow/media/hub"
+	"liveflow/media/streamer/rtspbase"
+)
+
+const testSecret = "s3cret"
+
+type testSource struct {
+	streamID string
+}
+
+func (s *testSource) Name() string {
+	return "test"
+}
+
+func (s *testSource) MediaSpecs() []hub.MediaSpec {
+	return []hub.MediaSpec{{MediaType: hub.Audio, ClockRate: opusClockRate, CodecType: hub.CodecTypeOpus}}
+}
+
+func (s *testSource) StreamID() string {
+	return s.streamID
+}
+
+func (s *testSource) Depth() int {
+	return 0
+}
+
+// newTestConn returns the server side of a client connection to a server that plays an opus stream.
+func newTestConn(t *testing.T, playback *auth.PlaybackVerifier) *serverConn {
+	t.Helper()
+	s := NewServer(ServerArgs{Playback: playback})
+	st, err := newStream(&testSource{streamID: "stream"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addStream(st)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &serverConn{
+		server: s,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+	t.Cleanup(func() {
+		if c.session != nil {
+			c.session.close()
+		}
+		conn.Close()
+		client.Close()
+	})
+	return c
+}
+
+func request(c *serverConn, method string, url string) *rtspbase.Response {
+	req := &rtspbase.Request{
+		Method: method,
+		URL:    url,
+		Header: rtspbase.Header{"CSeq": "1"},
+	}
+	if method == rtspbase.MethodSetup {
+		req.Header.Set("Transport", "RTP/AVP/TCP;unicast;interleaved=0-1")
+	}
+	res, _ := c.handleRequest(context.Background(), req)
+	return res
+}
+
+func token(t *testing.T, claims auth.PlaybackClaims) string {
+	t.Helper()
+	claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	token, err := auth.SignPlaybackToken(testSecret, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestPlaybackToken(t *testing.T) {
+	valid := token(t, auth.PlaybackClaims{StreamID: "stream"})
+	tests := []struct {
+		name     string
+		playback *auth.PlaybackVerifier
+		query    string
+		describe int
+	}{
+		{name: "open", describe: 200},
+		{name: "no token", playback: auth.NewPlaybackVerifier(testSecret), describe: 401},
+		{name: "valid", playback: auth.NewPlaybackVerifier(testSecret), query: "?token=" + valid, describe: 200},
+		{
+			name:     "other stream",
+			playback: auth.NewPlaybackVerifier(testSecret),
+			query:    "?token=" + token(t, auth.PlaybackClaims{StreamID: "other"}),
+			describe: 401,
+		},
+		{
+			name:     "bound to the viewer address",
+			playback: auth.NewPlaybackVerifier(testSecret),
+			query:    "?token=" + token(t, auth.PlaybackClaims{StreamID: "stream", IP: "127.0.0.1"}),
+			describe: 200,
+		},
+		{
+			name:     "bound to another address",
+			playback: auth.NewPlaybackVerifier(testSecret),
+			query:    "?token=" + token(t, auth.PlaybackClaims{StreamID: "stream", IP: "192.0.2.1"}),
+			describe: 401,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConn(t, tt.playback)
+			res := request(c, rtspbase.MethodDescribe, "rtsp://127.0.0.1:8554/stream"+tt.query)
+			if res.StatusCode != tt.describe {
+				t.Fatalf("describe status %d, want %d", res.StatusCode, tt.describe)
+			}
+			if res.StatusCode != 200 {
+				// SETUP without DESCRIBE needs the token as well
+				if res := request(c, rtspbase.MethodSetup, "rtsp://127.0.0.1:8554/stream/trackID=1"); res.StatusCode != 401 {
+					t.Fatalf("setup status %d, want 401", res.StatusCode)
+				}
+				return
+			}
+			// the client builds the SETUP URL from the Content-Base, which has no token
+			base := res.Header.Get("Content-Base")
+			if base != "rtsp://127.0.0.1:8554/stream/" {
+				t.Fatalf("content base %q", base)
+			}
+			if res := request(c, rtspbase.MethodSetup, base+"trackID=1"); res.StatusCode != 200 {
+				t.Fatalf("setup status %d after describe", res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestPlaybackTokenIsPerStream(t *testing.T) {
+	c := newTestConn(t, auth.NewPlaybackVerifier(testSecret))
+	st, err := newStream(&testSource{streamID: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.server.addStream(st)
+	if res := request(c, rtspbase.MethodDescribe, "rtsp://127.0.0.1:8554/stream?token="+token(t, auth.PlaybackClaims{StreamID: "stream"})); res.StatusCode != 200 {
+		t.Fatalf("describe status %d", res.StatusCode)
+	}
+	// the token of one stream does not open another one on the same connection
+	if res := request(c, rtspbase.MethodDescribe, "rtsp://127.0.0.1:8554/other"); res.StatusCode != 401 {
+		t.Fatalf("describe of another stream status %d, want 401", res.StatusCode)
+	}
+	if res := request(c, rtspbase.MethodSetup, "rtsp://127.0.0.1:8554/other/trackID=1"); res.StatusCode != 401 {
+		t.Fatalf("setup of another stream status %d, want 401", res.StatusCode)
+	}
+}
+
+// The stream of a source is replaced on re-publish, takeover or standby promotion before the old one ends.
+func TestReplacedStreamIsRemovedLater(t *testing.T) {
+	s := NewServer(ServerArgs{})
+	old, err := newStream(&testSource{streamID: "stream"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := newStream(&testSource{streamID: "stream"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addStream(old)
+	s.addStream(next)
+	select {
+	case <-old.closed:
+	default:
+		t.Fatal("the replaced stream was not closed")
+	}
+	s.removeStream(old)
+	if s.stream("stream") != next {
+		t.Fatal("removing the replaced stream removed the new one")
+	}
+	select {
+	case <-next.closed:
+		t.Fatal("removing the replaced stream closed the new one")
+	default:
+	}
+	s.removeStream(next)
+	if s.stream("stream") != nil {
+		t.Fatal("the stream is still served after its source ended")
+	}
+}
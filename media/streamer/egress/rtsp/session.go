@@ -0,0 +1,96 @@
+package rtsp
+
+import (
+	"net"
+	"sync"
+
+	"liveflow/media/hub"
+	"liveflow/media/streamer/rtspbase"
+)
+
+const sessionQueueSize = 1024
+
+type outPacket struct {
+	trackIndex int
+	data       []byte
+}
+
+// session is a playing RTSP client of a stream.
+type session struct {
+	id         string
+	stream     *stream
+	conn       net.Conn
+	writeMu    *sync.Mutex
+	udpConn    *net.UDPConn
+	remoteIP   net.IP
+	transports map[int]rtspbase.Transport
+
+	packets   chan outPacket
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Video is held back until a keyframe so that players can start decoding.
+	waitingKeyframe bool
+}
+
+func (s *session) start() {
+	for trackIndex := range s.transports {
+		if s.stream.tracks[trackIndex].codecType == hub.CodecTypeH264 {
+			s.waitingKeyframe = true
+		}
+	}
+	s.stream.addSession(s)
+	go s.writeLoop()
+}
+
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// writePacket queues a packet without blocking the hub; it is called with the stream lock held.
+func (s *session) writePacket(trackIndex int, b []byte, keyframe bool) {
+	if _, ok := s.transports[trackIndex]; !ok {
+		return
+	}
+	if s.stream.tracks[trackIndex].codecType == hub.CodecTypeH264 && s.waitingKeyframe {
+		if !keyframe {
+			return
+		}
+		s.waitingKeyframe = false
+	}
+	select {
+	case s.packets <- outPacket{trackIndex: trackIndex, data: b}:
+	default:
+		// The viewer is too slow, wait for the next keyframe to recover.
+		s.waitingKeyframe = true
+	}
+}
+
+func (s *session) writeLoop() {
+	defer s.stream.removeSession(s)
+	for {
+		select {
+		case <-s.done:
+			return
+		case p := <-s.packets:
+			if err := s.send(p); err != nil {
+				s.close()
+				s.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (s *session) send(p outPacket) error {
+	transport := s.transports[p.trackIndex]
+	if transport.Protocol == rtspbase.ProtocolTCP {
+		s.writeMu.Lock()
+		defer s.writeMu.Unlock()
+		return rtspbase.WriteInterleavedFrame(s.conn, transport.Interleaved[0], p.data)
+	}
+	_, err := s.udpConn.WriteToUDP(p.data, &net.UDPAddr{IP: s.remoteIP, Port: transport.ClientPort[0]})
+	return err
+}
@@ -0,0 +1,317 @@
+package rtsp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+
+	"liveflow/log"
+	"liveflow/media/hub"
+)
+
+const (
+	mtu               = 1400
+	h264PayloadType   = 96
+	aacPayloadType    = 97
+	opusPayloadType   = 111
+	h264ClockRate     = 90000
+	opusClockRate     = 48000
+	videoTrackControl = "trackID=0"
+	audioTrackControl = "trackID=1"
+)
+
+// streamTrack is the RTP state of a track shared by every viewer of a stream.
+type streamTrack struct {
+	index       int
+	codecType   hub.CodecType
+	payloadType uint8
+	clockRate   uint32
+	ssrc        uint32
+	sequencer   rtp.Sequencer
+	fmtp        string
+	rtpmap      string
+}
+
+// stream is a published source as seen by RTSP clients.
+type stream struct {
+	streamID string
+	tracks   []*streamTrack
+
+	mu        sync.Mutex
+	sessions  map[*session]struct{}
+	ready     chan struct{}
+	readyOnce sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	sps                   []byte
+	pps                   []byte
+	mpeg4AudioConfigBytes []byte
+	h264Payloader         codecs.H264Payloader
+}
+
+func newStream(source hub.Source) (*stream, error) {
+	s := &stream{
+		streamID: source.StreamID(),
+		sessions: map[*session]struct{}{},
+		ready:    make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	for _, spec := range source.MediaSpecs() {
+		t := &streamTrack{
+			index:     len(s.tracks),
+			codecType: spec.CodecType,
+			ssrc:      randomUint32(),
+			sequencer: rtp.NewRandomSequencer(),
+		}
+		switch spec.CodecType {
+		case hub.CodecTypeH264:
+			t.payloadType = h264PayloadType
+			t.clockRate = h264ClockRate
+		case hub.CodecTypeAAC:
+			t.payloadType = aacPayloadType
+			t.clockRate = spec.ClockRate
+		case hub.CodecTypeOpus:
+			t.payloadType = opusPayloadType
+			t.clockRate = opusClockRate
+			t.rtpmap = fmt.Sprintf("%d opus/%d/2", t.payloadType, t.clockRate)
+			t.fmtp = fmt.Sprintf("%d sprop-stereo=1", t.payloadType)
+		default:
+			continue
+		}
+		if s.track(spec.MediaType) != nil {
+			continue
+		}
+		s.tracks = append(s.tracks, t)
+	}
+	if len(s.tracks) == 0 {
+		return nil, ErrUnsupportedCodec
+	}
+	s.checkReady()
+	return s, nil
+}
+
+func (s *stream) track(mediaType hub.MediaType) *streamTrack {
+	for _, t := range s.tracks {
+		if (mediaType == hub.Video) == (t.codecType == hub.CodecTypeH264) {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *stream) trackByControl(control string) *streamTrack {
+	for _, t := range s.tracks {
+		if t.control() == control {
+			return t
+		}
+	}
+	return nil
+}
+
+func (t *streamTrack) control() string {
+	if t.codecType == hub.CodecTypeH264 {
+		return videoTrackControl
+	}
+	return audioTrackControl
+}
+
+// checkReady marks the stream describable once the SDP parameters of every track are known.
+func (s *stream) checkReady() {
+	for _, t := range s.tracks {
+		if t.rtpmap == "" {
+			return
+		}
+	}
+	s.readyOnce.Do(func() {
+		close(s.ready)
+	})
+}
+
+// sdp generates the session description served by DESCRIBE.
+func (s *stream) sdp(host string) []byte {
+	var b strings.Builder
+	b.WriteString("v=0\r\n")
+	fmt.Fprintf(&b, "o=- 0 0 IN IP4 %s\r\n", host)
+	fmt.Fprintf(&b, "s=%s\r\n", s.streamID)
+	b.WriteString("c=IN IP4 0.0.0.0\r\n")
+	b.WriteString("t=0 0\r\n")
+	b.WriteString("a=control:*\r\n")
+	for _, t := range s.tracks {
+		media := "audio"
+		if t.codecType == hub.CodecTypeH264 {
+			media = "video"
+		}
+		fmt.Fprintf(&b, "m=%s 0 RTP/AVP %d\r\n", media, t.payloadType)
+		fmt.Fprintf(&b, "a=rtpmap:%s\r\n", t.rtpmap)
+		if t.fmtp != "" {
+			fmt.Fprintf(&b, "a=fmtp:%s\r\n", t.fmtp)
+		}
+		fmt.Fprintf(&b, "a=control:%s\r\n", t.control())
+	}
+	return []byte(b.String())
+}
+
+func (s *stream) addSession(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[sess] = struct{}{}
+}
+
+func (s *stream) removeSession(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sess)
+}
+
+// close disconnects every viewer once the source is gone. A stream replaced by a new one is closed again when its
+// source ends.
+func (s *stream) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for sess := range s.sessions {
+			sess.close()
+		}
+	})
+}
+
+func (s *stream) onFrame(ctx context.Context, data *hub.FrameData) {
+	if data.H264Video != nil {
+		s.onVideo(ctx, data.H264Video)
+	}
+	if data.AACAudio != nil {
+		s.onAACAudio(data.AACAudio)
+	}
+	if data.OPUSAudio != nil {
+		s.onOPUSAudio(data.OPUSAudio)
+	}
+}
+
+func (s *stream) onVideo(ctx context.Context, video *hub.H264Video) {
+	t := s.track(hub.Video)
+	if t == nil {
+		return
+	}
+	if t.rtpmap == "" {
+		sps, pps := video.SPS, video.PPS
+		nalus, _ := h264parser.SplitNALUs(video.Data)
+		for _, nalu := range nalus {
+			if len(nalu) > 0 && nalu[0]&0x1f == h264parser.NALU_SPS {
+				sps = nalu
+			} else if len(nalu) > 0 && nalu[0]&0x1f == h264parser.NALU_PPS {
+				pps = nalu
+			}
+		}
+		if len(sps) < 4 || len(pps) == 0 {
+			return
+		}
+		s.sps = append([]byte{}, sps...)
+		s.pps = append([]byte{}, pps...)
+		t.fmtp = fmt.Sprintf("%d packetization-mode=1;profile-level-id=%s;sprop-parameter-sets=%s,%s",
+			t.payloadType, hex.EncodeToString(s.sps[1:4]),
+			base64.StdEncoding.EncodeToString(s.sps), base64.StdEncoding.EncodeToString(s.pps))
+		t.rtpmap = fmt.Sprintf("%d H264/%d", t.payloadType, t.clockRate)
+		s.checkReady()
+		log.Info(ctx, "rtsp stream is ready")
+	}
+	ts := rescale(video.PTS, video.VideoClockRate, t.clockRate)
+	payloads := s.h264Payloader.Payload(mtu, video.Data)
+	for i, payload := range payloads {
+		s.writePacket(t, ts, i == len(payloads)-1, payload, hasKeyframe(video))
+	}
+}
+
+func (s *stream) onAACAudio(audio *hub.AACAudio) {
+	t := s.track(hub.Audio)
+	if t == nil || t.codecType != hub.CodecTypeAAC || len(audio.Data) == 0 {
+		return
+	}
+	if t.rtpmap == "" {
+		if audio.MPEG4AudioConfig == nil || len(audio.MPEG4AudioConfigBytes) == 0 {
+			return
+		}
+		config := audio.MPEG4AudioConfig
+		s.mpeg4AudioConfigBytes = audio.MPEG4AudioConfigBytes
+		t.clockRate = uint32(config.SampleRate)
+		t.rtpmap = fmt.Sprintf("%d MPEG4-GENERIC/%d/%d", t.payloadType, t.clockRate, channelCount(config))
+		t.fmtp = fmt.Sprintf("%d streamtype=5;profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=%s",
+			t.payloadType, hex.EncodeToString(s.mpeg4AudioConfigBytes))
+		s.checkReady()
+	}
+	// RFC 3640 AAC-hbr with a single access unit per packet.
+	payload := make([]byte, 4+len(audio.Data))
+	binary.BigEndian.PutUint16(payload[0:2], 16)
+	binary.BigEndian.PutUint16(payload[2:4], uint16(len(audio.Data)<<3))
+	copy(payload[4:], audio.Data)
+	ts := rescale(audio.PTS, audio.AudioClockRate, t.clockRate)
+	s.writePacket(t, ts, true, payload, false)
+}
+
+func (s *stream) onOPUSAudio(audio *hub.OPUSAudio) {
+	t := s.track(hub.Audio)
+	if t == nil || t.codecType != hub.CodecTypeOpus || len(audio.Data) == 0 {
+		return
+	}
+	ts := rescale(audio.PTS, audio.AudioClockRate, t.clockRate)
+	s.writePacket(t, ts, true, audio.Data, false)
+}
+
+func (s *stream) writePacket(t *streamTrack, ts uint32, marker bool, payload []byte, keyframe bool) {
+	pkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         marker,
+			PayloadType:    t.payloadType,
+			SequenceNumber: t.sequencer.NextSequenceNumber(),
+			Timestamp:      ts,
+			SSRC:           t.ssrc,
+		},
+		Payload: payload,
+	}
+	b, err := pkt.Marshal()
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sess := range s.sessions {
+		sess.writePacket(t.index, b, keyframe)
+	}
+}
+
+func rescale(ts int64, from uint32, to uint32) uint32 {
+	if from == 0 || from == to {
+		return uint32(ts)
+	}
+	return uint32(ts * int64(to) / int64(from))
+}
+
+func hasKeyframe(video *hub.H264Video) bool {
+	for _, sliceType := range video.SliceTypes {
+		if sliceType == hub.SliceI {
+			return true
+		}
+	}
+	return false
+}
+
+func channelCount(config *aacparser.MPEG4AudioConfig) int {
+	if config.ChannelLayout != 0 {
+		return config.ChannelLayout.Count()
+	}
+	if config.ChannelConfig > 0 {
+		return int(config.ChannelConfig)
+	}
+	return 2
+}
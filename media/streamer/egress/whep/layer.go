@@ -0,0 +1,184 @@
+package whep
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+
+	"liveflow/media/hub"
+	"liveflow/media/streamer/av1"
+)
+
+const (
+	videoClockRate = 90000
+	// the bitrate of a layer is measured over this window.
+	layerBitrateWindow = 2 * time.Second
+	// a layer may use this share of the bandwidth estimate of a viewer, the rest is left to audio and retransmissions.
+	layerHeadroom = 0.85
+	// adaptInterval is how often viewers in auto mode pick a layer.
+	adaptInterval = time.Second
+	// a REMB older than this is not used anymore.
+	rembTimeout = 5 * time.Second
+	// keyFrameRequestInterval limits the key frame requests a viewer sends to the source.
+	keyFrameRequestInterval = 500 * time.Millisecond
+)
+
+// layerInfo is a simulcast layer as viewers see it. A source without simulcast has a single layer named "".
+type layerInfo struct {
+	name string
+	// bitrate is in bits per second, zero until it has been measured.
+	bitrate int
+}
+
+// videoFrame is a video frame of any codec, split into the units the payloader takes.
+type videoFrame struct {
+	units     [][]byte
+	dts       int64
+	clockRate uint32
+	rawDTS    int64
+	keyFrame  bool
+}
+
+// newVideoFrame returns nil when data carries no video.
+func newVideoFrame(data *hub.FrameData) (*videoFrame, error) {
+	switch {
+	case data.H264Video != nil:
+		keyFrame := false
+		for _, sliceType := range data.H264Video.SliceTypes {
+			if sliceType == hub.SliceI {
+				keyFrame = true
+				break
+			}
+		}
+		return &videoFrame{
+			units:     [][]byte{data.H264Video.Data},
+			dts:       data.H264Video.DTS,
+			clockRate: data.H264Video.VideoClockRate,
+			rawDTS:    data.H264Video.RawDTS(),
+			keyFrame:  keyFrame,
+		}, nil
+	case data.VP8Video != nil:
+		return &videoFrame{
+			units:     [][]byte{data.VP8Video.Data},
+			dts:       data.VP8Video.DTS,
+			clockRate: data.VP8Video.VideoClockRate,
+			rawDTS:    data.VP8Video.RawDTS(),
+			keyFrame:  data.VP8Video.KeyFrame,
+		}, nil
+	case data.VP9Video != nil:
+		return &videoFrame{
+			units:     [][]byte{data.VP9Video.Data},
+			dts:       data.VP9Video.DTS,
+			clockRate: data.VP9Video.VideoClockRate,
+			rawDTS:    data.VP9Video.RawDTS(),
+			keyFrame:  data.VP9Video.KeyFrame,
+		}, nil
+	case data.AV1Video != nil:
+		obus, err := av1.Split(data.AV1Video.Data)
+		if err != nil {
+			return nil, err
+		}
+		return &videoFrame{
+			units:     obus,
+			dts:       data.AV1Video.DTS,
+			clockRate: data.AV1Video.VideoClockRate,
+			rawDTS:    data.AV1Video.RawDTS(),
+			keyFrame:  data.AV1Video.KeyFrame,
+		}, nil
+	}
+	return nil, nil
+}
+
+// layerPacketizer packetizes the video of one layer of a source.
+type layerPacketizer struct {
+	name          string
+	mimeType      string
+	packetizer    rtp.Packetizer
+	lastTimestamp int64
+
+	bitrateBytes int
+	bitrateTime  time.Time
+}
+
+func newLayerPacketizer(name string, mimeType string) *layerPacketizer {
+	return &layerPacketizer{
+		name:     name,
+		mimeType: mimeType,
+	}
+}
+
+// packetize packetizes the units of a frame with one timestamp, only the last packet of the frame has the marker.
+// Only the first packet of a key frame is marked as key frame, viewers switch layers there.
+func (l *layerPacketizer) packetize(frame *videoFrame) []*packetWithTimestamp {
+	if l.packetizer == nil {
+		ssrc := uint32(110)
+		const (
+			videoPayloadType = 96
+			mtu              = 1400
+		)
+		l.packetizer = rtp.NewPacketizer(mtu, videoPayloadType, ssrc, newVideoPayloader(l.mimeType), rtp.NewRandomSequencer(), frame.clockRate)
+	}
+
+	videoDuration := frame.dts - l.lastTimestamp
+	var videoPackets []*rtp.Packet
+	for i, unit := range frame.units {
+		samples := uint32(0)
+		if i == len(frame.units)-1 {
+			samples = uint32(videoDuration)
+		}
+		videoPackets = append(videoPackets, l.packetizer.Packetize(unit, samples)...)
+	}
+	l.lastTimestamp = frame.dts
+
+	ret := make([]*packetWithTimestamp, 0, len(videoPackets))
+	for i, packet := range videoPackets {
+		packet.Marker = i == len(videoPackets)-1
+		ret = append(ret, &packetWithTimestamp{
+			packet:    packet,
+			timestamp: uint32(frame.rawDTS),
+			layer:     l.name,
+			keyFrame:  frame.keyFrame && i == 0,
+		})
+	}
+	return ret
+}
+
+// measure adds n bytes and returns the bitrate once a window has passed.
+func (l *layerPacketizer) measure(n int) (int, bool) {
+	now := time.Now()
+	if l.bitrateTime.IsZero() {
+		l.bitrateTime = now
+	}
+	l.bitrateBytes += n
+	elapsed := now.Sub(l.bitrateTime)
+	if elapsed < layerBitrateWindow {
+		return 0, false
+	}
+	bitrate := int(float64(l.bitrateBytes*8) / elapsed.Seconds())
+	l.bitrateBytes = 0
+	l.bitrateTime = now
+	return bitrate, true
+}
+
+// pickLayer returns the highest measured layer that fits in the bandwidth estimate, or the lowest one when none fits.
+func pickLayer(layers []layerInfo, estimate int) (string, bool) {
+	best, lowest := -1, -1
+	for i, layer := range layers {
+		if layer.bitrate <= 0 {
+			continue
+		}
+		if lowest < 0 || layer.bitrate < layers[lowest].bitrate {
+			lowest = i
+		}
+		if float64(layer.bitrate) <= float64(estimate)*layerHeadroom && (best < 0 || layer.bitrate > layers[best].bitrate) {
+			best = i
+		}
+	}
+	if best < 0 {
+		best = lowest
+	}
+	if best < 0 {
+		return "", false
+	}
+	return layers[best].name, true
+}
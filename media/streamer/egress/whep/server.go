@@ -0,0 +1,540 @@
+package whep
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/sirupsen/logrus"
+
+	"liveflow/auth"
+	"liveflow/log"
+	"liveflow/media/hub"
+	"liveflow/media/streamer/fields"
+	"liveflow/media/streamer/trickle"
+)
+
+var (
+	errNoStreamKey = echo.NewHTTPError(http.StatusUnauthorized, "No stream key provided")
+)
+
+var (
+	peerConnectionConfiguration = webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		},
+	}
+)
+
+// maxGOPPackets bounds the cached GOP of a layer, a longer GOP is not cached.
+// The hub caches the GOP as frames for new subscriptions, its gopCache tells why viewers need the packets.
+const maxGOPPackets = 4096
+
+// Server accepts WHEP viewers at /whep and keeps a session per viewer.
+// PATCH /whep/<sessionID> trickles ICE candidates or restarts ICE,
+// a session ends with DELETE /whep/<sessionID> or when its ICE connection fails.
+// Viewers of a simulcast stream pick a layer with /whep?layer=<rid>, without it they follow their bandwidth estimate.
+// Key frame requests of viewers go to the source through the hub, the cached GOP is replayed to new viewers of
+// sources that cannot take them.
+type Server struct {
+	echo          *echo.Echo
+	hub           *hub.Hub
+	dockerMode    bool
+	playback      *auth.PlaybackVerifier
+	onViewerJoin  func(SessionStats)
+	onViewerLeave func(SessionStats)
+
+	mu sync.RWMutex
+	// [sessionID]session
+	sessions map[string]*session
+	// [streamID][sessionID]session
+	streams map[string]map[string]*session
+	// [streamID]mime type of the video of the last publish, H.264 until the stream is published
+	videoMimeTypes map[string]string
+	// [streamID]layers of the last publish, the main layer first
+	layers map[string][]layerInfo
+	// [streamID][layer]packets since the last key frame
+	gops map[string]map[string][]*packetWithTimestamp
+}
+
+type ServerArgs struct {
+	Echo       *echo.Echo
+	Hub        *hub.Hub
+	DockerMode bool
+	// Playback checks the token of every viewer, /whep?token=<token>, viewers need none when it is nil.
+	Playback *auth.PlaybackVerifier
+	// OnViewerJoin and OnViewerLeave are called when a viewer is answered and when it is gone, they may be nil.
+	OnViewerJoin  func(SessionStats)
+	OnViewerLeave func(SessionStats)
+}
+
+func NewServer(args ServerArgs) *Server {
+	return &Server{
+		echo:           args.Echo,
+		hub:            args.Hub,
+		dockerMode:     args.DockerMode,
+		playback:       args.Playback,
+		onViewerJoin:   args.OnViewerJoin,
+		onViewerLeave:  args.OnViewerLeave,
+		sessions:       map[string]*session{},
+		streams:        map[string]map[string]*session{},
+		videoMimeTypes: map[string]string{},
+		layers:         map[string][]layerInfo{},
+		gops:           map[string]map[string][]*packetWithTimestamp{},
+	}
+}
+
+func (s *Server) RegisterRoute() {
+	s.echo.POST("/whep", s.handleOffer)
+	s.echo.PATCH("/whep/:sessionID", s.handlePatch)
+	s.echo.DELETE("/whep/:sessionID", s.handleDelete)
+}
+
+// Sessions returns the stats of the viewers of streamID.
+func (s *Server) Sessions(streamID string) []SessionStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ret []SessionStats
+	for _, sess := range s.streams[streamID] {
+		ret = append(ret, sess.stats())
+	}
+	return ret
+}
+
+// CloseSession ends a viewer as DELETE /whep/<sessionID> does, it reports false for an unknown session.
+func (s *Server) CloseSession(sessionID string) bool {
+	s.mu.RLock()
+	sess, ok := s.sessions[sessionID]
+	s.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	ctx := log.WithFields(context.Background(), logrus.Fields{
+		fields.StreamID: sess.streamID,
+	})
+	s.removeSession(ctx, sess)
+	return true
+}
+
+func (s *Server) addSession(sess *session) {
+	s.mu.Lock()
+	if sess.removed {
+		// ICE failed before the answer was sent
+		s.mu.Unlock()
+		return
+	}
+	s.sessions[sess.id] = sess
+	if s.streams[sess.streamID] == nil {
+		s.streams[sess.streamID] = map[string]*session{}
+	}
+	s.streams[sess.streamID][sess.id] = sess
+	s.mu.Unlock()
+	if s.onViewerJoin != nil {
+		s.onViewerJoin(sess.stats())
+	}
+}
+
+func (s *Server) removeSession(ctx context.Context, sess *session) {
+	s.mu.Lock()
+	_, added := s.sessions[sess.id]
+	sess.removed = true
+	delete(s.sessions, sess.id)
+	delete(s.streams[sess.streamID], sess.id)
+	if len(s.streams[sess.streamID]) == 0 {
+		delete(s.streams, sess.streamID)
+	}
+	s.mu.Unlock()
+	if sess.close() {
+		stats := sess.stats()
+		log.Infof(ctx, "whep session %s closed, sent %d packets (%d bytes)", sess.id, stats.PacketsSent, stats.BytesSent)
+		if added && s.onViewerLeave != nil {
+			s.onViewerLeave(stats)
+		}
+	}
+}
+
+func (s *Server) setVideoMimeType(streamID string, mimeType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.videoMimeTypes[streamID] = mimeType
+}
+
+func (s *Server) videoMimeType(streamID string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if mimeType, ok := s.videoMimeTypes[streamID]; ok {
+		return mimeType
+	}
+	return webrtc.MimeTypeH264
+}
+
+// setLayers is called for every publish, viewers whose layer is gone move to the main layer.
+func (s *Server) setLayers(streamID string, names []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	layers := make([]layerInfo, 0, len(names))
+	for _, name := range names {
+		layers = append(layers, layerInfo{name: name})
+	}
+	s.layers[streamID] = layers
+	delete(s.gops, streamID)
+	for _, sess := range s.streams[streamID] {
+		sess.resetLayer(names)
+	}
+}
+
+func (s *Server) setLayerBitrate(streamID string, name string, bitrate int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.layers[streamID] {
+		if s.layers[streamID][i].name == name {
+			s.layers[streamID][i].bitrate = bitrate
+		}
+	}
+}
+
+func (s *Server) layerInfos(streamID string) []layerInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]layerInfo(nil), s.layers[streamID]...)
+}
+
+// initialLayer returns the requested layer, or the main layer in auto mode when none is requested.
+// A requested layer that the current publish does not have falls back to the main layer.
+func (s *Server) initialLayer(streamID string, requested string) (string, bool) {
+	layers := s.layerInfos(streamID)
+	if requested == "" {
+		if len(layers) == 0 {
+			return "", true
+		}
+		return layers[0].name, true
+	}
+	if len(layers) == 0 {
+		// resetLayer checks the layer once the stream is published
+		return requested, false
+	}
+	for _, layer := range layers {
+		if layer.name == requested {
+			return requested, false
+		}
+	}
+	return layers[0].name, false
+}
+
+// adaptLayer moves a viewer in auto mode to the highest layer its bandwidth estimate can carry.
+func (s *Server) adaptLayer(sess *session) {
+	ticker := time.NewTicker(adaptInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sess.done:
+			return
+		case <-ticker.C:
+		}
+		estimate := sess.bandwidthEstimate()
+		if estimate <= 0 {
+			continue
+		}
+		if layer, ok := pickLayer(s.layerInfos(sess.streamID), estimate); ok && sess.setPendingLayer(layer) {
+			// switch at the next key frame of the layer instead of waiting for the periodic one
+			sess.requestKeyFrame()
+		}
+	}
+}
+
+// forwardKeyFrameRequests sends the key frame requests of a viewer to the source of the layer it waits for,
+// at most once per keyFrameRequestInterval. The source rate limits the requests of all viewers together.
+func (s *Server) forwardKeyFrameRequests(ctx context.Context, sess *session) {
+	var last time.Time
+	for {
+		select {
+		case <-sess.done:
+			return
+		case <-sess.keyFrameRequested:
+		}
+		if time.Since(last) < keyFrameRequestInterval {
+			continue
+		}
+		last = time.Now()
+		layer, videoSent := sess.waitedLayer()
+		err := s.hub.SendControl(s.layerStreamID(sess.streamID, layer), hub.ControlKeyFrameRequest)
+		if errors.Is(err, hub.ErrNoControlHandler) {
+			if !videoSent {
+				sess.replay(s.cachedGOP(sess.streamID, layer))
+			}
+			continue
+		}
+		if err != nil {
+			log.Error(ctx, err, "failed to request key frame")
+		}
+	}
+}
+
+// layerStreamID returns the stream ID a layer of streamID is published under.
+func (s *Server) layerStreamID(streamID string, layer string) string {
+	layers := s.layerInfos(streamID)
+	if len(layers) == 0 || layers[0].name == layer {
+		return streamID
+	}
+	return hub.RenditionStreamID(streamID, layer)
+}
+
+// cacheGOP keeps the packets of a layer from its last key frame on.
+func (s *Server) cacheGOP(streamID string, packet *packetWithTimestamp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gops[streamID] == nil {
+		s.gops[streamID] = map[string][]*packetWithTimestamp{}
+	}
+	gop := s.gops[streamID][packet.layer]
+	switch {
+	case packet.keyFrame:
+		gop = []*packetWithTimestamp{packet}
+	case len(gop) == 0:
+		return
+	case len(gop) >= maxGOPPackets:
+		gop = nil
+	default:
+		gop = append(gop, packet)
+	}
+	s.gops[streamID][packet.layer] = gop
+}
+
+func (s *Server) cachedGOP(streamID string, layer string) []*packetWithTimestamp {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*packetWithTimestamp(nil), s.gops[streamID][layer]...)
+}
+
+func (s *Server) removeGOPs(streamID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.gops, streamID)
+}
+
+func (s *Server) viewers(streamID string) []*session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make([]*session, 0, len(s.streams[streamID]))
+	for _, sess := range s.streams[streamID] {
+		ret = append(ret, sess)
+	}
+	return ret
+}
+
+func (s *Server) writeVideo(streamID string, packet *packetWithTimestamp) {
+	s.cacheGOP(streamID, packet)
+	mimeType := s.videoMimeType(streamID)
+	for _, sess := range s.viewers(streamID) {
+		// viewers that joined before a publish with another codec keep waiting for their codec
+		if sess.videoTrack.Codec().MimeType != mimeType {
+			continue
+		}
+		sess.writeVideo(packet)
+	}
+}
+
+func (s *Server) writeAudio(streamID string, packet *rtp.Packet) {
+	for _, sess := range s.viewers(streamID) {
+		sess.writeRTP(sess.audioTrack, packet)
+	}
+}
+
+func (s *Server) bearerToken(c echo.Context) (string, error) {
+	bearerToken := c.Request().Header.Get("Authorization")
+	if len(bearerToken) == 0 {
+		return "", errNoStreamKey
+	}
+	authHeaderParts := strings.Split(bearerToken, " ")
+	if len(authHeaderParts) != 2 {
+		return "", errNoStreamKey
+	}
+	return authHeaderParts[1], nil
+}
+
+func (s *Server) handleOffer(c echo.Context) error {
+	offer, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	streamKey, err := s.bearerToken(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, err.Error())
+	}
+	if s.playback != nil {
+		if err := s.playback.Verify(c.QueryParam(auth.PlaybackTokenParam), streamKey, c.RealIP()); err != nil {
+			log.Warnf(context.Background(), "rejected whep viewer of %s: %v", streamKey, err)
+			return c.JSON(http.StatusUnauthorized, err.Error())
+		}
+	}
+	sessionID, err := newSessionID()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	ctx := log.WithFields(context.Background(), logrus.Fields{
+		fields.StreamID: streamKey,
+	})
+
+	m := &webrtc.MediaEngine{}
+	if err := registerCodec(m); err != nil {
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	i := &interceptor.Registry{}
+	// the send side estimate follows the TWCC feedback of the viewer, the pacer is left out to send as before
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(gcc.SendSideBWEPacer(gcc.NewNoOpPacer()))
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	var estimator cc.BandwidthEstimator
+	congestionController.OnNewPeerConnection(func(_ string, e cc.BandwidthEstimator) {
+		estimator = e
+	})
+	i.Add(congestionController)
+	if err = webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBGoogREMB}, webrtc.RTPCodecTypeVideo)
+	if err = webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	se := webrtc.SettingEngine{}
+	se.SetEphemeralUDPPortRange(30000, 30500)
+	if s.dockerMode {
+		se.SetNAT1To1IPs([]string{"127.0.0.1"}, webrtc.ICECandidateTypeHost)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(se))
+	peerConnection, err := api.NewPeerConnection(peerConnectionConfiguration)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	layer, autoLayer := s.initialLayer(streamKey, c.QueryParam("layer"))
+	sess, err := newSession(sessionID, streamKey, s.videoMimeType(streamKey), layer, autoLayer, peerConnection)
+	if err != nil {
+		_ = peerConnection.Close()
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	sess.estimator = estimator
+	for _, track := range []*webrtc.TrackLocalStaticRTP{sess.videoTrack, sess.audioTrack} {
+		sender, err := peerConnection.AddTrack(track)
+		if err != nil {
+			_ = peerConnection.Close()
+			return c.JSON(http.StatusInternalServerError, err.Error())
+		}
+		// Read incoming RTCP packets so that the interceptors keep working
+		go sess.readRTCP(sender)
+	}
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		// the tracks are bound once DTLS is connected, a key frame before that would not reach the viewer
+		if state == webrtc.PeerConnectionStateConnected {
+			sess.requestKeyFrame()
+		}
+	})
+	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		log.Infof(ctx, "whep session %s ICE connection state: %s", sessionID, connectionState.String())
+		sess.state.Store(connectionState.String())
+		switch connectionState {
+		case webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateClosed:
+			s.removeSession(ctx, sess)
+		}
+	})
+
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)}); err != nil {
+		_ = peerConnection.Close()
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	// Create channel that is blocked until ICE Gathering is complete
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		_ = peerConnection.Close()
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	} else if err = peerConnection.SetLocalDescription(answer); err != nil {
+		_ = peerConnection.Close()
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
+	// Block until ICE Gathering is complete, disabling trickle ICE
+	<-gatherComplete
+
+	s.addSession(sess)
+	go s.forwardKeyFrameRequests(ctx, sess)
+	if autoLayer {
+		go s.adaptLayer(sess)
+	}
+	log.Infof(ctx, "whep session %s started on layer %q", sessionID, layer)
+	// WHEP expects a Location header and a HTTP Status Code of 201
+	c.Response().Header().Set("Location", "/whep/"+sessionID)
+	c.Response().Header().Set("ETag", trickle.ETag(peerConnection))
+	return c.Blob(http.StatusCreated, "application/sdp", []byte(peerConnection.LocalDescription().SDP))
+}
+
+func (s *Server) handlePatch(c echo.Context) error {
+	s.mu.RLock()
+	sess, ok := s.sessions[c.Param("sessionID")]
+	s.mu.RUnlock()
+	if !ok {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return trickle.HandlePatch(c, sess.pc)
+}
+
+func (s *Server) handleDelete(c echo.Context) error {
+	if !s.CloseSession(c.Param("sessionID")) {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+var videoCodecs = []webrtc.RTPCodecParameters{
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000},
+		PayloadType:        96,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		PayloadType:        97,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"},
+		PayloadType:        98,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000},
+		PayloadType:        45,
+	},
+}
+
+func registerCodec(m *webrtc.MediaEngine) error {
+	for _, codec := range videoCodecs {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	return m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		PayloadType:        111,
+	}, webrtc.RTPCodecTypeAudio)
+}
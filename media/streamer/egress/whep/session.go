@@ -0,0 +1,296 @@
+package whep
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// SessionStats is a snapshot of the counters of a viewer.
+type SessionStats struct {
+	ID        string
+	StreamID  string
+	StartedAt time.Time
+	State     string
+	// Layer is the simulcast layer the viewer receives, AutoLayer whether it follows the bandwidth estimate.
+	Layer       string
+	AutoLayer   bool
+	PacketsSent uint64
+	BytesSent   uint64
+	// WriteErrors counts packets the peer connection refused.
+	WriteErrors uint64
+	// KeyFrameRequests counts the PLIs and FIRs of the viewer.
+	KeyFrameRequests uint64
+}
+
+// session is one WHEP viewer. Every viewer has its own tracks, closing one viewer never touches the others.
+type session struct {
+	id         string
+	streamID   string
+	pc         *webrtc.PeerConnection
+	videoTrack *webrtc.TrackLocalStaticRTP
+	audioTrack *webrtc.TrackLocalStaticRTP
+	startedAt  time.Time
+
+	state       atomic.Value
+	packetsSent atomic.Uint64
+	bytesSent   atomic.Uint64
+	writeErrors atomic.Uint64
+	closeOnce   atomic.Bool
+	done        chan struct{}
+	// removed is guarded by the mutex of the server, a removed session is not added again.
+	removed bool
+
+	// keyFrameRequested wakes forwardKeyFrameRequests, requests that come while one is pending are merged.
+	keyFrameRequested chan struct{}
+	keyFrameRequests  atomic.Uint64
+
+	// layer is the layer the viewer receives, it switches to pendingLayer at the next key frame of that layer.
+	// Every layer has its own sequence numbers and timestamps, the offsets continue those of the previous layer.
+	// Video starts at a key frame, videoSent is false until then. Every publish starts its own sequence numbers
+	// and timestamps too, rebase is set until the first key frame of a new publish.
+	layerMu      sync.Mutex
+	layer        string
+	pendingLayer string
+	autoLayer    bool
+	videoSent    bool
+	rebase       bool
+	seqOffset    uint16
+	tsOffset     uint32
+	lastSeq      uint16
+	lastTS       uint32
+	lastVideo    time.Time
+
+	// estimator is the TWCC send side estimate, used once the viewer sends TWCC feedback.
+	estimator  cc.BandwidthEstimator
+	twccSeen   atomic.Bool
+	remb       atomic.Uint64
+	rembAtNano atomic.Int64
+}
+
+func newSession(id string, streamID string, videoMimeType string, layer string, autoLayer bool, pc *webrtc.PeerConnection) (*session, error) {
+	videoTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: videoMimeType}, "video", streamID)
+	if err != nil {
+		return nil, err
+	}
+	audioTrack, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", streamID)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		id:                id,
+		streamID:          streamID,
+		pc:                pc,
+		videoTrack:        videoTrack,
+		audioTrack:        audioTrack,
+		startedAt:         time.Now(),
+		done:              make(chan struct{}),
+		keyFrameRequested: make(chan struct{}, 1),
+		layer:             layer,
+		pendingLayer:      layer,
+		autoLayer:         autoLayer,
+	}
+	s.state.Store(webrtc.ICEConnectionStateNew.String())
+	return s, nil
+}
+
+func (s *session) writeRTP(track *webrtc.TrackLocalStaticRTP, packet *rtp.Packet) {
+	if err := track.WriteRTP(packet); err != nil {
+		s.writeErrors.Add(1)
+		return
+	}
+	s.packetsSent.Add(1)
+	s.bytesSent.Add(uint64(packet.MarshalSize()))
+}
+
+// writeVideo drops the packets of other layers and switches to the pending layer at its first key frame.
+// After a new publish it drops the packets until the first key frame, the offsets continue the last sent packet.
+func (s *session) writeVideo(p *packetWithTimestamp) {
+	s.layerMu.Lock()
+	switch {
+	case p.layer != s.layer:
+		if p.layer != s.pendingLayer || !p.keyFrame {
+			s.layerMu.Unlock()
+			return
+		}
+		s.layer = s.pendingLayer
+		s.rebaseOffsets(p.packet)
+	case s.rebase:
+		if !p.keyFrame {
+			s.layerMu.Unlock()
+			return
+		}
+		s.rebaseOffsets(p.packet)
+	}
+	packet, ok := s.rewrite(p)
+	s.layerMu.Unlock()
+	if ok {
+		s.writeRTP(s.videoTrack, packet)
+	}
+}
+
+// replay sends a cached GOP of the current layer to a viewer that has not received video yet.
+// The live packets continue its sequence numbers, those that were already replayed are dropped by rewrite.
+func (s *session) replay(packets []*packetWithTimestamp) {
+	s.layerMu.Lock()
+	defer s.layerMu.Unlock()
+	if s.videoSent {
+		return
+	}
+	for _, p := range packets {
+		if p.layer != s.layer {
+			continue
+		}
+		if packet, ok := s.rewrite(p); ok {
+			s.writeRTP(s.videoTrack, packet)
+		}
+	}
+}
+
+// rewrite is called with layerMu held. It applies the offsets of the layer and drops the packets
+// before the first key frame as well as those at or before the last sent one.
+func (s *session) rewrite(p *packetWithTimestamp) (*rtp.Packet, bool) {
+	if !s.videoSent && !p.keyFrame {
+		return nil, false
+	}
+	packet := *p.packet
+	packet.SequenceNumber += s.seqOffset
+	packet.Timestamp += s.tsOffset
+	if s.videoSent && int16(packet.SequenceNumber-s.lastSeq) <= 0 {
+		return nil, false
+	}
+	s.videoSent = true
+	s.lastSeq = packet.SequenceNumber
+	s.lastTS = packet.Timestamp
+	s.lastVideo = time.Now()
+	return &packet, true
+}
+
+// rebaseOffsets is called with layerMu held, packet is the key frame the viewer continues with.
+func (s *session) rebaseOffsets(packet *rtp.Packet) {
+	s.rebase = false
+	if !s.videoSent {
+		return
+	}
+	elapsed := uint32(time.Since(s.lastVideo).Seconds() * videoClockRate)
+	if elapsed == 0 {
+		elapsed = 1
+	}
+	s.seqOffset = s.lastSeq + 1 - packet.SequenceNumber
+	s.tsOffset = s.lastTS + elapsed - packet.Timestamp
+}
+
+// setPendingLayer reports whether the viewer now waits for a key frame of another layer.
+func (s *session) setPendingLayer(layer string) bool {
+	s.layerMu.Lock()
+	defer s.layerMu.Unlock()
+	changed := layer != s.pendingLayer && layer != s.layer
+	s.pendingLayer = layer
+	return changed
+}
+
+// waitedLayer returns the layer the viewer waits for a key frame of, and whether it has received video yet.
+func (s *session) waitedLayer() (string, bool) {
+	s.layerMu.Lock()
+	defer s.layerMu.Unlock()
+	return s.pendingLayer, s.videoSent
+}
+
+// requestKeyFrame never blocks, forwardKeyFrameRequests rate limits the requests of the viewer.
+func (s *session) requestKeyFrame() {
+	select {
+	case s.keyFrameRequested <- struct{}{}:
+	default:
+	}
+}
+
+// resetLayer moves the viewer to the main layer when a new publish does not have its layer.
+// The viewer continues with the first key frame of the new publish.
+func (s *session) resetLayer(layers []string) {
+	s.layerMu.Lock()
+	defer s.layerMu.Unlock()
+	s.rebase = s.videoSent
+	has := func(name string) bool {
+		for _, layer := range layers {
+			if layer == name {
+				return true
+			}
+		}
+		return false
+	}
+	if !has(s.layer) {
+		s.layer = layers[0]
+	}
+	if !has(s.pendingLayer) {
+		s.pendingLayer = s.layer
+	}
+}
+
+// readRTCP keeps the REMB of the viewer, notes whether it sends TWCC feedback and passes on its key frame requests.
+func (s *session) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			switch p := packet.(type) {
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				s.remb.Store(uint64(p.Bitrate))
+				s.rembAtNano.Store(time.Now().UnixNano())
+			case *rtcp.TransportLayerCC:
+				s.twccSeen.Store(true)
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				s.keyFrameRequests.Add(1)
+				s.requestKeyFrame()
+			}
+		}
+	}
+}
+
+// bandwidthEstimate returns the lower of the REMB and TWCC estimates in bits per second, zero when there is none.
+func (s *session) bandwidthEstimate() int {
+	estimate := 0
+	if time.Since(time.Unix(0, s.rembAtNano.Load())) < rembTimeout {
+		estimate = int(s.remb.Load())
+	}
+	if s.estimator != nil && s.twccSeen.Load() {
+		if target := s.estimator.GetTargetBitrate(); estimate == 0 || target < estimate {
+			estimate = target
+		}
+	}
+	return estimate
+}
+
+func (s *session) stats() SessionStats {
+	s.layerMu.Lock()
+	layer := s.layer
+	s.layerMu.Unlock()
+	return SessionStats{
+		ID:               s.id,
+		StreamID:         s.streamID,
+		StartedAt:        s.startedAt,
+		State:            s.state.Load().(string),
+		Layer:            layer,
+		AutoLayer:        s.autoLayer,
+		PacketsSent:      s.packetsSent.Load(),
+		BytesSent:        s.bytesSent.Load(),
+		WriteErrors:      s.writeErrors.Load(),
+		KeyFrameRequests: s.keyFrameRequests.Load(),
+	}
+}
+
+// close reports whether this call closed the session.
+func (s *session) close() bool {
+	if !s.closeOnce.CompareAndSwap(false, true) {
+		return false
+	}
+	close(s.done)
+	_ = s.pc.Close()
+	return true
+}
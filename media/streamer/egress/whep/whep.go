@@ -27,24 +27,24 @@ const (
 )
 
 type WHEPArgs struct {
-	Tracks map[string][]*webrtc.TrackLocalStaticRTP
 	Hub    *hub.Hub
+	Server *Server
 }
 type packetWithTimestamp struct {
 	packet    *rtp.Packet
 	timestamp uint32
+	// layer and keyFrame are only set on video packets
+	layer    string
+	keyFrame bool
 }
 
-// WHEP represents a WebRTC to HLS conversion pipeline.
+// WHEP packetizes a source once and sends the packets to every viewer of the Server.
 type WHEP struct {
 	hub                *hub.Hub
-	tracks             map[string][]*webrtc.TrackLocalStaticRTP
-	audioTrack         *webrtc.TrackLocalStaticRTP
-	videoTrack         *webrtc.TrackLocalStaticRTP
+	server             *Server
 	audioPacketizer    rtp.Packetizer
-	videoPacketizer    rtp.Packetizer
+	video              *layerPacketizer
 	lastAudioTimestamp int64
-	lastVideoTimestamp int64
 
 	videoBuffer []*packetWithTimestamp
 	audioBuffer []*packetWithTimestamp
@@ -53,7 +53,7 @@ type WHEP struct {
 func NewWHEP(args WHEPArgs) *WHEP {
 	return &WHEP{
 		hub:    args.Hub,
-		tracks: args.Tracks,
+		server: args.Server,
 	}
 }
 
@@ -61,7 +61,8 @@ func (w *WHEP) Start(ctx context.Context, source hub.Source) error {
 	if !hub.HasCodecType(source.MediaSpecs(), hub.CodecTypeOpus) && !hub.HasCodecType(source.MediaSpecs(), hub.CodecTypeAAC) {
 		return ErrUnsupportedCodec
 	}
-	if !hub.HasCodecType(source.MediaSpecs(), hub.CodecTypeH264) {
+	videoMimeType, ok := videoMimeType(source.MediaSpecs())
+	if !ok {
 		return ErrUnsupportedCodec
 	}
 	ctx = log.WithFields(ctx, logrus.Fields{
@@ -69,15 +70,35 @@ func (w *WHEP) Start(ctx context.Context, source hub.Source) error {
 		fields.SourceName: source.Name(),
 	})
 	log.Info(ctx, "start whep")
-	sub := w.hub.Subscribe(source.StreamID())
+	w.server.setVideoMimeType(source.StreamID(), videoMimeType)
+	renditions := hub.Renditions(source)
+	var layers []string
+	for _, rendition := range renditions {
+		layers = append(layers, rendition.Name)
+	}
+	if len(layers) == 0 {
+		layers = []string{""}
+	}
+	w.server.setLayers(source.StreamID(), layers)
+	w.video = newLayerPacketizer(layers[0], videoMimeType)
+	// the other simulcast layers are sent as they come, audio is synchronized with the main layer only
+	for _, rendition := range renditions {
+		if rendition.StreamID == source.StreamID() {
+			continue
+		}
+		go w.runLayer(ctx, source, newLayerPacketizer(rendition.Name, videoMimeType), w.hub.SubscribeWithOptions(rendition.StreamID, hub.SubscribeOptions{Name: "whep", ReplayGOP: true}).Frames())
+	}
+	sub := w.hub.SubscribeWithOptions(source.StreamID(), hub.SubscribeOptions{Name: "whep", ReplayGOP: true})
 	go func() {
+		defer w.server.removeGOPs(source.StreamID())
 		var audioTranscodingProcess *processes.AudioTranscodingProcess
-		for data := range sub {
-			if data.H264Video != nil {
-				err := w.onVideo(source, data.H264Video)
-				if err != nil {
-					log.Error(ctx, err, "failed to process video")
-				}
+		for data := range sub.Frames() {
+			frame, err := newVideoFrame(data)
+			if err == nil && frame != nil {
+				err = w.onVideo(source, frame)
+			}
+			if err != nil {
+				log.Error(ctx, err, "failed to process video")
 			}
 			if data.AACAudio != nil {
 				if audioTranscodingProcess == nil {
@@ -102,42 +123,74 @@ func (w *WHEP) Start(ctx context.Context, source hub.Source) error {
 	return nil
 }
 
-func (w *WHEP) onVideo(source hub.Source, h264Video *hub.H264Video) error {
-	if w.videoTrack == nil {
-		var err error
-		w.videoTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "pion")
-		if err != nil {
-			return err
-		}
-		w.tracks[source.StreamID()] = append(w.tracks[source.StreamID()], w.videoTrack)
-		ssrc := uint32(110)
-		const (
-			h264PayloadType = 96
-			mtu             = 1400
-		)
-		w.videoPacketizer = rtp.NewPacketizer(mtu, h264PayloadType, ssrc, &codecs.H264Payloader{}, rtp.NewRandomSequencer(), h264Video.VideoClockRate)
+// videoMimeType returns the mime type of the video codec viewers receive, the video is passed through as is.
+func videoMimeType(specs []hub.MediaSpec) (string, bool) {
+	switch {
+	case hub.HasCodecType(specs, hub.CodecTypeH264):
+		return webrtc.MimeTypeH264, true
+	case hub.HasCodecType(specs, hub.CodecTypeVP8):
+		return webrtc.MimeTypeVP8, true
+	case hub.HasCodecType(specs, hub.CodecTypeVP9):
+		return webrtc.MimeTypeVP9, true
+	case hub.HasCodecType(specs, hub.CodecTypeAV1):
+		return webrtc.MimeTypeAV1, true
 	}
+	return "", false
+}
 
-	videoDuration := h264Video.DTS - w.lastVideoTimestamp
-	videoPackets := w.videoPacketizer.Packetize(h264Video.Data, uint32(videoDuration))
-
-	for _, packet := range videoPackets {
-		w.videoBuffer = append(w.videoBuffer, &packetWithTimestamp{packet: packet, timestamp: uint32(h264Video.RawDTS())})
+func newVideoPayloader(mimeType string) rtp.Payloader {
+	switch mimeType {
+	case webrtc.MimeTypeVP8:
+		return &codecs.VP8Payloader{EnablePictureID: true}
+	case webrtc.MimeTypeVP9:
+		return &codecs.VP9Payloader{}
+	case webrtc.MimeTypeAV1:
+		// the payloader keeps the sequence header and sends it with the next frame
+		return &codecs.AV1Payloader{}
 	}
+	return &codecs.H264Payloader{}
+}
 
-	w.lastVideoTimestamp = h264Video.DTS
-	w.syncAndSendPackets()
+func (w *WHEP) onVideo(source hub.Source, frame *videoFrame) error {
+	w.videoBuffer = append(w.videoBuffer, w.video.packetize(frame)...)
+	w.measureLayer(source, w.video, frame)
+	w.syncAndSendPackets(source)
 	return nil
 }
 
-func (w *WHEP) onAudio(source hub.Source, opusAudio *hub.OPUSAudio) error {
-	if w.audioTrack == nil {
-		var err error
-		w.audioTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "pion")
+// runLayer sends a simulcast layer other than the main one to the viewers that receive it.
+func (w *WHEP) runLayer(ctx context.Context, source hub.Source, layer *layerPacketizer, sub <-chan *hub.FrameData) {
+	ctx = log.WithFields(ctx, logrus.Fields{
+		fields.Rendition: layer.name,
+	})
+	for data := range sub {
+		frame, err := newVideoFrame(data)
 		if err != nil {
-			return err
+			log.Error(ctx, err, "failed to process video")
+			continue
+		}
+		if frame == nil {
+			continue
+		}
+		for _, packet := range layer.packetize(frame) {
+			w.server.writeVideo(source.StreamID(), packet)
 		}
-		w.tracks[source.StreamID()] = append(w.tracks[source.StreamID()], w.audioTrack)
+		w.measureLayer(source, layer, frame)
+	}
+}
+
+func (w *WHEP) measureLayer(source hub.Source, layer *layerPacketizer, frame *videoFrame) {
+	n := 0
+	for _, unit := range frame.units {
+		n += len(unit)
+	}
+	if bitrate, ok := layer.measure(n); ok {
+		w.server.setLayerBitrate(source.StreamID(), layer.name, bitrate)
+	}
+}
+
+func (w *WHEP) onAudio(source hub.Source, opusAudio *hub.OPUSAudio) error {
+	if w.audioPacketizer == nil {
 		ssrc := uint32(111)
 		const (
 			opusPayloadType = 111
@@ -154,14 +207,11 @@ func (w *WHEP) onAudio(source hub.Source, opusAudio *hub.OPUSAudio) error {
 	}
 
 	w.lastAudioTimestamp = opusAudio.DTS
-	err := w.syncAndSendPackets()
-	if err != nil {
-		return err
-	}
+	w.syncAndSendPackets(source)
 	return nil
 }
 
-func (w *WHEP) syncAndSendPackets() error {
+func (w *WHEP) syncAndSendPackets(source hub.Source) {
 	for len(w.videoBuffer) > 0 && len(w.audioBuffer) > 0 {
 		videoPacket := w.videoBuffer[0]
 		audioPacket := w.audioBuffer[0]
@@ -169,18 +219,13 @@ func (w *WHEP) syncAndSendPackets() error {
 		if videoPacket.timestamp <= audioPacket.timestamp {
 			// If audio is ahead, remove video from buffer
 			w.videoBuffer = w.videoBuffer[1:]
-			if err := w.videoTrack.WriteRTP(videoPacket.packet); err != nil {
-				return err
-			}
+			w.server.writeVideo(source.StreamID(), videoPacket)
 		} else {
 			// If video is ahead, remove audio from buffer
 			w.audioBuffer = w.audioBuffer[1:]
-			if err := w.audioTrack.WriteRTP(audioPacket.packet); err != nil {
-				return err
-			}
+			w.server.writeAudio(source.StreamID(), audioPacket.packet)
 		}
 	}
-	return nil
 }
 
 func abs(x int64) int64 {
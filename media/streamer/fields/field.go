@@ -3,4 +3,5 @@ package fields
 const (
 	StreamID   = "liveflow_stream_id"
 	SourceName = "liveflow_source_name"
+	Rendition  = "liveflow_rendition"
 )
@@ -3,30 +3,32 @@ package rtmp
 import (
 	"bytes"
 	"context"
-	"fmt"
 	"io"
 	"liveflow/media/streamer/ingress"
-	"os"
-	"path/filepath"
+	"net"
 
 	"github.com/deepch/vdk/codec/aacparser"
 	"github.com/deepch/vdk/codec/h264parser"
 	"github.com/pkg/errors"
-	"github.com/yutopp/go-flv"
 	flvtag "github.com/yutopp/go-flv/tag"
 	"github.com/yutopp/go-rtmp"
 	rtmpmsg "github.com/yutopp/go-rtmp/message"
 
+	"liveflow/auth"
 	"liveflow/log"
 	"liveflow/media/hub"
 )
 
+// statusChunkStreamID is the chunk stream the status of a rejected publish is sent on.
+const statusChunkStreamID = 5
+
 type Handler struct {
-	hub      *hub.Hub
-	streamID string
+	hub        *hub.Hub
+	conn       net.Conn
+	rtmpConn   *rtmp.Conn
+	authorizer auth.Authorizer
+	streamID   string
 	rtmp.DefaultHandler
-	flvFile *os.File
-	flvEnc  *flv.Encoder
 
 	width  int
 	height int
@@ -57,7 +59,13 @@ func (h *Handler) StreamID() string {
 	return h.streamID
 }
 
+// Close disconnects the publisher, OnClose unpublishes the stream once the connection is gone.
+func (h *Handler) Close() error {
+	return h.conn.Close()
+}
+
 func (h *Handler) OnServe(conn *rtmp.Conn) {
+	h.rtmpConn = conn
 }
 
 func (h *Handler) OnConnect(timestamp uint32, cmd *rtmpmsg.NetConnectionConnect) error {
@@ -70,7 +78,7 @@ func (h *Handler) OnCreateStream(timestamp uint32, cmd *rtmpmsg.NetConnectionCre
 	return nil
 }
 
-func (h *Handler) OnPublish(_ *rtmp.StreamContext, timestamp uint32, cmd *rtmpmsg.NetStreamPublish) error {
+func (h *Handler) OnPublish(streamCtx *rtmp.StreamContext, timestamp uint32, cmd *rtmpmsg.NetStreamPublish) error {
 	ctx := context.Background()
 	log.Infof(ctx, "OnPublish: %#v", cmd)
 
@@ -79,25 +87,20 @@ func (h *Handler) OnPublish(_ *rtmp.StreamContext, timestamp uint32, cmd *rtmpms
 		return errors.New("PublishingName is empty")
 	}
 
-	// Record streams as FLV!
-	p := filepath.Join(
-		os.TempDir(),
-		filepath.Clean(filepath.Join("/", fmt.Sprintf("%s.flv", cmd.PublishingName))),
-	)
-	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		return errors.Wrap(err, "Failed to create flv file")
-	}
-	h.flvFile = f
-
-	enc, err := flv.NewEncoder(f, flv.FlagsAudio|flv.FlagsVideo)
+	streamID, err := h.authorizer.AuthorizePublish(ctx, auth.PublishRequest{
+		Ingress:    h.Name(),
+		StreamKey:  cmd.PublishingName,
+		RemoteAddr: h.conn.RemoteAddr().String(),
+	})
 	if err != nil {
-		_ = f.Close()
-		return errors.Wrap(err, "Failed to create flv encoder")
+		log.Warnf(ctx, "rejected rtmp publisher from %s: %v", h.conn.RemoteAddr(), err)
+		// go-rtmp answers an error with NetStream.Publish.Failed, publishers give up on BadName
+		if err := h.rejectPublish(streamCtx, timestamp); err != nil {
+			log.Error(ctx, err, "failed to send publish status")
+		}
+		return err
 	}
-	h.flvEnc = enc
-
-	h.streamID = cmd.PublishingName
+	h.streamID = streamID
 	h.mediaSpecs = []hub.MediaSpec{
 		{
 			MediaType: hub.Video,
@@ -112,12 +115,49 @@ func (h *Handler) OnPublish(_ *rtmp.StreamContext, timestamp uint32, cmd *rtmpms
 	}
 
 	if !h.notifiedSource && len(h.mediaSpecs) == 2 {
-		h.hub.Notify(ctx, h)
+		err := h.hub.Notify(ctx, h)
+		switch {
+		case errors.Is(err, hub.ErrStandby):
+			log.Infof(ctx, "rtmp publisher of %s is on standby", h.streamID)
+		case err != nil:
+			log.Warnf(ctx, "rejected rtmp publisher of %s: %v", h.streamID, err)
+			if err := h.rejectPublish(streamCtx, timestamp); err != nil {
+				log.Error(ctx, err, "failed to send publish status")
+			}
+			return err
+		}
 		h.notifiedSource = true
 	}
 	return nil
 }
 
+// rejectPublish sends NetStream.Publish.BadName for the publish being rejected.
+func (h *Handler) rejectPublish(streamCtx *rtmp.StreamContext, timestamp uint32) error {
+	if h.rtmpConn == nil {
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	amfEnc := rtmpmsg.NewAMFEncoder(buf, rtmpmsg.EncodingTypeAMF0)
+	if err := rtmpmsg.EncodeBodyAnyValues(amfEnc, &rtmpmsg.NetStreamOnStatus{
+		InfoObject: rtmpmsg.NetStreamOnStatusInfoObject{
+			Level:       rtmpmsg.NetStreamOnStatusLevelError,
+			Code:        rtmpmsg.NetStreamOnStatusCodePublishBadName,
+			Description: "Publish rejected.",
+		},
+	}); err != nil {
+		return err
+	}
+	return h.rtmpConn.Write(context.Background(), statusChunkStreamID, timestamp, &rtmp.ChunkMessage{
+		StreamID: streamCtx.StreamID,
+		Message: &rtmpmsg.CommandMessage{
+			CommandName:   "onStatus",
+			TransactionID: 0,
+			Encoding:      rtmpmsg.EncodingTypeAMF0,
+			Body:          buf,
+		},
+	})
+}
+
 func (h *Handler) OnSetDataFrame(timestamp uint32, data *rtmpmsg.NetStreamSetDataFrame) error {
 	r := bytes.NewReader(data.Payload)
 
@@ -128,15 +168,6 @@ func (h *Handler) OnSetDataFrame(timestamp uint32, data *rtmpmsg.NetStreamSetDat
 	}
 
 	log.Infof(context.Background(), "SetDataFrame: Script = %#v", script)
-
-	if err := h.flvEnc.Encode(&flvtag.FlvTag{
-		TagType:   flvtag.TagTypeScriptData,
-		Timestamp: timestamp,
-		Data:      &script,
-	}); err != nil {
-		log.Infof(context.Background(), "Failed to write script data: Err = %+v", err)
-	}
-
 	return nil
 }
 
@@ -186,7 +217,7 @@ func (h *Handler) OnAudio(timestamp uint32, payload io.Reader) error {
 		frameData.AACAudio.MPEG4AudioConfigBytes = h.MPEG4AudioConfigBytes
 		frameData.AACAudio.SequenceHeader = false
 	}
-	h.hub.Publish(h.streamID, &frameData)
+	h.hub.Publish(h, h.streamID, &frameData)
 	return nil
 }
 
@@ -337,7 +368,7 @@ func (h *Handler) publishVideoData(timestamp uint32, compositionTime int32, vide
 	pts := int64(compositionTime) + dts
 
 	sliceTypes := ingress.SliceTypes(videoDataToSend)
-	h.hub.Publish(h.streamID, &hub.FrameData{
+	h.hub.Publish(h, h.streamID, &hub.FrameData{
 		H264Video: &hub.H264Video{
 			VideoClockRate: 90000,
 			DTS:            dts * 90,
@@ -353,11 +384,7 @@ func (h *Handler) publishVideoData(timestamp uint32, compositionTime int32, vide
 
 func (h *Handler) OnClose() {
 	log.Infof(context.Background(), "OnClose")
-
-	if h.flvFile != nil {
-		_ = h.flvFile.Close()
-	}
-	h.hub.Unpublish(h.streamID)
+	h.hub.Unpublish(h)
 }
 
 func flvSampleRate(soundRate flvtag.SoundRate) uint32 {
@@ -8,6 +8,7 @@ import (
 
 	"github.com/yutopp/go-rtmp"
 
+	"liveflow/auth"
 	"liveflow/log"
 	"liveflow/media/hub"
 )
@@ -20,19 +21,27 @@ type RTMP struct {
 	serverConfig *rtmp.ServerConfig
 	hub          *hub.Hub
 	port         int
+	authorizer   auth.Authorizer
 }
 
 type RTMPArgs struct {
 	ServerConfig *rtmp.ServerConfig
 	Hub          *hub.Hub
 	Port         int
+	// Authorizer checks the publishing name of every publisher, every name is accepted when it is nil.
+	Authorizer auth.Authorizer
 }
 
 func NewRTMP(args RTMPArgs) *RTMP {
+	authorizer := args.Authorizer
+	if authorizer == nil {
+		authorizer = auth.AllowAll{}
+	}
 	return &RTMP{
 		//serverConfig: args.ServerConfig,
-		hub:  args.Hub,
-		port: args.Port,
+		hub:        args.Hub,
+		port:       args.Port,
+		authorizer: authorizer,
 	}
 }
 
@@ -48,7 +57,9 @@ func (r *RTMP) Serve(ctx context.Context) error {
 	srv := rtmp.NewServer(&rtmp.ServerConfig{
 		OnConnect: func(conn net.Conn) (io.ReadWriteCloser, *rtmp.ConnConfig) {
 			h := &Handler{
-				hub: r.hub,
+				hub:        r.hub,
+				conn:       conn,
+				authorizer: r.authorizer,
 			}
 			return conn, &rtmp.ConnConfig{
 				Handler: h,
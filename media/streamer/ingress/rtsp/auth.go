@@ -0,0 +1,80 @@
+package rtsp
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrUnsupportedAuth = errors.New("unsupported rtsp authentication")
+
+// authenticator answers the WWW-Authenticate challenge of a camera with Basic or Digest credentials.
+type authenticator struct {
+	user     string
+	password string
+	digest   bool
+	realm    string
+	nonce    string
+}
+
+func newAuthenticator(user, password, challenge string) (*authenticator, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	a := &authenticator{user: user, password: password}
+	switch strings.ToLower(scheme) {
+	case "basic":
+		return a, nil
+	case "digest":
+		values := parseAuthParams(params)
+		if algorithm := values["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+			return nil, fmt.Errorf("%w: digest algorithm %s", ErrUnsupportedAuth, algorithm)
+		}
+		a.digest = true
+		a.realm = values["realm"]
+		a.nonce = values["nonce"]
+		return a, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAuth, scheme)
+	}
+}
+
+func (a *authenticator) header(method, uri string) string {
+	if !a.digest {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.user+":"+a.password))
+	}
+	ha1 := md5Hex(a.user + ":" + a.realm + ":" + a.password)
+	ha2 := md5Hex(method + ":" + uri)
+	response := md5Hex(ha1 + ":" + a.nonce + ":" + ha2)
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		a.user, a.realm, a.nonce, uri, response)
+}
+
+func parseAuthParams(params string) map[string]string {
+	values := map[string]string{}
+	for len(params) > 0 {
+		params = strings.TrimLeft(params, " ,")
+		key, rest, ok := strings.Cut(params, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, params = rest[1:end+1], rest[end+2:]
+		} else {
+			value, params, _ = strings.Cut(rest, ",")
+		}
+		values[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return values
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,334 @@
+package rtsp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/sdp/v3"
+
+	"liveflow/log"
+	"liveflow/media/streamer/rtspbase"
+)
+
+var (
+	ErrUnexpectedStatus = errors.New("unexpected rtsp status")
+	ErrUnknownTransport = errors.New("unknown rtsp transport")
+)
+
+const (
+	TransportTCP = "tcp"
+	TransportUDP = "udp"
+
+	defaultPort     = "554"
+	dialTimeout     = 5 * time.Second
+	requestTimeout  = 10 * time.Second
+	readTimeout     = 10 * time.Second
+	packetQueueSize = 1024
+	maxUDPPacket    = 2048
+	userAgent       = "liveflow"
+)
+
+type rtpPayload struct {
+	trackIndex int
+	data       []byte
+}
+
+// client is the control connection of a single RTSP session.
+type client struct {
+	url       *url.URL
+	user      string
+	password  string
+	transport string
+
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+	cseq    int
+	auth    *authenticator
+
+	session  string
+	timeout  time.Duration
+	udpConns []*net.UDPConn
+}
+
+func dial(ctx context.Context, rawURL string, transport string) (*client, error) {
+	if transport != TransportTCP && transport != TransportUDP {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTransport, transport)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rtsp" {
+		return nil, fmt.Errorf("unsupported url scheme: %s", u.Scheme)
+	}
+	c := &client{transport: transport, timeout: rtspbase.DefaultSessionTimeout}
+	if u.User != nil {
+		c.user = u.User.Username()
+		c.password, _ = u.User.Password()
+		u.User = nil
+	}
+	c.url = u
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	dialer := net.Dialer{Timeout: dialTimeout}
+	c.conn, err = dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	c.reader = bufio.NewReader(c.conn)
+	return c, nil
+}
+
+func (c *client) close() {
+	c.conn.Close()
+	for _, conn := range c.udpConns {
+		conn.Close()
+	}
+}
+
+// describe returns the SDP of the stream and the base url for the track control urls.
+func (c *client) describe() (*sdp.SessionDescription, string, error) {
+	if _, err := c.do(rtspbase.MethodOptions, c.url.String(), nil); err != nil {
+		return nil, "", err
+	}
+	res, err := c.do(rtspbase.MethodDescribe, c.url.String(), rtspbase.Header{"Accept": "application/sdp"})
+	if err != nil {
+		return nil, "", err
+	}
+	sd := &sdp.SessionDescription{}
+	if err := sd.Unmarshal(res.Body); err != nil {
+		return nil, "", err
+	}
+	baseURL := res.Header.Get("Content-Base")
+	if baseURL == "" {
+		baseURL = res.Header.Get("Content-Location")
+	}
+	if baseURL == "" {
+		baseURL = c.url.String()
+	}
+	if control, ok := sd.Attribute("control"); ok && control != "*" {
+		baseURL = controlURL(baseURL, control)
+	}
+	return sd, strings.TrimSuffix(baseURL, "/"), nil
+}
+
+func (c *client) setup(tracks []*track) error {
+	for i, t := range tracks {
+		transport := rtspbase.Transport{Protocol: rtspbase.ProtocolTCP, Unicast: true, Interleaved: []int{2 * i, 2*i + 1}}
+		if c.transport == TransportUDP {
+			rtpPort, err := c.listenUDP()
+			if err != nil {
+				return err
+			}
+			transport = rtspbase.Transport{Protocol: rtspbase.ProtocolUDP, Unicast: true, ClientPort: []int{rtpPort, rtpPort + 1}}
+		}
+		header := rtspbase.Header{"Transport": transport.String()}
+		res, err := c.do(rtspbase.MethodSetup, t.control, header)
+		if err != nil {
+			return err
+		}
+		if _, err := rtspbase.ParseTransport(res.Header.Get("Transport")); err != nil {
+			return err
+		}
+		if c.session == "" {
+			c.session, c.timeout = rtspbase.ParseSession(res.Header.Get("Session"))
+		}
+	}
+	return nil
+}
+
+// listenUDP opens an RTP/RTCP port pair and returns the RTP port.
+func (c *client) listenUDP() (int, error) {
+	for attempt := 0; attempt < 16; attempt++ {
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return 0, err
+		}
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		if port%2 == 0 {
+			rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1})
+			if err == nil {
+				rtcpConn.Close()
+				c.udpConns = append(c.udpConns, rtpConn)
+				return port, nil
+			}
+		}
+		rtpConn.Close()
+	}
+	return 0, errors.New("failed to allocate rtp port pair")
+}
+
+func (c *client) play(baseURL string) error {
+	_, err := c.do(rtspbase.MethodPlay, baseURL, rtspbase.Header{"Range": "npt=0.000-"})
+	return err
+}
+
+func (c *client) teardown(baseURL string) {
+	c.send(rtspbase.MethodTeardown, baseURL, nil)
+}
+
+// keepalive refreshes the session; the answer is consumed by the packet reader.
+func (c *client) keepalive() error {
+	return c.send(rtspbase.MethodGetParameter, c.url.String(), nil)
+}
+
+// do sends a request and waits for its response. It is only used before PLAY.
+func (c *client) do(method string, uri string, header rtspbase.Header) (*rtspbase.Response, error) {
+	for retried := false; ; retried = true {
+		if err := c.send(method, uri, header); err != nil {
+			return nil, err
+		}
+		c.conn.SetReadDeadline(time.Now().Add(requestTimeout))
+		res, err := c.readResponse()
+		c.conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode == 401 && !retried && c.user != "" {
+			if c.auth, err = newAuthenticator(c.user, c.password, res.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if res.StatusCode != 200 {
+			return nil, fmt.Errorf("%w: %s %d %s", ErrUnexpectedStatus, method, res.StatusCode, res.Status)
+		}
+		return res, nil
+	}
+}
+
+// readResponse skips interleaved frames some servers send before answering PLAY.
+func (c *client) readResponse() (*rtspbase.Response, error) {
+	for {
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != rtspbase.InterleavedSign {
+			return rtspbase.ReadResponse(c.reader)
+		}
+		if _, _, err := rtspbase.ReadInterleavedFrame(c.reader); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *client) send(method string, uri string, header rtspbase.Header) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.cseq++
+	req := &rtspbase.Request{
+		Method: method,
+		URL:    uri,
+		Header: rtspbase.Header{
+			"CSeq":       strconv.Itoa(c.cseq),
+			"User-Agent": userAgent,
+		},
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if c.session != "" {
+		req.Header.Set("Session", c.session)
+	}
+	if c.auth != nil {
+		req.Header.Set("Authorization", c.auth.header(method, uri))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(requestTimeout))
+	defer c.conn.SetWriteDeadline(time.Time{})
+	return req.Write(c.conn)
+}
+
+// readPackets forwards RTP payloads to onRTP until the session fails or ctx is done.
+func (c *client) readPackets(ctx context.Context, onRTP func(trackIndex int, data []byte)) error {
+	done := make(chan struct{})
+	defer close(done)
+	packets := make(chan rtpPayload, packetQueueSize)
+	errs := make(chan error, len(c.udpConns)+1)
+	go c.readControl(ctx, packets, errs, done)
+	for i, conn := range c.udpConns {
+		go readUDP(i, conn, packets, errs, done)
+	}
+	keepalive := time.NewTicker(c.timeout / 2)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errs:
+			return err
+		case p := <-packets:
+			onRTP(p.trackIndex, p.data)
+		case <-keepalive.C:
+			if err := c.keepalive(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readControl reads the TCP connection, which carries interleaved RTP in TCP mode and keepalive answers.
+func (c *client) readControl(ctx context.Context, packets chan<- rtpPayload, errs chan<- error, done <-chan struct{}) {
+	for {
+		if c.transport == TransportTCP {
+			c.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		}
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			errs <- err
+			return
+		}
+		if b[0] != rtspbase.InterleavedSign {
+			res, err := rtspbase.ReadResponse(c.reader)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if res.StatusCode != 200 {
+				log.Warnf(ctx, "rtsp keepalive answered %d %s", res.StatusCode, res.Status)
+			}
+			continue
+		}
+		channel, data, err := rtspbase.ReadInterleavedFrame(c.reader)
+		if err != nil {
+			errs <- err
+			return
+		}
+		if channel%2 != 0 {
+			continue
+		}
+		select {
+		case packets <- rtpPayload{trackIndex: channel / 2, data: data}:
+		case <-done:
+			return
+		}
+	}
+}
+
+func readUDP(trackIndex int, conn *net.UDPConn, packets chan<- rtpPayload, errs chan<- error, done <-chan struct{}) {
+	buf := make([]byte, maxUDPPacket)
+	for {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			errs <- err
+			return
+		}
+		select {
+		case packets <- rtpPayload{trackIndex: trackIndex, data: append([]byte{}, buf[:n]...)}:
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package rtsp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+
+	"liveflow/log"
+	"liveflow/media/hub"
+	"liveflow/media/streamer/ingress"
+)
+
+const (
+	aacSamples  = 1024
+	naluTypeIDR = 5
+)
+
+var startCode = []byte{0, 0, 0, 1}
+
+// Handler depacketizes the RTP of an RTSP session and publishes it to the hub.
+type Handler struct {
+	hub            *hub.Hub
+	streamID       string
+	tracks         []*trackState
+	notifiedSource bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type HandlerArgs struct {
+	Hub      *hub.Hub
+	StreamID string
+	Tracks   []*track
+}
+
+// trackState is the depacketizer state of a single track.
+type trackState struct {
+	*track
+	h264Packet *codecs.H264Packet
+	opusPacket *codecs.OpusPacket
+	hasSeq     bool
+	nextSeq    uint16
+	frame      []byte
+	frameTS    uint32
+	// dropFrame drops the packets of the access unit at dropTS, one of its packets is lost
+	dropFrame bool
+	dropTS    uint32
+	// waitKeyFrame drops the frames that refer to a damaged or missing one until the next IDR
+	waitKeyFrame bool
+	aacFragment  []byte
+	hasTimestamp bool
+	firstTS      uint32
+	lastTS       uint32
+	tsWraps      int64
+}
+
+func NewHandler(args HandlerArgs) *Handler {
+	h := &Handler{
+		hub:      args.Hub,
+		streamID: args.StreamID,
+		closed:   make(chan struct{}),
+	}
+	for _, t := range args.Tracks {
+		h.tracks = append(h.tracks, &trackState{
+			track:        t,
+			h264Packet:   &codecs.H264Packet{},
+			opusPacket:   &codecs.OpusPacket{},
+			waitKeyFrame: t.codecType == hub.CodecTypeH264,
+		})
+	}
+	return h
+}
+
+func (h *Handler) Depth() int {
+	return 0
+}
+
+func (h *Handler) Name() string {
+	return "rtsp"
+}
+
+func (h *Handler) MediaSpecs() []hub.MediaSpec {
+	var ret []hub.MediaSpec
+	for _, t := range h.tracks {
+		ret = append(ret, t.mediaSpec())
+	}
+	return ret
+}
+
+func (h *Handler) StreamID() string {
+	return h.streamID
+}
+
+// Notify returns hub.ErrStreamTaken when another source publishes the stream, the source stays on standby otherwise.
+func (h *Handler) Notify(ctx context.Context) error {
+	err := h.hub.Notify(ctx, h)
+	if errors.Is(err, hub.ErrStandby) {
+		log.Infof(ctx, "rtsp source of %s is on standby", h.streamID)
+	} else if err != nil {
+		return err
+	}
+	h.notifiedSource = true
+	return nil
+}
+
+// Close ends the session of the handler, e.g. when another publisher takes the stream over. OnClose unpublishes the
+// stream once the session is gone.
+func (h *Handler) Close() error {
+	h.closeOnce.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
+
+func (h *Handler) OnClose(ctx context.Context) {
+	log.Info(ctx, "OnClose")
+	if h.notifiedSource {
+		h.hub.Unpublish(h)
+	}
+}
+
+func (h *Handler) OnRTP(ctx context.Context, trackIndex int, data []byte) {
+	if trackIndex < 0 || trackIndex >= len(h.tracks) {
+		return
+	}
+	t := h.tracks[trackIndex]
+	pkt := &rtp.Packet{}
+	if err := pkt.Unmarshal(data); err != nil {
+		log.Error(ctx, err, "failed to unmarshal rtp packet")
+		return
+	}
+	if pkt.PayloadType != t.payloadType {
+		return
+	}
+	lost := t.hasSeq && pkt.SequenceNumber != t.nextSeq
+	if lost && int16(pkt.SequenceNumber-t.nextSeq) < 0 {
+		return
+	}
+	t.hasSeq = true
+	t.nextSeq = pkt.SequenceNumber + 1
+	switch t.codecType {
+	case hub.CodecTypeH264:
+		h.onH264(ctx, t, pkt, lost)
+	case hub.CodecTypeAAC:
+		h.onAAC(ctx, t, pkt, lost)
+	case hub.CodecTypeOpus:
+		h.onOpus(ctx, t, pkt)
+	}
+}
+
+// onH264 collects the NAL units of an access unit until the marker bit or a new timestamp.
+func (h *Handler) onH264(ctx context.Context, t *trackState, pkt *rtp.Packet, lost bool) {
+	if lost {
+		// the lost packets belong to the frame being collected or to the one of pkt, both are dropped
+		log.Warn(ctx, "rtp packet lost, dropping h264 frames until the next keyframe")
+		t.h264Packet = &codecs.H264Packet{}
+		t.frame = nil
+		t.dropFrame = true
+		t.dropTS = pkt.Timestamp
+		t.waitKeyFrame = true
+	} else if len(t.frame) > 0 && pkt.Timestamp != t.frameTS {
+		h.publishH264(ctx, t)
+	}
+	if t.dropFrame && pkt.Timestamp != t.dropTS {
+		t.h264Packet = &codecs.H264Packet{}
+		t.dropFrame = false
+	}
+	t.frameTS = pkt.Timestamp
+	b, err := t.h264Packet.Unmarshal(pkt.Payload)
+	if err != nil {
+		log.Error(ctx, err, "failed to unmarshal h264")
+		return
+	}
+	if !t.dropFrame {
+		t.frame = append(t.frame, b...)
+	}
+	if pkt.Marker {
+		h.publishH264(ctx, t)
+	}
+}
+
+func (h *Handler) publishH264(ctx context.Context, t *trackState) {
+	frame := t.frame
+	t.frame = nil
+	if !h.notifiedSource || len(frame) == 0 {
+		return
+	}
+	var payload []byte
+	hasIDR, hasParameterSets := false, false
+	nalus, _ := h264parser.SplitNALUs(frame)
+	for _, nalu := range nalus {
+		if len(nalu) < 1 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case h264parser.NALU_SPS:
+			t.sps = append([]byte{}, nalu...)
+			hasParameterSets = true
+		case h264parser.NALU_PPS:
+			t.pps = append([]byte{}, nalu...)
+		case naluTypeIDR:
+			hasIDR = true
+		}
+		payload = append(payload, startCode...)
+		payload = append(payload, nalu...)
+	}
+	if t.waitKeyFrame {
+		if !hasIDR {
+			return
+		}
+		t.waitKeyFrame = false
+	}
+	// Cameras often only announce SPS/PPS in the SDP, while the egresses expect them in front of keyframes.
+	if hasIDR && !hasParameterSets && t.sps != nil && t.pps != nil {
+		payload = append(append(append(append(append([]byte{}, startCode...), t.sps...), startCode...), t.pps...), payload...)
+	}
+	pts := t.timestamp(t.frameTS)
+	h.hub.Publish(h, h.streamID, &hub.FrameData{
+		H264Video: &hub.H264Video{
+			PTS:            pts,
+			DTS:            pts,
+			VideoClockRate: t.clockRate,
+			Data:           payload,
+			SPS:            t.sps,
+			PPS:            t.pps,
+			SliceTypes:     ingress.SliceTypes(payload),
+		},
+	})
+}
+
+// onAAC splits an RFC 3640 payload into its access units.
+func (h *Handler) onAAC(ctx context.Context, t *trackState, pkt *rtp.Packet, lost bool) {
+	if lost {
+		t.aacFragment = nil
+	}
+	payload := pkt.Payload
+	if len(payload) < 2 {
+		return
+	}
+	headersLength := (int(payload[0])<<8 | int(payload[1])) / 8
+	headerBits := t.sizeLength + t.indexLength
+	if headersLength == 0 || len(payload) < 2+headersLength {
+		log.Warn(ctx, "invalid aac au headers")
+		return
+	}
+	headers := payload[2 : 2+headersLength]
+	data := payload[2+headersLength:]
+	var sizes []int
+	for bit := 0; bit+headerBits <= headersLength*8; {
+		sizes = append(sizes, readBits(headers, bit, t.sizeLength))
+		bit += headerBits
+		headerBits = t.sizeLength + t.indexDeltaLength
+	}
+	// A single access unit may be fragmented over several packets, the last one carries the marker bit.
+	if len(sizes) == 1 && sizes[0] > len(data) {
+		t.aacFragment = append(t.aacFragment, data...)
+		if !pkt.Marker {
+			return
+		}
+		data, t.aacFragment = t.aacFragment, nil
+		if len(data) != sizes[0] {
+			log.Warn(ctx, "incomplete fragmented aac access unit")
+			return
+		}
+	}
+	for i, size := range sizes {
+		if size > len(data) {
+			log.Warn(ctx, "truncated aac access unit")
+			return
+		}
+		frame := data[:size]
+		data = data[size:]
+		if !h.notifiedSource {
+			continue
+		}
+		pts := t.timestamp(pkt.Timestamp) + int64(i*aacSamples)
+		h.hub.Publish(h, h.streamID, &hub.FrameData{
+			AACAudio: &hub.AACAudio{
+				Data:                  bytes.Clone(frame),
+				MPEG4AudioConfigBytes: t.mpeg4AudioConfigBytes,
+				MPEG4AudioConfig:      t.mpeg4AudioConfig,
+				PTS:                   pts,
+				DTS:                   pts,
+				AudioClockRate:        t.clockRate,
+			},
+		})
+	}
+}
+
+func (h *Handler) onOpus(ctx context.Context, t *trackState, pkt *rtp.Packet) {
+	payload, err := t.opusPacket.Unmarshal(pkt.Payload)
+	if err != nil {
+		log.Error(ctx, err, "failed to unmarshal opus")
+		return
+	}
+	if len(payload) == 0 || !h.notifiedSource {
+		return
+	}
+	pts := t.timestamp(pkt.Timestamp)
+	h.hub.Publish(h, h.streamID, &hub.FrameData{
+		OPUSAudio: &hub.OPUSAudio{
+			PTS:            pts,
+			DTS:            pts,
+			AudioClockRate: t.clockRate,
+			Data:           bytes.Clone(payload),
+		},
+	})
+}
+
+// timestamp unwraps the 32-bit RTP timestamp and makes it start at zero.
+func (t *trackState) timestamp(ts uint32) int64 {
+	if !t.hasTimestamp {
+		t.firstTS = ts
+		t.lastTS = ts
+		t.hasTimestamp = true
+	}
+	if ts < t.lastTS && t.lastTS-ts > 1<<31 {
+		t.tsWraps++
+	} else if ts > t.lastTS && ts-t.lastTS > 1<<31 {
+		// A late packet from before the last wrap.
+		return t.tsWraps<<32 + int64(ts) - 1<<32 - int64(t.firstTS)
+	}
+	t.lastTS = ts
+	return t.tsWraps<<32 + int64(ts) - int64(t.firstTS)
+}
+
+func readBits(b []byte, offset int, n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		bit := offset + i
+		v = v<<1 | int(b[bit/8]>>(7-bit%8)&1)
+	}
+	return v
+}
@@ -0,0 +1,191 @@
+package rtsp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"liveflow/log"
+	"liveflow/media/hub"
+	"liveflow/media/streamer/fields"
+)
+
+var (
+	ErrInvalidStream = errors.New("rtsp stream requires a stream id and an url")
+	// ErrClosed ends a session closed by the server, e.g. by a takeover or an admin.
+	ErrClosed = errors.New("rtsp session closed by the server")
+)
+
+const (
+	defaultMinReconnectDelay = 1 * time.Second
+	defaultMaxReconnectDelay = 30 * time.Second
+)
+
+// RTSP pulls the configured camera streams and publishes them to the hub.
+type RTSP struct {
+	hub       *hub.Hub
+	streams   []Stream
+	transport string
+
+	minReconnectDelay time.Duration
+	maxReconnectDelay time.Duration
+}
+
+type Stream struct {
+	StreamID string
+	URL      string
+	// Transport overrides RTSPArgs.Transport for this stream.
+	Transport string
+}
+
+type RTSPArgs struct {
+	Hub     *hub.Hub
+	Streams []Stream
+	// Transport is either TransportTCP (default) or TransportUDP.
+	Transport string
+}
+
+func NewRTSP(args RTSPArgs) *RTSP {
+	transport := args.Transport
+	if transport == "" {
+		transport = TransportTCP
+	}
+	return &RTSP{
+		hub:       args.Hub,
+		streams:   args.Streams,
+		transport: transport,
+
+		minReconnectDelay: defaultMinReconnectDelay,
+		maxReconnectDelay: defaultMaxReconnectDelay,
+	}
+}
+
+// Serve pulls every stream until ctx is done.
+func (r *RTSP) Serve(ctx context.Context) error {
+	for _, stream := range r.streams {
+		if stream.StreamID == "" || stream.URL == "" {
+			return ErrInvalidStream
+		}
+	}
+	var wg sync.WaitGroup
+	for _, stream := range r.streams {
+		if stream.Transport == "" {
+			stream.Transport = r.transport
+		}
+		wg.Add(1)
+		go func(stream Stream) {
+			defer wg.Done()
+			r.pull(ctx, stream)
+		}(stream)
+	}
+	wg.Wait()
+	return nil
+}
+
+// pull keeps a stream published, reconnecting with exponential backoff while the camera is down.
+func (r *RTSP) pull(ctx context.Context, stream Stream) {
+	ctx = log.WithFields(ctx, logrus.Fields{
+		fields.StreamID:   stream.StreamID,
+		fields.SourceName: "rtsp",
+	})
+	delay := r.minReconnectDelay
+	for {
+		startedAt := time.Now()
+		err := r.session(ctx, stream)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, ErrClosed) {
+			// pulling again right away would take the stream back from the publisher that took it over
+			log.Infof(ctx, "rtsp session closed, pulling again once %s is unpublished", stream.StreamID)
+			if !r.waitUnpublished(ctx, stream.StreamID) {
+				return
+			}
+			delay = r.minReconnectDelay
+			continue
+		}
+		log.Errorf(ctx, "rtsp session ended: %v", err)
+		if time.Since(startedAt) > r.maxReconnectDelay {
+			delay = r.minReconnectDelay
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > r.maxReconnectDelay {
+			delay = r.maxReconnectDelay
+		}
+	}
+}
+
+func (r *RTSP) session(ctx context.Context, stream Stream) error {
+	c, err := dial(ctx, stream.URL, stream.Transport)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	sd, baseURL, err := c.describe()
+	if err != nil {
+		return err
+	}
+	tracks, err := parseTracks(sd, baseURL)
+	if err != nil {
+		return err
+	}
+	if err := c.setup(tracks); err != nil {
+		return err
+	}
+	if err := c.play(baseURL); err != nil {
+		return err
+	}
+	defer c.teardown(baseURL)
+	log.Infof(ctx, "rtsp session started: %s", c.url.Redacted())
+	handler := NewHandler(HandlerArgs{
+		Hub:      r.hub,
+		StreamID: stream.StreamID,
+		Tracks:   tracks,
+	})
+	// the stream is pulled again with the reconnect delay while another source publishes it
+	if err := handler.Notify(ctx); err != nil {
+		return err
+	}
+	defer handler.OnClose(ctx)
+	readCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-handler.closed:
+			cancel()
+		case <-readCtx.Done():
+		}
+	}()
+	err = c.readPackets(readCtx, func(trackIndex int, data []byte) {
+		handler.OnRTP(ctx, trackIndex, data)
+	})
+	select {
+	case <-handler.closed:
+		return ErrClosed
+	default:
+		return err
+	}
+}
+
+// waitUnpublished polls the hub with the shortest reconnect delay until no source publishes streamID.
+// It returns false when ctx is done first.
+func (r *RTSP) waitUnpublished(ctx context.Context, streamID string) bool {
+	for {
+		if _, published := r.hub.Get(streamID); !published {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(r.minReconnectDelay):
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"liveflow/media/hub"
+	"liveflow/media/streamer/rtspbase"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xC0, 0x1F, 0xDA, 0x01, 0x40, 0x16, 0xE8}
+	testPPS = []byte{0x68, 0xCE, 0x3C, 0x80}
+	// an IDR slice with first_mb_in_slice 0 and slice_type 7 (I)
+	testIDR = []byte{0x65, 0x88, 0x84, 0x00, 0x33, 0xFF, 0x10, 0x20}
+)
+
+type testSource struct {
+	streamID string
+}
+
+func (s *testSource) Name() string {
+	return "test"
+}
+
+func (s *testSource) MediaSpecs() []hub.MediaSpec {
+	return []hub.MediaSpec{{MediaType: hub.Video, ClockRate: 90000, CodecType: hub.CodecTypeH264}}
+}
+
+func (s *testSource) StreamID() string {
+	return s.streamID
+}
+
+func (s *testSource) Depth() int {
+	return 0
+}
+
+// fakeCamera is an RTSP server that hands each connection to serve, with the index of the connection.
+type fakeCamera struct {
+	ln       net.Listener
+	accepted chan time.Time
+	serve    func(i int, conn net.Conn)
+}
+
+func newFakeCamera(t *testing.T, serve func(i int, conn net.Conn)) *fakeCamera {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	c := &fakeCamera{
+		ln:       ln,
+		accepted: make(chan time.Time, 64),
+		serve:    serve,
+	}
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.accepted <- time.Now()
+			go func(i int) {
+				defer conn.Close()
+				c.serve(i, conn)
+			}(i)
+		}
+	}()
+	return c
+}
+
+func (c *fakeCamera) url() string {
+	return "rtsp://" + c.ln.Addr().String() + "/stream"
+}
+
+func (c *fakeCamera) waitAccepted(t *testing.T) time.Time {
+	select {
+	case at := <-c.accepted:
+		return at
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection to the camera")
+	}
+	return time.Time{}
+}
+
+// play answers the requests of a client until PLAY.
+func play(t *testing.T, conn net.Conn, r *bufio.Reader) bool {
+	sd := fmt.Sprintf("v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=test\r\nt=0 0\r\n"+
+		"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\n"+
+		"a=fmtp:96 packetization-mode=1;sprop-parameter-sets=%s,%s\r\na=control:trackID=0\r\n",
+		base64.StdEncoding.EncodeToString(testSPS), base64.StdEncoding.EncodeToString(testPPS))
+	for {
+		req, err := rtspbase.ReadRequest(r)
+		if err != nil {
+			return false
+		}
+		res := rtspbase.NewResponse(200, req.Header.Get("CSeq"))
+		switch req.Method {
+		case rtspbase.MethodDescribe:
+			res.Header.Set("Content-Type", "application/sdp")
+			res.Header.Set("Content-Base", "rtsp://"+conn.LocalAddr().String()+"/stream/")
+			res.Body = []byte(sd)
+		case rtspbase.MethodSetup:
+			if want := "rtsp://" + conn.LocalAddr().String() + "/stream/trackID=0"; req.URL != want {
+				t.Errorf("SETUP %s, want %s", req.URL, want)
+			}
+			res.Header.Set("Transport", req.Header.Get("Transport"))
+			res.Header.Set("Session", "12345678;timeout=60")
+		}
+		if err := res.Write(conn); err != nil {
+			return false
+		}
+		if req.Method == rtspbase.MethodPlay {
+			return true
+		}
+	}
+}
+
+func writeRTP(t *testing.T, conn net.Conn, seq uint16, ts uint32, marker bool, payload []byte) {
+	pkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    96,
+			SequenceNumber: seq,
+			Timestamp:      ts,
+			Marker:         marker,
+		},
+		Payload: payload,
+	}
+	b, err := pkt.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rtspbase.WriteInterleavedFrame(conn, 0, b); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPullReconnectBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the camera is down, it drops every connection
+	camera := newFakeCamera(t, func(int, net.Conn) {})
+	r := NewRTSP(RTSPArgs{
+		Hub:     hub.NewHub(),
+		Streams: []Stream{{StreamID: "cam", URL: camera.url()}},
+	})
+	r.minReconnectDelay = 50 * time.Millisecond
+	r.maxReconnectDelay = 200 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := r.Serve(ctx); err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	}()
+
+	want := []time.Duration{50, 100, 200, 200, 200}
+	last := camera.waitAccepted(t)
+	for i, delay := range want {
+		delay *= time.Millisecond
+		at := camera.waitAccepted(t)
+		gap := at.Sub(last)
+		last = at
+		if gap < delay || gap > delay*3/2+25*time.Millisecond {
+			t.Errorf("reconnect %d after %s, want %s", i+1, gap, delay)
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after cancel")
+	}
+}
+
+func TestPullSessionPublishesAndResetsBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const hold = 300 * time.Millisecond
+	sessionClosed := make(chan time.Time, 1)
+	camera := newFakeCamera(t, func(i int, conn net.Conn) {
+		// the first connection fails, the second plays longer than the longest reconnect delay
+		if i != 1 {
+			return
+		}
+		r := bufio.NewReader(conn)
+		if !play(t, conn, r) {
+			t.Error("client did not play")
+			return
+		}
+		// an IDR frame in two FU-A fragments and an IDR frame in a single NAL unit packet
+		fuIndicator := testIDR[0]&0xE0 | 28
+		writeRTP(t, conn, 65535, 1000, false, append([]byte{fuIndicator, 0x80 | testIDR[0]&0x1F}, testIDR[1:4]...))
+		writeRTP(t, conn, 0, 1000, true, append([]byte{fuIndicator, 0x40 | testIDR[0]&0x1F}, testIDR[4:]...))
+		writeRTP(t, conn, 1, 4000, true, testIDR)
+		time.Sleep(hold)
+		sessionClosed <- time.Now()
+	})
+
+	h := hub.NewHub()
+	sub := h.Subscribe("cam")
+	defer sub.Close()
+	r := NewRTSP(RTSPArgs{
+		Hub:     h,
+		Streams: []Stream{{StreamID: "cam", URL: camera.url()}},
+	})
+	r.minReconnectDelay = 50 * time.Millisecond
+	r.maxReconnectDelay = 200 * time.Millisecond
+	go func() {
+		_ = r.Serve(ctx)
+	}()
+
+	camera.waitAccepted(t)
+	camera.waitAccepted(t)
+	var frames []*hub.H264Video
+	for data := range sub.Frames() {
+		if data.H264Video == nil {
+			t.Fatal("got a frame without h264 video")
+		}
+		frames = append(frames, data.H264Video)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(frames))
+	}
+	for i, wantPTS := range []int64{0, 3000} {
+		frame := frames[i]
+		if frame.PTS != wantPTS {
+			t.Errorf("frame %d PTS %d, want %d", i, frame.PTS, wantPTS)
+		}
+		// the parameter sets of the SDP are put in front of the key frames
+		want := bytes.Join([][]byte{nil, testSPS, testPPS, testIDR}, []byte{0, 0, 0, 1})
+		if !bytes.Equal(frame.Data, want) {
+			t.Errorf("frame %d data %x, want %x", i, frame.Data, want)
+		}
+		if !bytes.Equal(frame.SPS, testSPS) || !bytes.Equal(frame.PPS, testPPS) {
+			t.Errorf("frame %d sps %x pps %x", i, frame.SPS, frame.PPS)
+		}
+	}
+	if _, published := h.Get("cam"); published {
+		t.Fatal("stream is still published after the session ended")
+	}
+
+	closedAt := <-sessionClosed
+	// a session that lasted longer than the longest delay starts over with the shortest one
+	if gap := camera.waitAccepted(t).Sub(closedAt); gap > 100*time.Millisecond {
+		t.Fatalf("reconnected %s after a long session, want about 50ms", gap)
+	}
+}
+
+func TestPullTakenOver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sessionEnded := make(chan struct{}, 8)
+	camera := newFakeCamera(t, func(i int, conn net.Conn) {
+		r := bufio.NewReader(conn)
+		if !play(t, conn, r) {
+			return
+		}
+		// the session lasts until the client goes away
+		_, _ = io.Copy(io.Discard, r)
+		sessionEnded <- struct{}{}
+	})
+	h := hub.NewHub()
+	h.SetTakeoverPolicy(hub.KickOldPublisher)
+	go func() {
+		for {
+			select {
+			case <-h.SubscribeToStreamID():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	r := NewRTSP(RTSPArgs{
+		Hub:     h,
+		Streams: []Stream{{StreamID: "cam", URL: camera.url()}},
+	})
+	r.minReconnectDelay = 50 * time.Millisecond
+	r.maxReconnectDelay = 200 * time.Millisecond
+	go func() {
+		_ = r.Serve(ctx)
+	}()
+	waitPublisher := func(name string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if info, ok := h.Get("cam"); ok && info.Source.Name() == name {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("cam is not published by %s", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	camera.waitAccepted(t)
+	waitPublisher("rtsp")
+	info, _ := h.Get("cam")
+	if _, ok := info.Source.(hub.ClosableSource); !ok {
+		t.Fatal("the rtsp source cannot be closed")
+	}
+	newcomer := &testSource{streamID: "cam"}
+	if err := h.Notify(ctx, newcomer); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sessionEnded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session of the camera was not closed on takeover")
+	}
+	// the camera is not pulled again while the newcomer publishes the stream
+	select {
+	case <-camera.accepted:
+		t.Fatal("pulled the camera again while the stream is taken over")
+	case <-time.After(4 * r.minReconnectDelay):
+	}
+	waitPublisher("test")
+
+	h.Unpublish(newcomer)
+	camera.waitAccepted(t)
+	waitPublisher("rtsp")
+}
+
+func TestPullDropsDamagedFramesUntilKeyFrame(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a P slice with first_mb_in_slice 0 and slice_type 5 (P)
+	testP := []byte{0x41, 0x9A, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}
+	fuIndicator := testIDR[0]&0xE0 | 28
+	fuStart := func(nalu []byte) []byte {
+		return append([]byte{fuIndicator, 0x80 | nalu[0]&0x1F}, nalu[1:3]...)
+	}
+	fuMiddle := func(nalu []byte) []byte {
+		return append([]byte{fuIndicator, nalu[0] & 0x1F}, nalu[3:5]...)
+	}
+	fuEnd := func(nalu []byte) []byte {
+		return append([]byte{fuIndicator, 0x40 | nalu[0]&0x1F}, nalu[5:]...)
+	}
+	camera := newFakeCamera(t, func(i int, conn net.Conn) {
+		if i != 0 {
+			return
+		}
+		if !play(t, conn, bufio.NewReader(conn)) {
+			t.Error("client did not play")
+			return
+		}
+		// the P frame before the first keyframe refers to a frame the viewers never got
+		writeRTP(t, conn, 10, 1000, true, testP)
+		writeRTP(t, conn, 11, 4000, true, testIDR)
+		// the first packet of a P frame is lost, so are the P frames after it
+		writeRTP(t, conn, 13, 7000, true, fuEnd(testP))
+		writeRTP(t, conn, 14, 10000, true, testP)
+		writeRTP(t, conn, 15, 13000, false, fuStart(testIDR))
+		writeRTP(t, conn, 16, 13000, false, fuMiddle(testIDR))
+		writeRTP(t, conn, 17, 13000, true, fuEnd(testIDR))
+		writeRTP(t, conn, 18, 16000, true, testP)
+		// the middle packet of a keyframe is lost, the frames up to the next keyframe are dropped
+		writeRTP(t, conn, 19, 19000, false, fuStart(testIDR))
+		writeRTP(t, conn, 21, 19000, true, fuEnd(testIDR))
+		writeRTP(t, conn, 22, 22000, true, testP)
+		writeRTP(t, conn, 23, 25000, false, fuStart(testIDR))
+		writeRTP(t, conn, 24, 25000, false, fuMiddle(testIDR))
+		writeRTP(t, conn, 25, 25000, true, fuEnd(testIDR))
+		writeRTP(t, conn, 26, 28000, true, testP)
+		time.Sleep(100 * time.Millisecond)
+	})
+
+	h := hub.NewHub()
+	sub := h.Subscribe("cam")
+	defer sub.Close()
+	r := NewRTSP(RTSPArgs{
+		Hub:     h,
+		Streams: []Stream{{StreamID: "cam", URL: camera.url()}},
+	})
+	go func() {
+		_ = r.Serve(ctx)
+	}()
+
+	var got []int64
+	for data := range sub.Frames() {
+		video := data.H264Video
+		if video == nil {
+			t.Fatal("got a frame without h264 video")
+		}
+		if hub.IsKeyFrame(data) && !bytes.Contains(video.Data, testIDR) {
+			t.Errorf("keyframe at %d is damaged: %x", video.PTS, video.Data)
+		}
+		got = append(got, video.PTS)
+	}
+	// the timestamps start at the first published frame
+	want := []int64{0, 9000, 12000, 21000, 24000}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("published frames at %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,188 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/pion/sdp/v3"
+
+	"liveflow/media/hub"
+)
+
+var ErrNoSupportedTrack = errors.New("no supported track in sdp")
+
+// track is a media description of the camera SDP that can be published to the hub.
+type track struct {
+	mediaType   hub.MediaType
+	codecType   hub.CodecType
+	payloadType uint8
+	clockRate   uint32
+	control     string
+
+	// H264
+	sps []byte
+	pps []byte
+
+	// AAC (RFC 3640)
+	mpeg4AudioConfig      *aacparser.MPEG4AudioConfig
+	mpeg4AudioConfigBytes []byte
+	sizeLength            int
+	indexLength           int
+	indexDeltaLength      int
+}
+
+func (t *track) mediaSpec() hub.MediaSpec {
+	clockRate := t.clockRate
+	if t.mpeg4AudioConfig != nil {
+		clockRate = uint32(t.mpeg4AudioConfig.SampleRate)
+	}
+	return hub.MediaSpec{
+		MediaType: t.mediaType,
+		ClockRate: clockRate,
+		CodecType: t.codecType,
+	}
+}
+
+// parseTracks picks the first H264 video and the first AAC or Opus audio of a DESCRIBE answer.
+func parseTracks(sd *sdp.SessionDescription, baseURL string) ([]*track, error) {
+	var tracks []*track
+	var hasVideo, hasAudio bool
+	for _, md := range sd.MediaDescriptions {
+		for _, format := range md.MediaName.Formats {
+			t, err := parseTrack(md, format)
+			if err != nil || t == nil {
+				continue
+			}
+			if (t.mediaType == hub.Video && hasVideo) || (t.mediaType == hub.Audio && hasAudio) {
+				break
+			}
+			control, _ := md.Attribute("control")
+			t.control = controlURL(baseURL, control)
+			if t.mediaType == hub.Video {
+				hasVideo = true
+			} else {
+				hasAudio = true
+			}
+			tracks = append(tracks, t)
+			break
+		}
+	}
+	if len(tracks) == 0 {
+		return nil, ErrNoSupportedTrack
+	}
+	return tracks, nil
+}
+
+func parseTrack(md *sdp.MediaDescription, format string) (*track, error) {
+	pt, err := strconv.Atoi(format)
+	if err != nil {
+		return nil, err
+	}
+	codec, clockRate := rtpmap(md, format)
+	fmtp := fmtpParams(md, format)
+	t := &track{payloadType: uint8(pt), clockRate: clockRate}
+	switch {
+	case md.MediaName.Media == "video" && codec == "h264":
+		t.mediaType = hub.Video
+		t.codecType = hub.CodecTypeH264
+		for _, ps := range strings.Split(fmtp["sprop-parameter-sets"], ",") {
+			nalu, err := base64.StdEncoding.DecodeString(ps)
+			if err != nil || len(nalu) == 0 {
+				continue
+			}
+			switch nalu[0] & 0x1f {
+			case 7:
+				t.sps = nalu
+			case 8:
+				t.pps = nalu
+			}
+		}
+	case md.MediaName.Media == "audio" && codec == "mpeg4-generic":
+		t.mediaType = hub.Audio
+		t.codecType = hub.CodecTypeAAC
+		if !strings.EqualFold(fmtp["mode"], "AAC-hbr") {
+			return nil, fmt.Errorf("unsupported mpeg4-generic mode: %s", fmtp["mode"])
+		}
+		configBytes, err := hex.DecodeString(fmtp["config"])
+		if err != nil {
+			return nil, err
+		}
+		config, err := aacparser.ParseMPEG4AudioConfigBytes(configBytes)
+		if err != nil {
+			return nil, err
+		}
+		t.mpeg4AudioConfig = &config
+		t.mpeg4AudioConfigBytes = configBytes
+		t.sizeLength, _ = strconv.Atoi(fmtp["sizelength"])
+		t.indexLength, _ = strconv.Atoi(fmtp["indexlength"])
+		t.indexDeltaLength, _ = strconv.Atoi(fmtp["indexdeltalength"])
+		if t.sizeLength == 0 {
+			return nil, errors.New("missing aac sizelength")
+		}
+	case md.MediaName.Media == "audio" && codec == "opus":
+		t.mediaType = hub.Audio
+		t.codecType = hub.CodecTypeOpus
+	default:
+		return nil, nil
+	}
+	if t.clockRate == 0 {
+		return nil, fmt.Errorf("missing clock rate for payload type %d", pt)
+	}
+	return t, nil
+}
+
+// rtpmap returns the lowercase encoding name and the clock rate of a payload type.
+func rtpmap(md *sdp.MediaDescription, format string) (string, uint32) {
+	for _, attr := range md.Attributes {
+		if attr.Key != "rtpmap" {
+			continue
+		}
+		pt, encoding, ok := strings.Cut(attr.Value, " ")
+		if !ok || pt != format {
+			continue
+		}
+		parts := strings.Split(encoding, "/")
+		var clockRate uint64
+		if len(parts) > 1 {
+			clockRate, _ = strconv.ParseUint(parts[1], 10, 32)
+		}
+		return strings.ToLower(parts[0]), uint32(clockRate)
+	}
+	return "", 0
+}
+
+func fmtpParams(md *sdp.MediaDescription, format string) map[string]string {
+	params := map[string]string{}
+	for _, attr := range md.Attributes {
+		if attr.Key != "fmtp" {
+			continue
+		}
+		pt, values, ok := strings.Cut(attr.Value, " ")
+		if !ok || pt != format {
+			continue
+		}
+		for _, param := range strings.Split(values, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			params[strings.ToLower(key)] = value
+		}
+	}
+	return params
+}
+
+func controlURL(baseURL string, control string) string {
+	switch {
+	case control == "" || control == "*":
+		return baseURL
+	case strings.HasPrefix(strings.ToLower(control), "rtsp://"):
+		return control
+	case strings.HasSuffix(baseURL, "/"):
+		return baseURL + control
+	default:
+		return baseURL + "/" + control
+	}
+}
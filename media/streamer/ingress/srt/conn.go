@@ -0,0 +1,400 @@
+package srt
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"liveflow/log"
+)
+
+const (
+	ackInterval        = 10 * time.Millisecond
+	minNAKInterval     = 20 * time.Millisecond
+	keepaliveInterval  = 1 * time.Second
+	peerIdleTimeout    = 5 * time.Second
+	defaultRTT         = 100 * time.Millisecond
+	incomingQueueSize  = 1024
+	payloadQueueSize   = 4096
+	maxLossRange       = 8192
+	availableBufferPkt = 8192
+)
+
+type bufferedPacket struct {
+	*packet
+	deliverAt time.Time
+}
+
+// conn is the receiving side of a single SRT connection.
+// Packets are pushed by the UDP reader and the reordered payloads are read through Read.
+type conn struct {
+	socketID     uint32
+	peerSocketID uint32
+	remote       *net.UDPAddr
+	streamID     string
+	latency      time.Duration
+	decrypter    *decrypter
+	write        func(b []byte) error
+	start        time.Time
+
+	incoming  chan *packet
+	payloads  chan []byte
+	pending   []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Receiver state, owned by the run goroutine.
+	nextSeq     uint32
+	maxSeq      uint32
+	buffer      map[uint32]*bufferedPacket
+	losses      map[uint32]time.Time
+	ackNumber   uint32
+	ackTimes    map[uint32]time.Time
+	lastAckSeq  uint32
+	rtt         time.Duration
+	rttVar      time.Duration
+	lastRecv    time.Time
+	lastSend    time.Time
+	tsbpdBase   time.Time
+	lastTS      uint32
+	tsWraps     int64
+	recvPackets uint32
+	recvBytes   uint32
+	lastRateAt  time.Time
+}
+
+type connArgs struct {
+	SocketID     uint32
+	PeerSocketID uint32
+	Remote       *net.UDPAddr
+	StreamID     string
+	InitialSeq   uint32
+	Latency      time.Duration
+	Decrypter    *decrypter
+	Write        func(b []byte) error
+}
+
+func newConn(args connArgs) *conn {
+	now := time.Now()
+	return &conn{
+		socketID:     args.SocketID,
+		peerSocketID: args.PeerSocketID,
+		remote:       args.Remote,
+		streamID:     args.StreamID,
+		latency:      args.Latency,
+		decrypter:    args.Decrypter,
+		write:        args.Write,
+		start:        now,
+		incoming:     make(chan *packet, incomingQueueSize),
+		payloads:     make(chan []byte, payloadQueueSize),
+		done:         make(chan struct{}),
+		nextSeq:      args.InitialSeq,
+		maxSeq:       seqAdd(args.InitialSeq, -1),
+		lastAckSeq:   args.InitialSeq,
+		buffer:       map[uint32]*bufferedPacket{},
+		losses:       map[uint32]time.Time{},
+		ackTimes:     map[uint32]time.Time{},
+		rtt:          defaultRTT,
+		rttVar:       defaultRTT / 2,
+		lastRecv:     now,
+		lastSend:     now,
+		lastRateAt:   now,
+	}
+}
+
+// push hands a packet received by the socket reader to the connection.
+func (c *conn) push(p *packet) {
+	select {
+	case c.incoming <- p:
+	case <-c.done:
+	default:
+		log.Warn(context.Background(), "srt incoming queue is full, dropping packet")
+	}
+}
+
+// Read returns the in-order payload of the connection, which is an MPEG-TS byte stream.
+func (c *conn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		payload, ok := <-c.payloads
+		if !ok {
+			return 0, io.EOF
+		}
+		c.pending = payload
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close ends the connection; the run goroutine notifies the peer.
+func (c *conn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+func (c *conn) run(ctx context.Context) {
+	defer close(c.payloads)
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			c.Close()
+			c.sendControl(controlShutdown, 0, make([]byte, 4))
+			return
+		case <-c.done:
+			c.sendControl(controlShutdown, 0, make([]byte, 4))
+			return
+		case p := <-c.incoming:
+			c.lastRecv = time.Now()
+			if !c.handlePacket(ctx, p) {
+				c.Close()
+				return
+			}
+		case now := <-ticker.C:
+			if now.Sub(c.lastRecv) > peerIdleTimeout {
+				log.Warn(ctx, "srt peer idle timeout")
+				c.Close()
+				return
+			}
+			c.dropTooLate(ctx, now)
+			c.sendACK(now)
+			c.sendPeriodicNAK(now)
+			if now.Sub(c.lastSend) >= keepaliveInterval {
+				c.sendControl(controlKeepalive, 0, nil)
+			}
+		}
+	}
+}
+
+// handlePacket returns false when the peer has shut the connection down.
+func (c *conn) handlePacket(ctx context.Context, p *packet) bool {
+	if !p.isControl {
+		c.onData(ctx, p)
+		return true
+	}
+	switch p.controlType {
+	case controlShutdown:
+		log.Info(ctx, "srt peer shutdown")
+		return false
+	case controlACKACK:
+		c.onACKACK(p.typeSpecific)
+	}
+	return true
+}
+
+func (c *conn) onData(ctx context.Context, p *packet) {
+	if p.keyFlag() != 0 {
+		if c.decrypter == nil {
+			log.Warn(ctx, "srt encrypted packet without a passphrase")
+			return
+		}
+		if err := c.decrypter.decrypt(p); err != nil {
+			log.Error(ctx, err, "failed to decrypt srt packet")
+			return
+		}
+	}
+	ts := c.unwrapTimestamp(p.timestamp)
+	if c.tsbpdBase.IsZero() {
+		c.tsbpdBase = time.Now().Add(-time.Duration(ts) * time.Microsecond)
+	}
+	c.recvPackets++
+	c.recvBytes += uint32(len(p.payload))
+
+	diff := seqDiff(p.seq, c.nextSeq)
+	if diff < 0 {
+		return
+	}
+	if diff == 0 {
+		delete(c.losses, p.seq)
+		c.deliver(ctx, p)
+		c.nextSeq = seqAdd(c.nextSeq, 1)
+		if seqDiff(c.nextSeq, c.maxSeq) > 0 {
+			c.maxSeq = seqAdd(c.nextSeq, -1)
+		}
+		c.flush(ctx)
+		return
+	}
+	if _, exists := c.buffer[p.seq]; exists {
+		return
+	}
+	c.buffer[p.seq] = &bufferedPacket{
+		packet:    p,
+		deliverAt: c.tsbpdBase.Add(time.Duration(ts)*time.Microsecond + c.latency),
+	}
+	delete(c.losses, p.seq)
+	gap := seqDiff(p.seq, c.maxSeq)
+	if gap <= 0 {
+		return
+	}
+	if gap > maxLossRange {
+		log.Warnf(ctx, "srt sequence jumped by %d packets", gap)
+	}
+	var lost []uint32
+	now := time.Now()
+	for s := seqAdd(c.maxSeq, 1); s != p.seq && len(lost) < maxLossRange; s = seqAdd(s, 1) {
+		if seqDiff(s, c.nextSeq) < 0 {
+			continue
+		}
+		c.losses[s] = now
+		lost = append(lost, s)
+	}
+	c.maxSeq = p.seq
+	c.sendNAK(lost)
+}
+
+func (c *conn) flush(ctx context.Context) {
+	for {
+		p, ok := c.buffer[c.nextSeq]
+		if !ok {
+			return
+		}
+		delete(c.buffer, c.nextSeq)
+		c.deliver(ctx, p.packet)
+		c.nextSeq = seqAdd(c.nextSeq, 1)
+	}
+}
+
+func (c *conn) deliver(ctx context.Context, p *packet) {
+	select {
+	case c.payloads <- p.payload:
+	default:
+		log.Warn(ctx, "srt payload queue is full, dropping packet")
+	}
+}
+
+// dropTooLate gives up on missing packets once the first packet after the gap is due for playback.
+func (c *conn) dropTooLate(ctx context.Context, now time.Time) {
+	if len(c.buffer) == 0 {
+		return
+	}
+	var first *bufferedPacket
+	for seq, p := range c.buffer {
+		if first == nil || seqDiff(seq, first.seq) < 0 {
+			first = p
+		}
+	}
+	if now.Before(first.deliverAt) {
+		return
+	}
+	dropped := seqDiff(first.seq, c.nextSeq)
+	for s := c.nextSeq; s != first.seq; s = seqAdd(s, 1) {
+		delete(c.losses, s)
+	}
+	log.Warnf(ctx, "srt dropped %d packets that were not recovered in time", dropped)
+	c.nextSeq = first.seq
+	c.flush(ctx)
+}
+
+func (c *conn) unwrapTimestamp(ts uint32) int64 {
+	if ts < c.lastTS && c.lastTS-ts > 1<<31 {
+		c.tsWraps++
+	}
+	c.lastTS = ts
+	return c.tsWraps<<32 | int64(ts)
+}
+
+func (c *conn) sendACK(now time.Time) {
+	if c.nextSeq == c.lastAckSeq {
+		return
+	}
+	c.lastAckSeq = c.nextSeq
+	c.ackNumber++
+	c.ackTimes[c.ackNumber] = now
+	elapsed := now.Sub(c.lastRateAt).Seconds()
+	var packetRate, byteRate uint32
+	if elapsed > 0 {
+		packetRate = uint32(float64(c.recvPackets) / elapsed)
+		byteRate = uint32(float64(c.recvBytes) / elapsed)
+	}
+	if elapsed >= 1 {
+		c.recvPackets, c.recvBytes, c.lastRateAt = 0, 0, now
+	}
+	cif := make([]byte, 28)
+	binary.BigEndian.PutUint32(cif[0:4], c.nextSeq)
+	binary.BigEndian.PutUint32(cif[4:8], uint32(c.rtt.Microseconds()))
+	binary.BigEndian.PutUint32(cif[8:12], uint32(c.rttVar.Microseconds()))
+	binary.BigEndian.PutUint32(cif[12:16], availableBufferPkt)
+	binary.BigEndian.PutUint32(cif[16:20], packetRate)
+	binary.BigEndian.PutUint32(cif[20:24], packetRate)
+	binary.BigEndian.PutUint32(cif[24:28], byteRate)
+	c.sendControl(controlACK, c.ackNumber, cif)
+}
+
+func (c *conn) onACKACK(ackNumber uint32) {
+	sentAt, ok := c.ackTimes[ackNumber]
+	if !ok {
+		return
+	}
+	for n := range c.ackTimes {
+		if n <= ackNumber {
+			delete(c.ackTimes, n)
+		}
+	}
+	sample := time.Since(sentAt)
+	delta := c.rtt - sample
+	if delta < 0 {
+		delta = -delta
+	}
+	c.rttVar = (3*c.rttVar + delta) / 4
+	c.rtt = (7*c.rtt + sample) / 8
+}
+
+func (c *conn) sendPeriodicNAK(now time.Time) {
+	interval := c.rtt + 4*c.rttVar
+	if interval < minNAKInterval {
+		interval = minNAKInterval
+	}
+	var lost []uint32
+	for seq, last := range c.losses {
+		if now.Sub(last) >= interval {
+			c.losses[seq] = now
+			lost = append(lost, seq)
+		}
+	}
+	c.sendNAK(lost)
+}
+
+// sendNAK reports lost sequence numbers, compressing consecutive numbers into ranges.
+func (c *conn) sendNAK(lost []uint32) {
+	if len(lost) == 0 {
+		return
+	}
+	sort.Slice(lost, func(i, j int) bool {
+		return seqDiff(lost[i], c.nextSeq) < seqDiff(lost[j], c.nextSeq)
+	})
+	var cif []byte
+	for i := 0; i < len(lost); {
+		j := i
+		for j+1 < len(lost) && lost[j+1] == seqAdd(lost[j], 1) {
+			j++
+		}
+		if i == j {
+			cif = binary.BigEndian.AppendUint32(cif, lost[i])
+		} else {
+			cif = binary.BigEndian.AppendUint32(cif, lost[i]|0x80000000)
+			cif = binary.BigEndian.AppendUint32(cif, lost[j])
+		}
+		i = j + 1
+	}
+	c.sendControl(controlNAK, 0, cif)
+}
+
+func (c *conn) sendControl(typ controlType, typeSpecific uint32, cif []byte) {
+	p := newControlPacket(typ, typeSpecific, cif)
+	p.timestamp = uint32(time.Since(c.start).Microseconds())
+	p.destSocketID = c.peerSocketID
+	if err := c.write(p.marshal()); err != nil {
+		log.Error(context.Background(), err, "failed to send srt control packet")
+	}
+	c.lastSend = time.Now()
+}
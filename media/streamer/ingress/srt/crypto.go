@@ -0,0 +1,209 @@
+package srt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	errInvalidKeyMaterial = errors.New("invalid srt key material")
+	errBadSecret          = errors.New("srt passphrase does not match")
+	errNoKey              = errors.New("no key for encrypted srt packet")
+)
+
+const (
+	kmHeaderSize      = 16
+	kmSaltSize        = 16
+	kmCipherAESCTR    = 2
+	kmStreamEncapSRT  = 2
+	kmKeyFlagEven     = 0x1
+	kmKeyFlagOdd      = 0x2
+	kmWrapICVSize     = 8
+	pbkdf2Iterations  = 2048
+	defaultKeyLength  = 16
+	kmHeaderSignature = 0x12202900 // version 1, packet type KMmsg, signature "HAI"
+)
+
+var keyWrapIV = []byte{0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6}
+
+// keyMaterial is the KMREQ/KMRSP message carrying the wrapped stream encrypting keys.
+type keyMaterial struct {
+	keyFlags uint8
+	salt     []byte
+	keyLen   int
+	wrapped  []byte
+}
+
+func parseKeyMaterial(b []byte) (*keyMaterial, error) {
+	if len(b) < kmHeaderSize {
+		return nil, errInvalidKeyMaterial
+	}
+	if binary.BigEndian.Uint32(b[0:4])&^0x3 != kmHeaderSignature || b[8] != kmCipherAESCTR {
+		return nil, errInvalidKeyMaterial
+	}
+	km := &keyMaterial{
+		keyFlags: b[3] & 0x3,
+		keyLen:   int(b[15]) * 4,
+	}
+	saltLen := int(b[14]) * 4
+	keyCount := 1
+	if km.keyFlags == kmKeyFlagEven|kmKeyFlagOdd {
+		keyCount = 2
+	}
+	if km.keyFlags == 0 || saltLen != kmSaltSize || len(b) < kmHeaderSize+saltLen+kmWrapICVSize+keyCount*km.keyLen {
+		return nil, errInvalidKeyMaterial
+	}
+	km.salt = b[kmHeaderSize : kmHeaderSize+saltLen]
+	km.wrapped = b[kmHeaderSize+saltLen : kmHeaderSize+saltLen+kmWrapICVSize+keyCount*km.keyLen]
+	return km, nil
+}
+
+func (km *keyMaterial) marshal() []byte {
+	b := make([]byte, kmHeaderSize, kmHeaderSize+len(km.salt)+len(km.wrapped))
+	binary.BigEndian.PutUint32(b[0:4], kmHeaderSignature|uint32(km.keyFlags))
+	b[8] = kmCipherAESCTR
+	b[10] = kmStreamEncapSRT
+	b[14] = byte(len(km.salt) / 4)
+	b[15] = byte(km.keyLen / 4)
+	b = append(b, km.salt...)
+	return append(b, km.wrapped...)
+}
+
+// decrypter holds the even and odd stream encrypting keys of a connection.
+type decrypter struct {
+	salt []byte
+	even cipher.Block
+	odd  cipher.Block
+}
+
+func newDecrypter(km *keyMaterial, passphrase string) (*decrypter, error) {
+	kek := deriveKEK(passphrase, km.salt, km.keyLen)
+	keys, err := unwrapKey(kek, km.wrapped)
+	if err != nil {
+		return nil, err
+	}
+	d := &decrypter{salt: km.salt}
+	if km.keyFlags&kmKeyFlagEven != 0 {
+		if d.even, err = aes.NewCipher(keys[:km.keyLen]); err != nil {
+			return nil, err
+		}
+		keys = keys[km.keyLen:]
+	}
+	if km.keyFlags&kmKeyFlagOdd != 0 {
+		if d.odd, err = aes.NewCipher(keys[:km.keyLen]); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// newKeyMaterial generates a fresh even key, used when we are the caller of an encrypted connection.
+func newKeyMaterial(passphrase string, keyLen int) (*keyMaterial, *decrypter, error) {
+	salt := make([]byte, kmSaltSize)
+	sek := make([]byte, keyLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(sek); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := wrapKey(deriveKEK(passphrase, salt, keyLen), sek)
+	if err != nil {
+		return nil, nil, err
+	}
+	km := &keyMaterial{
+		keyFlags: kmKeyFlagEven,
+		salt:     salt,
+		keyLen:   keyLen,
+		wrapped:  wrapped,
+	}
+	d, err := newDecrypter(km, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	return km, d, nil
+}
+
+func (d *decrypter) decrypt(p *packet) error {
+	var block cipher.Block
+	switch p.keyFlag() {
+	case kmKeyFlagEven:
+		block = d.even
+	case kmKeyFlagOdd:
+		block = d.odd
+	}
+	if block == nil {
+		return errNoKey
+	}
+	// The counter block is the salt XORed with the packet index at bytes 10..13.
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint32(iv[10:14], p.seq)
+	for i := 0; i < 14; i++ {
+		iv[i] ^= d.salt[i]
+	}
+	cipher.NewCTR(block, iv).XORKeyStream(p.payload, p.payload)
+	return nil
+}
+
+func deriveKEK(passphrase string, salt []byte, keyLen int) []byte {
+	return pbkdf2.Key([]byte(passphrase), salt[len(salt)-8:], pbkdf2Iterations, keyLen, sha1.New)
+}
+
+// unwrapKey implements the AES key unwrap of RFC 3394.
+func unwrapKey(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, errInvalidKeyMaterial
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(wrapped)/8 - 1
+	a := append([]byte{}, wrapped[:8]...)
+	r := append([]byte{}, wrapped[8:]...)
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(a)^t)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Decrypt(buf, buf)
+			copy(a, buf[:8])
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+	if subtle.ConstantTimeCompare(a, keyWrapIV) != 1 {
+		return nil, errBadSecret
+	}
+	return r, nil
+}
+
+// wrapKey implements the AES key wrap of RFC 3394.
+func wrapKey(kek, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(key) / 8
+	a := append([]byte{}, keyWrapIV...)
+	r := append([]byte{}, key...)
+	buf := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf[:8], a)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Encrypt(buf, buf)
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(buf[:8])^t)
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+	return append(a, r...), nil
+}
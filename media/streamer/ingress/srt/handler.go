@@ -0,0 +1,298 @@
+package srt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/asticode/go-astits"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/sirupsen/logrus"
+
+	"liveflow/log"
+	"liveflow/media/hub"
+	"liveflow/media/streamer/fields"
+	"liveflow/media/streamer/ingress"
+)
+
+const (
+	mpegtsClockRate = 90000
+	aacSamples      = 1024
+	ptsWrap         = 1 << 33
+	naluTypeAUD     = 9
+)
+
+// Handler demuxes the MPEG-TS carried by an SRT connection and publishes it to the hub.
+type Handler struct {
+	hub      *hub.Hub
+	conn     *conn
+	streamID string
+
+	mediaSpecs     []hub.MediaSpec
+	notifiedSource bool
+	// closed is set when the server disconnects the publisher
+	closed atomic.Bool
+
+	videoPID uint16
+	audioPID uint16
+	sps      []byte
+	pps      []byte
+
+	mpeg4AudioConfigBytes []byte
+	mpeg4AudioConfig      *aacparser.MPEG4AudioConfig
+
+	timestampBase    int64
+	hasTimestampBase bool
+	lastVideoDTS     int64
+	lastAudioPTS     int64
+}
+
+func (h *Handler) Depth() int {
+	return 0
+}
+
+func (h *Handler) Name() string {
+	return "srt"
+}
+
+func (h *Handler) MediaSpecs() []hub.MediaSpec {
+	return h.mediaSpecs
+}
+
+func (h *Handler) StreamID() string {
+	return h.streamID
+}
+
+func (h *Handler) Serve(ctx context.Context) {
+	ctx = log.WithFields(ctx, logrus.Fields{
+		fields.StreamID:   h.streamID,
+		fields.SourceName: h.Name(),
+	})
+	defer h.OnClose(ctx)
+	// a Read returns the payload of a single SRT packet, the demuxer detects the packet size in a peek of more than that
+	dmx := astits.NewDemuxer(ctx, bufio.NewReader(h.conn))
+	for {
+		data, err := dmx.NextData()
+		if err != nil {
+			if !errors.Is(err, astits.ErrNoMorePackets) && !errors.Is(err, io.EOF) {
+				log.Error(ctx, err, "failed to demux mpegts")
+			}
+			return
+		}
+		switch {
+		case data.PMT != nil:
+			h.onPMT(ctx, data.PMT)
+		case data.PES != nil && data.PES.Header.OptionalHeader != nil && data.PES.Header.OptionalHeader.PTS != nil:
+			switch data.PID {
+			case h.videoPID:
+				h.onVideo(ctx, data.PES)
+			case h.audioPID:
+				h.onAudio(ctx, data.PES)
+			}
+		}
+	}
+}
+
+func (h *Handler) onPMT(ctx context.Context, pmt *astits.PMTData) {
+	if h.videoPID != 0 || h.audioPID != 0 {
+		return
+	}
+	for _, es := range pmt.ElementaryStreams {
+		switch es.StreamType {
+		case astits.StreamTypeH264Video:
+			if h.videoPID == 0 {
+				h.videoPID = es.ElementaryPID
+			}
+		case astits.StreamTypeAACAudio:
+			if h.audioPID == 0 {
+				h.audioPID = es.ElementaryPID
+			}
+		default:
+			log.Warnf(ctx, "unsupported mpegts stream type: %s", es.StreamType)
+		}
+	}
+	if h.videoPID != 0 {
+		h.mediaSpecs = append(h.mediaSpecs, hub.MediaSpec{
+			MediaType: hub.Video,
+			ClockRate: mpegtsClockRate,
+			CodecType: hub.CodecTypeH264,
+		})
+	}
+	h.notifyIfReady(ctx)
+}
+
+// notifyIfReady notifies the hub once every elementary stream is known.
+// The AAC clock rate is only known after the first ADTS header.
+func (h *Handler) notifyIfReady(ctx context.Context) {
+	if h.notifiedSource || (h.videoPID == 0 && h.audioPID == 0) {
+		return
+	}
+	if h.audioPID != 0 && h.mpeg4AudioConfig == nil {
+		return
+	}
+	err := h.hub.Notify(ctx, h)
+	switch {
+	case errors.Is(err, hub.ErrStandby):
+		log.Infof(ctx, "srt publisher of %s is on standby", h.streamID)
+	case err != nil:
+		// the demuxer fails on the closed connection and Serve returns
+		log.Warnf(ctx, "rejected srt publisher of %s: %v", h.streamID, err)
+		h.conn.Close()
+		return
+	}
+	h.notifiedSource = true
+}
+
+func (h *Handler) onVideo(ctx context.Context, pes *astits.PESData) {
+	pts := pes.Header.OptionalHeader.PTS.Base
+	dts := pts
+	if pes.Header.OptionalHeader.DTS != nil {
+		dts = pes.Header.OptionalHeader.DTS.Base
+	}
+	dts = unwrapPTS(dts, h.lastVideoDTS)
+	pts = unwrapPTS(pts, dts)
+	h.lastVideoDTS = dts
+
+	var payload []byte
+	startCode := []byte{0, 0, 0, 1}
+	nalus, _ := h264parser.SplitNALUs(pes.Data)
+	for _, nalu := range nalus {
+		if len(nalu) < 1 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case h264parser.NALU_SPS:
+			h.sps = append([]byte{}, nalu...)
+		case h264parser.NALU_PPS:
+			h.pps = append([]byte{}, nalu...)
+		case naluTypeAUD:
+			continue
+		}
+		payload = append(payload, startCode...)
+		payload = append(payload, nalu...)
+	}
+	if len(payload) == 0 || !h.notifiedSource {
+		return
+	}
+	base := h.baseTimestamp(dts)
+	if dts < base {
+		return
+	}
+	h.hub.Publish(h, h.streamID, &hub.FrameData{
+		H264Video: &hub.H264Video{
+			VideoClockRate: mpegtsClockRate,
+			PTS:            pts - base,
+			DTS:            dts - base,
+			Data:           payload,
+			SPS:            h.sps,
+			PPS:            h.pps,
+			SliceTypes:     ingress.SliceTypes(payload),
+		},
+	})
+}
+
+// onAudio splits an AAC PES into its ADTS frames and publishes them as raw AAC.
+func (h *Handler) onAudio(ctx context.Context, pes *astits.PESData) {
+	pts := unwrapPTS(pes.Header.OptionalHeader.PTS.Base, h.lastAudioPTS)
+	h.lastAudioPTS = pts
+
+	data := pes.Data
+	for frameIndex := 0; len(data) > 0; frameIndex++ {
+		if len(data) < aacparser.ADTSHeaderLength {
+			log.Warn(ctx, "truncated adts frame")
+			return
+		}
+		config, hdrLen, frameLen, _, err := aacparser.ParseADTSHeader(data)
+		if err != nil || frameLen > len(data) || hdrLen >= frameLen || config.SampleRate == 0 {
+			log.Warn(ctx, "invalid adts frame")
+			return
+		}
+		if h.mpeg4AudioConfig == nil {
+			if err := h.setAudioConfig(config); err != nil {
+				log.Error(ctx, err, "failed to write mpeg4 audio config")
+				return
+			}
+			h.notifyIfReady(ctx)
+		}
+		frame := data[hdrLen:frameLen]
+		data = data[frameLen:]
+		if !h.notifiedSource {
+			continue
+		}
+		framePTS := pts + int64(frameIndex*aacSamples)*mpegtsClockRate/int64(config.SampleRate)
+		base := h.baseTimestamp(framePTS)
+		if framePTS < base {
+			continue
+		}
+		audioClockRate := int64(h.mpeg4AudioConfig.SampleRate)
+		ts := (framePTS - base) * audioClockRate / mpegtsClockRate
+		h.hub.Publish(h, h.streamID, &hub.FrameData{
+			AACAudio: &hub.AACAudio{
+				Data:                  append([]byte{}, frame...),
+				MPEG4AudioConfigBytes: h.mpeg4AudioConfigBytes,
+				MPEG4AudioConfig:      h.mpeg4AudioConfig,
+				PTS:                   ts,
+				DTS:                   ts,
+				AudioClockRate:        uint32(audioClockRate),
+			},
+		})
+	}
+}
+
+func (h *Handler) setAudioConfig(config aacparser.MPEG4AudioConfig) error {
+	var buf bytes.Buffer
+	if err := aacparser.WriteMPEG4AudioConfig(&buf, config); err != nil {
+		return err
+	}
+	h.mpeg4AudioConfig = &config
+	h.mpeg4AudioConfigBytes = buf.Bytes()
+	h.mediaSpecs = append(h.mediaSpecs, hub.MediaSpec{
+		MediaType: hub.Audio,
+		ClockRate: uint32(config.SampleRate),
+		CodecType: hub.CodecTypeAAC,
+	})
+	return nil
+}
+
+// baseTimestamp makes published timestamps start at zero like the other ingresses.
+func (h *Handler) baseTimestamp(ts int64) int64 {
+	if !h.hasTimestampBase {
+		h.timestampBase = ts
+		h.hasTimestampBase = true
+	}
+	return h.timestampBase
+}
+
+// Close disconnects the publisher, e.g. when another publisher takes the stream over. OnClose unpublishes the stream
+// once the demuxer has stopped.
+func (h *Handler) Close() error {
+	h.closed.Store(true)
+	h.conn.Close()
+	return nil
+}
+
+func (h *Handler) OnClose(ctx context.Context) {
+	log.Info(ctx, "OnClose")
+	h.conn.Close()
+	if h.notifiedSource {
+		h.hub.Unpublish(h)
+	}
+}
+
+// unwrapPTS extends a 33-bit MPEG-TS timestamp so that it stays close to the previous one.
+func unwrapPTS(ts int64, prev int64) int64 {
+	if prev == 0 {
+		return ts
+	}
+	ts += prev - prev%ptsWrap
+	if ts-prev > ptsWrap/2 {
+		ts -= ptsWrap
+	} else if prev-ts > ptsWrap/2 {
+		ts += ptsWrap
+	}
+	return ts
+}
@@ -0,0 +1,27 @@
+package srt
+
+import "testing"
+
+func TestUnwrapPTS(t *testing.T) {
+	tests := []struct {
+		name string
+		ts   int64
+		prev int64
+		want int64
+	}{
+		{name: "first timestamp", ts: 900000, prev: 0, want: 900000},
+		{name: "forward", ts: 903000, prev: 900000, want: 903000},
+		{name: "small step back", ts: 897000, prev: 900000, want: 897000},
+		{name: "wrap", ts: 1000, prev: ptsWrap - 3000, want: ptsWrap + 1000},
+		{name: "after wrap", ts: 4000, prev: ptsWrap + 1000, want: ptsWrap + 4000},
+		{name: "reordered across wrap", ts: ptsWrap - 2000, prev: ptsWrap + 1000, want: ptsWrap - 2000},
+		{name: "second wrap", ts: 500, prev: 2*ptsWrap - 1000, want: 2*ptsWrap + 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unwrapPTS(tt.ts, tt.prev); got != tt.want {
+				t.Fatalf("unwrapPTS(%d, %d) = %d, want %d", tt.ts, tt.prev, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package srt
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+var (
+	errShortHandshake = errors.New("srt handshake too short")
+)
+
+const (
+	handshakeCIFSize = 48
+	srtMagic         = 0x4A17
+	srtVersion       = 0x00010500
+)
+
+type handshakeType uint32
+
+const (
+	handshakeTypeInduction  handshakeType = 0x00000001
+	handshakeTypeConclusion handshakeType = 0xFFFFFFFF
+)
+
+// Handshake extension types.
+const (
+	extTypeHSREQ = 1
+	extTypeHSRSP = 2
+	extTypeKMREQ = 3
+	extTypeKMRSP = 4
+	extTypeSID   = 5
+)
+
+// Flags carried in the handshake extension field of a conclusion request.
+const (
+	extFlagHSREQ  = 0x1
+	extFlagKMREQ  = 0x2
+	extFlagConfig = 0x4
+)
+
+// SRT flags exchanged in HSREQ/HSRSP.
+const (
+	flagTSBPDSND     = 0x01
+	flagTSBPDRCV     = 0x02
+	flagCRYPT        = 0x04
+	flagTLPKTDROP    = 0x08
+	flagPERIODICNAK  = 0x10
+	flagREXMITFLG    = 0x20
+	receiverSRTFlags = flagTSBPDRCV | flagCRYPT | flagTLPKTDROP | flagPERIODICNAK | flagREXMITFLG
+)
+
+// Rejection reasons sent back in the handshake type field.
+const (
+	rejectPeer       handshakeType = 1002
+	rejectRogue      handshakeType = 1004
+	rejectVersion    handshakeType = 1008
+	rejectBadSecret  handshakeType = 1010
+	rejectUnsecure   handshakeType = 1011
+	rejectBadRequest handshakeType = 1400
+)
+
+func (t handshakeType) isRejection() bool {
+	return t >= 1000 && t < 3000
+}
+
+type handshakeExtension struct {
+	typ  uint16
+	data []byte
+}
+
+type handshake struct {
+	version    uint32
+	encryption uint16
+	extension  uint16
+	initialSeq uint32
+	mtu        uint32
+	flowWindow uint32
+	hsType     handshakeType
+	socketID   uint32
+	cookie     uint32
+	peerIP     [16]byte
+	extensions []handshakeExtension
+}
+
+func parseHandshake(b []byte) (*handshake, error) {
+	if len(b) < handshakeCIFSize {
+		return nil, errShortHandshake
+	}
+	h := &handshake{
+		version:    binary.BigEndian.Uint32(b[0:4]),
+		encryption: binary.BigEndian.Uint16(b[4:6]),
+		extension:  binary.BigEndian.Uint16(b[6:8]),
+		initialSeq: binary.BigEndian.Uint32(b[8:12]) & seqNumberMask,
+		mtu:        binary.BigEndian.Uint32(b[12:16]),
+		flowWindow: binary.BigEndian.Uint32(b[16:20]),
+		hsType:     handshakeType(binary.BigEndian.Uint32(b[20:24])),
+		socketID:   binary.BigEndian.Uint32(b[24:28]),
+		cookie:     binary.BigEndian.Uint32(b[28:32]),
+	}
+	copy(h.peerIP[:], b[32:48])
+	rest := b[handshakeCIFSize:]
+	for len(rest) >= 4 {
+		typ := binary.BigEndian.Uint16(rest[0:2])
+		size := int(binary.BigEndian.Uint16(rest[2:4])) * 4
+		rest = rest[4:]
+		if size > len(rest) {
+			return nil, errShortHandshake
+		}
+		h.extensions = append(h.extensions, handshakeExtension{typ: typ, data: rest[:size]})
+		rest = rest[size:]
+	}
+	return h, nil
+}
+
+func (h *handshake) marshal() []byte {
+	b := make([]byte, handshakeCIFSize)
+	binary.BigEndian.PutUint32(b[0:4], h.version)
+	binary.BigEndian.PutUint16(b[4:6], h.encryption)
+	binary.BigEndian.PutUint16(b[6:8], h.extension)
+	binary.BigEndian.PutUint32(b[8:12], h.initialSeq)
+	binary.BigEndian.PutUint32(b[12:16], h.mtu)
+	binary.BigEndian.PutUint32(b[16:20], h.flowWindow)
+	binary.BigEndian.PutUint32(b[20:24], uint32(h.hsType))
+	binary.BigEndian.PutUint32(b[24:28], h.socketID)
+	binary.BigEndian.PutUint32(b[28:32], h.cookie)
+	copy(b[32:48], h.peerIP[:])
+	for _, ext := range h.extensions {
+		hdr := make([]byte, 4)
+		binary.BigEndian.PutUint16(hdr[0:2], ext.typ)
+		binary.BigEndian.PutUint16(hdr[2:4], uint16(len(ext.data)/4))
+		b = append(b, hdr...)
+		b = append(b, ext.data...)
+	}
+	return b
+}
+
+func (h *handshake) findExtension(typ uint16) ([]byte, bool) {
+	for _, ext := range h.extensions {
+		if ext.typ == typ {
+			return ext.data, true
+		}
+	}
+	return nil, false
+}
+
+// hsExtension is the content of HSREQ and HSRSP.
+type hsExtension struct {
+	version       uint32
+	flags         uint32
+	receiverDelay uint16
+	senderDelay   uint16
+}
+
+func parseHSExtension(b []byte) (*hsExtension, error) {
+	if len(b) < 12 {
+		return nil, errShortHandshake
+	}
+	return &hsExtension{
+		version:       binary.BigEndian.Uint32(b[0:4]),
+		flags:         binary.BigEndian.Uint32(b[4:8]),
+		receiverDelay: binary.BigEndian.Uint16(b[8:10]),
+		senderDelay:   binary.BigEndian.Uint16(b[10:12]),
+	}, nil
+}
+
+func (e *hsExtension) marshal() []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b[0:4], e.version)
+	binary.BigEndian.PutUint32(b[4:8], e.flags)
+	binary.BigEndian.PutUint16(b[8:10], e.receiverDelay)
+	binary.BigEndian.PutUint16(b[10:12], e.senderDelay)
+	return b
+}
+
+// The stream ID is sent as 32-bit words with the bytes of each word reversed.
+func parseStreamID(b []byte) string {
+	out := make([]byte, 0, len(b))
+	for i := 0; i+4 <= len(b); i += 4 {
+		out = append(out, b[i+3], b[i+2], b[i+1], b[i])
+	}
+	for len(out) > 0 && out[len(out)-1] == 0 {
+		out = out[:len(out)-1]
+	}
+	return string(out)
+}
+
+func marshalStreamID(streamID string) []byte {
+	padded := make([]byte, (len(streamID)+3)/4*4)
+	copy(padded, streamID)
+	out := make([]byte, len(padded))
+	for i := 0; i < len(padded); i += 4 {
+		out[i], out[i+1], out[i+2], out[i+3] = padded[i+3], padded[i+2], padded[i+1], padded[i]
+	}
+	return out
+}
+
+func marshalPeerIP(addr *net.UDPAddr) [16]byte {
+	var ret [16]byte
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		// IPv4 is stored as the first 32-bit word in little-endian order.
+		ret[0], ret[1], ret[2], ret[3] = ip4[3], ip4[2], ip4[1], ip4[0]
+		return ret
+	}
+	copy(ret[:], addr.IP.To16())
+	return ret
+}
@@ -0,0 +1,109 @@
+package srt
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	hs := &handshake{
+		version:    5,
+		encryption: 2,
+		extension:  extFlagHSREQ | extFlagKMREQ | extFlagConfig,
+		initialSeq: 0x12345678,
+		mtu:        1500,
+		flowWindow: 8192,
+		hsType:     handshakeTypeConclusion,
+		socketID:   0xCAFEBABE,
+		cookie:     0x0BADF00D,
+		peerIP:     marshalPeerIP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}),
+		extensions: []handshakeExtension{
+			{typ: extTypeHSREQ, data: (&hsExtension{
+				version:       srtVersion,
+				flags:         receiverSRTFlags,
+				receiverDelay: 120,
+				senderDelay:   200,
+			}).marshal()},
+			{typ: extTypeSID, data: marshalStreamID("live/cam1")},
+		},
+	}
+	b := hs.marshal()
+	got, err := parseHandshake(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.version != hs.version || got.encryption != hs.encryption || got.extension != hs.extension ||
+		got.initialSeq != hs.initialSeq || got.mtu != hs.mtu || got.flowWindow != hs.flowWindow ||
+		got.hsType != hs.hsType || got.socketID != hs.socketID || got.cookie != hs.cookie || got.peerIP != hs.peerIP {
+		t.Fatalf("got %+v, want %+v", got, hs)
+	}
+	if len(got.extensions) != len(hs.extensions) {
+		t.Fatalf("got %d extensions, want %d", len(got.extensions), len(hs.extensions))
+	}
+
+	hsreqBytes, ok := got.findExtension(extTypeHSREQ)
+	if !ok {
+		t.Fatal("HSREQ extension not found")
+	}
+	hsreq, err := parseHSExtension(hsreqBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hsreq.version != srtVersion || hsreq.flags != receiverSRTFlags || hsreq.receiverDelay != 120 || hsreq.senderDelay != 200 {
+		t.Fatalf("got HSREQ %+v", hsreq)
+	}
+	sid, ok := got.findExtension(extTypeSID)
+	if !ok {
+		t.Fatal("SID extension not found")
+	}
+	if streamID := parseStreamID(sid); streamID != "live/cam1" {
+		t.Fatalf("got stream id %q, want %q", streamID, "live/cam1")
+	}
+	if _, ok := got.findExtension(extTypeKMREQ); ok {
+		t.Fatal("found a KMREQ extension that was not sent")
+	}
+}
+
+func TestParseHandshakeErrors(t *testing.T) {
+	if _, err := parseHandshake(make([]byte, handshakeCIFSize-1)); !errors.Is(err, errShortHandshake) {
+		t.Fatalf("short cif: got %v, want %v", err, errShortHandshake)
+	}
+	// an extension that claims two words but carries one
+	b := append(make([]byte, handshakeCIFSize), 0, extTypeSID, 0, 2, 'a', 'b', 'c', 'd')
+	if _, err := parseHandshake(b); !errors.Is(err, errShortHandshake) {
+		t.Fatalf("truncated extension: got %v, want %v", err, errShortHandshake)
+	}
+	if _, err := parseHSExtension(make([]byte, 11)); !errors.Is(err, errShortHandshake) {
+		t.Fatalf("short HSREQ: got %v, want %v", err, errShortHandshake)
+	}
+}
+
+func TestStreamIDEncoding(t *testing.T) {
+	tests := []struct {
+		streamID string
+		wire     []byte
+	}{
+		{streamID: "abcd", wire: []byte("dcba")},
+		{streamID: "abcde", wire: []byte{'d', 'c', 'b', 'a', 0, 0, 0, 'e'}},
+		{streamID: "", wire: []byte{}},
+	}
+	for _, tt := range tests {
+		wire := marshalStreamID(tt.streamID)
+		if !bytes.Equal(wire, tt.wire) {
+			t.Errorf("marshalStreamID(%q) = %q, want %q", tt.streamID, wire, tt.wire)
+		}
+		if got := parseStreamID(wire); got != tt.streamID {
+			t.Errorf("parseStreamID(%q) = %q, want %q", wire, got, tt.streamID)
+		}
+	}
+}
+
+func TestMarshalPeerIP(t *testing.T) {
+	got := marshalPeerIP(&net.UDPAddr{IP: net.IPv4(192, 168, 1, 2)})
+	want := [16]byte{2, 1, 168, 192}
+	if got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,110 @@
+package srt
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	errShortPacket = errors.New("srt packet too short")
+)
+
+const (
+	headerSize    = 16
+	maxPacketSize = 1500
+	seqNumberMask = 0x7FFFFFFF
+)
+
+type controlType uint16
+
+const (
+	controlHandshake controlType = 0x0000
+	controlKeepalive controlType = 0x0001
+	controlACK       controlType = 0x0002
+	controlNAK       controlType = 0x0003
+	controlShutdown  controlType = 0x0005
+	controlACKACK    controlType = 0x0006
+)
+
+// packet is either a data packet or a control packet.
+// For control packets, payload holds the control information field (CIF).
+type packet struct {
+	isControl bool
+
+	// data packet
+	seq      uint32
+	msgFlags uint32
+
+	// control packet
+	controlType  controlType
+	subtype      uint16
+	typeSpecific uint32
+
+	timestamp    uint32
+	destSocketID uint32
+	payload      []byte
+}
+
+func parsePacket(b []byte) (*packet, error) {
+	if len(b) < headerSize {
+		return nil, errShortPacket
+	}
+	p := &packet{
+		timestamp:    binary.BigEndian.Uint32(b[8:12]),
+		destSocketID: binary.BigEndian.Uint32(b[12:16]),
+		payload:      append([]byte{}, b[headerSize:]...),
+	}
+	word0 := binary.BigEndian.Uint32(b[0:4])
+	if word0&0x80000000 != 0 {
+		p.isControl = true
+		p.controlType = controlType((word0 >> 16) & 0x7FFF)
+		p.subtype = uint16(word0)
+		p.typeSpecific = binary.BigEndian.Uint32(b[4:8])
+	} else {
+		p.seq = word0 & seqNumberMask
+		p.msgFlags = binary.BigEndian.Uint32(b[4:8])
+	}
+	return p, nil
+}
+
+func (p *packet) marshal() []byte {
+	b := make([]byte, headerSize+len(p.payload))
+	if p.isControl {
+		binary.BigEndian.PutUint32(b[0:4], 0x80000000|uint32(p.controlType)<<16|uint32(p.subtype))
+		binary.BigEndian.PutUint32(b[4:8], p.typeSpecific)
+	} else {
+		binary.BigEndian.PutUint32(b[0:4], p.seq&seqNumberMask)
+		binary.BigEndian.PutUint32(b[4:8], p.msgFlags)
+	}
+	binary.BigEndian.PutUint32(b[8:12], p.timestamp)
+	binary.BigEndian.PutUint32(b[12:16], p.destSocketID)
+	copy(b[headerSize:], p.payload)
+	return b
+}
+
+// keyFlag returns the KK field of a data packet: 0 plain, 1 even key, 2 odd key.
+func (p *packet) keyFlag() uint8 {
+	return uint8(p.msgFlags>>27) & 0x3
+}
+
+func newControlPacket(typ controlType, typeSpecific uint32, cif []byte) *packet {
+	return &packet{
+		isControl:    true,
+		controlType:  typ,
+		typeSpecific: typeSpecific,
+		payload:      cif,
+	}
+}
+
+// seqDiff returns a-b on the 31-bit sequence number circle.
+func seqDiff(a, b uint32) int32 {
+	d := (a - b) & seqNumberMask
+	if d > seqNumberMask/2 {
+		return int32(d) - seqNumberMask - 1
+	}
+	return int32(d)
+}
+
+func seqAdd(a uint32, n int32) uint32 {
+	return (a + uint32(n)) & seqNumberMask
+}
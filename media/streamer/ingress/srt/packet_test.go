@@ -0,0 +1,110 @@
+package srt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		p    *packet
+	}{
+		{
+			name: "data",
+			p: &packet{
+				seq:          seqNumberMask,
+				msgFlags:     0xC0000001 | 2<<27,
+				timestamp:    123456,
+				destSocketID: 0xDEADBEEF,
+				payload:      []byte{0x47, 1, 2, 3},
+			},
+		},
+		{
+			name: "control",
+			p: &packet{
+				isControl:    true,
+				controlType:  controlACK,
+				subtype:      7,
+				typeSpecific: 42,
+				timestamp:    1,
+				destSocketID: 2,
+				payload:      []byte{0, 0, 0, 1},
+			},
+		},
+		{
+			name: "control without cif",
+			p:    newControlPacket(controlKeepalive, 0, nil),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := tt.p.marshal()
+			if len(b) != headerSize+len(tt.p.payload) {
+				t.Fatalf("marshaled %d bytes, want %d", len(b), headerSize+len(tt.p.payload))
+			}
+			got, err := parsePacket(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.isControl != tt.p.isControl || got.seq != tt.p.seq || got.msgFlags != tt.p.msgFlags ||
+				got.controlType != tt.p.controlType || got.subtype != tt.p.subtype || got.typeSpecific != tt.p.typeSpecific ||
+				got.timestamp != tt.p.timestamp || got.destSocketID != tt.p.destSocketID || !bytes.Equal(got.payload, tt.p.payload) {
+				t.Fatalf("got %+v, want %+v", got, tt.p)
+			}
+		})
+	}
+}
+
+func TestParsePacketShort(t *testing.T) {
+	if _, err := parsePacket(make([]byte, headerSize-1)); !errors.Is(err, errShortPacket) {
+		t.Fatalf("got %v, want %v", err, errShortPacket)
+	}
+}
+
+func TestPacketKeyFlag(t *testing.T) {
+	for _, kk := range []uint8{0, 1, 2} {
+		p := &packet{msgFlags: 0xC0000000 | uint32(kk)<<27}
+		if got := p.keyFlag(); got != kk {
+			t.Errorf("keyFlag() = %d, want %d", got, kk)
+		}
+	}
+}
+
+func TestSeqDiff(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want int32
+	}{
+		{a: 10, b: 10, want: 0},
+		{a: 11, b: 10, want: 1},
+		{a: 10, b: 11, want: -1},
+		{a: 0, b: seqNumberMask, want: 1},
+		{a: seqNumberMask, b: 0, want: -1},
+		{a: 5, b: seqNumberMask - 4, want: 10},
+	}
+	for _, tt := range tests {
+		if got := seqDiff(tt.a, tt.b); got != tt.want {
+			t.Errorf("seqDiff(%d, %d) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSeqAdd(t *testing.T) {
+	tests := []struct {
+		a    uint32
+		n    int32
+		want uint32
+	}{
+		{a: 10, n: 1, want: 11},
+		{a: seqNumberMask, n: 1, want: 0},
+		{a: 0, n: -1, want: seqNumberMask},
+		{a: seqNumberMask - 4, n: 10, want: 5},
+	}
+	for _, tt := range tests {
+		if got := seqAdd(tt.a, tt.n); got != tt.want {
+			t.Errorf("seqAdd(%d, %d) = %d, want %d", tt.a, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,520 @@
+package srt
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"liveflow/log"
+	"liveflow/media/hub"
+)
+
+var (
+	ErrUnknownMode       = errors.New("unknown srt mode")
+	ErrMissingStreamID   = errors.New("srt caller mode requires a stream id")
+	ErrHandshakeTimeout  = errors.New("srt handshake timeout")
+	ErrHandshakeRejected = errors.New("srt handshake rejected")
+	// ErrClosed ends a caller connection closed by the server, e.g. by a takeover or an admin.
+	ErrClosed = errors.New("srt connection closed by the server")
+)
+
+const (
+	ModeListener = "listener"
+	ModeCaller   = "caller"
+)
+
+const (
+	defaultLatency         = 120 * time.Millisecond
+	defaultMTU             = 1500
+	defaultFlowWindow      = 8192
+	handshakeRetryInterval = 250 * time.Millisecond
+	handshakeTimeout       = 3 * time.Second
+	callerReconnectDelay   = 3 * time.Second
+)
+
+type SRT struct {
+	hub        *hub.Hub
+	port       int
+	mode       string
+	address    string
+	streamID   string
+	passphrase string
+	latency    time.Duration
+
+	mu           sync.Mutex
+	conns        map[uint32]*conn
+	peers        map[string]*acceptedPeer
+	cookieSecret []byte
+}
+
+type SRTArgs struct {
+	Hub *hub.Hub
+	// Port is the local UDP port of the listener.
+	Port int
+	// Mode is either ModeListener or ModeCaller.
+	Mode string
+	// Address is the remote host:port that is dialed in caller mode.
+	Address string
+	// StreamID is sent to the remote in caller mode and used as the published stream ID.
+	StreamID   string
+	Passphrase string
+	LatencyMS  int
+}
+
+// acceptedPeer keeps the conclusion response so that retransmitted conclusions get the same answer.
+type acceptedPeer struct {
+	conn     *conn
+	response []byte
+}
+
+func NewSRT(args SRTArgs) *SRT {
+	latency := time.Duration(args.LatencyMS) * time.Millisecond
+	if latency == 0 {
+		latency = defaultLatency
+	}
+	mode := args.Mode
+	if mode == "" {
+		mode = ModeListener
+	}
+	secret := make([]byte, 16)
+	_, _ = rand.Read(secret)
+	return &SRT{
+		hub:          args.Hub,
+		port:         args.Port,
+		mode:         mode,
+		address:      args.Address,
+		streamID:     args.StreamID,
+		passphrase:   args.Passphrase,
+		latency:      latency,
+		conns:        map[uint32]*conn{},
+		peers:        map[string]*acceptedPeer{},
+		cookieSecret: secret,
+	}
+}
+
+func (r *SRT) Serve(ctx context.Context) error {
+	switch r.mode {
+	case ModeListener:
+		return r.listen(ctx)
+	case ModeCaller:
+		if r.streamID == "" {
+			return ErrMissingStreamID
+		}
+		for {
+			err := r.call(ctx)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, ErrClosed) {
+				// calling again right away would take the stream back from the publisher that took it over
+				log.Infof(ctx, "srt caller closed, calling again once %s is unpublished", r.streamID)
+				if !r.waitUnpublished(ctx) {
+					return nil
+				}
+				continue
+			}
+			if err != nil {
+				log.Errorf(ctx, "srt caller failed: %+v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(callerReconnectDelay):
+			}
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownMode, r.mode)
+	}
+}
+
+func (r *SRT) listen(ctx context.Context) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", ":"+strconv.Itoa(r.port))
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = pc.Close()
+	}()
+	log.Info(ctx, "SRT server started")
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		p, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		if p.isControl && p.controlType == controlHandshake && p.destSocketID == 0 {
+			r.onHandshake(ctx, pc, addr, p)
+			continue
+		}
+		r.mu.Lock()
+		c, ok := r.conns[p.destSocketID]
+		r.mu.Unlock()
+		if ok && c.remote.String() == addr.String() {
+			c.push(p)
+		}
+	}
+}
+
+func (r *SRT) onHandshake(ctx context.Context, pc *net.UDPConn, addr *net.UDPAddr, p *packet) {
+	hs, err := parseHandshake(p.payload)
+	if err != nil {
+		log.Error(ctx, err, "failed to parse srt handshake")
+		return
+	}
+	write := func(b []byte) error {
+		_, err := pc.WriteToUDP(b, addr)
+		return err
+	}
+	switch hs.hsType {
+	case handshakeTypeInduction:
+		resp := &handshake{
+			version:    5,
+			extension:  srtMagic,
+			initialSeq: hs.initialSeq,
+			mtu:        hs.mtu,
+			flowWindow: hs.flowWindow,
+			hsType:     handshakeTypeInduction,
+			socketID:   randomUint32(),
+			cookie:     r.cookie(addr, time.Now()),
+			peerIP:     marshalPeerIP(addr),
+		}
+		sendHandshake(write, hs.socketID, resp)
+	case handshakeTypeConclusion:
+		now := time.Now()
+		if hs.cookie != r.cookie(addr, now) && hs.cookie != r.cookie(addr, now.Add(-time.Minute)) {
+			r.reject(write, hs, addr, rejectRogue)
+			return
+		}
+		peerKey := fmt.Sprintf("%s/%d", addr, hs.socketID)
+		r.mu.Lock()
+		peer, exists := r.peers[peerKey]
+		r.mu.Unlock()
+		if exists {
+			_ = write(peer.response)
+			return
+		}
+		r.accept(ctx, write, hs, addr, peerKey)
+	}
+}
+
+func (r *SRT) accept(ctx context.Context, write func([]byte) error, hs *handshake, addr *net.UDPAddr, peerKey string) {
+	if hs.version < 5 {
+		r.reject(write, hs, addr, rejectVersion)
+		return
+	}
+	hsreqBytes, ok := hs.findExtension(extTypeHSREQ)
+	if !ok {
+		r.reject(write, hs, addr, rejectVersion)
+		return
+	}
+	hsreq, err := parseHSExtension(hsreqBytes)
+	if err != nil {
+		r.reject(write, hs, addr, rejectPeer)
+		return
+	}
+	var streamID string
+	if sid, ok := hs.findExtension(extTypeSID); ok {
+		streamID = parseStreamID(sid)
+	}
+	if streamID == "" {
+		log.Warn(ctx, "srt caller did not send a stream id")
+		r.reject(write, hs, addr, rejectBadRequest)
+		return
+	}
+
+	var dec *decrypter
+	kmreq, hasKM := hs.findExtension(extTypeKMREQ)
+	if hasKM != (r.passphrase != "") {
+		r.reject(write, hs, addr, rejectUnsecure)
+		return
+	}
+	if hasKM {
+		km, err := parseKeyMaterial(kmreq)
+		if err != nil {
+			r.reject(write, hs, addr, rejectPeer)
+			return
+		}
+		dec, err = newDecrypter(km, r.passphrase)
+		if err != nil {
+			log.Error(ctx, err, "failed to unwrap srt key")
+			r.reject(write, hs, addr, rejectBadSecret)
+			return
+		}
+	}
+
+	latency := r.latency
+	if peerLatency := time.Duration(hsreq.senderDelay) * time.Millisecond; peerLatency > latency {
+		latency = peerLatency
+	}
+	socketID := randomUint32()
+	resp := &handshake{
+		version:    5,
+		extension:  extFlagHSREQ,
+		initialSeq: hs.initialSeq,
+		mtu:        hs.mtu,
+		flowWindow: hs.flowWindow,
+		hsType:     handshakeTypeConclusion,
+		socketID:   socketID,
+		peerIP:     marshalPeerIP(addr),
+		extensions: []handshakeExtension{
+			{typ: extTypeHSRSP, data: (&hsExtension{
+				version:       srtVersion,
+				flags:         receiverSRTFlags,
+				receiverDelay: uint16(latency.Milliseconds()),
+				senderDelay:   uint16(latency.Milliseconds()),
+			}).marshal()},
+		},
+	}
+	if hasKM {
+		resp.extension |= extFlagKMREQ
+		resp.extensions = append(resp.extensions, handshakeExtension{typ: extTypeKMRSP, data: kmreq})
+	}
+	c := newConn(connArgs{
+		SocketID:     socketID,
+		PeerSocketID: hs.socketID,
+		Remote:       addr,
+		StreamID:     streamID,
+		InitialSeq:   hs.initialSeq,
+		Latency:      latency,
+		Decrypter:    dec,
+		Write:        write,
+	})
+	response := sendHandshake(write, hs.socketID, resp)
+	r.mu.Lock()
+	r.conns[socketID] = c
+	r.peers[peerKey] = &acceptedPeer{conn: c, response: response}
+	r.mu.Unlock()
+	log.Infof(ctx, "srt connection accepted: %s streamid=%s latency=%s", addr, streamID, latency)
+
+	go c.run(ctx)
+	go func() {
+		r.serveConn(ctx, c)
+		r.mu.Lock()
+		delete(r.conns, socketID)
+		delete(r.peers, peerKey)
+		r.mu.Unlock()
+	}()
+}
+
+func (r *SRT) reject(write func([]byte) error, hs *handshake, addr *net.UDPAddr, reason handshakeType) {
+	log.Warnf(context.Background(), "srt handshake rejected: %s reason=%d", addr, reason)
+	sendHandshake(write, hs.socketID, &handshake{
+		version:    5,
+		initialSeq: hs.initialSeq,
+		mtu:        hs.mtu,
+		flowWindow: hs.flowWindow,
+		hsType:     reason,
+		peerIP:     marshalPeerIP(addr),
+	})
+}
+
+// call dials the remote listener and receives from it until the connection ends.
+func (r *SRT) call(ctx context.Context) error {
+	raddr, err := net.ResolveUDPAddr("udp", r.address)
+	if err != nil {
+		return err
+	}
+	uc, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return err
+	}
+	defer uc.Close()
+	write := func(b []byte) error {
+		_, err := uc.Write(b)
+		return err
+	}
+
+	socketID := randomUint32()
+	initialSeq := randomUint32() & seqNumberMask
+	induction, err := exchangeHandshake(uc, write, socketID, &handshake{
+		version:    4,
+		extension:  2,
+		initialSeq: initialSeq,
+		mtu:        defaultMTU,
+		flowWindow: defaultFlowWindow,
+		hsType:     handshakeTypeInduction,
+		socketID:   socketID,
+		peerIP:     marshalPeerIP(raddr),
+	})
+	if err != nil {
+		return err
+	}
+	if induction.version < 5 || induction.extension != srtMagic {
+		return fmt.Errorf("%w: peer does not support srt handshake v5", ErrHandshakeRejected)
+	}
+
+	conclusion := &handshake{
+		version:    5,
+		extension:  extFlagHSREQ | extFlagConfig,
+		initialSeq: initialSeq,
+		mtu:        defaultMTU,
+		flowWindow: defaultFlowWindow,
+		hsType:     handshakeTypeConclusion,
+		socketID:   socketID,
+		cookie:     induction.cookie,
+		peerIP:     marshalPeerIP(raddr),
+		extensions: []handshakeExtension{
+			{typ: extTypeHSREQ, data: (&hsExtension{
+				version:       srtVersion,
+				flags:         receiverSRTFlags,
+				receiverDelay: uint16(r.latency.Milliseconds()),
+				senderDelay:   uint16(r.latency.Milliseconds()),
+			}).marshal()},
+			{typ: extTypeSID, data: marshalStreamID(r.streamID)},
+		},
+	}
+	var dec *decrypter
+	if r.passphrase != "" {
+		var km *keyMaterial
+		km, dec, err = newKeyMaterial(r.passphrase, defaultKeyLength)
+		if err != nil {
+			return err
+		}
+		conclusion.encryption = defaultKeyLength / 8
+		conclusion.extension |= extFlagKMREQ
+		conclusion.extensions = append(conclusion.extensions, handshakeExtension{typ: extTypeKMREQ, data: km.marshal()})
+	}
+	resp, err := exchangeHandshake(uc, write, socketID, conclusion)
+	if err != nil {
+		return err
+	}
+	if resp.hsType != handshakeTypeConclusion {
+		return fmt.Errorf("%w: reason=%d", ErrHandshakeRejected, resp.hsType)
+	}
+	latency := r.latency
+	if hsrspBytes, ok := resp.findExtension(extTypeHSRSP); ok {
+		if hsrsp, err := parseHSExtension(hsrspBytes); err == nil {
+			if peerLatency := time.Duration(hsrsp.senderDelay) * time.Millisecond; peerLatency > latency {
+				latency = peerLatency
+			}
+		}
+	}
+
+	c := newConn(connArgs{
+		SocketID:     socketID,
+		PeerSocketID: resp.socketID,
+		Remote:       raddr,
+		StreamID:     r.streamID,
+		InitialSeq:   initialSeq,
+		Latency:      latency,
+		Decrypter:    dec,
+		Write:        write,
+	})
+	log.Infof(ctx, "srt connected to %s streamid=%s latency=%s", raddr, r.streamID, latency)
+	go c.run(ctx)
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, err := uc.Read(buf)
+			if err != nil {
+				c.Close()
+				return
+			}
+			if p, err := parsePacket(buf[:n]); err == nil && p.destSocketID == socketID {
+				c.push(p)
+			}
+		}
+	}()
+	if r.serveConn(ctx, c) {
+		return ErrClosed
+	}
+	return nil
+}
+
+// serveConn publishes the stream of c until the connection ends, it reports whether the server closed it.
+func (r *SRT) serveConn(ctx context.Context, c *conn) bool {
+	h := &Handler{
+		hub:      r.hub,
+		conn:     c,
+		streamID: c.streamID,
+	}
+	h.Serve(ctx)
+	return h.closed.Load()
+}
+
+// waitUnpublished polls the hub with the reconnect delay until no source publishes the stream of the caller.
+// It returns false when ctx is done first.
+func (r *SRT) waitUnpublished(ctx context.Context) bool {
+	for {
+		if _, published := r.hub.Get(r.streamID); !published {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(callerReconnectDelay):
+		}
+	}
+}
+
+// exchangeHandshake sends a handshake until the peer answers or the handshake times out.
+func exchangeHandshake(uc *net.UDPConn, write func([]byte) error, socketID uint32, req *handshake) (*handshake, error) {
+	deadline := time.Now().Add(handshakeTimeout)
+	buf := make([]byte, maxPacketSize)
+	for time.Now().Before(deadline) {
+		sendHandshake(write, 0, req)
+		_ = uc.SetReadDeadline(time.Now().Add(handshakeRetryInterval))
+		for {
+			n, err := uc.Read(buf)
+			if err != nil {
+				break
+			}
+			p, err := parsePacket(buf[:n])
+			if err != nil || !p.isControl || p.controlType != controlHandshake || p.destSocketID != socketID {
+				continue
+			}
+			resp, err := parseHandshake(p.payload)
+			if err != nil {
+				continue
+			}
+			_ = uc.SetReadDeadline(time.Time{})
+			if resp.hsType.isRejection() {
+				return nil, fmt.Errorf("%w: reason=%d", ErrHandshakeRejected, resp.hsType)
+			}
+			return resp, nil
+		}
+	}
+	return nil, ErrHandshakeTimeout
+}
+
+func sendHandshake(write func([]byte) error, destSocketID uint32, hs *handshake) []byte {
+	p := newControlPacket(controlHandshake, 0, hs.marshal())
+	p.destSocketID = destSocketID
+	b := p.marshal()
+	if err := write(b); err != nil {
+		log.Error(context.Background(), err, "failed to send srt handshake")
+	}
+	return b
+}
+
+func (r *SRT) cookie(addr *net.UDPAddr, t time.Time) uint32 {
+	h := sha1.New()
+	h.Write(r.cookieSecret)
+	fmt.Fprintf(h, "%s/%d", addr, t.Unix()/60)
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
+func randomUint32() uint32 {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return binary.BigEndian.Uint32(b)
+}
@@ -0,0 +1,372 @@
+package srt
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astits"
+
+	"liveflow/media/hub"
+)
+
+const (
+	testVideoPID   = 0x100
+	tsPacketsPerSR = 7
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xC0, 0x1F, 0xDA, 0x01, 0x40, 0x16, 0xE8}
+	testPPS = []byte{0x68, 0xCE, 0x3C, 0x80}
+	// an IDR slice with first_mb_in_slice 0 and slice_type 7 (I)
+	testIDR = []byte{0x65, 0x88, 0x84, 0x00, 0x33, 0xFF}
+)
+
+// testSender is the sending side of an SRT connection, as a caller that publishes MPEG-TS.
+type testSender struct {
+	uc       *net.UDPConn
+	socketID uint32
+	peerID   uint32
+	seq      uint32
+	start    time.Time
+}
+
+func dialTestSender(t *testing.T, addr string, streamID string) *testSender {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = uc.Close() })
+	s := &testSender{
+		uc:       uc,
+		socketID: 0x1234,
+		seq:      seqNumberMask - 2, // the sequence numbers wrap during the test
+		start:    time.Now(),
+	}
+	write := func(b []byte) error {
+		_, err := uc.Write(b)
+		return err
+	}
+	induction, err := exchangeHandshake(uc, write, s.socketID, &handshake{
+		version:    4,
+		extension:  2,
+		initialSeq: s.seq,
+		mtu:        defaultMTU,
+		flowWindow: defaultFlowWindow,
+		hsType:     handshakeTypeInduction,
+		socketID:   s.socketID,
+	})
+	if err != nil {
+		t.Fatalf("induction: %v", err)
+	}
+	if induction.extension != srtMagic {
+		t.Fatalf("induction extension = %#x, want %#x", induction.extension, srtMagic)
+	}
+	conclusion, err := exchangeHandshake(uc, write, s.socketID, &handshake{
+		version:    5,
+		extension:  extFlagHSREQ | extFlagConfig,
+		initialSeq: s.seq,
+		mtu:        defaultMTU,
+		flowWindow: defaultFlowWindow,
+		hsType:     handshakeTypeConclusion,
+		socketID:   s.socketID,
+		cookie:     induction.cookie,
+		extensions: []handshakeExtension{
+			{typ: extTypeHSREQ, data: (&hsExtension{version: srtVersion, flags: flagTSBPDSND}).marshal()},
+			{typ: extTypeSID, data: marshalStreamID(streamID)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("conclusion: %v", err)
+	}
+	if conclusion.hsType != handshakeTypeConclusion {
+		t.Fatalf("conclusion type = %d", conclusion.hsType)
+	}
+	s.peerID = conclusion.socketID
+	return s
+}
+
+// Write sends MPEG-TS in data packets of up to seven TS packets.
+func (s *testSender) Write(b []byte) (int, error) {
+	for rest := b; len(rest) > 0; {
+		n := min(len(rest), tsPacketsPerSR*astits.MpegTsPacketSize)
+		p := &packet{
+			seq:          s.seq,
+			msgFlags:     0xC0000000,
+			timestamp:    uint32(time.Since(s.start).Microseconds()),
+			destSocketID: s.peerID,
+			payload:      rest[:n],
+		}
+		if _, err := s.uc.Write(p.marshal()); err != nil {
+			return 0, err
+		}
+		s.seq = seqAdd(s.seq, 1)
+		rest = rest[n:]
+	}
+	return len(b), nil
+}
+
+func (s *testSender) shutdown() {
+	p := newControlPacket(controlShutdown, 0, make([]byte, 4))
+	p.destSocketID = s.peerID
+	_, _ = s.uc.Write(p.marshal())
+}
+
+func freeUDPPort(t *testing.T) int {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	return pc.LocalAddr().(*net.UDPAddr).Port
+}
+
+func annexB(nalus ...[]byte) []byte {
+	var b []byte
+	for _, nalu := range nalus {
+		b = append(b, 0, 0, 0, 1)
+		b = append(b, nalu...)
+	}
+	return b
+}
+
+func TestListenerLoopbackPublish(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := hub.NewHub()
+	port := freeUDPPort(t)
+	server := NewSRT(SRTArgs{
+		Hub:       h,
+		Port:      port,
+		LatencyMS: 20,
+	})
+	go func() {
+		if err := server.Serve(ctx); err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	}()
+
+	// the handshake is resent until the listener is up
+	sender := dialTestSender(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), "cam1")
+
+	muxer := astits.NewMuxer(ctx, sender)
+	if err := muxer.AddElementaryStream(astits.PMTElementaryStream{
+		ElementaryPID: testVideoPID,
+		StreamType:    astits.StreamTypeH264Video,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	muxer.SetPCRPID(testVideoPID)
+	const frameDuration = 3000
+	firstPTS := int64(ptsWrap - 5*frameDuration)
+	stop := make(chan struct{})
+	sent := make(chan struct{})
+	stopSending := sync.OnceFunc(func() {
+		close(stop)
+		<-sent
+	})
+	defer stopSending()
+	go func() {
+		defer close(sent)
+		for i := int64(0); ; i++ {
+			pts := astits.ClockReference{Base: (firstPTS + i*frameDuration) % ptsWrap}
+			_, err := muxer.WriteData(&astits.MuxerData{
+				PID:             testVideoPID,
+				AdaptationField: &astits.PacketAdaptationField{HasPCR: true, PCR: &pts, RandomAccessIndicator: true},
+				PES: &astits.PESData{
+					Header: &astits.PESHeader{
+						OptionalHeader: &astits.PESOptionalHeader{
+							PTS:             &pts,
+							PTSDTSIndicator: astits.PTSDTSIndicatorOnlyPTS,
+						},
+					},
+					Data: annexB(testSPS, testPPS, testIDR),
+				},
+			})
+			if err != nil {
+				t.Errorf("write data: %v", err)
+				return
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	var source hub.Source
+	select {
+	case source = <-h.SubscribeToStreamID():
+	case <-time.After(5 * time.Second):
+		t.Fatal("srt source was not notified")
+	}
+	if source.StreamID() != "cam1" || source.Name() != "srt" {
+		t.Fatalf("notified %s/%s, want srt/cam1", source.Name(), source.StreamID())
+	}
+	if !hub.HasCodecType(source.MediaSpecs(), hub.CodecTypeH264) {
+		t.Fatalf("media specs %+v without h264", source.MediaSpecs())
+	}
+
+	sub := h.SubscribeWithOptions("cam1", hub.SubscribeOptions{Name: "test", ReplayGOP: true})
+	defer sub.Close()
+	var lastDTS int64 = -1
+	for i := 0; i < 10; i++ {
+		select {
+		case data := <-sub.Frames():
+			video := data.H264Video
+			if video == nil {
+				t.Fatal("got a frame without h264 video")
+			}
+			if !hub.IsKeyFrame(data) {
+				t.Fatalf("slice types %v of an IDR frame", video.SliceTypes)
+			}
+			if !bytes.Equal(video.SPS, testSPS) || !bytes.Equal(video.PPS, testPPS) {
+				t.Fatalf("got sps %x pps %x", video.SPS, video.PPS)
+			}
+			if !bytes.Contains(video.Data, testIDR) {
+				t.Fatalf("frame %x without the IDR slice", video.Data)
+			}
+			// the PTS wraps at 2^33 after five frames, the published timestamps keep increasing
+			if video.DTS <= lastDTS || video.DTS%frameDuration != 0 {
+				t.Fatalf("DTS %d after %d", video.DTS, lastDTS)
+			}
+			lastDTS = video.DTS
+		case <-time.After(5 * time.Second):
+			t.Fatal("no frame received")
+		}
+	}
+	if lastDTS < 6*frameDuration {
+		t.Fatalf("last DTS %d did not pass the PTS wrap", lastDTS)
+	}
+
+	stopSending()
+	sender.shutdown()
+	for {
+		select {
+		case _, ok := <-sub.Frames():
+			if !ok {
+				if _, published := h.Get("cam1"); published {
+					t.Fatal("stream is still published after the shutdown")
+				}
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream did not end after the shutdown")
+		}
+	}
+}
+
+type testSource struct {
+	streamID string
+}
+
+func (s *testSource) Name() string {
+	return "test"
+}
+
+func (s *testSource) MediaSpecs() []hub.MediaSpec {
+	return []hub.MediaSpec{{MediaType: hub.Video, ClockRate: 90000, CodecType: hub.CodecTypeH264}}
+}
+
+func (s *testSource) StreamID() string {
+	return s.streamID
+}
+
+func (s *testSource) Depth() int {
+	return 0
+}
+
+func TestListenerTakenOver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := hub.NewHub()
+	h.SetTakeoverPolicy(hub.KickOldPublisher)
+	port := freeUDPPort(t)
+	server := NewSRT(SRTArgs{
+		Hub:       h,
+		Port:      port,
+		LatencyMS: 20,
+	})
+	go func() {
+		_ = server.Serve(ctx)
+	}()
+	sender := dialTestSender(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), "cam1")
+	muxer := astits.NewMuxer(ctx, sender)
+	if err := muxer.AddElementaryStream(astits.PMTElementaryStream{
+		ElementaryPID: testVideoPID,
+		StreamType:    astits.StreamTypeH264Video,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	muxer.SetPCRPID(testVideoPID)
+	stop := make(chan struct{})
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := int64(0); ; i++ {
+			pts := astits.ClockReference{Base: i * 3000}
+			if _, err := muxer.WriteData(&astits.MuxerData{
+				PID:             testVideoPID,
+				AdaptationField: &astits.PacketAdaptationField{HasPCR: true, PCR: &pts, RandomAccessIndicator: true},
+				PES: &astits.PESData{
+					Header: &astits.PESHeader{
+						OptionalHeader: &astits.PESOptionalHeader{PTS: &pts, PTSDTSIndicator: astits.PTSDTSIndicatorOnlyPTS},
+					},
+					Data: annexB(testSPS, testPPS, testIDR),
+				},
+			}); err != nil {
+				return
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-sent
+	}()
+
+	var source hub.Source
+	select {
+	case source = <-h.SubscribeToStreamID():
+	case <-time.After(5 * time.Second):
+		t.Fatal("srt source was not notified")
+	}
+	handler, ok := source.(*Handler)
+	if !ok {
+		t.Fatalf("notified %T", source)
+	}
+	var _ hub.ClosableSource = handler
+
+	newcomer := &testSource{streamID: "cam1"}
+	if err := h.Notify(ctx, newcomer); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handler.conn.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the srt connection was not closed on takeover")
+	}
+	if !handler.closed.Load() {
+		t.Fatal("the handler does not know that the server closed it")
+	}
+	// the closed publisher leaves the stream of the newcomer alone
+	time.Sleep(100 * time.Millisecond)
+	if info, ok := h.Get("cam1"); !ok || info.Source != newcomer {
+		t.Fatalf("cam1 is published by %+v after the takeover, want the newcomer", info.Source)
+	}
+}
@@ -2,20 +2,24 @@ package whip
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"liveflow/media/streamer/ingress"
-	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/labstack/echo/v4"
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/rtp/codecs"
+	"github.com/pion/rtp/codecs/av1/frame"
 	"github.com/pion/webrtc/v3"
 
 	"liveflow/log"
 	"liveflow/media/hub"
+	"liveflow/media/streamer/av1"
+	"liveflow/media/streamer/jitter"
 )
 
 var (
@@ -23,16 +27,70 @@ var (
 	ErrTrackWaitTimeOut = fmt.Errorf("track wait timeout")
 )
 
+const (
+	// jitterLatency is how long a missing packet is waited for, long enough for a NACK and its retransmission.
+	jitterLatency    = 300 * time.Millisecond
+	jitterMaxPackets = 1500
+	// keyFrameRequestInterval limits the PLIs sent while waiting for a key frame.
+	keyFrameRequestInterval = 500 * time.Millisecond
+)
+
 type WebRTCHandler struct {
 	hub               *hub.Hub
 	pc                *webrtc.PeerConnection
 	streamID          string
 	audioTimestampGen TimestampGenerator[int64]
-	videoTimestampGen TimestampGenerator[int64]
 	notifiedSource    bool
+	// layers are the rids of a simulcast publisher, the main layer first
+	layers         []string
+	videoEpoch     time.Time
+	videoEpochOnce sync.Once
 
 	mediaArgs          []hub.MediaSpec
 	expectedTrackCount int
+	closeOnce          sync.Once
+
+	tracksMu sync.Mutex
+	tracks   []*receivedTrack
+}
+
+// videoLayer is the depacketizing state of a video track. A simulcast publisher sends a track per layer,
+// the main layer is published under the stream ID and the others under their rendition stream IDs.
+type videoLayer struct {
+	rid          string
+	main         bool
+	streamID     string
+	timestampGen TimestampGenerator[int64]
+	offset       int64
+	// av1Frame keeps the OBU fragments that continue in the next packet
+	av1Frame frame.AV1
+
+	ssrc  uint32
+	track *receivedTrack
+	// waitingKeyFrame drops the frames after a loss, the decoders of the outputs need a key frame to recover
+	waitingKeyFrame bool
+	// lastKeyFrameReq is in unix nanoseconds, viewers request key frames from their own goroutines
+	lastKeyFrameReq atomic.Int64
+}
+
+// receivedTrack keeps the counters of a published track for its stats.
+type receivedTrack struct {
+	kind   string
+	rid    string
+	buffer *jitter.Buffer
+
+	framesSkipped    atomic.Uint64
+	keyFrameRequests atomic.Uint64
+}
+
+// TrackStats are the receive counters of a published track.
+type TrackStats struct {
+	Kind string
+	RID  string
+	jitter.Stats
+	// FramesSkipped were complete, but came after a loss and before the next key frame.
+	FramesSkipped    uint64
+	KeyFrameRequests uint64
 }
 
 func (w *WebRTCHandler) Depth() int {
@@ -43,8 +101,9 @@ type WebRTCHandlerArgs struct {
 	Hub                *hub.Hub
 	PeerConnection     *webrtc.PeerConnection
 	StreamID           string
-	Tracks             map[string][]*webrtc.TrackLocalStaticRTP
 	ExpectedTrackCount int
+	// Layers are the rids of the simulcast offer, the main layer first. It is empty without simulcast.
+	Layers []string
 }
 
 func NewWebRTCHandler(hub *hub.Hub, args *WebRTCHandlerArgs) *WebRTCHandler {
@@ -52,9 +111,9 @@ func NewWebRTCHandler(hub *hub.Hub, args *WebRTCHandlerArgs) *WebRTCHandler {
 		hub:                hub,
 		streamID:           args.StreamID,
 		audioTimestampGen:  TimestampGenerator[int64]{},
-		videoTimestampGen:  TimestampGenerator[int64]{},
 		pc:                 args.PeerConnection,
 		expectedTrackCount: args.ExpectedTrackCount,
+		layers:             args.Layers,
 	}
 	return ret
 }
@@ -74,6 +133,102 @@ func (w *WebRTCHandler) MediaSpecs() []hub.MediaSpec {
 	return ret
 }
 
+// Renditions returns the simulcast layers, or nil when the publisher sends a single layer.
+func (w *WebRTCHandler) Renditions() []hub.Rendition {
+	if len(w.layers) < 2 {
+		return nil
+	}
+	var ret []hub.Rendition
+	for i, rid := range w.layers {
+		streamID := w.streamID
+		if i > 0 {
+			streamID = hub.RenditionStreamID(w.streamID, rid)
+		}
+		ret = append(ret, hub.Rendition{
+			Name:     rid,
+			StreamID: streamID,
+		})
+	}
+	return ret
+}
+
+func (w *WebRTCHandler) newVideoLayer(rid string) *videoLayer {
+	if rid == "" || len(w.layers) < 2 || rid == w.layers[0] {
+		return &videoLayer{rid: rid, main: true, streamID: w.streamID}
+	}
+	return &videoLayer{rid: rid, streamID: hub.RenditionStreamID(w.streamID, rid)}
+}
+
+// videoTimestamp aligns the layers of a simulcast publisher, every layer starts its timestamps at a random value.
+// A layer starts at the time elapsed since the first video frame of any layer.
+func (w *WebRTCHandler) videoTimestamp(layer *videoLayer, timestamp int64) int64 {
+	if !layer.timestampGen.IsInitialized() {
+		w.videoEpochOnce.Do(func() {
+			w.videoEpoch = time.Now()
+		})
+		layer.offset = int64(time.Since(w.videoEpoch).Seconds() * 90000)
+	}
+	return layer.timestampGen.Generate(timestamp) + layer.offset
+}
+
+func (w *WebRTCHandler) addTrack(track *webrtc.TrackRemote, buffer *jitter.Buffer) *receivedTrack {
+	w.tracksMu.Lock()
+	defer w.tracksMu.Unlock()
+	received := &receivedTrack{
+		kind:   track.Kind().String(),
+		rid:    track.RID(),
+		buffer: buffer,
+	}
+	w.tracks = append(w.tracks, received)
+	return received
+}
+
+// TrackStats returns the counters of the tracks received so far.
+func (w *WebRTCHandler) TrackStats() []TrackStats {
+	w.tracksMu.Lock()
+	defer w.tracksMu.Unlock()
+	ret := make([]TrackStats, 0, len(w.tracks))
+	for _, track := range w.tracks {
+		ret = append(ret, TrackStats{
+			Kind:             track.kind,
+			RID:              track.rid,
+			Stats:            track.buffer.Stats(),
+			FramesSkipped:    track.framesSkipped.Load(),
+			KeyFrameRequests: track.keyFrameRequests.Load(),
+		})
+	}
+	return ret
+}
+
+// passFrame drops the frames of a layer after a loss until the next key frame.
+func (w *WebRTCHandler) passFrame(ctx context.Context, layer *videoLayer, keyFrame bool) bool {
+	if !layer.waitingKeyFrame {
+		return true
+	}
+	if keyFrame {
+		layer.waitingKeyFrame = false
+		return true
+	}
+	layer.track.framesSkipped.Add(1)
+	w.requestKeyFrame(ctx, layer)
+	return false
+}
+
+// requestKeyFrame sends a PLI to the publisher, at most once per keyFrameRequestInterval for a layer.
+// It is called for losses of the layer as well as for the key frame requests of the subscribers.
+func (w *WebRTCHandler) requestKeyFrame(ctx context.Context, layer *videoLayer) {
+	last := layer.lastKeyFrameReq.Load()
+	now := time.Now().UnixNano()
+	if time.Duration(now-last) < keyFrameRequestInterval || !layer.lastKeyFrameReq.CompareAndSwap(last, now) {
+		return
+	}
+	if err := w.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: layer.ssrc}}); err != nil {
+		log.Error(ctx, err, "failed to send pli")
+		return
+	}
+	layer.track.keyFrameRequests.Add(1)
+}
+
 func (w *WebRTCHandler) WaitTrackArgs(ctx context.Context, timeout time.Duration, trackArgCh <-chan TrackArgs) error {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
@@ -103,7 +258,12 @@ func (w *WebRTCHandler) WaitTrackArgs(ctx context.Context, timeout time.Duration
 				})
 			}
 			if len(w.mediaArgs) == w.expectedTrackCount {
-				w.hub.Notify(ctx, w)
+				err := w.hub.Notify(ctx, w)
+				if errors.Is(err, hub.ErrStandby) {
+					log.Infof(ctx, "whip publisher of %s is on standby", w.streamID)
+				} else if err != nil {
+					return err
+				}
 				w.notifiedSource = true
 				return nil
 			}
@@ -118,18 +278,25 @@ func (w *WebRTCHandler) OnICEConnectionStateChange(connectionState webrtc.ICECon
 		log.Info(ctx, "ICE Connection State Connected")
 		go func() {
 			err := w.WaitTrackArgs(ctx, 3*time.Second, trackArgCh)
+			if errors.Is(err, hub.ErrStreamTaken) {
+				log.Warnf(ctx, "rejected whip publisher of %s: %v", w.streamID, err)
+				_ = w.Close()
+				return
+			}
 			if err != nil {
 				log.Error(ctx, err, "failed to wait track args")
 				return
 			}
 		}()
 	case webrtc.ICEConnectionStateDisconnected:
-		w.OnClose(ctx)
-		//delete(w.tracks, streamKey)
+		// the publisher may come back with an ICE restart, the stream ends on failure or DELETE
 		log.Info(ctx, "ICE Connection State Disconnected")
 	case webrtc.ICEConnectionStateFailed:
 		log.Info(ctx, "ICE Connection State Failed")
+		w.OnClose(ctx)
 		_ = w.pc.Close()
+	case webrtc.ICEConnectionStateClosed:
+		w.OnClose(ctx)
 	}
 }
 
@@ -141,75 +308,101 @@ type TrackArgs struct {
 
 func (w *WebRTCHandler) OnTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver, trackArgCh chan<- TrackArgs) {
 	ctx := context.Background()
-	fmt.Printf("Track has started, of type %s %s\n", track.Kind(), track.Codec().MimeType)
-	var videoPackets []*rtp.Packet
-	var audioPackets []*rtp.Packet
-	var videoPacketsQueue [][]*rtp.Packet
-	var audioPacketsQueue [][]*rtp.Packet
-	currentVideoTimestamp := uint32(0)
-	currentAudioTimestamp := uint32(0)
-	trackArgCh <- TrackArgs{
-		MimeType:  track.Codec().MimeType,
-		ClockRate: track.Codec().ClockRate,
-		Channels:  track.Codec().Channels,
+	log.Infof(ctx, "Track has started, of type %s %s %s", track.Kind(), track.Codec().MimeType, track.RID())
+	buffer := jitter.New(jitter.Config{
+		Latency:    jitterLatency,
+		MaxPackets: jitterMaxPackets,
+		Video:      track.Kind() == webrtc.RTPCodecTypeVideo,
+	})
+	received := w.addTrack(track, buffer)
+	var layer *videoLayer
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		layer = w.newVideoLayer(track.RID())
+		layer.ssrc = uint32(track.SSRC())
+		layer.track = received
+		w.hub.HandleControl(w, layer.streamID, func(control hub.Control) {
+			if control == hub.ControlKeyFrameRequest {
+				w.requestKeyFrame(ctx, layer)
+			}
+		})
 	}
+	// the source only describes the main layer, the other layers are published without notification
+	if layer == nil || layer.main {
+		trackArgCh <- TrackArgs{
+			MimeType:  track.Codec().MimeType,
+			ClockRate: track.Codec().ClockRate,
+			Channels:  track.Codec().Channels,
+		}
+	}
+	var framesQueue []jitter.Frame
 	for {
-		pkt, _, err := track.ReadRTP()
+		pkt, attributes, err := track.ReadRTP()
 		if err != nil {
 			log.Error(ctx, err, "failed to read rtp")
 			break
 		}
-
-		switch track.Kind() {
-		case webrtc.RTPCodecTypeVideo:
-			if len(videoPackets) > 0 && currentVideoTimestamp != pkt.Timestamp {
-				videoPacketsQueue = append(videoPacketsQueue, videoPackets)
-				videoPackets = nil
-			}
-
-			videoPackets = append(videoPackets, pkt)
-			currentVideoTimestamp = pkt.Timestamp
-			if pkt.Marker {
-				videoPacketsQueue = append(videoPacketsQueue, videoPackets)
-				videoPackets = nil
-			}
-		case webrtc.RTPCodecTypeAudio:
-			if len(audioPackets) > 0 && currentAudioTimestamp != pkt.Timestamp {
-				audioPacketsQueue = append(audioPacketsQueue, audioPackets)
-				audioPackets = nil
-			}
-			audioPackets = append(audioPackets, pkt)
-			currentAudioTimestamp = pkt.Timestamp
-			if pkt.Marker {
-				audioPacketsQueue = append(audioPacketsQueue, audioPackets)
-				audioPackets = nil
-			}
-		}
-		if len(videoPacketsQueue) > 0 || len(audioPacketsQueue) > 0 {
+		// pion returns RTX retransmissions as the packets they repair
+		_, recovered := attributes.Get(webrtc.AttributeRtxSsrc).(uint32)
+		now := time.Now()
+		buffer.Push(pkt, recovered, now)
+		framesQueue = append(framesQueue, buffer.Pop(now)...)
+		if len(framesQueue) > 0 {
 			if !w.notifiedSource {
 				log.Warn(ctx, "not yet notified source")
 			}
 		}
 		if w.notifiedSource {
-			for _, videoPackets := range videoPacketsQueue {
-				w.onVideo(ctx, videoPackets)
-			}
-			videoPacketsQueue = nil
-			for _, audioPackets := range audioPacketsQueue {
-				w.onAudio(ctx, track.Codec().ClockRate, audioPackets)
+			for _, queued := range framesQueue {
+				if layer != nil {
+					w.onVideo(ctx, layer, track.Codec().MimeType, queued)
+				} else {
+					w.onAudio(ctx, track.Codec().ClockRate, queued.Packets)
+				}
 			}
-			audioPacketsQueue = nil
+			framesQueue = nil
 		}
 	}
+	stats := buffer.Stats()
+	log.Infof(ctx, "%s track %s ended, received %d packets, lost %d, recovered %d, reordered %d",
+		track.Kind(), track.RID(), stats.Received, stats.Lost, stats.Recovered, stats.Reordered)
+}
 
+// Close disconnects the publisher and unpublishes the stream.
+func (w *WebRTCHandler) Close() error {
+	_ = w.OnClose(context.Background())
+	return w.pc.Close()
 }
+
+// OnClose unpublishes the stream once, whether DELETE or the ICE state closes the session first.
 func (w *WebRTCHandler) OnClose(ctx context.Context) error {
-	w.hub.Unpublish(w.streamID)
-	log.Info(ctx, "OnClose")
+	w.closeOnce.Do(func() {
+		// the hub ends the streams of the renditions with the stream
+		w.hub.Unpublish(w)
+		log.Info(ctx, "OnClose")
+	})
 	return nil
 }
 
-func (w *WebRTCHandler) onVideo(ctx context.Context, packets []*rtp.Packet) error {
+func (w *WebRTCHandler) onVideo(ctx context.Context, layer *videoLayer, mimeType string, videoFrame jitter.Frame) error {
+	if videoFrame.Discontinuity {
+		// the fragments kept by the depacketizer belong to the lost frames
+		layer.av1Frame = frame.AV1{}
+		layer.waitingKeyFrame = true
+		w.requestKeyFrame(ctx, layer)
+	}
+	packets := videoFrame.Packets
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return w.onVP8Video(ctx, layer, packets)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return w.onVP9Video(ctx, layer, packets)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		return w.onAV1Video(ctx, layer, packets)
+	}
+	return w.onH264Video(ctx, layer, packets)
+}
+
+func (w *WebRTCHandler) onH264Video(ctx context.Context, layer *videoLayer, packets []*rtp.Packet) error {
 	var h264RTPParser = &codecs.H264Packet{}
 	payload := make([]byte, 0)
 	for _, pkt := range packets {
@@ -226,9 +419,18 @@ func (w *WebRTCHandler) onVideo(ctx context.Context, packets []*rtp.Packet) erro
 	if len(payload) == 0 {
 		return nil
 	}
-	pts := w.videoTimestampGen.Generate(int64(packets[0].Timestamp))
 	sliceTypes := ingress.SliceTypes(payload)
-	w.hub.Publish(w.streamID, &hub.FrameData{
+	keyFrame := false
+	for _, sliceType := range sliceTypes {
+		if sliceType == hub.SliceI {
+			keyFrame = true
+		}
+	}
+	if !w.passFrame(ctx, layer, keyFrame) {
+		return nil
+	}
+	pts := w.videoTimestamp(layer, int64(packets[0].Timestamp))
+	w.hub.Publish(w, layer.streamID, &hub.FrameData{
 		H264Video: &hub.H264Video{
 			PTS:            pts,
 			DTS:            pts,
@@ -245,107 +447,208 @@ func (w *WebRTCHandler) onVideo(ctx context.Context, packets []*rtp.Packet) erro
 	return nil
 }
 
-func (w *WebRTCHandler) onAudio(ctx context.Context, clockRate uint32, packets []*rtp.Packet) error {
-	var opusRTPParser = &codecs.OpusPacket{}
+func (w *WebRTCHandler) onVP8Video(ctx context.Context, layer *videoLayer, packets []*rtp.Packet) error {
 	payload := make([]byte, 0)
+	keyFrame := false
 	for _, pkt := range packets {
-		if len(pkt.Payload) == 0 {
+		vp8Packet := &codecs.VP8Packet{}
+		b, err := vp8Packet.Unmarshal(pkt.Payload)
+		if err != nil {
+			log.Error(ctx, err, "failed to unmarshal vp8")
 			continue
 		}
-		b, err := opusRTPParser.Unmarshal(pkt.Payload)
-		if err != nil {
-			log.Error(ctx, err, "failed to unmarshal opus")
+		// the P bit of the frame tag at the start of the first partition is 0 for key frames
+		if vp8Packet.S == 1 && vp8Packet.PID == 0 && len(b) > 0 {
+			keyFrame = b[0]&0x01 == 0
 		}
 		payload = append(payload, b...)
 	}
-
-	if len(payload) == 0 {
+	if len(payload) == 0 || !w.passFrame(ctx, layer, keyFrame) {
 		return nil
 	}
-	pts := w.audioTimestampGen.Generate(int64(packets[0].Timestamp))
-	w.hub.Publish(w.streamID, &hub.FrameData{
-		OPUSAudio: &hub.OPUSAudio{
+	pts := w.videoTimestamp(layer, int64(packets[0].Timestamp))
+	w.hub.Publish(w, layer.streamID, &hub.FrameData{
+		VP8Video: &hub.VP8Video{
 			PTS:            pts,
 			DTS:            pts,
-			AudioClockRate: clockRate,
+			VideoClockRate: 90000,
 			Data:           payload,
+			KeyFrame:       keyFrame,
 		},
 	})
 	return nil
 }
 
-func (r *WHIP) whepHandler(c echo.Context) error {
-	// Read the offer from HTTP Request
-	offer, err := io.ReadAll(c.Request().Body)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err.Error())
+func (w *WebRTCHandler) onVP9Video(ctx context.Context, layer *videoLayer, packets []*rtp.Packet) error {
+	payload := make([]byte, 0)
+	keyFrame := false
+	for i, pkt := range packets {
+		vp9Packet := &codecs.VP9Packet{}
+		b, err := vp9Packet.Unmarshal(pkt.Payload)
+		if err != nil {
+			log.Error(ctx, err, "failed to unmarshal vp9")
+			continue
+		}
+		// P is set for frames predicted from earlier pictures
+		if i == 0 && vp9Packet.B {
+			keyFrame = !vp9Packet.P
+		}
+		payload = append(payload, b...)
 	}
-	streamKey, err := r.bearerToken(c)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err.Error())
+	if len(payload) == 0 || !w.passFrame(ctx, layer, keyFrame) {
+		return nil
 	}
+	pts := w.videoTimestamp(layer, int64(packets[0].Timestamp))
+	w.hub.Publish(w, layer.streamID, &hub.FrameData{
+		VP9Video: &hub.VP9Video{
+			PTS:            pts,
+			DTS:            pts,
+			VideoClockRate: 90000,
+			Data:           payload,
+			KeyFrame:       keyFrame,
+		},
+	})
+	return nil
+}
 
-	// Create a MediaEngine object to configure the supported codec
-	m := &webrtc.MediaEngine{}
-	err = registerCodec(m)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err.Error())
+func (w *WebRTCHandler) onAV1Video(ctx context.Context, layer *videoLayer, packets []*rtp.Packet) error {
+	var obus [][]byte
+	keyFrame := false
+	for _, pkt := range packets {
+		av1Packet := &codecs.AV1Packet{}
+		if _, err := av1Packet.Unmarshal(pkt.Payload); err != nil {
+			log.Error(ctx, err, "failed to unmarshal av1")
+			continue
+		}
+		// N marks the first packet of a coded video sequence, which starts with a key frame
+		if av1Packet.N {
+			keyFrame = true
+		}
+		frames, err := layer.av1Frame.ReadFrames(av1Packet)
+		if err != nil {
+			log.Error(ctx, err, "failed to read av1 obus")
+			continue
+		}
+		obus = append(obus, frames...)
 	}
-
-	se := webrtc.SettingEngine{}
-	se.SetEphemeralUDPPortRange(30000, 30500)
-	if r.dockerMode {
-		se.SetNAT1To1IPs([]string{"127.0.0.1"}, webrtc.ICECandidateTypeHost)
+	if len(obus) == 0 {
+		return nil
 	}
-	// Create a new RTCPeerConnection
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(se))
-	peerConnection, err := api.NewPeerConnection(peerConnectionConfiguration)
+	keyFrame = keyFrame || av1.HasSequenceHeader(obus)
+	if !w.passFrame(ctx, layer, keyFrame) {
+		return nil
+	}
+	payload, err := av1.Marshal(obus)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err.Error())
+		return err
 	}
+	pts := w.videoTimestamp(layer, int64(packets[0].Timestamp))
+	w.hub.Publish(w, layer.streamID, &hub.FrameData{
+		AV1Video: &hub.AV1Video{
+			PTS:            pts,
+			DTS:            pts,
+			VideoClockRate: 90000,
+			Data:           payload,
+			KeyFrame:       keyFrame,
+		},
+	})
+	return nil
+}
 
-	var rtpSenders []*webrtc.RTPSender
-	fmt.Println("tracks: ", len(r.tracks))
-	for _, track := range r.tracks[streamKey] {
-		sender, err := peerConnection.AddTrack(track)
+func (w *WebRTCHandler) onAudio(ctx context.Context, clockRate uint32, packets []*rtp.Packet) error {
+	var opusRTPParser = &codecs.OpusPacket{}
+	payload := make([]byte, 0)
+	for _, pkt := range packets {
+		if len(pkt.Payload) == 0 {
+			continue
+		}
+		b, err := opusRTPParser.Unmarshal(pkt.Payload)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, err.Error())
+			log.Error(ctx, err, "failed to unmarshal opus")
 		}
-		rtpSenders = append(rtpSenders, sender)
+		payload = append(payload, b...)
 	}
 
-	// Read incoming RTCP packets
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			for _, rtpSender := range rtpSenders {
-				_, _, rtcpErr := rtpSender.Read(rtcpBuf)
-				if rtcpErr != nil {
-					return
-				}
-			}
-		}
-	}()
-	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		fmt.Printf("ICE Connection State has changed: %s\n", connectionState.String())
-
-		if connectionState == webrtc.ICEConnectionStateFailed {
-			delete(r.tracks, streamKey)
-			_ = peerConnection.Close()
-		}
+	if len(payload) == 0 {
+		return nil
+	}
+	pts := w.audioTimestampGen.Generate(int64(packets[0].Timestamp))
+	w.hub.Publish(w, w.streamID, &hub.FrameData{
+		OPUSAudio: &hub.OPUSAudio{
+			PTS:            pts,
+			DTS:            pts,
+			AudioClockRate: clockRate,
+			Data:           payload,
+		},
 	})
-	// Send answer via HTTP Response
-	return writeAnswer3(c, peerConnection, offer, "/whep")
+	return nil
+}
+
+// videoCodecs are listed in the order of preference. H.264 comes first since most egresses only carry H.264,
+// publishers without it fall back to VP8, VP9 or AV1.
+var videoCodecs = []webrtc.RTPCodecParameters{
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000},
+		PayloadType:        96,
+	},
+	// browsers offer H.264 with packetization-mode=1, which has to match exactly once VP8 matches exactly
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"},
+		PayloadType:        102,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+		PayloadType:        104,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f"},
+		PayloadType:        106,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=64001f"},
+		PayloadType:        108,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		PayloadType:        97,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"},
+		PayloadType:        98,
+	},
+	{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000},
+		PayloadType:        45,
+	},
+}
+
+const mimeTypeRTX = "video/rtx"
+
+// rtxPayloadTypes are the RTX payload types of videoCodecs, publishers retransmit NACKed packets on them.
+var rtxPayloadTypes = map[webrtc.PayloadType]webrtc.PayloadType{
+	96:  99,
+	97:  100,
+	98:  101,
+	102: 103,
+	104: 105,
+	106: 107,
+	108: 109,
+	45:  46,
 }
 
 func registerCodec(m *webrtc.MediaEngine) error {
 	// Setup the codecs you want to use.
 	var err error
-	if err = m.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: nil},
-		PayloadType:        96,
-	}, webrtc.RTPCodecTypeVideo); err != nil {
-		return err
+	for _, codec := range videoCodecs {
+		if err = m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+		if err = m.RegisterCodec(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeRTX, ClockRate: 90000, SDPFmtpLine: fmt.Sprintf("apt=%d", codec.PayloadType)},
+			PayloadType:        rtxPayloadTypes[codec.PayloadType],
+		}, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
 	}
 	if err = m.RegisterCodec(webrtc.RTPCodecParameters{
 		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "", RTCPFeedback: nil},
@@ -2,11 +2,16 @@ package whip
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"liveflow/log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/labstack/echo/v4"
 	"github.com/pion/interceptor"
@@ -14,7 +19,9 @@ import (
 	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v3"
 
+	"liveflow/auth"
 	"liveflow/media/hub"
+	"liveflow/media/streamer/trickle"
 )
 
 var (
@@ -33,24 +40,39 @@ var (
 
 type WHIP struct {
 	hub        *hub.Hub
-	tracks     map[string][]*webrtc.TrackLocalStaticRTP
 	dockerMode bool
 	echo       *echo.Echo
+	authorizer auth.Authorizer
+
+	mu sync.RWMutex
+	// [sessionID]session, a session is the resource at the Location of the answer
+	sessions map[string]*session
+}
+
+type session struct {
+	pc      *webrtc.PeerConnection
+	handler *WebRTCHandler
 }
 
 type WHIPArgs struct {
 	Hub        *hub.Hub
-	Tracks     map[string][]*webrtc.TrackLocalStaticRTP
 	DockerMode bool
 	Echo       *echo.Echo
+	// Authorizer checks the bearer token of every publisher, every token is accepted when it is nil.
+	Authorizer auth.Authorizer
 }
 
 func NewWHIP(args WHIPArgs) *WHIP {
+	authorizer := args.Authorizer
+	if authorizer == nil {
+		authorizer = auth.AllowAll{}
+	}
 	return &WHIP{
 		hub:        args.Hub,
-		tracks:     args.Tracks,
 		dockerMode: args.DockerMode,
 		echo:       args.Echo,
+		authorizer: authorizer,
+		sessions:   map[string]*session{},
 	}
 }
 
@@ -58,7 +80,8 @@ func (r *WHIP) RegisterRoute() {
 	whipServer := r.echo
 	whipServer.Static("/", "static")
 	whipServer.POST("/whip", r.whipHandler)
-	whipServer.POST("/whep", r.whepHandler)
+	whipServer.PATCH("/whip/:sessionID", r.patchHandler)
+	whipServer.DELETE("/whip/:sessionID", r.deleteHandler)
 }
 
 func (r *WHIP) bearerToken(c echo.Context) (string, error) {
@@ -67,7 +90,7 @@ func (r *WHIP) bearerToken(c echo.Context) (string, error) {
 		return "", errNoStreamKey
 	}
 	authHeaderParts := strings.Split(bearerToken, " ")
-	if len(authHeaderParts) != 2 {
+	if len(authHeaderParts) != 2 || authHeaderParts[1] == "" {
 		return "", errNoStreamKey
 	}
 	return authHeaderParts[1], nil
@@ -97,9 +120,22 @@ func (r *WHIP) whipHandler(c echo.Context) error {
 
 	streamKey, err := r.bearerToken(c)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, err.Error())
+		return c.JSON(http.StatusUnauthorized, err.Error())
+	}
+	streamID, err := r.authorizer.AuthorizePublish(c.Request().Context(), auth.PublishRequest{
+		Ingress:    "whip",
+		StreamKey:  streamKey,
+		RemoteAddr: c.Request().RemoteAddr,
+	})
+	if err != nil {
+		log.Warnf(ctx, "rejected whip publisher from %s: %v", c.Request().RemoteAddr, err)
+		return c.JSON(http.StatusUnauthorized, err.Error())
+	}
+	// a rejected publisher is told before it gets an answer, Notify still rejects one that loses a race for the stream
+	if err := r.hub.CanPublish(streamID); err != nil {
+		log.Warnf(ctx, "rejected whip publisher of %s: %v", streamID, err)
+		return c.JSON(http.StatusConflict, err.Error())
 	}
-	fmt.Println("streamkey: ", streamKey)
 
 	// Create a MediaEngine object to configure the supported codec
 	m := &webrtc.MediaEngine{}
@@ -108,6 +144,10 @@ func (r *WHIP) whipHandler(c echo.Context) error {
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, err.Error())
 	}
+	// simulcast layers are told apart by the rid header extension
+	if err = webrtc.ConfigureSimulcastExtensionHeaders(m); err != nil {
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
 	// Create a InterceptorRegistry
 	i := &interceptor.Registry{}
 
@@ -118,7 +158,7 @@ func (r *WHIP) whipHandler(c echo.Context) error {
 	}
 	i.Add(intervalPliFactory)
 
-	// Use the default set of Interceptors
+	// Use the default set of Interceptors, the NACK generator asks for the packets the jitter buffer misses
 	if err = webrtc.RegisterDefaultInterceptors(m, i); err != nil {
 		return c.JSON(http.StatusInternalServerError, err.Error())
 	}
@@ -139,24 +179,45 @@ func (r *WHIP) whipHandler(c echo.Context) error {
 	}
 
 	// Allow us to receive 1 video track
-	if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+	videoTransceiver, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	})
+	if err != nil {
 		return c.JSON(http.StatusInternalServerError, err.Error())
 	}
+	// the answer lists the codecs in our order, so that publishers send H.264 when they can
+	if preferred := preferredVideoCodecs(&parsedSDP); len(preferred) > 0 {
+		if err = videoTransceiver.SetCodecPreferences(preferred); err != nil {
+			return c.JSON(http.StatusInternalServerError, err.Error())
+		}
+	}
 	// Allow us to receive 1 audio track
-	if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+	if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
 		return c.JSON(http.StatusInternalServerError, err.Error())
 	}
 
 	whipHandler := NewWebRTCHandler(r.hub, &WebRTCHandlerArgs{
 		Hub:                r.hub,
 		PeerConnection:     peerConnection,
-		StreamID:           streamKey,
+		StreamID:           streamID,
 		ExpectedTrackCount: trackCount,
+		Layers:             simulcastLayers(&parsedSDP),
 	})
+	sessionID, err := newSessionID()
+	if err != nil {
+		_ = peerConnection.Close()
+		return c.JSON(http.StatusInternalServerError, err.Error())
+	}
 	trackArgCh := make(chan TrackArgs)
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		whipHandler.OnICEConnectionStateChange(connectionState, trackArgCh)
 		fmt.Printf("ICE Connection State has changed: %s\n", connectionState.String())
+		switch connectionState {
+		case webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateClosed:
+			r.removeSession(sessionID)
+		}
 	})
 	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		for _, t := range receiver.GetParameters().Codecs {
@@ -164,11 +225,192 @@ func (r *WHIP) whipHandler(c echo.Context) error {
 		}
 		whipHandler.OnTrack(track, receiver, trackArgCh)
 	})
+	r.addSession(sessionID, &session{
+		pc:      peerConnection,
+		handler: whipHandler,
+	})
 	// Send answer via HTTP Response
-	return writeAnswer3(c, peerConnection, offer, "/whip")
+	err = writeAnswer3(c, peerConnection, offer, "/whip/"+sessionID)
+	if err != nil || c.Response().Status != http.StatusCreated {
+		r.removeSession(sessionID)
+		_ = peerConnection.Close()
+	}
+	return err
+}
+
+// preferredVideoCodecs returns the video codecs of the offer that we support, in the order of videoCodecs,
+// followed by the RTX codecs of those. They keep the payload types and parameters of the offer, which the answer has to repeat.
+func preferredVideoCodecs(offer *sdp.SessionDescription) []webrtc.RTPCodecParameters {
+	rank := func(mimeType string) int {
+		for i, codec := range videoCodecs {
+			if strings.EqualFold(codec.MimeType, mimeType) {
+				return i
+			}
+		}
+		return -1
+	}
+	var ret, rtx []webrtc.RTPCodecParameters
+	for _, media := range offer.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		for _, format := range media.MediaName.Formats {
+			payloadType, err := strconv.ParseUint(format, 10, 8)
+			if err != nil {
+				continue
+			}
+			codec, err := offer.GetCodecForPayloadType(uint8(payloadType))
+			if err != nil {
+				continue
+			}
+			if strings.EqualFold("video/"+codec.Name, mimeTypeRTX) {
+				rtx = append(rtx, webrtc.RTPCodecParameters{
+					RTPCodecCapability: webrtc.RTPCodecCapability{
+						MimeType:    mimeTypeRTX,
+						ClockRate:   codec.ClockRate,
+						SDPFmtpLine: codec.Fmtp,
+					},
+					PayloadType: webrtc.PayloadType(payloadType),
+				})
+				continue
+			}
+			if rank("video/"+codec.Name) < 0 {
+				continue
+			}
+			var feedbacks []webrtc.RTCPFeedback
+			for _, feedback := range codec.RTCPFeedback {
+				feedbackType, parameter, _ := strings.Cut(feedback, " ")
+				feedbacks = append(feedbacks, webrtc.RTCPFeedback{Type: feedbackType, Parameter: parameter})
+			}
+			ret = append(ret, webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{
+					MimeType:     videoCodecs[rank("video/"+codec.Name)].MimeType,
+					ClockRate:    codec.ClockRate,
+					SDPFmtpLine:  codec.Fmtp,
+					RTCPFeedback: feedbacks,
+				},
+				PayloadType: webrtc.PayloadType(payloadType),
+			})
+		}
+		break
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return rank(ret[i].MimeType) < rank(ret[j].MimeType)
+	})
+	for _, codec := range rtx {
+		for _, primary := range ret {
+			if codec.SDPFmtpLine == fmt.Sprintf("apt=%d", primary.PayloadType) {
+				ret = append(ret, codec)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// simulcastLayers returns the rids of the a=simulcast:send attribute of the video section.
+// Publishers list the layers from the highest, which becomes the main layer of the stream.
+func simulcastLayers(offer *sdp.SessionDescription) []string {
+	for _, media := range offer.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		value, ok := media.Attribute("simulcast")
+		if !ok {
+			return nil
+		}
+		direction, streams, _ := strings.Cut(value, " ")
+		if direction != "send" {
+			return nil
+		}
+		var rids []string
+		for _, stream := range strings.Split(streams, ";") {
+			// the first of the alternatives, a leading ~ only marks a paused layer
+			rid, _, _ := strings.Cut(stream, ",")
+			rid = strings.TrimPrefix(rid, "~")
+			if rid != "" {
+				rids = append(rids, rid)
+			}
+		}
+		return rids
+	}
+	return nil
+}
+
+// SessionStats is a snapshot of the receive counters of a publisher.
+type SessionStats struct {
+	ID       string
+	StreamID string
+	Tracks   []TrackStats
+}
+
+// Sessions returns the stats of the publishers of streamID.
+func (r *WHIP) Sessions(streamID string) []SessionStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var ret []SessionStats
+	for id, s := range r.sessions {
+		if s.handler.StreamID() != streamID {
+			continue
+		}
+		ret = append(ret, SessionStats{
+			ID:       id,
+			StreamID: streamID,
+			Tracks:   s.handler.TrackStats(),
+		})
+	}
+	return ret
+}
+
+func (r *WHIP) addSession(sessionID string, s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[sessionID] = s
+}
+
+func (r *WHIP) removeSession(sessionID string) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.sessions[sessionID]
+	delete(r.sessions, sessionID)
+	return s
+}
+
+func (r *WHIP) session(sessionID string) *session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.sessions[sessionID]
+}
+
+// patchHandler adds trickled ICE candidates or restarts ICE.
+func (r *WHIP) patchHandler(c echo.Context) error {
+	s := r.session(c.Param("sessionID"))
+	if s == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return trickle.HandlePatch(c, s.pc)
+}
+
+// deleteHandler ends the publish right away instead of waiting for ICE to disconnect.
+func (r *WHIP) deleteHandler(c echo.Context) error {
+	s := r.removeSession(c.Param("sessionID"))
+	if s == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	_ = s.handler.OnClose(context.Background())
+	_ = s.pc.Close()
+	return c.NoContent(http.StatusOK)
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
-func writeAnswer3(c echo.Context, peerConnection *webrtc.PeerConnection, offer []byte, path string) error {
+func writeAnswer3(c echo.Context, peerConnection *webrtc.PeerConnection, offer []byte, location string) error {
 	// Set the handler for ICE connection state
 
 	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)}); err != nil {
@@ -190,9 +432,9 @@ func writeAnswer3(c echo.Context, peerConnection *webrtc.PeerConnection, offer [
 	<-gatherComplete
 
 	// WHIP+WHEP expects a Location header and a HTTP Status Code of 201
-	c.Response().Header().Add("Location", path)
-	c.Response().WriteHeader(http.StatusCreated)
+	c.Response().Header().Set("Location", location)
+	c.Response().Header().Set("ETag", trickle.ETag(peerConnection))
 
 	// Write Answer with Candidates as HTTP Response
-	return c.String(http.StatusOK, peerConnection.LocalDescription().SDP)
+	return c.Blob(http.StatusCreated, "application/sdp", []byte(peerConnection.LocalDescription().SDP))
 }
@@ -0,0 +1,97 @@
+package whip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pion/webrtc/v3"
+
+	"liveflow/media/hub"
+)
+
+type testSource struct {
+	streamID string
+}
+
+func (s *testSource) Name() string {
+	return "test"
+}
+
+func (s *testSource) MediaSpecs() []hub.MediaSpec {
+	return []hub.MediaSpec{{MediaType: hub.Video, ClockRate: 90000, CodecType: hub.CodecTypeH264}}
+}
+
+func (s *testSource) StreamID() string {
+	return s.streamID
+}
+
+func (s *testSource) Depth() int {
+	return 0
+}
+
+// newOffer returns the offer of a publisher of a video and an audio track.
+func newOffer(t *testing.T) string {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return offer.SDP
+}
+
+func TestPublishTakenStream(t *testing.T) {
+	tests := []struct {
+		policy hub.TakeoverPolicy
+		want   int
+	}{
+		{policy: hub.RejectNewPublisher, want: http.StatusConflict},
+		{policy: hub.KickOldPublisher, want: http.StatusCreated},
+		{policy: hub.StandbyNewPublisher, want: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			h := hub.NewHub()
+			h.SetTakeoverPolicy(tt.policy)
+			if err := h.Notify(context.Background(), &testSource{streamID: "stream"}); err != nil {
+				t.Fatal(err)
+			}
+			<-h.SubscribeToStreamID()
+			e := echo.New()
+			r := NewWHIP(WHIPArgs{Hub: h, Echo: e})
+			r.RegisterRoute()
+
+			req := httptest.NewRequest(http.MethodPost, "/whip", strings.NewReader(newOffer(t)))
+			req.Header.Set("Content-Type", "application/sdp")
+			req.Header.Set("Authorization", "Bearer stream")
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status %d %s, want %d", rec.Code, rec.Body, tt.want)
+			}
+			r.mu.Lock()
+			sessions := r.sessions
+			r.sessions = map[string]*session{}
+			r.mu.Unlock()
+			if tt.want == http.StatusConflict && len(sessions) != 0 {
+				t.Fatalf("%d sessions of a rejected publisher", len(sessions))
+			}
+			for _, s := range sessions {
+				_ = s.pc.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// Package jitter reorders the RTP packets of a received track by sequence number and assembles them into frames.
+// Missing packets are waited for so that NACKed retransmissions can fill the gaps. The caller passes the time,
+// so a buffer can be driven by a simulated lossy loopback as well as by a peer connection.
+package jitter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Frame is the packets of one frame in sequence number order.
+type Frame struct {
+	Packets []*rtp.Packet
+	// Discontinuity is set on the first frame and on the first frame after lost packets.
+	// Video decoders need a key frame to continue from there.
+	Discontinuity bool
+}
+
+// Stats are the packet counters of a buffer.
+type Stats struct {
+	Received uint64
+	// Lost packets were given up after the latency, Recovered packets arrived as RTX retransmissions.
+	Lost      uint64
+	Recovered uint64
+	// Reordered packets arrived after a packet with a higher sequence number.
+	Reordered uint64
+	// Late packets arrived after they were given up, Duplicates were already buffered.
+	Late       uint64
+	Duplicates uint64
+	// FramesDropped were incomplete because of lost packets.
+	FramesDropped uint64
+}
+
+type Config struct {
+	// Latency is how long a missing packet is waited for, NACKs and retransmissions have to fit in it.
+	// Complete frames never wait.
+	Latency time.Duration
+	// MaxPackets bounds the buffer, missing packets are given up right away past it.
+	MaxPackets int
+	// Video frames end at the packet with the marker bit. Without Video every packet is a frame, as for Opus.
+	Video bool
+}
+
+type entry struct {
+	packet  *rtp.Packet
+	arrival time.Time
+}
+
+// Buffer is safe for concurrent use, Stats is usually read from another goroutine than Push and Pop.
+type Buffer struct {
+	config Config
+
+	mu            sync.Mutex
+	packets       map[uint16]*entry
+	started       bool
+	next          uint16
+	highest       uint16
+	discontinuity bool
+	stats         Stats
+}
+
+func New(config Config) *Buffer {
+	return &Buffer{
+		config:        config,
+		packets:       map[uint16]*entry{},
+		discontinuity: true,
+	}
+}
+
+// before reports whether sequence number a comes before b, with wrap around.
+func before(a uint16, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// Push adds a packet that arrived at now. recovered marks packets that arrived as RTX retransmissions.
+func (b *Buffer) Push(packet *rtp.Packet, recovered bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	seq := packet.SequenceNumber
+	if !b.started {
+		b.started = true
+		b.next = seq
+		b.highest = seq
+	}
+	if before(seq, b.next) && b.config.MaxPackets > 0 && int(b.next-seq) > b.config.MaxPackets {
+		// too old to be late, the sender has restarted its sequence numbers
+		b.packets = map[uint16]*entry{}
+		b.next = seq
+		b.highest = seq
+		b.discontinuity = true
+	}
+	if before(seq, b.next) {
+		b.stats.Late++
+		return
+	}
+	if _, ok := b.packets[seq]; ok {
+		b.stats.Duplicates++
+		return
+	}
+	b.stats.Received++
+	if recovered {
+		b.stats.Recovered++
+	}
+	if before(seq, b.highest) {
+		if !recovered {
+			b.stats.Reordered++
+		}
+	} else {
+		b.highest = seq
+	}
+	b.packets[seq] = &entry{packet: packet, arrival: now}
+}
+
+// Pop returns the frames that are complete, giving up on packets that have been missing for longer than the latency.
+func (b *Buffer) Pop(now time.Time) []Frame {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var frames []Frame
+	for len(b.packets) > 0 {
+		if packets, ok := b.frameAt(b.next); ok {
+			for _, packet := range packets {
+				delete(b.packets, packet.SequenceNumber)
+			}
+			b.next = packets[len(packets)-1].SequenceNumber + 1
+			frames = append(frames, Frame{Packets: packets, Discontinuity: b.discontinuity})
+			b.discontinuity = false
+			continue
+		}
+		if !b.expired(now) || !b.skip() {
+			break
+		}
+	}
+	return frames
+}
+
+func (b *Buffer) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+// frameAt returns the frame starting at seq once all of its packets are buffered.
+func (b *Buffer) frameAt(seq uint16) ([]*rtp.Packet, bool) {
+	var packets []*rtp.Packet
+	for {
+		e, ok := b.packets[seq]
+		if !ok {
+			return nil, false
+		}
+		packets = append(packets, e.packet)
+		if !b.config.Video || e.packet.Marker {
+			return packets, true
+		}
+		seq++
+	}
+}
+
+// expired reports whether the first missing packet has been waited for long enough.
+// A packet is known to be missing once the packet after the gap has arrived.
+func (b *Buffer) expired(now time.Time) bool {
+	if b.config.MaxPackets > 0 && len(b.packets) > b.config.MaxPackets {
+		return true
+	}
+	seq := b.next
+	for ; seq != b.highest+1; seq++ {
+		if _, ok := b.packets[seq]; !ok {
+			break
+		}
+	}
+	for ; seq != b.highest+1; seq++ {
+		if e, ok := b.packets[seq]; ok {
+			return now.Sub(e.arrival) >= b.config.Latency
+		}
+	}
+	return false
+}
+
+// skip gives up on the missing packets before the next frame that can be assembled.
+// A video frame can only start after a packet with the marker bit, the frame in between is dropped.
+// It reports false when the buffer has to wait for the start of a frame.
+func (b *Buffer) skip() bool {
+	start, found := b.next, false
+	for seq := b.next; seq != b.highest+1; seq++ {
+		e, ok := b.packets[seq]
+		if !ok {
+			continue
+		}
+		if !b.config.Video {
+			if seq != b.next {
+				start, found = seq, true
+				break
+			}
+			continue
+		}
+		if e.packet.Marker {
+			start, found = seq+1, true
+			break
+		}
+	}
+	if !found {
+		if b.config.MaxPackets <= 0 || len(b.packets) <= b.config.MaxPackets {
+			return false
+		}
+		start = b.highest + 1
+	}
+	timestamps := map[uint32]struct{}{}
+	for seq := b.next; seq != start; seq++ {
+		e, ok := b.packets[seq]
+		if !ok {
+			b.stats.Lost++
+			continue
+		}
+		timestamps[e.packet.Timestamp] = struct{}{}
+		delete(b.packets, seq)
+	}
+	if b.config.Video {
+		dropped := uint64(len(timestamps))
+		if dropped == 0 {
+			dropped = 1
+		}
+		b.stats.FramesDropped += dropped
+	}
+	b.next = start
+	b.discontinuity = true
+	return true
+}
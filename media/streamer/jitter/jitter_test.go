@@ -0,0 +1,425 @@
+package jitter
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const testLatency = 100 * time.Millisecond
+
+// step pushes a packet at the time at, or only pops at that time when pop is set.
+type step struct {
+	at        time.Duration
+	seq       uint16
+	ts        uint32
+	marker    bool
+	recovered bool
+	pop       bool
+}
+
+func push(at time.Duration, seq uint16, ts uint32, marker bool) step {
+	return step{at: at, seq: seq, ts: ts, marker: marker}
+}
+
+func popAt(at time.Duration) step {
+	return step{at: at, pop: true}
+}
+
+// wantFrame is the sequence numbers of a frame, with its discontinuity flag.
+type wantFrame struct {
+	seqs          []uint16
+	discontinuity bool
+}
+
+func TestBufferPushPop(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name       string
+		audio      bool
+		maxPackets int
+		steps      []step
+		want       []wantFrame
+		stats      Stats
+	}{
+		{
+			name: "in order",
+			steps: []step{
+				push(0, 10, 1, false),
+				push(0, 11, 1, true),
+				push(0, 12, 2, true),
+			},
+			want:  []wantFrame{{seqs: []uint16{10, 11}, discontinuity: true}, {seqs: []uint16{12}}},
+			stats: Stats{Received: 3},
+		},
+		{
+			name: "reordered within the latency",
+			steps: []step{
+				push(0, 10, 1, true),
+				push(0, 12, 3, true),
+				push(10*ms, 11, 2, true),
+			},
+			want:  []wantFrame{{seqs: []uint16{10}, discontinuity: true}, {seqs: []uint16{11}}, {seqs: []uint16{12}}},
+			stats: Stats{Received: 3, Reordered: 1},
+		},
+		{
+			name: "gap waits for the latency",
+			steps: []step{
+				push(0, 10, 1, true),
+				push(0, 12, 3, true),
+				popAt(testLatency - ms),
+			},
+			want:  []wantFrame{{seqs: []uint16{10}, discontinuity: true}},
+			stats: Stats{Received: 2},
+		},
+		{
+			name: "gap expires",
+			steps: []step{
+				push(0, 10, 1, true),
+				push(0, 12, 3, true),
+				popAt(testLatency),
+				push(testLatency, 13, 4, true),
+			},
+			// the packet after the gap may end the frame of the lost packet, the next frame starts after it
+			want:  []wantFrame{{seqs: []uint16{10}, discontinuity: true}, {seqs: []uint16{13}, discontinuity: true}},
+			stats: Stats{Received: 3, Lost: 1, FramesDropped: 1},
+		},
+		{
+			name: "lost marker drops the frames up to the next marker",
+			steps: []step{
+				push(0, 10, 1, true),
+				push(0, 11, 2, false),
+				push(0, 13, 3, true),
+				popAt(testLatency),
+				push(testLatency, 14, 4, true),
+			},
+			want:  []wantFrame{{seqs: []uint16{10}, discontinuity: true}, {seqs: []uint16{14}, discontinuity: true}},
+			stats: Stats{Received: 4, Lost: 1, FramesDropped: 2},
+		},
+		{
+			name: "sequence wrap",
+			steps: []step{
+				push(0, 65534, 1, true),
+				push(0, 65535, 2, false),
+				push(0, 0, 2, true),
+				push(0, 1, 3, true),
+			},
+			want: []wantFrame{
+				{seqs: []uint16{65534}, discontinuity: true},
+				{seqs: []uint16{65535, 0}},
+				{seqs: []uint16{1}},
+			},
+			stats: Stats{Received: 4},
+		},
+		{
+			name: "reordered across the wrap",
+			steps: []step{
+				push(0, 65535, 1, true),
+				push(0, 1, 3, true),
+				push(5*ms, 0, 2, true),
+			},
+			want:  []wantFrame{{seqs: []uint16{65535}, discontinuity: true}, {seqs: []uint16{0}}, {seqs: []uint16{1}}},
+			stats: Stats{Received: 3, Reordered: 1},
+		},
+		{
+			name: "gap expires across the wrap",
+			steps: []step{
+				push(0, 65534, 1, true),
+				push(0, 0, 3, true),
+				popAt(testLatency),
+				push(testLatency, 1, 4, true),
+			},
+			want:  []wantFrame{{seqs: []uint16{65534}, discontinuity: true}, {seqs: []uint16{1}, discontinuity: true}},
+			stats: Stats{Received: 3, Lost: 1, FramesDropped: 1},
+		},
+		{
+			name: "recovered retransmission",
+			steps: []step{
+				push(0, 10, 1, true),
+				push(0, 12, 3, true),
+				{at: 40 * ms, seq: 11, ts: 2, marker: true, recovered: true},
+			},
+			want:  []wantFrame{{seqs: []uint16{10}, discontinuity: true}, {seqs: []uint16{11}}, {seqs: []uint16{12}}},
+			stats: Stats{Received: 3, Recovered: 1},
+		},
+		{
+			name: "duplicate and late",
+			steps: []step{
+				push(0, 10, 1, true),
+				push(0, 12, 3, true),
+				push(ms, 12, 3, true),
+				popAt(testLatency),
+				push(testLatency+ms, 11, 2, true),
+				push(testLatency+ms, 10, 1, true),
+			},
+			want:  []wantFrame{{seqs: []uint16{10}, discontinuity: true}},
+			stats: Stats{Received: 2, Lost: 1, Late: 2, Duplicates: 1, FramesDropped: 1},
+		},
+		{
+			name:       "full buffer gives up without waiting",
+			maxPackets: 3,
+			steps: []step{
+				push(0, 10, 1, true),
+				push(0, 12, 3, true),
+				push(0, 13, 4, true),
+				push(0, 14, 5, true),
+				push(0, 15, 6, true),
+			},
+			want: []wantFrame{
+				{seqs: []uint16{10}, discontinuity: true},
+				{seqs: []uint16{13}, discontinuity: true},
+				{seqs: []uint16{14}},
+				{seqs: []uint16{15}},
+			},
+			stats: Stats{Received: 5, Lost: 1, FramesDropped: 1},
+		},
+		{
+			name: "sender restart",
+			steps: []step{
+				push(0, 1000, 1, true),
+				push(0, 10, 2, true),
+				push(0, 11, 3, true),
+			},
+			want: []wantFrame{
+				{seqs: []uint16{1000}, discontinuity: true},
+				{seqs: []uint16{10}, discontinuity: true},
+				{seqs: []uint16{11}},
+			},
+			stats: Stats{Received: 3},
+		},
+		{
+			name:  "audio packets are frames",
+			audio: true,
+			steps: []step{
+				push(0, 10, 960, false),
+				push(0, 11, 1920, false),
+				push(0, 13, 3840, false),
+				popAt(testLatency),
+			},
+			want: []wantFrame{
+				{seqs: []uint16{10}, discontinuity: true},
+				{seqs: []uint16{11}},
+				{seqs: []uint16{13}, discontinuity: true},
+			},
+			stats: Stats{Received: 3, Lost: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxPackets := tt.maxPackets
+			if maxPackets == 0 {
+				maxPackets = 50
+			}
+			b := New(Config{Latency: testLatency, MaxPackets: maxPackets, Video: !tt.audio})
+			start := time.Now()
+			var got []wantFrame
+			for _, s := range tt.steps {
+				now := start.Add(s.at)
+				if !s.pop {
+					b.Push(&rtp.Packet{Header: rtp.Header{SequenceNumber: s.seq, Timestamp: s.ts, Marker: s.marker}}, s.recovered, now)
+				}
+				for _, frame := range b.Pop(now) {
+					var seqs []uint16
+					for _, packet := range frame.Packets {
+						seqs = append(seqs, packet.SequenceNumber)
+					}
+					got = append(got, wantFrame{seqs: seqs, discontinuity: frame.Discontinuity})
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("frames %+v, want %+v", got, tt.want)
+			}
+			if stats := b.Stats(); stats != tt.stats {
+				t.Errorf("stats %+v, want %+v", stats, tt.stats)
+			}
+		})
+	}
+}
+
+// loopback is a simulated lossy link between a sender and a buffer. Packets are delayed by a random
+// jitter, which reorders them, and dropped at a loss rate. The receiver NACKs the gaps it sees and the
+// sender retransmits the missing packets, as RTX, one round trip later.
+type loopback struct {
+	rand   *rand.Rand
+	start  time.Time
+	buffer *Buffer
+	nack   bool
+
+	events  []event
+	sent    map[uint16]*rtp.Packet
+	highest uint16
+	started bool
+	frames  []Frame
+	dropped int
+}
+
+type event struct {
+	at        time.Duration
+	packet    *rtp.Packet
+	recovered bool
+}
+
+const (
+	loopbackDelay  = 20 * time.Millisecond
+	loopbackJitter = 15 * time.Millisecond
+	loopbackRTT    = 2 * loopbackDelay
+	loopbackLoss   = 0.05
+)
+
+func (l *loopback) send(at time.Duration, packet *rtp.Packet, lossy bool) {
+	l.sent[packet.SequenceNumber] = packet
+	if lossy && l.rand.Float64() < loopbackLoss {
+		l.dropped++
+		return
+	}
+	l.events = append(l.events, event{
+		at:     at + loopbackDelay + time.Duration(l.rand.Int63n(int64(loopbackJitter))),
+		packet: packet,
+	})
+}
+
+// receive delivers the events in the order of their arrival until the link is idle.
+func (l *loopback) receive(until time.Duration) {
+	for {
+		next := -1
+		for i, e := range l.events {
+			if e.at <= until && (next < 0 || e.at < l.events[next].at) {
+				next = i
+			}
+		}
+		if next < 0 {
+			return
+		}
+		e := l.events[next]
+		l.events = append(l.events[:next], l.events[next+1:]...)
+		seq := e.packet.SequenceNumber
+		if l.nack && !e.recovered && l.started && before(l.highest+1, seq) {
+			for missing := l.highest + 1; missing != seq; missing++ {
+				l.events = append(l.events, event{at: e.at + loopbackRTT, packet: l.sent[missing], recovered: true})
+			}
+		}
+		if !l.started || before(l.highest, seq) {
+			l.started = true
+			l.highest = seq
+		}
+		now := l.start.Add(e.at)
+		l.buffer.Push(e.packet, e.recovered, now)
+		l.frames = append(l.frames, l.buffer.Pop(now)...)
+	}
+}
+
+// run sends frameCount frames of one to four packets every 33ms, starting at a sequence number that wraps,
+// and returns the packets of each frame by timestamp.
+func (l *loopback) run(frameCount int) map[uint32][]uint16 {
+	sentFrames := map[uint32][]uint16{}
+	seq := uint16(65500)
+	var at time.Duration
+	for i := 0; i < frameCount; i++ {
+		ts := uint32(i * 3000)
+		count := 1 + l.rand.Intn(4)
+		for j := 0; j < count; j++ {
+			packet := &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: ts, Marker: j == count-1}}
+			// the first and the last frames are not lost, the buffer starts and ends with them
+			l.send(at, packet, i > 0 && i < frameCount-1)
+			sentFrames[ts] = append(sentFrames[ts], seq)
+			seq++
+		}
+		l.receive(at)
+		at += 33 * time.Millisecond
+	}
+	l.receive(at + time.Second)
+	l.frames = append(l.frames, l.buffer.Pop(l.start.Add(at+time.Second))...)
+	return sentFrames
+}
+
+func newLoopback(nack bool) *loopback {
+	return &loopback{
+		rand:   rand.New(rand.NewSource(1)),
+		start:  time.Now(),
+		buffer: New(Config{Latency: 300 * time.Millisecond, MaxPackets: 1500, Video: true}),
+		nack:   nack,
+		sent:   map[uint16]*rtp.Packet{},
+	}
+}
+
+// checkFrames verifies that every frame is complete and that the frames come out in order.
+func checkFrames(t *testing.T, frames []Frame, sentFrames map[uint32][]uint16) {
+	var lastTS int64 = -1
+	for i, frame := range frames {
+		ts := frame.Packets[0].Timestamp
+		var seqs []uint16
+		for _, packet := range frame.Packets {
+			if packet.Timestamp != ts {
+				t.Fatalf("frame %d mixes timestamps %d and %d", i, ts, packet.Timestamp)
+			}
+			seqs = append(seqs, packet.SequenceNumber)
+		}
+		if !reflect.DeepEqual(seqs, sentFrames[ts]) {
+			t.Fatalf("frame %d at %d has packets %v, sent %v", i, ts, seqs, sentFrames[ts])
+		}
+		if int64(ts) <= lastTS {
+			t.Fatalf("frame %d at %d after %d", i, ts, lastTS)
+		}
+		lastTS = int64(ts)
+	}
+}
+
+func TestLossyLoopbackRecovers(t *testing.T) {
+	const frameCount = 300
+	l := newLoopback(true)
+	sentFrames := l.run(frameCount)
+	if l.dropped == 0 {
+		t.Fatal("the link dropped no packets")
+	}
+
+	checkFrames(t, l.frames, sentFrames)
+	if len(l.frames) != frameCount {
+		t.Fatalf("got %d frames, want %d", len(l.frames), frameCount)
+	}
+	for i, frame := range l.frames {
+		if frame.Discontinuity != (i == 0) {
+			t.Fatalf("frame %d discontinuity %v", i, frame.Discontinuity)
+		}
+	}
+	stats := l.buffer.Stats()
+	if stats.Received != uint64(len(l.sent)) || stats.Lost != 0 || stats.FramesDropped != 0 {
+		t.Fatalf("stats %+v, sent %d packets", stats, len(l.sent))
+	}
+	if stats.Recovered != uint64(l.dropped) {
+		t.Fatalf("recovered %d packets, the link dropped %d", stats.Recovered, l.dropped)
+	}
+	if stats.Reordered == 0 {
+		t.Fatal("the jitter of the link reordered no packets")
+	}
+}
+
+func TestLossyLoopbackWithoutRetransmissions(t *testing.T) {
+	const frameCount = 300
+	l := newLoopback(false)
+	sentFrames := l.run(frameCount)
+
+	checkFrames(t, l.frames, sentFrames)
+	stats := l.buffer.Stats()
+	if stats.Lost != uint64(l.dropped) || stats.Received+stats.Lost != uint64(len(l.sent)) {
+		t.Fatalf("stats %+v, sent %d packets and the link dropped %d", stats, len(l.sent), l.dropped)
+	}
+	if stats.Recovered != 0 || stats.FramesDropped == 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+	if len(l.frames)+int(stats.FramesDropped) > frameCount || len(l.frames) >= frameCount {
+		t.Fatalf("got %d frames and dropped %d of %d", len(l.frames), stats.FramesDropped, frameCount)
+	}
+	// a frame after a loss is marked for the decoders to wait for a key frame
+	discontinuities := 0
+	for _, frame := range l.frames {
+		if frame.Discontinuity {
+			discontinuities++
+		}
+	}
+	if discontinuities < 2 {
+		t.Fatalf("got %d discontinuities after %d lost packets", discontinuities, stats.Lost)
+	}
+}
@@ -39,15 +39,24 @@ func (v *VideoDecodingProcess) Init() error {
 
 	return nil
 }
+
+func (v *VideoDecodingProcess) Close() {
+	if v.decCodecContext != nil {
+		v.decCodecContext.Free()
+	}
+}
+
 func (v *VideoDecodingProcess) Process(data hub.H264Video) ([]*astiav.Frame, error) {
 	// Decode data
 	ctx := context.Background()
 	packet := astiav.AllocPacket()
-	//defer packet.Free()
+	defer packet.Free()
 	err := packet.FromData(data.Data)
 	if err != nil {
 		log.Error(ctx, err, "failed to create packet")
 	}
+	packet.SetPts(data.PTS)
+	packet.SetDts(data.DTS)
 	err = v.decCodecContext.SendPacket(packet)
 	if err != nil {
 		log.Error(ctx, err, "failed to send packet")
@@ -58,9 +67,14 @@ func (v *VideoDecodingProcess) Process(data hub.H264Video) ([]*astiav.Frame, err
 		err := v.decCodecContext.ReceiveFrame(frame)
 		if errors.Is(err, astiav.ErrEof) {
 			fmt.Println("EOF: ", err.Error())
+			frame.Free()
 			break
 		} else if errors.Is(err, astiav.ErrEagain) {
+			frame.Free()
 			break
+		} else if err != nil {
+			frame.Free()
+			return frames, err
 		}
 		frames = append(frames, frame)
 	}
@@ -0,0 +1,312 @@
+package processes
+
+import (
+	"errors"
+	"strconv"
+
+	astiav "github.com/asticode/go-astiav"
+	"github.com/deepch/vdk/codec/h264parser"
+
+	"liveflow/media/hub"
+	"liveflow/media/streamer/ingress"
+	"liveflow/media/streamer/pipe"
+)
+
+var _ pipe.ProcessInterface[*hub.H264Video, []*hub.H264Video] = (*VideoTranscodingProcess)(nil)
+
+const (
+	defaultVideoFrameRate = 30
+	defaultVideoPreset    = "veryfast"
+	// keyframes follow the source when no GOP size is given, this only bounds sources without regular keyframes.
+	maxGOPSeconds = 10
+)
+
+type VideoTranscodingArgs struct {
+	// Width and Height keep the source resolution when both are zero, and the source aspect ratio when one is zero.
+	Width  int
+	Height int
+	// FrameRate keeps the source frame rate when it is zero. Frames are dropped or repeated to reach it.
+	FrameRate int
+	Bitrate   int
+	// Profile is an H264 profile of libx264 such as baseline, main or high.
+	Profile string
+	// GOPSize is in frames. When it is zero, keyframes are placed where the source has them so that
+	// renditions transcoded from the same source stay aligned.
+	GOPSize int
+	// Preset defaults to veryfast.
+	Preset string
+	// Tune is a libx264 tune such as zerolatency, which also disables B-frames.
+	Tune string
+}
+
+// VideoTranscodingProcess decodes H264, optionally scales it and changes the frame rate, and encodes it again with libx264.
+type VideoTranscodingProcess struct {
+	pipe.BaseProcess[*hub.H264Video, []*hub.H264Video]
+
+	decodingProcess *VideoDecodingProcess
+	encCodec        *astiav.Codec
+	encCodecContext *astiav.CodecContext
+	scaleContext    *astiav.SoftwareScaleContext
+	clockRate       uint32
+
+	width     int
+	height    int
+	frameRate int
+	bitrate   int
+	profile   string
+	gopSize   int
+	preset    string
+	tune      string
+
+	// frame rate conversion
+	basePTS         int64
+	frameIndex      int64
+	hasBasePTS      bool
+	pendingKeyframe bool
+}
+
+func NewVideoTranscodingProcess(args VideoTranscodingArgs) *VideoTranscodingProcess {
+	preset := args.Preset
+	if preset == "" {
+		preset = defaultVideoPreset
+	}
+	return &VideoTranscodingProcess{
+		decodingProcess: NewVideoDecodingProcess(astiav.CodecIDH264),
+		width:           args.Width,
+		height:          args.Height,
+		frameRate:       args.FrameRate,
+		bitrate:         args.Bitrate,
+		profile:         args.Profile,
+		gopSize:         args.GOPSize,
+		preset:          preset,
+		tune:            args.Tune,
+	}
+}
+
+func (t *VideoTranscodingProcess) Init() error {
+	if t.width < 0 || t.height < 0 || t.frameRate < 0 || t.bitrate <= 0 || t.gopSize < 0 {
+		return errors.New("invalid video transcoding args")
+	}
+	t.encCodec = astiav.FindEncoderByName("libx264")
+	if t.encCodec == nil {
+		t.encCodec = astiav.FindEncoder(astiav.CodecIDH264)
+	}
+	if t.encCodec == nil {
+		return errors.New("codec is nil")
+	}
+	return t.decodingProcess.Init()
+}
+
+// Width and Height return the encoded resolution, which is known after the first decoded frame.
+func (t *VideoTranscodingProcess) Width() int {
+	return t.width
+}
+
+func (t *VideoTranscodingProcess) Height() int {
+	return t.height
+}
+
+func (t *VideoTranscodingProcess) Close() {
+	t.decodingProcess.Close()
+	if t.encCodecContext != nil {
+		t.encCodecContext.Free()
+	}
+	if t.scaleContext != nil {
+		t.scaleContext.Free()
+	}
+}
+
+// openEncoder is called with the first decoded frame since the source resolution is not known before.
+func (t *VideoTranscodingProcess) openEncoder(frame *astiav.Frame) error {
+	switch {
+	case t.width == 0 && t.height == 0:
+		t.width = frame.Width()
+		t.height = frame.Height()
+	case t.width == 0:
+		t.width = frame.Width() * t.height / frame.Height()
+	case t.height == 0:
+		t.height = frame.Height() * t.width / frame.Width()
+	}
+	// yuv420p needs even dimensions
+	t.width &^= 1
+	t.height &^= 1
+	scaleContext, err := astiav.CreateSoftwareScaleContext(
+		frame.Width(), frame.Height(), frame.PixelFormat(),
+		t.width, t.height, astiav.PixelFormatYuv420P,
+		astiav.NewSoftwareScaleContextFlags(astiav.SoftwareScaleContextFlagBilinear))
+	if err != nil {
+		return err
+	}
+	t.scaleContext = scaleContext
+
+	var frameRate astiav.Rational
+	if t.frameRate > 0 {
+		frameRate = astiav.NewRational(t.frameRate, 1)
+	} else {
+		frameRate = t.decodingProcess.decCodecContext.Framerate()
+		if frameRate.Num() <= 0 || frameRate.Den() <= 0 {
+			frameRate = astiav.NewRational(defaultVideoFrameRate, 1)
+		}
+	}
+	t.encCodecContext = astiav.AllocCodecContext(t.encCodec)
+	if t.encCodecContext == nil {
+		return errors.New("codec context is nil")
+	}
+	t.encCodecContext.SetWidth(t.width)
+	t.encCodecContext.SetHeight(t.height)
+	t.encCodecContext.SetPixelFormat(astiav.PixelFormatYuv420P)
+	t.encCodecContext.SetSampleAspectRatio(frame.SampleAspectRatio())
+	t.encCodecContext.SetTimeBase(astiav.NewRational(1, int(t.clockRate)))
+	t.encCodecContext.SetFramerate(frameRate)
+	t.encCodecContext.SetBitRate(int64(t.bitrate))
+	dict := astiav.NewDictionary()
+	defer dict.Free()
+	if t.gopSize > 0 {
+		t.encCodecContext.SetGopSize(t.gopSize)
+		// a fixed GOP should not be broken up by scene cuts
+		dict.Set("x264-params", "scenecut=0:min-keyint="+strconv.Itoa(t.gopSize), 0)
+	} else {
+		t.encCodecContext.SetGopSize(maxGOPSeconds * frameRate.Num() / frameRate.Den())
+		dict.Set("forced-idr", "1", 0)
+	}
+	dict.Set("preset", t.preset, 0)
+	if t.tune != "" {
+		dict.Set("tune", t.tune, 0)
+	}
+	if t.profile != "" {
+		dict.Set("profile", t.profile, 0)
+	}
+	return t.encCodecContext.Open(t.encCodec, dict)
+}
+
+func (t *VideoTranscodingProcess) Process(data *hub.H264Video) ([]*hub.H264Video, error) {
+	if t.clockRate == 0 {
+		t.clockRate = data.VideoClockRate
+		if t.clockRate == 0 {
+			t.clockRate = 1000
+		}
+	}
+	frames, err := t.decodingProcess.Process(*data)
+	defer func() {
+		for _, frame := range frames {
+			frame.Free()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+	var videos []*hub.H264Video
+	for _, frame := range frames {
+		if t.encCodecContext == nil {
+			if err := t.openEncoder(frame); err != nil {
+				return nil, err
+			}
+		}
+		pts := frame.Pts()
+		if pts == astiav.NoPtsValue {
+			pts = frame.PktDts()
+		}
+		keyframe := frame.KeyFrame() || t.pendingKeyframe
+		for _, outPTS := range t.outputPTSs(pts) {
+			encoded, err := t.encode(frame, outPTS, keyframe)
+			if err != nil {
+				return videos, err
+			}
+			videos = append(videos, encoded...)
+			keyframe = false
+		}
+		// a dropped source keyframe moves to the next encoded frame
+		t.pendingKeyframe = keyframe && t.gopSize == 0
+	}
+	select {
+	case t.ResultChan() <- videos:
+	default:
+	}
+	return videos, nil
+}
+
+// outputPTSs returns the timestamps at which a decoded frame is encoded: none when it is dropped,
+// several when it is repeated to fill the output frame rate.
+func (t *VideoTranscodingProcess) outputPTSs(pts int64) []int64 {
+	if t.frameRate <= 0 {
+		return []int64{pts}
+	}
+	frameDuration := int64(t.clockRate) / int64(t.frameRate)
+	if !t.hasBasePTS || pts-t.nextPTS() > maxGOPSeconds*int64(t.clockRate) || t.nextPTS()-pts > 2*frameDuration {
+		// start over on the first frame and on timestamp jumps
+		t.basePTS = pts
+		t.frameIndex = 0
+		t.hasBasePTS = true
+	}
+	var ptss []int64
+	for t.nextPTS() <= pts+frameDuration/2 {
+		ptss = append(ptss, t.nextPTS())
+		t.frameIndex++
+	}
+	return ptss
+}
+
+func (t *VideoTranscodingProcess) nextPTS() int64 {
+	return t.basePTS + t.frameIndex*int64(t.clockRate)/int64(t.frameRate)
+}
+
+func (t *VideoTranscodingProcess) encode(frame *astiav.Frame, pts int64, keyframe bool) ([]*hub.H264Video, error) {
+	scaledFrame := astiav.AllocFrame()
+	defer scaledFrame.Free()
+	scaledFrame.SetWidth(t.width)
+	scaledFrame.SetHeight(t.height)
+	scaledFrame.SetPixelFormat(astiav.PixelFormatYuv420P)
+	if err := scaledFrame.AllocBuffer(0); err != nil {
+		return nil, err
+	}
+	if err := t.scaleContext.ScaleFrame(frame, scaledFrame); err != nil {
+		return nil, err
+	}
+	scaledFrame.SetPts(pts)
+	if keyframe && t.gopSize == 0 {
+		scaledFrame.SetPictureType(astiav.PictureTypeI)
+	}
+	if err := t.encCodecContext.SendFrame(scaledFrame); err != nil {
+		return nil, err
+	}
+	var videos []*hub.H264Video
+	for {
+		pkt := astiav.AllocPacket()
+		err := t.encCodecContext.ReceivePacket(pkt)
+		if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+			pkt.Free()
+			break
+		} else if err != nil {
+			pkt.Free()
+			return videos, err
+		}
+		videos = append(videos, t.newH264Video(pkt))
+		pkt.Free()
+	}
+	return videos, nil
+}
+
+func (t *VideoTranscodingProcess) newH264Video(pkt *astiav.Packet) *hub.H264Video {
+	data := pkt.Data()
+	video := &hub.H264Video{
+		PTS:            pkt.Pts(),
+		DTS:            pkt.Dts(),
+		VideoClockRate: t.clockRate,
+		Data:           data,
+		SliceTypes:     ingress.SliceTypes(data),
+	}
+	// libx264 repeats SPS and PPS in front of every keyframe since no global header is requested
+	nalus, _ := h264parser.SplitNALUs(data)
+	for _, nalu := range nalus {
+		if len(nalu) < 1 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case h264parser.NALU_SPS:
+			video.SPS = nalu
+		case h264parser.NALU_PPS:
+			video.PPS = nalu
+		}
+	}
+	return video
+}
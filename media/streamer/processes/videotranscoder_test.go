@@ -0,0 +1,286 @@
+package processes
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	astiav "github.com/asticode/go-astiav"
+	"github.com/deepch/vdk/codec/h264parser"
+
+	"liveflow/media/hub"
+	"liveflow/media/streamer/ingress"
+)
+
+const testClockRate = 90000
+
+type testSourceArgs struct {
+	width     int
+	height    int
+	frameRate int
+	frames    int
+	gopSize   int
+}
+
+// encodeTestSource encodes black frames with libx264 without B-frames, as a camera or an OBS publisher would send them.
+func encodeTestSource(t *testing.T, args testSourceArgs) []*hub.H264Video {
+	t.Helper()
+	codec := astiav.FindEncoderByName("libx264")
+	if codec == nil {
+		t.Skip("libx264 is not available")
+	}
+	cc := astiav.AllocCodecContext(codec)
+	defer cc.Free()
+	cc.SetWidth(args.width)
+	cc.SetHeight(args.height)
+	cc.SetPixelFormat(astiav.PixelFormatYuv420P)
+	cc.SetTimeBase(astiav.NewRational(1, testClockRate))
+	cc.SetFramerate(astiav.NewRational(args.frameRate, 1))
+	cc.SetGopSize(args.gopSize)
+	cc.SetBitRate(500_000)
+	dict := astiav.NewDictionary()
+	defer dict.Free()
+	dict.Set("preset", "ultrafast", 0)
+	dict.Set("tune", "zerolatency", 0)
+	dict.Set("x264-params", "scenecut=0", 0)
+	if err := cc.Open(codec, dict); err != nil {
+		t.Fatal(err)
+	}
+
+	var videos []*hub.H264Video
+	receive := func() {
+		for {
+			pkt := astiav.AllocPacket()
+			err := cc.ReceivePacket(pkt)
+			if errors.Is(err, astiav.ErrEof) || errors.Is(err, astiav.ErrEagain) {
+				pkt.Free()
+				return
+			} else if err != nil {
+				pkt.Free()
+				t.Fatal(err)
+			}
+			data := pkt.Data()
+			videos = append(videos, &hub.H264Video{
+				PTS:            pkt.Pts(),
+				DTS:            pkt.Dts(),
+				VideoClockRate: testClockRate,
+				Data:           data,
+				SliceTypes:     ingress.SliceTypes(data),
+			})
+			pkt.Free()
+		}
+	}
+	for i := 0; i < args.frames; i++ {
+		frame := astiav.AllocFrame()
+		frame.SetWidth(args.width)
+		frame.SetHeight(args.height)
+		frame.SetPixelFormat(astiav.PixelFormatYuv420P)
+		if err := frame.AllocBuffer(0); err != nil {
+			t.Fatal(err)
+		}
+		if err := frame.ImageFillBlack(); err != nil {
+			t.Fatal(err)
+		}
+		frame.SetPts(int64(i) * testClockRate / int64(args.frameRate))
+		err := cc.SendFrame(frame)
+		frame.Free()
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive()
+	}
+	if err := cc.SendFrame(nil); err != nil {
+		t.Fatal(err)
+	}
+	receive()
+	if len(videos) != args.frames {
+		t.Fatalf("encoded %d source frames, want %d", len(videos), args.frames)
+	}
+	return videos
+}
+
+func transcode(t *testing.T, args VideoTranscodingArgs, source []*hub.H264Video) ([]*hub.H264Video, *VideoTranscodingProcess) {
+	t.Helper()
+	p := NewVideoTranscodingProcess(args)
+	if err := p.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	var ret []*hub.H264Video
+	for _, video := range source {
+		videos, err := p.Process(video)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, videos...)
+	}
+	if len(ret) == 0 {
+		t.Fatal("no frame was transcoded")
+	}
+	return ret, p
+}
+
+func hasIDR(video *hub.H264Video) bool {
+	nalus, _ := h264parser.SplitNALUs(video.Data)
+	for _, nalu := range nalus {
+		if len(nalu) > 0 && nalu[0]&0x1f == 5 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTimestamps checks the decode order of the encoded frames, their presentation order is checked when
+// the encoder does not reorder frames.
+func checkTimestamps(t *testing.T, videos []*hub.H264Video, reordered bool) {
+	t.Helper()
+	var ptss []int64
+	for i, video := range videos {
+		if video.PTS < video.DTS {
+			t.Errorf("frame %d PTS %d before its DTS %d", i, video.PTS, video.DTS)
+		}
+		if i > 0 && video.DTS <= videos[i-1].DTS {
+			t.Errorf("frame %d DTS %d after %d", i, video.DTS, videos[i-1].DTS)
+		}
+		if !reordered && i > 0 && video.PTS <= videos[i-1].PTS {
+			t.Errorf("frame %d PTS %d after %d", i, video.PTS, videos[i-1].PTS)
+		}
+		if video.VideoClockRate != testClockRate {
+			t.Errorf("frame %d clock rate %d", i, video.VideoClockRate)
+		}
+		ptss = append(ptss, video.PTS)
+	}
+	sort.Slice(ptss, func(i, j int) bool { return ptss[i] < ptss[j] })
+	for i := 1; i < len(ptss); i++ {
+		if ptss[i] == ptss[i-1] {
+			t.Errorf("two frames at PTS %d", ptss[i])
+		}
+	}
+}
+
+func TestVideoTranscodingTimestamps(t *testing.T) {
+	source := encodeTestSource(t, testSourceArgs{width: 320, height: 240, frameRate: 30, frames: 60, gopSize: 30})
+	t.Run("zerolatency", func(t *testing.T) {
+		videos, _ := transcode(t, VideoTranscodingArgs{Bitrate: 300_000, Tune: "zerolatency"}, source)
+		checkTimestamps(t, videos, false)
+	})
+	// without a tune libx264 uses B-frames, their PTS comes after the DTS
+	t.Run("b-frames", func(t *testing.T) {
+		videos, _ := transcode(t, VideoTranscodingArgs{Bitrate: 300_000}, source)
+		checkTimestamps(t, videos, true)
+	})
+}
+
+func TestVideoTranscodingGOP(t *testing.T) {
+	tests := []struct {
+		name    string
+		gopSize int
+		// keyframes are the indexes of the output frames that must be IDR frames, the others must not be
+		keyframes map[int]bool
+	}{
+		{name: "fixed", gopSize: 10, keyframes: map[int]bool{0: true, 10: true, 20: true, 30: true, 40: true, 50: true}},
+		{name: "follows the source", keyframes: map[int]bool{0: true, 15: true, 30: true, 45: true}},
+	}
+	source := encodeTestSource(t, testSourceArgs{width: 320, height: 240, frameRate: 30, frames: 60, gopSize: 15})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			videos, _ := transcode(t, VideoTranscodingArgs{Bitrate: 300_000, GOPSize: tt.gopSize, Tune: "zerolatency"}, source)
+			if len(videos) != len(source) {
+				t.Fatalf("transcoded %d frames, want %d", len(videos), len(source))
+			}
+			for i, video := range videos {
+				keyframe := hub.IsKeyFrame(&hub.FrameData{H264Video: video})
+				if keyframe != tt.keyframes[i] || hasIDR(video) != tt.keyframes[i] {
+					t.Errorf("frame %d is a keyframe %v with an IDR %v, slice types %v", i, keyframe, hasIDR(video), video.SliceTypes)
+				}
+				if keyframe && (video.SPS == nil || video.PPS == nil) {
+					t.Errorf("keyframe %d without SPS and PPS", i)
+				}
+			}
+		})
+	}
+}
+
+func TestVideoTranscodingScale(t *testing.T) {
+	tests := []struct {
+		name       string
+		width      int
+		height     int
+		wantWidth  int
+		wantHeight int
+	}{
+		{name: "source", wantWidth: 320, wantHeight: 240},
+		{name: "both", width: 160, height: 90, wantWidth: 160, wantHeight: 90},
+		{name: "width keeps the aspect ratio", width: 160, wantWidth: 160, wantHeight: 120},
+		{name: "height keeps the aspect ratio", height: 120, wantWidth: 160, wantHeight: 120},
+		{name: "odd sizes are made even", width: 161, height: 121, wantWidth: 160, wantHeight: 120},
+	}
+	source := encodeTestSource(t, testSourceArgs{width: 320, height: 240, frameRate: 30, frames: 10, gopSize: 30})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			videos, p := transcode(t, VideoTranscodingArgs{Width: tt.width, Height: tt.height, Bitrate: 300_000, Tune: "zerolatency"}, source)
+			if p.Width() != tt.wantWidth || p.Height() != tt.wantHeight {
+				t.Errorf("encoded %dx%d, want %dx%d", p.Width(), p.Height(), tt.wantWidth, tt.wantHeight)
+			}
+			// the output decodes to the scaled resolution
+			decoder := NewVideoDecodingProcess(astiav.CodecIDH264)
+			if err := decoder.Init(); err != nil {
+				t.Fatal(err)
+			}
+			defer decoder.Close()
+			decoded := 0
+			for _, video := range videos {
+				frames, err := decoder.Process(*video)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, frame := range frames {
+					if frame.Width() != tt.wantWidth || frame.Height() != tt.wantHeight {
+						t.Errorf("decoded %dx%d, want %dx%d", frame.Width(), frame.Height(), tt.wantWidth, tt.wantHeight)
+					}
+					frame.Free()
+					decoded++
+				}
+			}
+			if decoded == 0 {
+				t.Fatal("no transcoded frame was decoded")
+			}
+		})
+	}
+}
+
+func TestVideoTranscodingFrameRate(t *testing.T) {
+	tests := []struct {
+		name            string
+		sourceFrameRate int
+		sourceFrames    int
+		frameRate       int
+		// output frames are taken every 1/frameRate seconds up to half an output frame after the last source frame
+		want int
+	}{
+		{name: "keep", sourceFrameRate: 30, sourceFrames: 60, want: 60},
+		{name: "drop", sourceFrameRate: 30, sourceFrames: 60, frameRate: 15, want: 31},
+		{name: "repeat", sourceFrameRate: 15, sourceFrames: 30, frameRate: 30, want: 59},
+		{name: "drop to a rate that does not divide the source", sourceFrameRate: 30, sourceFrames: 60, frameRate: 24, want: 48},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := encodeTestSource(t, testSourceArgs{width: 320, height: 240, frameRate: tt.sourceFrameRate, frames: tt.sourceFrames, gopSize: tt.sourceFrames})
+			videos, _ := transcode(t, VideoTranscodingArgs{FrameRate: tt.frameRate, Bitrate: 300_000, Tune: "zerolatency"}, source)
+			if len(videos) != tt.want {
+				t.Fatalf("transcoded %d frames, want %d", len(videos), tt.want)
+			}
+			checkTimestamps(t, videos, false)
+			frameRate := tt.frameRate
+			if frameRate == 0 {
+				frameRate = tt.sourceFrameRate
+			}
+			frameDuration := int64(testClockRate / frameRate)
+			for i, video := range videos {
+				if want := videos[0].PTS + int64(i)*testClockRate/int64(frameRate); video.PTS != want {
+					t.Errorf("frame %d PTS %d, want %d every %d", i, video.PTS, want, frameDuration)
+				}
+			}
+		})
+	}
+}
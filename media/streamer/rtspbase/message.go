@@ -0,0 +1,253 @@
+package rtspbase
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidMessage = errors.New("invalid rtsp message")
+	ErrBodyTooLarge   = errors.New("rtsp body too large")
+)
+
+const (
+	Version         = "RTSP/1.0"
+	maxBodySize     = 1 << 20
+	maxHeaderCount  = 256
+	InterleavedSign = '$'
+)
+
+const (
+	MethodOptions      = "OPTIONS"
+	MethodDescribe     = "DESCRIBE"
+	MethodSetup        = "SETUP"
+	MethodPlay         = "PLAY"
+	MethodPause        = "PAUSE"
+	MethodTeardown     = "TEARDOWN"
+	MethodGetParameter = "GET_PARAMETER"
+	MethodSetParameter = "SET_PARAMETER"
+)
+
+// Header keeps header names as they were written, lookups are case-insensitive.
+type Header map[string]string
+
+func (h Header) Get(key string) string {
+	if v, ok := h[key]; ok {
+		return v
+	}
+	for k, v := range h {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+func (h Header) Set(key string, value string) {
+	for k := range h {
+		if strings.EqualFold(k, key) {
+			delete(h, k)
+		}
+	}
+	h[key] = value
+}
+
+type Request struct {
+	Method string
+	URL    string
+	Header Header
+	Body   []byte
+}
+
+type Response struct {
+	StatusCode int
+	Status     string
+	Header     Header
+	Body       []byte
+}
+
+func NewResponse(statusCode int, cseq string) *Response {
+	return &Response{
+		StatusCode: statusCode,
+		Status:     StatusText(statusCode),
+		Header:     Header{"CSeq": cseq},
+	}
+}
+
+func StatusText(code int) string {
+	switch code {
+	case 200:
+		return "OK"
+	case 400:
+		return "Bad Request"
+	case 401:
+		return "Unauthorized"
+	case 404:
+		return "Not Found"
+	case 405:
+		return "Method Not Allowed"
+	case 454:
+		return "Session Not Found"
+	case 455:
+		return "Method Not Valid in This State"
+	case 461:
+		return "Unsupported Transport"
+	case 500:
+		return "Internal Server Error"
+	default:
+		return "Unknown"
+	}
+}
+
+func ReadRequest(r *bufio.Reader) (*Request, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 || parts[2] != Version {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidMessage, line)
+	}
+	req := &Request{Method: parts[0], URL: parts[1]}
+	if req.Header, err = readHeader(r); err != nil {
+		return nil, err
+	}
+	if req.Body, err = readBody(r, req.Header); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func ReadResponse(r *bufio.Reader) (*Response, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || parts[0] != Version {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidMessage, line)
+	}
+	res := &Response{}
+	if res.StatusCode, err = strconv.Atoi(parts[1]); err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidMessage, line)
+	}
+	if len(parts) == 3 {
+		res.Status = parts[2]
+	}
+	if res.Header, err = readHeader(r); err != nil {
+		return nil, err
+	}
+	if res.Body, err = readBody(r, res.Header); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (req *Request) Write(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s\r\n", req.Method, req.URL, Version)
+	writeHeader(&b, req.Header, req.Body)
+	_, err := io.WriteString(w, b.String()+string(req.Body))
+	return err
+}
+
+func (res *Response) Write(w io.Writer) error {
+	var b strings.Builder
+	status := res.Status
+	if status == "" {
+		status = StatusText(res.StatusCode)
+	}
+	fmt.Fprintf(&b, "%s %d %s\r\n", Version, res.StatusCode, status)
+	writeHeader(&b, res.Header, res.Body)
+	_, err := io.WriteString(w, b.String()+string(res.Body))
+	return err
+}
+
+// ReadInterleavedFrame reads a "$" framed RTP/RTCP packet of a TCP session.
+func ReadInterleavedFrame(r *bufio.Reader) (int, []byte, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, nil, err
+	}
+	if hdr[0] != InterleavedSign {
+		return 0, nil, ErrInvalidMessage
+	}
+	payload := make([]byte, int(hdr[2])<<8|int(hdr[3]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return int(hdr[1]), payload, nil
+}
+
+func WriteInterleavedFrame(w io.Writer, channel int, payload []byte) error {
+	b := make([]byte, 4+len(payload))
+	b[0] = InterleavedSign
+	b[1] = byte(channel)
+	b[2] = byte(len(payload) >> 8)
+	b[3] = byte(len(payload))
+	copy(b[4:], payload)
+	_, err := w.Write(b)
+	return err
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func readHeader(r *bufio.Reader) (Header, error) {
+	h := Header{}
+	for i := 0; ; i++ {
+		if i > maxHeaderCount {
+			return nil, ErrInvalidMessage
+		}
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return h, nil
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidMessage, line)
+		}
+		h[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+}
+
+func readBody(r *bufio.Reader, h Header) ([]byte, error) {
+	cl := h.Get("Content-Length")
+	if cl == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(cl)
+	if err != nil || n < 0 {
+		return nil, ErrInvalidMessage
+	}
+	if n > maxBodySize {
+		return nil, ErrBodyTooLarge
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func writeHeader(b *strings.Builder, h Header, body []byte) {
+	if len(body) > 0 {
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	for k, v := range h {
+		fmt.Fprintf(b, "%s: %s\r\n", k, v)
+	}
+	b.WriteString("\r\n")
+}
@@ -0,0 +1,110 @@
+package rtspbase
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ProtocolUDP = "RTP/AVP"
+	ProtocolTCP = "RTP/AVP/TCP"
+
+	DefaultSessionTimeout = 60 * time.Second
+)
+
+// Transport is a single entry of the Transport header.
+type Transport struct {
+	Protocol    string
+	Unicast     bool
+	Interleaved []int
+	ClientPort  []int
+	ServerPort  []int
+	Mode        string
+}
+
+// ParseTransport parses the first transport of a Transport header.
+func ParseTransport(value string) (Transport, error) {
+	first, _, _ := strings.Cut(value, ",")
+	params := strings.Split(first, ";")
+	t := Transport{Protocol: strings.TrimSpace(params[0])}
+	switch strings.ToUpper(t.Protocol) {
+	case ProtocolUDP, ProtocolUDP + "/UDP":
+		t.Protocol = ProtocolUDP
+	case ProtocolTCP:
+		t.Protocol = ProtocolTCP
+	default:
+		return Transport{}, fmt.Errorf("%w: unsupported transport %q", ErrInvalidMessage, t.Protocol)
+	}
+	var err error
+	for _, param := range params[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch strings.ToLower(key) {
+		case "unicast":
+			t.Unicast = true
+		case "interleaved":
+			t.Interleaved, err = parsePortRange(value)
+		case "client_port":
+			t.ClientPort, err = parsePortRange(value)
+		case "server_port":
+			t.ServerPort, err = parsePortRange(value)
+		case "mode":
+			t.Mode = strings.Trim(value, `"`)
+		}
+		if err != nil {
+			return Transport{}, err
+		}
+	}
+	return t, nil
+}
+
+func (t Transport) String() string {
+	parts := []string{t.Protocol}
+	if t.Unicast {
+		parts = append(parts, "unicast")
+	}
+	if len(t.Interleaved) == 2 {
+		parts = append(parts, fmt.Sprintf("interleaved=%d-%d", t.Interleaved[0], t.Interleaved[1]))
+	}
+	if len(t.ClientPort) == 2 {
+		parts = append(parts, fmt.Sprintf("client_port=%d-%d", t.ClientPort[0], t.ClientPort[1]))
+	}
+	if len(t.ServerPort) == 2 {
+		parts = append(parts, fmt.Sprintf("server_port=%d-%d", t.ServerPort[0], t.ServerPort[1]))
+	}
+	if t.Mode != "" {
+		parts = append(parts, "mode="+t.Mode)
+	}
+	return strings.Join(parts, ";")
+}
+
+// ParseSession splits a Session header into its id and timeout.
+func ParseSession(value string) (string, time.Duration) {
+	id, params, _ := strings.Cut(value, ";")
+	timeout := DefaultSessionTimeout
+	for _, param := range strings.Split(params, ";") {
+		key, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(key, "timeout") {
+			if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+				timeout = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return strings.TrimSpace(id), timeout
+}
+
+func parsePortRange(value string) ([]int, error) {
+	lo, hi, hasHi := strings.Cut(value, "-")
+	first, err := strconv.Atoi(lo)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid port range %q", ErrInvalidMessage, value)
+	}
+	second := first + 1
+	if hasHi {
+		if second, err = strconv.Atoi(hi); err != nil {
+			return nil, fmt.Errorf("%w: invalid port range %q", ErrInvalidMessage, value)
+		}
+	}
+	return []int{first, second}, nil
+}
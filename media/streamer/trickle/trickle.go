@@ -0,0 +1,231 @@
+// Package trickle implements the PATCH requests of WHIP and WHEP sessions (RFC 9725, RFC 8840):
+// trickled ICE candidates and ICE restarts carried in SDP fragments.
+package trickle
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const ContentType = "application/trickle-ice-sdpfrag"
+
+var (
+	ErrNoRemoteDescription = errors.New("no remote description")
+	ErrMissingCredentials  = errors.New("ice restart without ice-ufrag and ice-pwd")
+)
+
+// Fragment is a parsed SDP fragment.
+type Fragment struct {
+	Ufrag      string
+	Pwd        string
+	Candidates []Candidate
+}
+
+type Candidate struct {
+	Mid string
+	// Value is the attribute value, "candidate:..." without "a=".
+	Value string
+}
+
+func Parse(body []byte) (*Fragment, error) {
+	frag := &Fragment{}
+	mid := ""
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "m=") {
+			mid = ""
+			continue
+		}
+		if !strings.HasPrefix(line, "a=") {
+			continue
+		}
+		key, value, _ := strings.Cut(line[len("a="):], ":")
+		switch key {
+		case "mid":
+			mid = value
+		case "ice-ufrag":
+			if frag.Ufrag == "" {
+				frag.Ufrag = value
+			}
+		case "ice-pwd":
+			if frag.Pwd == "" {
+				frag.Pwd = value
+			}
+		case "candidate":
+			frag.Candidates = append(frag.Candidates, Candidate{
+				Mid:   mid,
+				Value: "candidate:" + value,
+			})
+		}
+	}
+	return frag, scanner.Err()
+}
+
+// ETag identifies the ICE session of pc by its local ufrag.
+func ETag(pc *webrtc.PeerConnection) string {
+	desc := pc.LocalDescription()
+	if desc == nil {
+		return ""
+	}
+	ufrag, _ := iceCredentials(desc.SDP)
+	return `"` + ufrag + `"`
+}
+
+// HandlePatch answers a PATCH of the session of pc. Candidates of the current ICE session are added with 204,
+// new credentials restart ICE and the local candidates of the new session are returned with 200.
+func HandlePatch(c echo.Context, pc *webrtc.PeerConnection) error {
+	if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), ContentType) {
+		return c.NoContent(http.StatusUnsupportedMediaType)
+	}
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	frag, err := Parse(body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	remote := pc.RemoteDescription()
+	if remote == nil {
+		return c.JSON(http.StatusConflict, ErrNoRemoteDescription.Error())
+	}
+	remoteUfrag, _ := iceCredentials(remote.SDP)
+	ifMatch := c.Request().Header.Get("If-Match")
+	if frag.Ufrag == "" || frag.Ufrag == remoteUfrag {
+		if ifMatch != "" && ifMatch != "*" && ifMatch != ETag(pc) {
+			return c.NoContent(http.StatusPreconditionFailed)
+		}
+		for _, candidate := range frag.Candidates {
+			if err := addCandidate(pc, candidate); err != nil {
+				return c.JSON(http.StatusBadRequest, err.Error())
+			}
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+	if ifMatch != "*" {
+		// an ICE restart must not depend on the current ICE session
+		return c.NoContent(http.StatusPreconditionRequired)
+	}
+	answer, err := restart(pc, frag)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, err.Error())
+	}
+	c.Response().Header().Set("ETag", ETag(pc))
+	return c.Blob(http.StatusOK, ContentType, answer)
+}
+
+func addCandidate(pc *webrtc.PeerConnection, candidate Candidate) error {
+	init := webrtc.ICECandidateInit{
+		Candidate: candidate.Value,
+	}
+	if candidate.Mid != "" {
+		init.SDPMid = &candidate.Mid
+	}
+	return pc.AddICECandidate(init)
+}
+
+// restart renegotiates the remote offer with the new credentials, which makes the peer connection restart ICE.
+func restart(pc *webrtc.PeerConnection, frag *Fragment) ([]byte, error) {
+	if frag.Ufrag == "" || frag.Pwd == "" {
+		return nil, ErrMissingCredentials
+	}
+	var offer sdp.SessionDescription
+	if err := offer.Unmarshal([]byte(pc.RemoteDescription().SDP)); err != nil {
+		return nil, err
+	}
+	offer.Attributes = replaceCredentials(offer.Attributes, frag)
+	for _, media := range offer.MediaDescriptions {
+		media.Attributes = replaceCredentials(media.Attributes, frag)
+		mid, _ := media.Attribute("mid")
+		for _, candidate := range frag.Candidates {
+			if candidate.Mid == "" || candidate.Mid == mid {
+				media.Attributes = append(media.Attributes, sdp.NewAttribute("candidate", strings.TrimPrefix(candidate.Value, "candidate:")))
+			}
+		}
+	}
+	offerBytes, err := offer.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offerBytes)}); err != nil {
+		return nil, err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return nil, err
+	}
+	// Block until ICE Gathering is complete, the answer carries every candidate
+	<-gatherComplete
+	return localFragment(pc.LocalDescription().SDP)
+}
+
+// replaceCredentials drops the ICE attributes of the previous session and sets the new credentials where they were.
+func replaceCredentials(attributes []sdp.Attribute, frag *Fragment) []sdp.Attribute {
+	var ret []sdp.Attribute
+	for _, attribute := range attributes {
+		switch attribute.Key {
+		case "ice-ufrag":
+			attribute.Value = frag.Ufrag
+		case "ice-pwd":
+			attribute.Value = frag.Pwd
+		case "candidate", "end-of-candidates":
+			continue
+		}
+		ret = append(ret, attribute)
+	}
+	return ret
+}
+
+// localFragment keeps the ICE lines of the first, bundled, media section of the local description.
+func localFragment(local string) ([]byte, error) {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(local)); err != nil {
+		return nil, err
+	}
+	ufrag, pwd := iceCredentials(local)
+	var b strings.Builder
+	if group, ok := desc.Attribute("group"); ok {
+		fmt.Fprintf(&b, "a=group:%s\r\n", group)
+	}
+	if len(desc.MediaDescriptions) == 0 {
+		return []byte(b.String()), nil
+	}
+	media := desc.MediaDescriptions[0]
+	fmt.Fprintf(&b, "m=%s %d %s %s\r\n", media.MediaName.Media, media.MediaName.Port.Value,
+		strings.Join(media.MediaName.Protos, "/"), strings.Join(media.MediaName.Formats, " "))
+	if mid, ok := media.Attribute("mid"); ok {
+		fmt.Fprintf(&b, "a=mid:%s\r\n", mid)
+	}
+	fmt.Fprintf(&b, "a=ice-ufrag:%s\r\n", ufrag)
+	fmt.Fprintf(&b, "a=ice-pwd:%s\r\n", pwd)
+	for _, attribute := range media.Attributes {
+		if attribute.Key == "candidate" {
+			fmt.Fprintf(&b, "a=candidate:%s\r\n", attribute.Value)
+		}
+	}
+	b.WriteString("a=end-of-candidates\r\n")
+	return []byte(b.String()), nil
+}
+
+// iceCredentials returns the first ice-ufrag and ice-pwd of a description, they are the same in every bundled section.
+func iceCredentials(description string) (string, string) {
+	frag, err := Parse([]byte(description))
+	if err != nil {
+		return "", ""
+	}
+	return frag.Ufrag, frag.Pwd
+}
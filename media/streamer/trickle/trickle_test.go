@@ -0,0 +1,286 @@
+package trickle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pion/webrtc/v3"
+)
+
+const testCandidate = "candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host"
+
+func TestParse(t *testing.T) {
+	body := "a=ice-ufrag:EsAw\r\n" +
+		"a=ice-pwd:bP+XJMM09aR8AiX1jdukzR6Y\r\n" +
+		"a=group:BUNDLE 0 1\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 0\r\n" +
+		"a=mid:0\r\n" +
+		"a=candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host\r\n" +
+		"a=candidate:3471623853 1 udp 2122194687 198.51.100.2 61765 typ host\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+		"a=candidate:1 1 udp 1 203.0.113.3 9 typ host\r\n" +
+		"a=mid:1\r\n" +
+		"a=ice-ufrag:other\r\n" +
+		"a=candidate:2 1 udp 2 203.0.113.4 9 typ host\r\n" +
+		"a=end-of-candidates\r\n"
+	frag, err := Parse([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Fragment{
+		Ufrag: "EsAw",
+		Pwd:   "bP+XJMM09aR8AiX1jdukzR6Y",
+		Candidates: []Candidate{
+			{Mid: "0", Value: "candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host"},
+			{Mid: "0", Value: "candidate:3471623853 1 udp 2122194687 198.51.100.2 61765 typ host"},
+			// a candidate before the mid of its media section has none
+			{Mid: "", Value: "candidate:1 1 udp 1 203.0.113.3 9 typ host"},
+			{Mid: "1", Value: "candidate:2 1 udp 2 203.0.113.4 9 typ host"},
+		},
+	}
+	if !reflect.DeepEqual(frag, want) {
+		t.Fatalf("parsed %+v, want %+v", frag, want)
+	}
+}
+
+// newPeerConnection returns a peer connection that gathers loopback candidates, a test machine may have no other.
+func newPeerConnection(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	se := webrtc.SettingEngine{}
+	se.SetIncludeLoopbackCandidate(true)
+	se.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(se)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	return pc
+}
+
+// newSession negotiates a publisher and a server as WHIP does, the descriptions they exchange carry no candidates.
+func newSession(t *testing.T) (client *webrtc.PeerConnection, server *webrtc.PeerConnection) {
+	t.Helper()
+	client = newPeerConnection(t)
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = newPeerConnection(t)
+	if err := server.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := server.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(server)
+	if err := server.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+	gatherComplete = webrtc.GatheringCompletePromise(client)
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gatherComplete
+	if err := client.SetRemoteDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func patch(pc *webrtc.PeerConnection, contentType string, ifMatch string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPatch, "/whip/session", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, contentType)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	if err := HandlePatch(c, pc); err != nil {
+		c.Error(err)
+	}
+	return rec
+}
+
+func TestETag(t *testing.T) {
+	pc := newPeerConnection(t)
+	if etag := ETag(pc); etag != "" {
+		t.Fatalf("etag %s without a local description", etag)
+	}
+	_, server := newSession(t)
+	ufrag, _ := iceCredentials(server.LocalDescription().SDP)
+	if ufrag == "" {
+		t.Fatal("no local ufrag")
+	}
+	if etag := ETag(server); etag != `"`+ufrag+`"` {
+		t.Fatalf("etag %s, want the quoted local ufrag %s", etag, ufrag)
+	}
+}
+
+func TestHandlePatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		// ifMatch is the ETag of the session when it is "etag"
+		ifMatch string
+		// body is a fragment of the current ICE session when it has no ufrag, "ufrag" is replaced by the current one
+		body string
+		want int
+	}{
+		{name: "content type", contentType: "application/sdp", body: "a=" + testCandidate + "\r\n", want: http.StatusUnsupportedMediaType},
+		{name: "candidate", body: "a=mid:0\r\na=" + testCandidate + "\r\n", want: http.StatusNoContent},
+		{name: "candidate of the current session", body: "a=ice-ufrag:ufrag\r\na=ice-pwd:pwd\r\na=mid:0\r\na=" + testCandidate + "\r\n", want: http.StatusNoContent},
+		{name: "matching etag", ifMatch: "etag", body: "a=" + testCandidate + "\r\n", want: http.StatusNoContent},
+		{name: "any etag", ifMatch: "*", body: "a=" + testCandidate + "\r\n", want: http.StatusNoContent},
+		{name: "other etag", ifMatch: `"other"`, body: "a=" + testCandidate + "\r\n", want: http.StatusPreconditionFailed},
+		{name: "end of candidates", ifMatch: "etag", body: "a=mid:0\r\na=end-of-candidates\r\n", want: http.StatusNoContent},
+		{name: "invalid candidate", body: "a=candidate:1 1 udp\r\n", want: http.StatusBadRequest},
+		{name: "restart without if-match", body: "a=ice-ufrag:new0\r\na=ice-pwd:aaaaaaaaaaaaaaaaaaaaaaaa\r\n", want: http.StatusPreconditionRequired},
+		// the etag names the ICE session the restart replaces
+		{name: "restart with an etag", ifMatch: "etag", body: "a=ice-ufrag:new0\r\na=ice-pwd:aaaaaaaaaaaaaaaaaaaaaaaa\r\n", want: http.StatusPreconditionRequired},
+		{name: "restart without password", ifMatch: "*", body: "a=ice-ufrag:new0\r\n", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, server := newSession(t)
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = ContentType
+			}
+			ifMatch := tt.ifMatch
+			if ifMatch == "etag" {
+				ifMatch = ETag(server)
+			}
+			ufrag, _ := iceCredentials(server.RemoteDescription().SDP)
+			body := strings.ReplaceAll(tt.body, "ice-ufrag:ufrag", "ice-ufrag:"+ufrag)
+			if rec := patch(server, contentType, ifMatch, body); rec.Code != tt.want {
+				t.Fatalf("status %d %s, want %d", rec.Code, rec.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestPatchWithoutRemoteDescription(t *testing.T) {
+	pc := newPeerConnection(t)
+	if rec := patch(pc, ContentType, "", "a="+testCandidate+"\r\n"); rec.Code != http.StatusConflict {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusConflict)
+	}
+}
+
+func TestICERestart(t *testing.T) {
+	_, server := newSession(t)
+	etag := ETag(server)
+	rec := patch(server, ContentType, "*", "a=ice-ufrag:new0\r\na=ice-pwd:aaaaaaaaaaaaaaaaaaaaaaaa\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:0\r\na="+testCandidate+"\r\n")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d %s", rec.Code, rec.Body)
+	}
+	if contentType := rec.Header().Get(echo.HeaderContentType); contentType != ContentType {
+		t.Fatalf("content type %s", contentType)
+	}
+	// the ICE session of the server restarts with new credentials
+	newETag := rec.Header().Get("ETag")
+	if newETag == etag || newETag != ETag(server) {
+		t.Fatalf("etag %s after restart, was %s, session %s", newETag, etag, ETag(server))
+	}
+	ufrag, pwd := iceCredentials(server.RemoteDescription().SDP)
+	if ufrag != "new0" || pwd != "aaaaaaaaaaaaaaaaaaaaaaaa" {
+		t.Fatalf("remote credentials %s %s after restart", ufrag, pwd)
+	}
+	if remote := server.RemoteDescription().SDP; !strings.Contains(remote, testCandidate) {
+		t.Fatalf("restart candidate missing from the remote description %s", remote)
+	}
+	// the answer is a fragment of the new local credentials and candidates
+	answer := rec.Body.String()
+	frag, err := Parse([]byte(answer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if `"`+frag.Ufrag+`"` != newETag || frag.Pwd == "" {
+		t.Fatalf("answer credentials %s %s, etag %s", frag.Ufrag, frag.Pwd, newETag)
+	}
+	if len(frag.Candidates) == 0 || frag.Candidates[0].Mid != "0" {
+		t.Fatalf("answer candidates %+v", frag.Candidates)
+	}
+	if !strings.HasSuffix(answer, "a=end-of-candidates\r\n") {
+		t.Fatalf("answer %q does not end the candidates", answer)
+	}
+	// candidates of the previous session are refused once it has been replaced
+	if rec := patch(server, ContentType, etag, "a="+testCandidate+"\r\n"); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("status %d for the previous session, want %d", rec.Code, http.StatusPreconditionFailed)
+	}
+}
+
+// Neither description carries candidates, the server only learns those of the publisher from PATCH requests.
+func TestTrickledCandidatesConnect(t *testing.T) {
+	client, server := newSession(t)
+	connected := make(chan struct{})
+	server.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		if state == webrtc.ICEConnectionStateConnected {
+			close(connected)
+		}
+	})
+	var candidates []string
+	for _, line := range strings.Split(client.LocalDescription().SDP, "\r\n") {
+		if strings.HasPrefix(line, "a=candidate:") {
+			candidates = append(candidates, line)
+		}
+	}
+	if len(candidates) == 0 {
+		t.Fatal("the client has no candidates")
+	}
+	body := "a=mid:0\r\n" + strings.Join(candidates, "\r\n") + "\r\na=end-of-candidates\r\n"
+	if rec := patch(server, ContentType, ETag(server), body); rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d %s", rec.Code, rec.Body)
+	}
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("ICE state %s with trickled candidates", server.ICEConnectionState())
+	}
+}
+
+// The servers route PATCH /<endpoint>/<sessionID> to HandlePatch with the peer connection of the session.
+func TestRoutes(t *testing.T) {
+	_, server := newSession(t)
+	sessions := map[string]*webrtc.PeerConnection{"session": server}
+	e := echo.New()
+	e.PATCH("/whip/:sessionID", func(c echo.Context) error {
+		pc, ok := sessions[c.Param("sessionID")]
+		if !ok {
+			return c.NoContent(http.StatusNotFound)
+		}
+		return HandlePatch(c, pc)
+	})
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{method: http.MethodPatch, path: "/whip/session", want: http.StatusNoContent},
+		{method: http.MethodPatch, path: "/whip/other", want: http.StatusNotFound},
+		{method: http.MethodGet, path: "/whip/session", want: http.StatusMethodNotAllowed},
+		{method: http.MethodPut, path: "/whip/session", want: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("a="+testCandidate+"\r\n"))
+		req.Header.Set(echo.HeaderContentType, ContentType)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s status %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package webhook
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// delivery is an event on its way to one URL, it is stored as <ID>.json in the queue directory.
+type delivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	EventType   string          `json:"event_type"`
+	Body        json.RawMessage `json:"body"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+}
+
+// backoff doubles the delay after every failed attempt.
+func backoff(attempts int) time.Duration {
+	delay := minBackoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+type queue struct {
+	// directory is empty for a queue in RAM
+	directory string
+	// wake is signaled when a delivery is pushed
+	wake chan struct{}
+
+	mu sync.Mutex
+	// [ID]delivery
+	deliveries map[string]*delivery
+}
+
+func newQueue(directory string) *queue {
+	return &queue{
+		directory:  directory,
+		wake:       make(chan struct{}, 1),
+		deliveries: map[string]*delivery{},
+	}
+}
+
+// load reads the deliveries left by the previous run.
+func (q *queue) load() error {
+	if q.directory == "" {
+		return nil
+	}
+	if err := os.MkdirAll(q.directory, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(q.directory)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(q.directory, entry.Name()))
+		if err != nil {
+			return err
+		}
+		var d delivery
+		if err := json.Unmarshal(b, &d); err != nil {
+			return err
+		}
+		if _, ok := q.deliveries[d.ID]; !ok {
+			q.deliveries[d.ID] = &d
+		}
+	}
+	return nil
+}
+
+func (q *queue) push(d *delivery) error {
+	q.mu.Lock()
+	q.deliveries[d.ID] = d
+	err := q.save(d)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+func (q *queue) update(d *delivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.save(d)
+}
+
+func (q *queue) remove(d *delivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.deliveries, d.ID)
+	if q.directory != "" {
+		_ = os.Remove(q.path(d.ID))
+	}
+}
+
+// due returns the deliveries whose next attempt is not after now, the oldest first.
+func (q *queue) due(now time.Time) []*delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var ret []*delivery
+	for _, d := range q.deliveries {
+		if !d.NextAttempt.After(now) {
+			ret = append(ret, d)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].NextAttempt.Before(ret[j].NextAttempt)
+	})
+	return ret
+}
+
+// next returns the earliest next attempt, false for an empty queue.
+func (q *queue) next() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var ret time.Time
+	for _, d := range q.deliveries {
+		if ret.IsZero() || d.NextAttempt.Before(ret) {
+			ret = d.NextAttempt
+		}
+	}
+	return ret, !ret.IsZero()
+}
+
+// save is called with the mutex held. The file is replaced by a rename so a crash never leaves half of it.
+func (q *queue) save(d *delivery) error {
+	if q.directory == "" {
+		return nil
+	}
+	if err := os.MkdirAll(q.directory, 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	tmp := q.path(d.ID) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path(d.ID))
+}
+
+func (q *queue) path(id string) string {
+	return filepath.Join(q.directory, id+".json")
+}
@@ -0,0 +1,319 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"liveflow/log"
+	"liveflow/media/hub"
+	"liveflow/media/streamer/egress/record"
+	"liveflow/media/streamer/egress/whep"
+)
+
+const (
+	EventStreamPublished    = "stream.published"
+	EventStreamUnpublished  = "stream.unpublished"
+	EventRecordingFinalized = "recording.finalized"
+	EventViewerJoined       = "viewer.joined"
+	EventViewerLeft         = "viewer.left"
+)
+
+const (
+	// SignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the body keyed with the secret.
+	SignatureHeader = "X-Liveflow-Signature"
+	EventHeader     = "X-Liveflow-Event"
+	DeliveryHeader  = "X-Liveflow-Delivery"
+)
+
+const (
+	defaultMaxAttempts = 10
+	defaultTimeout     = 5 * time.Second
+)
+
+// Event is the JSON body of a webhook.
+type Event struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	StreamID string    `json:"stream_id"`
+	Data     any       `json:"data,omitempty"`
+}
+
+type MediaSpec struct {
+	MediaType string `json:"media_type"`
+	CodecType string `json:"codec"`
+	ClockRate uint32 `json:"clock_rate"`
+}
+
+type StreamData struct {
+	Source     string      `json:"source"`
+	MediaSpecs []MediaSpec `json:"media_specs"`
+	StartedAt  time.Time   `json:"started_at"`
+	// DurationSeconds is set when the stream is unpublished.
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+}
+
+type RecordingData struct {
+	Format   string    `json:"format"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	ClosedAt time.Time `json:"closed_at"`
+}
+
+type ViewerData struct {
+	SessionID string    `json:"session_id"`
+	StartedAt time.Time `json:"started_at"`
+	Layer     string    `json:"layer,omitempty"`
+	// DurationSeconds, PacketsSent and BytesSent are set when the viewer leaves.
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	PacketsSent     uint64  `json:"packets_sent,omitempty"`
+	BytesSent       uint64  `json:"bytes_sent,omitempty"`
+}
+
+// Notifier posts the events of the streams to every webhook URL. A delivery is retried with backoff until the URL
+// answers 2xx or it runs out of attempts, deliveries not done yet are kept in the queue directory across restarts.
+type Notifier struct {
+	hub         *hub.Hub
+	urls        []string
+	secret      []byte
+	maxAttempts int
+	client      *http.Client
+	queue       *queue
+}
+
+type NotifierArgs struct {
+	Hub *hub.Hub
+	// URLs receive every event, there are no webhooks without them.
+	URLs   []string
+	Secret string
+	// QueueDirectory keeps the deliveries in RAM when it is empty.
+	QueueDirectory string
+	MaxAttempts    int
+	Timeout        time.Duration
+}
+
+func NewNotifier(args NotifierArgs) *Notifier {
+	maxAttempts := args.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxAttempts
+	}
+	timeout := args.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Notifier{
+		hub:         args.Hub,
+		urls:        args.URLs,
+		secret:      []byte(args.Secret),
+		maxAttempts: maxAttempts,
+		client:      &http.Client{Timeout: timeout},
+		queue:       newQueue(args.QueueDirectory),
+	}
+}
+
+// Run sends the publish and unpublish events of the hub and delivers the queue until ctx is done.
+func (n *Notifier) Run(ctx context.Context) {
+	if len(n.urls) == 0 {
+		return
+	}
+	if err := n.queue.load(); err != nil {
+		log.Error(ctx, err, "failed to load webhook queue")
+	}
+	go n.deliver(ctx)
+	for event := range n.hub.SubscribeEvents(ctx) {
+		switch event.Type {
+		case hub.EventPublished:
+			n.Send(ctx, EventStreamPublished, event.StreamID, streamData(event.Stream, time.Time{}))
+		case hub.EventUnpublished:
+			n.Send(ctx, EventStreamUnpublished, event.StreamID, streamData(event.Stream, event.Time))
+		}
+	}
+}
+
+// RecordingFinalized sends recording.finalized for a file closed by a recorder.
+func (n *Notifier) RecordingFinalized(file record.File) {
+	n.Send(context.Background(), EventRecordingFinalized, file.StreamID, RecordingData{
+		Format:   file.Format,
+		Path:     file.Path,
+		Size:     file.Size,
+		ClosedAt: file.ClosedAt,
+	})
+}
+
+func (n *Notifier) ViewerJoined(stats whep.SessionStats) {
+	n.Send(context.Background(), EventViewerJoined, stats.StreamID, ViewerData{
+		SessionID: stats.ID,
+		StartedAt: stats.StartedAt,
+		Layer:     stats.Layer,
+	})
+}
+
+func (n *Notifier) ViewerLeft(stats whep.SessionStats) {
+	n.Send(context.Background(), EventViewerLeft, stats.StreamID, ViewerData{
+		SessionID:       stats.ID,
+		StartedAt:       stats.StartedAt,
+		Layer:           stats.Layer,
+		DurationSeconds: time.Since(stats.StartedAt).Seconds(),
+		PacketsSent:     stats.PacketsSent,
+		BytesSent:       stats.BytesSent,
+	})
+}
+
+// Send queues an event for every URL, it never waits for the delivery.
+func (n *Notifier) Send(ctx context.Context, eventType string, streamID string, data any) {
+	if len(n.urls) == 0 {
+		return
+	}
+	id, err := newID()
+	if err != nil {
+		log.Error(ctx, err, "failed to create webhook event id")
+		return
+	}
+	body, err := json.Marshal(Event{
+		ID:       id,
+		Type:     eventType,
+		Time:     time.Now(),
+		StreamID: streamID,
+		Data:     data,
+	})
+	if err != nil {
+		log.Error(ctx, err, "failed to marshal webhook event")
+		return
+	}
+	for i, url := range n.urls {
+		err := n.queue.push(&delivery{
+			ID:          fmt.Sprintf("%s-%d", id, i),
+			URL:         url,
+			EventType:   eventType,
+			Body:        body,
+			NextAttempt: time.Now(),
+		})
+		if err != nil {
+			log.Errorf(ctx, "failed to queue %s webhook for %s: %v", eventType, url, err)
+		}
+	}
+}
+
+// deliver posts the due deliveries and waits for the next one.
+func (n *Notifier) deliver(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-n.queue.wake:
+		}
+		for _, d := range n.queue.due(time.Now()) {
+			if ctx.Err() != nil {
+				return
+			}
+			n.attempt(ctx, d)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if next, ok := n.queue.next(); ok {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+func (n *Notifier) attempt(ctx context.Context, d *delivery) {
+	err := n.post(ctx, d)
+	if err == nil {
+		n.queue.remove(d)
+		return
+	}
+	d.Attempts++
+	if d.Attempts >= n.maxAttempts {
+		log.Errorf(ctx, "giving up %s webhook %s for %s after %d attempts: %v", d.EventType, d.ID, d.URL, d.Attempts, err)
+		n.queue.remove(d)
+		return
+	}
+	d.NextAttempt = time.Now().Add(backoff(d.Attempts))
+	log.Warnf(ctx, "failed to deliver %s webhook %s to %s, retrying at %s: %v", d.EventType, d.ID, d.URL, d.NextAttempt.Format(time.RFC3339), err)
+	if err := n.queue.update(d); err != nil {
+		log.Error(ctx, err, "failed to update webhook queue")
+	}
+}
+
+func (n *Notifier) post(ctx context.Context, d *delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, d.EventType)
+	req.Header.Set(DeliveryHeader, d.ID)
+	req.Header.Set(SignatureHeader, Sign(n.secret, d.Body))
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature header value of body, receivers compare it with hmac.Equal.
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func streamData(info hub.StreamInfo, unpublishedAt time.Time) StreamData {
+	ret := StreamData{
+		MediaSpecs: []MediaSpec{},
+		StartedAt:  info.StartedAt,
+	}
+	if info.Source != nil {
+		ret.Source = info.Source.Name()
+	}
+	for _, spec := range info.MediaSpecs {
+		ret.MediaSpecs = append(ret.MediaSpecs, MediaSpec{
+			MediaType: mediaTypeName(spec.MediaType),
+			CodecType: string(spec.CodecType),
+			ClockRate: spec.ClockRate,
+		})
+	}
+	if !unpublishedAt.IsZero() && !info.StartedAt.IsZero() {
+		ret.DurationSeconds = unpublishedAt.Sub(info.StartedAt).Seconds()
+	}
+	return ret
+}
+
+func mediaTypeName(mediaType hub.MediaType) string {
+	switch mediaType {
+	case hub.Video:
+		return "video"
+	case hub.Audio:
+		return "audio"
+	}
+	return "unknown"
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
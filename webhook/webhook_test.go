@@ -0,0 +1,260 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"liveflow/media/hub"
+)
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+	at     time.Time
+}
+
+// receiver is a webhook URL that answers with the status codes in turn, the last one for the requests after them.
+type receiver struct {
+	*httptest.Server
+	statuses []int
+
+	mu       sync.Mutex
+	requests []receivedRequest
+	received chan struct{}
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	r := &receiver{
+		statuses: statuses,
+		received: make(chan struct{}, 64),
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		r.mu.Lock()
+		status := r.statuses[min(len(r.requests), len(r.statuses)-1)]
+		r.requests = append(r.requests, receivedRequest{header: req.Header.Clone(), body: body, at: time.Now()})
+		r.mu.Unlock()
+		w.WriteHeader(status)
+		r.received <- struct{}{}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) wait(t *testing.T, count int) []receivedRequest {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		select {
+		case <-r.received:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("received %d of %d requests", i, count)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedRequest(nil), r.requests...)
+}
+
+func TestDeliverySignature(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := newReceiver(t, http.StatusOK)
+	n := NewNotifier(NotifierArgs{
+		Hub:    hub.NewHub(),
+		URLs:   []string{r.URL},
+		Secret: "s3cret",
+	})
+	go n.Run(ctx)
+	n.Send(ctx, EventStreamPublished, "stream", StreamData{Source: "rtmp", MediaSpecs: []MediaSpec{}})
+
+	req := r.wait(t, 1)[0]
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(req.body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := req.header.Get(SignatureHeader); !hmac.Equal([]byte(got), []byte(want)) {
+		t.Fatalf("signature %q, want %q", got, want)
+	}
+	if got := req.header.Get("Content-Type"); got != "application/json" {
+		t.Fatalf("content type %q", got)
+	}
+	var event Event
+	if err := json.Unmarshal(req.body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != EventStreamPublished || event.StreamID != "stream" || event.ID == "" {
+		t.Fatalf("event %+v", event)
+	}
+	if got := req.header.Get(EventHeader); got != EventStreamPublished {
+		t.Fatalf("event header %q", got)
+	}
+	if got := req.header.Get(DeliveryHeader); got != event.ID+"-0" {
+		t.Fatalf("delivery header %q for event %s", got, event.ID)
+	}
+	// a receiver with another secret rejects the signature
+	if Sign([]byte("other"), req.body) == req.header.Get(SignatureHeader) {
+		t.Fatal("the signature does not depend on the secret")
+	}
+}
+
+func TestDeliveryRetriesServerErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := newReceiver(t, http.StatusServiceUnavailable, http.StatusOK)
+	n := NewNotifier(NotifierArgs{
+		Hub:  hub.NewHub(),
+		URLs: []string{r.URL},
+	})
+	go n.Run(ctx)
+	n.Send(ctx, EventRecordingFinalized, "stream", RecordingData{Format: "mp4", Path: "videos/stream.mp4"})
+
+	requests := r.wait(t, 2)
+	first, second := requests[0], requests[1]
+	if first.header.Get(DeliveryHeader) != second.header.Get(DeliveryHeader) || string(first.body) != string(second.body) {
+		t.Fatal("the retry is not the same delivery")
+	}
+	if gap := second.at.Sub(first.at); gap < minBackoff {
+		t.Fatalf("retried after %s, want at least %s", gap, minBackoff)
+	}
+	// the delivery is done after the 2xx
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := n.queue.next(); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the delivery stayed queued after it succeeded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-r.received:
+		t.Fatal("delivered again after a 2xx")
+	case <-time.After(minBackoff + 200*time.Millisecond):
+	}
+}
+
+func TestDeliveryGivesUpAfterMaxAttempts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := newReceiver(t, http.StatusInternalServerError)
+	n := NewNotifier(NotifierArgs{
+		Hub:         hub.NewHub(),
+		URLs:        []string{r.URL},
+		MaxAttempts: 1,
+	})
+	go n.Run(ctx)
+	n.Send(ctx, EventViewerJoined, "stream", ViewerData{SessionID: "viewer"})
+	r.wait(t, 1)
+	select {
+	case <-r.received:
+		t.Fatal("retried after the last attempt")
+	case <-time.After(minBackoff + 200*time.Millisecond):
+	}
+	if _, ok := n.queue.next(); ok {
+		t.Fatal("the delivery stayed queued after the last attempt")
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	directory := t.TempDir()
+	// the receiver is down during the first run and back after the restart
+	r := newReceiver(t, http.StatusBadGateway, http.StatusOK)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := NewNotifier(NotifierArgs{
+		Hub:            hub.NewHub(),
+		URLs:           []string{r.URL},
+		QueueDirectory: directory,
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.Run(ctx)
+	}()
+	n.Send(ctx, EventStreamUnpublished, "stream", StreamData{Source: "rtmp"})
+	failed := r.wait(t, 1)[0]
+	// the failed attempt is written before the next one is waited for
+	deadline := time.Now().Add(5 * time.Second)
+	var saved delivery
+	for saved.Attempts == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the failed attempt was not saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+		b, err := os.ReadFile(filepath.Join(directory, failed.header.Get(DeliveryHeader)+".json"))
+		if err != nil {
+			continue
+		}
+		if err := json.Unmarshal(b, &saved); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	<-done
+
+	// the restarted notifier delivers the event of the previous run once its backoff is over
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	restarted := NewNotifier(NotifierArgs{
+		Hub:            hub.NewHub(),
+		URLs:           []string{r.URL},
+		QueueDirectory: directory,
+	})
+	go restarted.Run(ctx)
+	delivered := r.wait(t, 1)[1]
+	if delivered.header.Get(DeliveryHeader) != failed.header.Get(DeliveryHeader) || string(delivered.body) != string(failed.body) {
+		t.Fatalf("delivered %s %s, want the queued %s %s", delivered.header.Get(DeliveryHeader), delivered.body,
+			failed.header.Get(DeliveryHeader), failed.body)
+	}
+	if got := delivered.header.Get(EventHeader); got != EventStreamUnpublished {
+		t.Fatalf("event header %q", got)
+	}
+	if delivered.at.Before(saved.NextAttempt) {
+		t.Fatalf("delivered at %s before the next attempt at %s", delivered.at, saved.NextAttempt)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		entries, err := os.ReadDir(directory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d files left in the queue directory after the delivery", len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: minBackoff},
+		{attempts: 2, want: 2 * minBackoff},
+		{attempts: 3, want: 4 * minBackoff},
+		{attempts: 20, want: maxBackoff},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}